@@ -315,6 +315,24 @@ Dump the freezer as jsonl`,
      Category: "BLOCKCHAIN COMMANDS",
      Description: `
 Load jsonl from stdin to ancients`,
+	}
+	freezerMigrateCommand = cli.Command{
+     Action:    utils.MigrateFlags(freezerMigrate),
+     Name:      "freezermigrate",
+     Usage:     "Migrate an S3 freezer to the batched layout",
+     ArgsUsage: "<s3 url>",
+     Flags: []cli.Flag{
+     },
+     Category: "BLOCKCHAIN COMMANDS",
+     Description: `
+Copies the blocks of an S3 freezer's per-block layout into batches of the size
+given by the URL's batch parameter, eg:
+
+  geth freezermigrate "s3://bucket/ancients?batch=1024"
+
+Batches that were already migrated are skipped, so the migration can be resumed
+if interrupted. Once it's done, use the same URL for --datadir.ancient. The
+per-block objects are left in place, and can be deleted afterwards.`,
 	}
 	diffBlocksCommand = cli.Command{
      Action:    utils.MigrateFlags(diffBlocks),
@@ -763,6 +781,13 @@ func freezerLoad(ctx *cli.Context) error {
 	return nil
 }
 
+func freezerMigrate(ctx *cli.Context) error {
+	if len(ctx.Args()) != 1 || !strings.HasPrefix(ctx.Args()[0], "s3://") {
+		return fmt.Errorf("Usage: freezermigrate [s3 url]")
+	}
+	return rawdb.MigrateS3Freezer(ctx.Args()[0])
+}
+
 func verifyStateTrie(ctx *cli.Context) error {
   stack, _ := makeConfigNode(ctx)
   db := utils.MakeChainDatabase(ctx, stack)
@@ -160,15 +160,27 @@ var (
 		utils.KafkaEventTopicFlag,
 		utils.KafkaTransactionPoolTopicFlag,
 		utils.KafkaTransactionTopicFlag,
+		utils.KafkaTransactionResultTopicFlag,
+		utils.KafkaTransactionDeadLetterTopicFlag,
 		utils.KafkaTransactionConsumerGroupFlag,
+		utils.TxRelayDedupeWindowFlag,
+		utils.TxRelayRetriesFlag,
+		utils.TxRelaySenderRateFlag,
+		utils.TxRelaySenderBurstFlag,
 		utils.KafkaStateDeltaTopicFlag,
 		utils.StateDeltaFileFlag,
 		utils.ReplicaSyncShutdownFlag,
+		utils.ReplicaBootstrapServeFlag,
 		utils.ReplicaStartupMaxAgeFlag,
 		utils.ReplicaRuntimeMaxOffsetAgeFlag,
 		utils.ReplicaRuntimeMaxBlockAgeFlag,
+		utils.ReplicaTransactionTimeoutFlag,
 		utils.ReplicaEVMConcurrencyFlag,
 		utils.ReplicaWarmAddressesFlag,
+		utils.ReplicaVerifySourceFlag,
+		utils.ReplicaVerifyFullFlag,
+		utils.ReplicaVerifySamplesFlag,
+		utils.ReplicaVerifyIntervalFlag,
 	}
 
 	rpcFlags = []cli.Flag{
@@ -266,8 +278,10 @@ func init() {
 		txrelayCommand,
 		freezerDumpCommand,
 		freezerLoadCommand,
+		freezerMigrateCommand,
 		// See snapshot.go
 		snapshotCommand,
+		overlayCommand,
 	}
 	sort.Sort(cli.CommandsByName(app.Commands))
 
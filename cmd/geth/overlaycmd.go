@@ -0,0 +1,239 @@
+// Copyright 2021 The go-ethereum Authors
+// This file is part of go-ethereum.
+//
+// go-ethereum is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// go-ethereum is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with go-ethereum. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/ethereum/go-ethereum/cmd/utils"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/ethdb/overlay"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/olekukonko/tablewriter"
+	cli "gopkg.in/urfave/cli.v1"
+)
+
+var (
+	overlayFlags = []cli.Flag{
+		utils.DataDirFlag,
+		utils.OverlayFlag,
+		utils.CacheFlag,
+		utils.CacheDatabaseFlag,
+		utils.RopstenFlag,
+		utils.RinkebyFlag,
+		utils.GoerliFlag,
+	}
+	overlayCommand = cli.Command{
+		Name:        "overlay",
+		Usage:       "A set of commands for managing an overlay database",
+		Category:    "MISCELLANEOUS COMMANDS",
+		Description: "",
+		Subcommands: []cli.Command{
+			{
+				Name:     "commit",
+				Usage:    "Fold the overlay database into the chain database",
+				Action:   utils.MigrateFlags(overlayCommit),
+				Category: "MISCELLANEOUS COMMANDS",
+				Flags:    overlayFlags,
+				Description: `
+geth overlay commit --datadir.overlay <path>
+will apply every write and deletion recorded in the overlay database to the
+chain database in the datadir, then empty the overlay. The node must not be
+running. An interrupted commit can be safely rerun.
+`,
+			},
+			{
+				Name:     "discard",
+				Usage:    "Throw away the changes recorded in the overlay database",
+				Action:   utils.MigrateFlags(overlayDiscard),
+				Category: "MISCELLANEOUS COMMANDS",
+				Flags:    overlayFlags,
+				Description: `
+geth overlay discard --datadir.overlay <path>
+will delete every key in the overlay database, so a node started with the same
+overlay sees the chain database as it was.
+`,
+			},
+			{
+				Name:     "inspect",
+				Usage:    "Summarize the changes recorded in the overlay database",
+				Action:   utils.MigrateFlags(overlayInspect),
+				Category: "MISCELLANEOUS COMMANDS",
+				Flags:    overlayFlags,
+				Description: `
+geth overlay inspect --datadir.overlay <path>
+will count the writes and deletions recorded in the overlay database, grouped
+by the same key categories as "geth db inspect". Range deletions are counted
+separately, as one deletion per range.
+`,
+			},
+		},
+	}
+)
+
+// openOverlay opens the leveldb overlay database named by --datadir.overlay.
+func openOverlay(ctx *cli.Context) (ethdb.KeyValueStore, error) {
+	path := ctx.GlobalString(utils.OverlayFlag.Name)
+	switch path {
+	case "":
+		return nil, errors.New("an overlay database is required (--datadir.overlay)")
+	case "null", "mem":
+		return nil, fmt.Errorf("overlay %q is not persisted", path)
+	}
+	log.Info("Opening overlay database", "path", path)
+	return rawdb.NewLevelDBDatabase(path, overlayCache(ctx), utils.MakeDatabaseHandles(), "")
+}
+
+func overlayCache(ctx *cli.Context) int {
+	return ctx.GlobalInt(utils.CacheFlag.Name) * ctx.GlobalInt(utils.CacheDatabaseFlag.Name) / 100
+}
+
+func overlayCommit(ctx *cli.Context) error {
+	stack, _ := makeConfigNode(ctx)
+	defer stack.Close()
+
+	overlayDb, err := openOverlay(ctx)
+	if err != nil {
+		log.Error("Failed to open overlay database", "err", err)
+		return err
+	}
+	defer overlayDb.Close()
+
+	// Open the bare key-value store, commits shouldn't touch the freezer
+	chaindb, err := rawdb.NewLevelDBDatabase(stack.ResolvePath("chaindata"), overlayCache(ctx), utils.MakeDatabaseHandles(), "")
+	if err != nil {
+		log.Error("Failed to open chain database", "err", err)
+		return err
+	}
+	defer chaindb.Close()
+
+	start := time.Now()
+	puts, deletes, err := overlay.Commit(overlayDb, chaindb)
+	if err != nil {
+		log.Error("Failed to commit overlay", "puts", puts, "deletes", deletes, "err", err)
+		return err
+	}
+	log.Info("Committed overlay", "puts", puts, "deletes", deletes, "elapsed", common.PrettyDuration(time.Since(start)))
+	return nil
+}
+
+func overlayDiscard(ctx *cli.Context) error {
+	stack, _ := makeConfigNode(ctx)
+	defer stack.Close()
+
+	overlayDb, err := openOverlay(ctx)
+	if err != nil {
+		log.Error("Failed to open overlay database", "err", err)
+		return err
+	}
+	defer overlayDb.Close()
+
+	start := time.Now()
+	count, err := overlay.Discard(overlayDb)
+	if err != nil {
+		log.Error("Failed to discard overlay", "deleted", count, "err", err)
+		return err
+	}
+	log.Info("Discarded overlay", "deleted", count, "elapsed", common.PrettyDuration(time.Since(start)))
+	return nil
+}
+
+// overlayStat counts the changes to a category of keys.
+type overlayStat struct {
+	writes  int
+	deletes int
+	size    common.StorageSize
+}
+
+func overlayInspect(ctx *cli.Context) error {
+	stack, _ := makeConfigNode(ctx)
+	defer stack.Close()
+
+	overlayDb, err := openOverlay(ctx)
+	if err != nil {
+		log.Error("Failed to open overlay database", "err", err)
+		return err
+	}
+	defer overlayDb.Close()
+
+	var (
+		stats  = make(map[string]*overlayStat)
+		total  overlayStat
+		count  int
+		ranges int
+		start  = time.Now()
+		logged = time.Now()
+	)
+	err = overlay.ForEach(overlayDb, func(key, value []byte, deleted bool) error {
+		category := rawdb.KeyCategory(key)
+		stat, ok := stats[category]
+		if !ok {
+			stat = &overlayStat{}
+			stats[category] = stat
+		}
+		size := common.StorageSize(len(key) + len(value))
+		if deleted {
+			stat.deletes++
+			total.deletes++
+		} else {
+			stat.writes++
+			total.writes++
+		}
+		stat.size += size
+		total.size += size
+		count++
+		if count%1000 == 0 && time.Since(logged) > 8*time.Second {
+			log.Info("Inspecting overlay", "count", count, "elapsed", common.PrettyDuration(time.Since(start)))
+			logged = time.Now()
+		}
+		return nil
+	})
+	if err == nil {
+		err = overlay.ForEachRange(overlayDb, func(start, end []byte) error {
+			ranges++
+			return nil
+		})
+	}
+	if err != nil {
+		log.Error("Failed to inspect overlay", "err", err)
+		return err
+	}
+	categories := make([]string, 0, len(stats))
+	for category := range stats {
+		categories = append(categories, category)
+	}
+	sort.Strings(categories)
+
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetHeader([]string{"Category", "Writes", "Deletes", "Size"})
+	for _, category := range categories {
+		stat := stats[category]
+		table.Append([]string{category, fmt.Sprint(stat.writes), fmt.Sprint(stat.deletes), stat.size.String()})
+	}
+	if ranges > 0 {
+		table.Append([]string{"Range deletions", "0", fmt.Sprint(ranges), common.StorageSize(0).String()})
+	}
+	table.SetFooter([]string{"Total", fmt.Sprint(total.writes), fmt.Sprint(total.deletes), total.size.String()})
+	table.Render()
+	return nil
+}
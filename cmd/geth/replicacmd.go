@@ -22,11 +22,18 @@ package main
 // )
 
 import (
-	// "fmt"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
 	"path/filepath"
+	"strconv"
 	"time"
 	"strings"
 	"github.com/ethereum/go-ethereum/cmd/utils"
+	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core"
 	"github.com/ethereum/go-ethereum/core/rawdb"
 	"github.com/ethereum/go-ethereum/consensus/ethash"
@@ -34,6 +41,7 @@ import (
 	"github.com/ethereum/go-ethereum/internal/debug"
 	"github.com/ethereum/go-ethereum/eth"
 	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/ethdb/cdc"
 	"github.com/ethereum/go-ethereum/ethdb/overlay"
 	"github.com/ethereum/go-ethereum/ethdb/devnull"
 	"github.com/ethereum/go-ethereum/ethdb/memorydb"
@@ -46,7 +54,7 @@ import (
 	"github.com/ethereum/go-ethereum/p2p"
 	"github.com/ethereum/go-ethereum/p2p/nat"
 	"github.com/ethereum/go-ethereum/node"
-	// "github.com/ethereum/go-ethereum/rpc"
+	"github.com/ethereum/go-ethereum/rpc"
 	"gopkg.in/urfave/cli.v1"
 )
 
@@ -61,49 +69,93 @@ var (
 The Geth replica captures a Geth node's write operations via a change-data-capture
 system and acts as an RPC node based on the replicated data.
 `,
-		Flags: append(debug.Flags, []cli.Flag{
-			utils.HTTPEnabledFlag,
-			utils.HTTPListenAddrFlag,
-			utils.HTTPPortFlag,
-			utils.HTTPCORSDomainFlag,
-			utils.HTTPVirtualHostsFlag,
-			utils.RopstenFlag,
-			utils.RinkebyFlag,
-			utils.GoerliFlag,
-			utils.KafkaLogBrokerFlag,
-			utils.KafkaLogTopicFlag,
-			utils.KafkaTransactionTopicFlag,
-			utils.KafkaTransactionPoolTopicFlag,
-			utils.DataDirFlag,
-			utils.ReplicaSyncShutdownFlag,
-			utils.LegacyRPCEnabledFlag,
-			utils.LegacyRPCPortFlag,
-			utils.LegacyRPCListenAddrFlag,
-			utils.LegacyRPCCORSDomainFlag,
-			utils.WSEnabledFlag,
-			utils.WSListenAddrFlag,
-			utils.WSPortFlag,
-			utils.WSAllowedOriginsFlag,
-			// utils.LegacyWSListenAddrFlag,
-			// utils.LegacyWSPortFlag,
-			// utils.LegacyWSAllowedOriginsFlag,
-			utils.GraphQLEnabledFlag,
-			utils.GraphQLCORSDomainFlag,
-			utils.GraphQLVirtualHostsFlag,
-			utils.ReplicaStartupMaxAgeFlag,
-			utils.ReplicaRuntimeMaxOffsetAgeFlag,
-			utils.ReplicaRuntimeMaxBlockAgeFlag,
-			utils.ReplicaEVMConcurrencyFlag,
-			utils.ReplicaWarmAddressesFlag,
-			utils.OverlayFlag,
-			utils.AncientFlag,
-			utils.CacheFlag,
-			utils.CacheTrieFlag,
-			utils.CacheGCFlag,
-			utils.CacheDatabaseFlag,
-			utils.SnapshotFlag,
-		}...),
+		Flags: replicaFlags,
+		Subcommands: []cli.Command{
+			{
+				Action:    utils.MigrateFlags(replicaBootstrap),
+				Name:      "bootstrap",
+				Usage:     "Populate a new replica from an export, then run it",
+				ArgsUsage: "<url>",
+				Flags:     append(replicaFlags, utils.ReplicaBootstrapSkipAncientsFlag),
+				Description: `
+geth replica bootstrap <url>
+
+Downloads a database export from the master or another replica running with
+--replica.bootstrap.serve (eg. http://master:8545), loads it into an empty
+datadir, then runs the replica starting from the CDC offset recorded in the
+export. If the datadir already contains a chain, the export is skipped and the
+replica resumes from its stored offset.
+`,
+			},
+			{
+				Action:    utils.MigrateFlags(replicaVerify),
+				Name:      "verify",
+				Usage:     "Verify the replica's data against the master",
+				ArgsUsage: "[<blockNum>]",
+				Flags:     replicaFlags,
+				Description: `
+geth replica verify --replica.verify.source <source> [<blockNum>]
+
+Checks that the replica's canonical header, block body, receipts and
+transaction lookups at the given block (by default, a few blocks behind the
+latest block) match the master given by --replica.verify.source, which may be
+an RPC endpoint or the master's chaindata directory. The state trie, contract
+code and storage tries at that block are sampled, or walked entirely with
+--replica.verify.full. Mismatched keys are printed, and the command exits 1 if
+there are any.
+`,
+			},
+		},
 	}
+	replicaFlags = append(debug.Flags, []cli.Flag{
+		utils.HTTPEnabledFlag,
+		utils.HTTPListenAddrFlag,
+		utils.HTTPPortFlag,
+		utils.HTTPCORSDomainFlag,
+		utils.HTTPVirtualHostsFlag,
+		utils.RopstenFlag,
+		utils.RinkebyFlag,
+		utils.GoerliFlag,
+		utils.KafkaLogBrokerFlag,
+		utils.KafkaLogTopicFlag,
+		utils.KafkaTransactionTopicFlag,
+		utils.KafkaTransactionPoolTopicFlag,
+		utils.KafkaEventTopicFlag,
+		utils.KafkaStateDeltaTopicFlag,
+		utils.DataDirFlag,
+		utils.ReplicaSyncShutdownFlag,
+		utils.LegacyRPCEnabledFlag,
+		utils.LegacyRPCPortFlag,
+		utils.LegacyRPCListenAddrFlag,
+		utils.LegacyRPCCORSDomainFlag,
+		utils.WSEnabledFlag,
+		utils.WSListenAddrFlag,
+		utils.WSPortFlag,
+		utils.WSAllowedOriginsFlag,
+		// utils.LegacyWSListenAddrFlag,
+		// utils.LegacyWSPortFlag,
+		// utils.LegacyWSAllowedOriginsFlag,
+		utils.GraphQLEnabledFlag,
+		utils.GraphQLCORSDomainFlag,
+		utils.GraphQLVirtualHostsFlag,
+		utils.ReplicaStartupMaxAgeFlag,
+		utils.ReplicaRuntimeMaxOffsetAgeFlag,
+		utils.ReplicaRuntimeMaxBlockAgeFlag,
+		utils.ReplicaEVMConcurrencyFlag,
+		utils.ReplicaWarmAddressesFlag,
+		utils.OverlayFlag,
+		utils.AncientFlag,
+		utils.CacheFlag,
+		utils.CacheTrieFlag,
+		utils.CacheGCFlag,
+		utils.CacheDatabaseFlag,
+		utils.SnapshotFlag,
+		utils.ReplicaBootstrapServeFlag,
+		utils.ReplicaVerifySourceFlag,
+		utils.ReplicaVerifyFullFlag,
+		utils.ReplicaVerifySamplesFlag,
+		utils.ReplicaVerifyIntervalFlag,
+	}...)
 	replicaTxPoolConfig = core.TxPoolConfig{
 		Journal:   "transactions.rlp",
 		Rejournal: time.Hour,
@@ -164,7 +216,7 @@ func replica(ctx *cli.Context) error {
 	// 	log.Info("Serving", "err", http.ListenAndServe("0.0.0.0:6060", nil))
 	// }()
 	debug.Setup(ctx)
-	node, _, err := makeReplicaNode(ctx)
+	node, _, err := makeReplicaNode(ctx, "")
 	if err != nil { return err }
 	defer node.Close()
 
@@ -173,7 +225,145 @@ func replica(ctx *cli.Context) error {
 	return nil
 }
 
-func makeReplicaNode(ctx *cli.Context) (*node.Node, ethapi.Backend, error) {
+// replicaBootstrap populates an empty replica from an export, then runs it
+func replicaBootstrap(ctx *cli.Context) error {
+	if len(ctx.Args()) != 1 {
+		utils.Fatalf("This command requires an argument.")
+	}
+	debug.Setup(ctx)
+	node, _, err := makeReplicaNode(ctx, ctx.Args().First())
+	if err != nil { return err }
+	defer node.Close()
+
+	utils.StartNode(ctx, node)
+	node.Wait()
+	return nil
+}
+
+// bootstrapReplicaDatabase loads the export served at source into db, unless
+// db already contains a chain.
+func bootstrapReplicaDatabase(ctx *cli.Context, db ethdb.Database, source string) error {
+	if head := rawdb.ReadHeadHeaderHash(db); head != (common.Hash{}) {
+		log.Warn("Database already populated, skipping bootstrap", "head", head)
+		return nil
+	}
+	sourceURL, err := url.Parse(source)
+	if err != nil { return err }
+	if sourceURL.Path == "" || sourceURL.Path == "/" {
+		sourceURL.Path = cdc.ExportPath
+	}
+	if ctx.GlobalBool(utils.ReplicaBootstrapSkipAncientsFlag.Name) {
+		query := sourceURL.Query()
+		query.Set("ancients", "0")
+		sourceURL.RawQuery = query.Encode()
+	}
+	log.Info("Bootstrapping replica", "source", sourceURL)
+	resp, err := http.Get(sourceURL.String())
+	if err != nil { return err }
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("Error fetching export: %v %v", resp.Status, strings.TrimSpace(string(body)))
+	}
+	// Check the topic before downloading the whole export
+	expectedTopic := strings.Split(ctx.GlobalString(utils.KafkaLogTopicFlag.Name), ":")[0]
+	if topic := resp.Header.Get("X-CDC-Topic"); topic != expectedTopic {
+		return fmt.Errorf("Export is for topic %q, but replica is configured for %q", topic, expectedTopic)
+	}
+	topic, offset, err := cdc.ReadExport(resp.Body, db)
+	if err != nil { return err }
+	log.Info("Bootstrapped replica", "topic", topic, "offset", offset, "head", rawdb.ReadHeadBlockHash(db))
+	return nil
+}
+
+// replicaVerify verifies the replica's database against a master
+func replicaVerify(ctx *cli.Context) error {
+	if len(ctx.Args()) > 1 {
+		utils.Fatalf("This command takes at most one argument.")
+	}
+	debug.Setup(ctx)
+	stack, cfg := makeReplicaConfig(ctx)
+	defer stack.Close()
+	chainDb := openReplicaDatabase(stack, &cfg)
+	defer chainDb.Close()
+	source, closeSource, err := openVerifySource(ctx.GlobalString(utils.ReplicaVerifySourceFlag.Name))
+	if err != nil {
+		utils.Fatalf("Could not open verification source: %v", err)
+	}
+	defer closeSource()
+	verifier := makeVerifier(ctx, chainDb, source)
+
+	var result *replicaModule.VerifyResult
+	if ctx.Args().Present() {
+		number, err := strconv.ParseUint(ctx.Args().First(), 10, 64)
+		if err != nil {
+			utils.Fatalf("Invalid block number: %v", err)
+		}
+		result, err = verifier.Verify(context.Background(), number)
+	} else {
+		result, err = verifier.VerifyLatest(context.Background())
+	}
+	if err != nil { return err }
+	for _, mismatch := range result.Mismatches {
+		fmt.Println(mismatch)
+	}
+	fmt.Printf("Verified block %v (%#x): %v nodes, %v accounts, %v slots, %v receipts, %v tx lookups in %v\n", result.Number, result.Hash, result.Nodes, result.Accounts, result.Slots, result.Receipts, result.TxLookups, common.PrettyDuration(result.Elapsed))
+	if len(result.Mismatches) > 0 {
+		return fmt.Errorf("Replica differs from master: %v mismatches", len(result.Mismatches))
+	}
+	return nil
+}
+
+// openVerifySource connects to the master at source, which is either an RPC
+// endpoint or the path of the master's chaindata directory.
+func openVerifySource(source string) (replicaModule.VerifySource, func(), error) {
+	if source == "" {
+		return nil, nil, fmt.Errorf("--%v is required", utils.ReplicaVerifySourceFlag.Name)
+	}
+	if strings.Contains(source, "://") || strings.HasSuffix(source, ".ipc") {
+		client, err := rpc.Dial(source)
+		if err != nil { return nil, nil, err }
+		return replicaModule.NewRPCVerifySource(client), client.Close, nil
+	}
+	db, err := rawdb.NewLevelDBDatabaseWithFreezer(source, 16, 16, filepath.Join(source, "ancient"), "")
+	if err != nil { return nil, nil, err }
+	return replicaModule.NewDBVerifySource(db), func() { db.Close() }, nil
+}
+
+func makeVerifier(ctx *cli.Context, db ethdb.Database, source replicaModule.VerifySource) *replicaModule.Verifier {
+	verifier := replicaModule.NewVerifier(db, source)
+	verifier.Full = ctx.GlobalBool(utils.ReplicaVerifyFullFlag.Name)
+	verifier.Samples = ctx.GlobalInt(utils.ReplicaVerifySamplesFlag.Name)
+	return verifier
+}
+
+// replicaVerifyService periodically verifies a running replica against the
+// master.
+type replicaVerifyService struct {
+	verifier *replicaModule.Verifier
+	interval time.Duration
+	closeSource func()
+	cancel context.CancelFunc
+}
+
+func (s *replicaVerifyService) Start() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancel = cancel
+	go s.verifier.Run(ctx, s.interval)
+	return nil
+}
+
+func (s *replicaVerifyService) Stop() error {
+	if s.cancel != nil {
+		s.cancel()
+	}
+	s.closeSource()
+	return nil
+}
+
+// makeReplicaConfig loads the replica's configuration and constructs its
+// protocol stack.
+func makeReplicaConfig(ctx *cli.Context) (*node.Node, gethConfig) {
 	// Load defaults.
 	cfg := gethConfig{
 		Eth:       ethConfig,
@@ -199,10 +389,16 @@ func makeReplicaNode(ctx *cli.Context) (*node.Node, ethapi.Backend, error) {
 		cfg.Ethstats.URL = ctx.GlobalString(utils.EthStatsURLFlag.Name)
 	}
 
+	return stack, cfg
+}
+
+// openReplicaDatabase opens the replica's chain database, with any overlay
+// and freezer configured.
+func openReplicaDatabase(stack *node.Node, cfg *gethConfig) ethdb.Database {
 	log.Info("Opening leveldb")
 	var chainKv ethdb.KeyValueStore
 	log.Info("Allocating DB", "path", stack.ResolvePath("chaindata"), "dbcache", cfg.Eth.DatabaseCache, "handles", cfg.Eth.DatabaseHandles)
-	chainKv, err = rawdb.NewLevelDBDatabase(stack.ResolvePath("chaindata"), cfg.Eth.DatabaseCache * 3 / 4, cfg.Eth.DatabaseHandles, "eth/db/chaindata")
+	chainKv, err := rawdb.NewLevelDBDatabase(stack.ResolvePath("chaindata"), cfg.Eth.DatabaseCache * 3 / 4, cfg.Eth.DatabaseHandles, "eth/db/chaindata")
 	// chainKv, err := stack.OpenRawDatabaseWithFreezer("chaindata", cfg.Eth.DatabaseCache, cfg.Eth.DatabaseHandles, cfg.Eth.DatabaseFreezer, "eth/db/chaindata/")
 	if err != nil {
 		utils.Fatalf("Could not open database: %v", err)
@@ -231,7 +427,7 @@ func makeReplicaNode(ctx *cli.Context) (*node.Node, ethapi.Backend, error) {
 	case freezer == "":
 		freezer = filepath.Join(root, "ancient")
 	case strings.HasPrefix(freezer, "s3://"):
-		log.Info("S3 freezer", "path", freezer)
+		log.Info("S3 freezer", "path", rawdb.RedactFreezerURL(freezer))
 	case strings.HasPrefix(freezer, "s3:/"):
 		// For some reason the flags system is dropping the second slash
 		freezer = "s3://" + strings.TrimPrefix(freezer, "s3:/")
@@ -243,6 +439,22 @@ func makeReplicaNode(ctx *cli.Context) (*node.Node, ethapi.Backend, error) {
 	if err != nil {
 		utils.Fatalf("Could not open freezer: %v", err)
 	}
+	return chainDb
+}
+
+// makeReplicaNode constructs a replica node. If bootstrapFrom is set, an empty
+// database is first populated from the export served at that URL.
+func makeReplicaNode(ctx *cli.Context, bootstrapFrom string) (*node.Node, ethapi.Backend, error) {
+	stack, cfg := makeReplicaConfig(ctx)
+	chainDb := openReplicaDatabase(stack, &cfg)
+	if bootstrapFrom != "" {
+		if strings.Contains(ctx.GlobalString(utils.KafkaLogTopicFlag.Name), ":") {
+			utils.Fatalf("Bootstrapped replicas start from the export's offset; do not specify one in --%v", utils.KafkaLogTopicFlag.Name)
+		}
+		if err := bootstrapReplicaDatabase(ctx, chainDb, bootstrapFrom); err != nil {
+			utils.Fatalf("Could not bootstrap replica: %v", err)
+		}
+	}
   replica, err := replicaModule.NewKafkaReplica(
 		chainDb,
 		&cfg.Eth,
@@ -250,7 +462,10 @@ func makeReplicaNode(ctx *cli.Context) (*node.Node, ethapi.Backend, error) {
 		ctx.GlobalString(utils.KafkaLogBrokerFlag.Name),
 		ctx.GlobalString(utils.KafkaLogTopicFlag.Name),
 		ctx.GlobalString(utils.KafkaTransactionTopicFlag.Name),
+		ctx.GlobalString(utils.KafkaTransactionResultTopicFlag.Name),
 		ctx.GlobalString(utils.KafkaTransactionPoolTopicFlag.Name),
+		ctx.GlobalString(utils.KafkaEventTopicFlag.Name),
+		ctx.GlobalString(utils.KafkaStateDeltaTopicFlag.Name),
 		ctx.GlobalBool(utils.ReplicaSyncShutdownFlag.Name),
 		ctx.GlobalInt64(utils.ReplicaStartupMaxAgeFlag.Name),
 		ctx.GlobalInt64(utils.ReplicaRuntimeMaxOffsetAgeFlag.Name),
@@ -260,11 +475,28 @@ func makeReplicaNode(ctx *cli.Context) (*node.Node, ethapi.Backend, error) {
 		ctx.GlobalString(utils.ReplicaWarmAddressesFlag.Name),
 		ctx.GlobalBool(utils.SnapshotFlag.Name),
 		ctx.GlobalInt64(utils.ReplicaMaxOffsetFlag.Name),
+		ctx.GlobalDuration(utils.ReplicaTransactionTimeoutFlag.Name),
 	)
 	if err != nil { return stack, nil, err }
 	if ctx.GlobalBool(utils.GraphQLEnabledFlag.Name) {
 		utils.RegisterGraphQLService(stack, replica.GetBackend(), cfg.Node)
 	}
+	stack.RegisterHandler("Replica health", replicaModule.HealthPath, replica.HealthHandler())
+	stack.RegisterHandler("Replica readiness", replicaModule.ReadyPath, replica.ReadyHandler())
+	if cfg.Node.ReplicaBootstrapServe {
+		stack.RegisterHandler("Replica bootstrap", cdc.ExportPath, replica.ExportHandler())
+	}
+	if interval := ctx.GlobalInt64(utils.ReplicaVerifyIntervalFlag.Name); interval > 0 {
+		source, closeSource, err := openVerifySource(ctx.GlobalString(utils.ReplicaVerifySourceFlag.Name))
+		if err != nil {
+			utils.Fatalf("Could not open verification source: %v", err)
+		}
+		stack.RegisterLifecycle(&replicaVerifyService{
+			verifier: makeVerifier(ctx, chainDb, source),
+			interval: time.Duration(interval) * time.Second,
+			closeSource: closeSource,
+		})
+	}
 	stack.RegisterAPIs(replica.APIs())
 	stack.RegisterLifecycle(replica)
 	return stack, replica.GetBackend(), nil
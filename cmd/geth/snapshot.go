@@ -17,17 +17,25 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
 	"time"
 
 	"github.com/ethereum/go-ethereum/cmd/utils"
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
 	"github.com/ethereum/go-ethereum/core/rawdb"
 	"github.com/ethereum/go-ethereum/core/state"
 	"github.com/ethereum/go-ethereum/core/state/pruner"
 	"github.com/ethereum/go-ethereum/core/state/snapshot"
 	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethdb"
 	"github.com/ethereum/go-ethereum/log"
 	"github.com/ethereum/go-ethereum/rlp"
 	"github.com/ethereum/go-ethereum/trie"
@@ -138,10 +146,40 @@ verification. The default checking target is the HEAD state. It's basically iden
 to traverse-state, but the check granularity is smaller. 
 
 It's also usable without snapshot enabled.
+`,
+			},
+			{
+				Name:      "replay-deltas",
+				Usage:     "Apply a state delta file to the snapshot, or write it out as per-block diffs",
+				ArgsUsage: "<file>",
+				Action:    utils.MigrateFlags(replayDeltas),
+				Category:  "MISCELLANEOUS COMMANDS",
+				Flags: []cli.Flag{
+					utils.DataDirFlag,
+					utils.RopstenFlag,
+					utils.RinkebyFlag,
+					utils.GoerliFlag,
+					replayDeltasOutputFlag,
+				},
+				Description: `
+geth snapshot replay-deltas <file>
+will read a state delta file written with --statedelta.file and apply each
+block's delta on top of the existing snapshot, skipping deltas the snapshot
+already has. All applied layers are flattened into the disk layer at the end.
+
+With --output, the deltas are instead written out as one JSON object per
+block, listing the destructed accounts and the changed accounts and storage
+slots, keyed by hash. If a datadir is given, each object also carries the
+number of the canonical block with that state root.
 `,
 			},
 		},
 	}
+
+	replayDeltasOutputFlag = cli.StringFlag{
+		Name:  "output",
+		Usage: "Write per-block diffs as JSON lines to this file (\"-\" for stdout) instead of applying the deltas",
+	}
 )
 
 func pruneState(ctx *cli.Context) error {
@@ -431,3 +469,274 @@ func parseRoot(input string) (common.Hash, error) {
 	}
 	return h, nil
 }
+
+// replayDeltas reads a state delta file written by snapshot.FileCDCTree, and
+// either applies it to the snapshot or writes it out as JSON.
+func replayDeltas(ctx *cli.Context) error {
+	if ctx.NArg() != 1 {
+		log.Error("Expected a state delta file")
+		return errors.New("expected a state delta file")
+	}
+	fi, err := os.Open(ctx.Args()[0])
+	if err != nil {
+		log.Error("Failed to open state delta file", "error", err)
+		return err
+	}
+	defer fi.Close()
+	reader, err := snapshot.NewDeltaFileReader(fi)
+	if err != nil {
+		log.Error("Failed to read state delta file", "error", err)
+		return err
+	}
+	defer reader.Close()
+
+	if output := ctx.String(replayDeltasOutputFlag.Name); output != "" {
+		return writeDeltaDiffs(ctx, reader, output)
+	}
+	return applyDeltas(ctx, reader)
+}
+
+// nextDelta returns the next delta from reader, or nil at the end of the
+// file. A truncated file is read up to its last complete delta.
+func nextDelta(reader *snapshot.DeltaFileReader) (*snapshot.StateDelta, error) {
+	delta, err := reader.Next()
+	switch err {
+	case nil:
+		return delta, nil
+	case io.EOF:
+		return nil, nil
+	case io.ErrUnexpectedEOF:
+		log.Warn("State delta file is truncated, stopping at the last complete delta")
+		return nil, nil
+	}
+	log.Error("Failed to decode state delta", "error", err)
+	return nil, err
+}
+
+func applyDeltas(ctx *cli.Context, reader *snapshot.DeltaFileReader) error {
+	stack, _ := makeConfigNode(ctx)
+	defer stack.Close()
+
+	chain, chaindb := utils.MakeChain(ctx, stack, true)
+	defer chaindb.Close()
+
+	head := chain.CurrentBlock()
+	snaptree, err := snapshot.New(chaindb, trie.NewDatabase(chaindb), 256, head.Root(), false, false, true)
+	if err != nil {
+		log.Error("Failed to open snapshot tree", "error", err)
+		return err
+	}
+	var (
+		start   = time.Now()
+		last    common.Hash
+		applied int
+		skipped int
+	)
+	for {
+		delta, err := nextDelta(reader)
+		if err != nil {
+			return err
+		}
+		if delta == nil {
+			break
+		}
+		if snaptree.Snapshot(delta.Root) != nil || snaptree.Snapshot(delta.ParentRoot) == nil {
+			// Either already in the snapshot, or not built on anything in it
+			log.Debug("Skipping state delta", "root", delta.Root, "parent", delta.ParentRoot)
+			skipped++
+			continue
+		}
+		if err := snaptree.Update(delta.Root, delta.ParentRoot, delta.Destructs, delta.Accounts, delta.Storage); err != nil {
+			log.Error("Failed to apply state delta", "root", delta.Root, "error", err)
+			return err
+		}
+		if err := snaptree.Cap(delta.Root, 128); err != nil {
+			log.Error("Failed to cap snapshot tree", "root", delta.Root, "error", err)
+			return err
+		}
+		last = delta.Root
+		applied++
+	}
+	if applied == 0 {
+		log.Info("No state deltas applied", "skipped", skipped)
+		return nil
+	}
+	if err := snaptree.Cap(last, 0); err != nil {
+		log.Error("Failed to flatten snapshot tree", "root", last, "error", err)
+		return err
+	}
+	if _, err := snaptree.Journal(last); err != nil {
+		log.Error("Failed to journal snapshot", "root", last, "error", err)
+		return err
+	}
+	if last != head.Root() {
+		// Unless geth knows the snapshot is ahead of its head, it will
+		// regenerate the snapshot on startup.
+		index := newStateRootIndex(chaindb)
+		if number, ok := index.number(last); ok && number > head.NumberU64() {
+			rawdb.WriteSnapshotRecoveryNumber(chaindb, number)
+		} else {
+			log.Warn("Snapshot does not match the chain head", "snaproot", last, "chainroot", head.Root())
+		}
+	}
+	log.Info("Applied state deltas", "applied", applied, "skipped", skipped, "root", last, "elapsed", common.PrettyDuration(time.Since(start)))
+	return nil
+}
+
+// deltaAccount is an account in a deltaDiff. Deleted accounts are null.
+type deltaAccount struct {
+	Nonce       uint64       `json:"nonce"`
+	Balance     *hexutil.Big `json:"balance"`
+	StorageRoot common.Hash  `json:"storageRoot"`
+	CodeHash    common.Hash  `json:"codeHash"`
+}
+
+// deltaDiff is the JSON form of a state delta. Deleted storage slots are 0x.
+type deltaDiff struct {
+	Block      *uint64                                       `json:"block,omitempty"`
+	Root       common.Hash                                   `json:"root"`
+	ParentRoot common.Hash                                   `json:"parentRoot"`
+	Destructs  []common.Hash                                 `json:"destructs"`
+	Accounts   map[common.Hash]*deltaAccount                 `json:"accounts"`
+	Storage    map[common.Hash]map[common.Hash]hexutil.Bytes `json:"storage"`
+}
+
+func newDeltaDiff(delta *snapshot.StateDelta) (*deltaDiff, error) {
+	diff := &deltaDiff{
+		Root:       delta.Root,
+		ParentRoot: delta.ParentRoot,
+		Destructs:  make([]common.Hash, 0, len(delta.Destructs)),
+		Accounts:   make(map[common.Hash]*deltaAccount),
+		Storage:    make(map[common.Hash]map[common.Hash]hexutil.Bytes),
+	}
+	for hash := range delta.Destructs {
+		diff.Destructs = append(diff.Destructs, hash)
+	}
+	sort.Slice(diff.Destructs, func(i, j int) bool {
+		return bytes.Compare(diff.Destructs[i][:], diff.Destructs[j][:]) < 0
+	})
+	for hash, data := range delta.Accounts {
+		if len(data) == 0 {
+			diff.Accounts[hash] = nil
+			continue
+		}
+		account, err := snapshot.FullAccount(data)
+		if err != nil {
+			return nil, fmt.Errorf("invalid account %#x: %v", hash, err)
+		}
+		diff.Accounts[hash] = &deltaAccount{
+			Nonce:       account.Nonce,
+			Balance:     (*hexutil.Big)(account.Balance),
+			StorageRoot: common.BytesToHash(account.Root),
+			CodeHash:    common.BytesToHash(account.CodeHash),
+		}
+	}
+	for accountHash, slots := range delta.Storage {
+		diff.Storage[accountHash] = make(map[common.Hash]hexutil.Bytes)
+		for slotHash, data := range slots {
+			value := []byte{}
+			if len(data) > 0 {
+				_, content, _, err := rlp.Split(data)
+				if err != nil {
+					return nil, fmt.Errorf("invalid storage slot %#x of %#x: %v", slotHash, accountHash, err)
+				}
+				value = content
+			}
+			diff.Storage[accountHash][slotHash] = value
+		}
+	}
+	return diff, nil
+}
+
+func writeDeltaDiffs(ctx *cli.Context, reader *snapshot.DeltaFileReader, output string) error {
+	var index *stateRootIndex
+	if ctx.GlobalIsSet(utils.DataDirFlag.Name) {
+		stack, _ := makeConfigNode(ctx)
+		defer stack.Close()
+
+		chaindb := utils.MakeChainDatabase(ctx, stack)
+		defer chaindb.Close()
+
+		index = newStateRootIndex(chaindb)
+	}
+	out := io.Writer(os.Stdout)
+	if output != "-" {
+		fi, err := os.Create(output)
+		if err != nil {
+			log.Error("Failed to create output file", "error", err)
+			return err
+		}
+		defer fi.Close()
+		out = fi
+	}
+	writer := bufio.NewWriter(out)
+	defer writer.Flush()
+	encoder := json.NewEncoder(writer)
+
+	count := 0
+	for {
+		delta, err := nextDelta(reader)
+		if err != nil {
+			return err
+		}
+		if delta == nil {
+			break
+		}
+		diff, err := newDeltaDiff(delta)
+		if err != nil {
+			log.Error("Failed to decode state delta", "root", delta.Root, "error", err)
+			return err
+		}
+		if index != nil {
+			if number, ok := index.number(delta.Root); ok {
+				diff.Block = &number
+			}
+		}
+		if err := encoder.Encode(diff); err != nil {
+			return err
+		}
+		count++
+	}
+	log.Info("Wrote state diffs", "blocks", count)
+	return nil
+}
+
+// stateRootIndex maps state roots to canonical block numbers, indexing headers
+// backwards from the chain head as far as lookups require.
+type stateRootIndex struct {
+	db    ethdb.Reader
+	next  uint64
+	done  bool
+	roots map[common.Hash]uint64
+}
+
+func newStateRootIndex(db ethdb.Reader) *stateRootIndex {
+	index := &stateRootIndex{db: db, roots: make(map[common.Hash]uint64)}
+	if number := rawdb.ReadHeaderNumber(db, rawdb.ReadHeadHeaderHash(db)); number != nil {
+		index.next = *number
+	} else {
+		index.done = true
+	}
+	return index
+}
+
+// number returns the number of the canonical block with the given state root.
+// Where several blocks share a root, the earliest indexed so far is returned.
+func (index *stateRootIndex) number(root common.Hash) (uint64, bool) {
+	for {
+		if number, ok := index.roots[root]; ok {
+			return number, true
+		}
+		if index.done {
+			return 0, false
+		}
+		if header := rawdb.ReadHeader(index.db, rawdb.ReadCanonicalHash(index.db, index.next), index.next); header != nil {
+			index.roots[header.Root] = index.next
+		}
+		if index.next == 0 {
+			index.done = true
+		} else {
+			index.next--
+		}
+	}
+}
@@ -21,10 +21,9 @@ import (
 	"fmt"
 	"github.com/ethereum/go-ethereum"
 	"github.com/ethereum/go-ethereum/cmd/utils"
-	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/ethclient"
-	"github.com/ethereum/go-ethereum/rlp"
 	"github.com/ethereum/go-ethereum/ethdb/cdc"
+	replicaModule "github.com/ethereum/go-ethereum/replica"
 	"github.com/Shopify/sarama"
 	"gopkg.in/urfave/cli.v1"
 	"os"
@@ -37,25 +36,35 @@ var (
 		Action:    utils.MigrateFlags(txrelay), // keep track of migration progress
 		Name:      "txrelay",
 		Usage:     "Broadcast signed transactions from a Kafka topic",
-		ArgsUsage: " ",
+		ArgsUsage: "[<endpoint> ...]",
 		Category:  "REPLICA COMMANDS",
 		Description: `
 Picks up transactions placed on Kafka topics by replicas an relays them to RPC
-nodes.
+nodes. If several endpoints are given, transactions fail over to the next one
+when an endpoint can't be reached. If --kafka.tx.result.topic is set, whether
+each transaction was accepted is reported on that topic, so replicas can return
+the master's errors. Transactions that can't be decoded, or can't be sent to
+any endpoint, are recorded on --kafka.tx.deadletter.topic.
 `,
 		Flags: []cli.Flag{
 			utils.KafkaLogBrokerFlag,
 			utils.KafkaTransactionTopicFlag,
+			utils.KafkaTransactionResultTopicFlag,
+			utils.KafkaTransactionDeadLetterTopicFlag,
 			utils.KafkaTransactionConsumerGroupFlag,
+			utils.TxRelayDedupeWindowFlag,
+			utils.TxRelayRetriesFlag,
+			utils.TxRelaySenderRateFlag,
+			utils.TxRelaySenderBurstFlag,
 		},
 	}
 )
 // replica starts replica node
 func txrelay(ctx *cli.Context) error {
 	sarama.Logger = log.New(os.Stderr, "[sarama]", 0)
-	rpcEndpoint := ctx.Args().First()
-	if rpcEndpoint == "" {
-		rpcEndpoint = fmt.Sprintf("%s/.ethereum/geth.ipc", os.Getenv("HOME"))
+	rpcEndpoints := ctx.Args()
+	if len(rpcEndpoints) == 0 {
+		rpcEndpoints = []string{fmt.Sprintf("%s/.ethereum/geth.ipc", os.Getenv("HOME"))}
 	}
 	brokerURL := ctx.GlobalString(utils.KafkaLogBrokerFlag.Name)
 	brokers, config := cdc.ParseKafkaURL(brokerURL)
@@ -71,13 +80,42 @@ func txrelay(ctx *cli.Context) error {
 		return err
 	}
 	defer consumerGroup.Close()
-	conn, err := ethclient.Dial(rpcEndpoint)
-	if err != nil {
-		fmt.Println("Dial Error")
-		return err
+	senders := make([]ethereum.TransactionSender, len(rpcEndpoints))
+	for i, rpcEndpoint := range rpcEndpoints {
+		conn, err := ethclient.Dial(rpcEndpoint)
+		if err != nil {
+			fmt.Printf("Dial Error: %v\n", rpcEndpoint)
+			return err
+		}
+		defer conn.Close()
+		senders[i] = conn
 	}
+	var results replicaModule.TransactionResultProducer
+	if resultTopic := ctx.GlobalString(utils.KafkaTransactionResultTopicFlag.Name); resultTopic != "" {
+		results, err = replicaModule.NewKafkaTransactionResultProducerFromURLs(brokerURL, resultTopic)
+		if err != nil {
+			fmt.Println("Error creating result producer")
+			return err
+		}
+		defer results.Close()
+	}
+	var deadLetters replicaModule.DeadLetterProducer
+	if deadLetterTopic := ctx.GlobalString(utils.KafkaTransactionDeadLetterTopicFlag.Name); deadLetterTopic != "" {
+		deadLetters, err = replicaModule.NewKafkaDeadLetterProducerFromURLs(brokerURL, deadLetterTopic)
+		if err != nil {
+			fmt.Println("Error creating dead letter producer")
+			return err
+		}
+		defer deadLetters.Close()
+	}
+	relay := replicaModule.NewTransactionRelay(senders, replicaModule.TransactionRelayConfig{
+		DedupeWindow: ctx.GlobalDuration(utils.TxRelayDedupeWindowFlag.Name),
+		Retries: ctx.GlobalInt(utils.TxRelayRetriesFlag.Name),
+		SenderRate: ctx.GlobalFloat64(utils.TxRelaySenderRateFlag.Name),
+		SenderBurst: ctx.GlobalInt(utils.TxRelaySenderBurstFlag.Name),
+	}, results, deadLetters)
 	for {
-		handler := relayConsumerGroup{conn}
+		handler := relayConsumerGroup{relay}
 		if err := consumerGroup.Consume(context.Background(), []string{topic}, handler); err != nil {
 			return err
 		}
@@ -87,23 +125,21 @@ func txrelay(ctx *cli.Context) error {
 
 
 type relayConsumerGroup struct{
-	txs ethereum.TransactionSender
+	relay *replicaModule.TransactionRelay
 }
 
 func (relayConsumerGroup) Setup(_ sarama.ConsumerGroupSession) error   { return nil }
 func (relayConsumerGroup) Cleanup(_ sarama.ConsumerGroupSession) error { return nil }
 func (h relayConsumerGroup) ConsumeClaim(sess sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
   for msg := range claim.Messages() {
-		transaction := &types.Transaction{}
-		fmt.Printf("Msg: %v\n", msg)
-		if err := rlp.DecodeBytes(msg.Value, transaction); err != nil {
-			fmt.Printf("Error decoding: %v\n", err.Error())
-		}
-		if err := h.txs.SendTransaction(context.Background(), transaction); err != nil {
-			fmt.Printf("Error Sending: %v\n", err.Error())
+		if err := h.relay.Relay(sess.Context(), msg.Value); err != nil {
+			if sess.Context().Err() != nil {
+				// The session is ending, so leave the message for the next one
+				return nil
+			}
+			fmt.Printf("Error relaying transaction at offset %v: %v\n", msg.Offset, err.Error())
 		}
     sess.MarkMessage(msg, "")
-		fmt.Println("Processed a message\n")
   }
   return nil
 }
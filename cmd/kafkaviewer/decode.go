@@ -0,0 +1,287 @@
+package main
+
+import (
+  "bytes"
+  "encoding/binary"
+  "fmt"
+  "sort"
+  "strings"
+  "time"
+  "github.com/ethereum/go-ethereum/common"
+  "github.com/ethereum/go-ethereum/common/hexutil"
+  "github.com/ethereum/go-ethereum/core/rawdb"
+  "github.com/ethereum/go-ethereum/core/state/snapshot"
+  "github.com/ethereum/go-ethereum/crypto"
+  "github.com/ethereum/go-ethereum/ethdb/cdc"
+  "github.com/ethereum/go-ethereum/replica"
+  "github.com/ethereum/go-ethereum/rlp"
+)
+
+// record is a single decoded message from a topic. Messages are decoded on
+// their own, so batch items and the parts of chain events and state deltas
+// are shown as they appear on the topic rather than reassembled.
+type record struct {
+  Partition int32 `json:"partition"`
+  Offset int64 `json:"offset"`
+  Time time.Time `json:"time"`
+  Type string `json:"type"`
+  Key hexutil.Bytes `json:"key,omitempty"`
+  Category string `json:"category,omitempty"`
+  Value hexutil.Bytes `json:"value,omitempty"`
+  Fields map[string]interface{} `json:"fields,omitempty"`
+  Error string `json:"error,omitempty"`
+
+  // accounts are the account hashes the message concerns, for messages that
+  // aren't database writes.
+  accounts []common.Hash
+}
+
+// decoder decodes a message from one of the topics the viewer understands.
+type decoder func(key, value []byte) *record
+
+var decoders = map[string]decoder{
+  "cdc": decodeOperation,
+  "events": decodeEvent,
+  "deltas": decodeDelta,
+}
+
+var opNames = map[byte]string{
+  cdc.OpPut: "put",
+  cdc.OpDelete: "delete",
+  cdc.OpWrite: "write",
+  cdc.OpHeartbeat: "heartbeat",
+  cdc.OpGet: "get",
+  cdc.OpHas: "has",
+  cdc.OpAppendAncient: "append-ancient",
+  cdc.OpTruncateAncients: "truncate-ancients",
+  cdc.OpSync: "sync",
+  cdc.OpBarrier: "barrier",
+}
+
+func opName(op byte) string {
+  if name, ok := opNames[op]; ok {
+    return name
+  }
+  return fmt.Sprintf("unknown(%d)", op)
+}
+
+func (r *record) set(key string, value interface{}) {
+  if r.Fields == nil {
+    r.Fields = make(map[string]interface{})
+  }
+  r.Fields[key] = value
+}
+
+func (r *record) fail(err error) *record {
+  r.Error = err.Error()
+  return r
+}
+
+func (r *record) setKey(key []byte) {
+  r.Key = common.CopyBytes(key)
+  r.Category = rawdb.KeyCategory(key)
+}
+
+// decodeOperation decodes a message from a CDC topic.
+func decodeOperation(key, value []byte) *record {
+  r := &record{}
+  value, identity, err := cdc.Unseal(value)
+  if err != nil { return r.fail(err) }
+  if !identity.IsZero() {
+    r.set("chain", identity.String())
+  }
+  if len(value) == 0 {
+    r.Type = "empty"
+    return r
+  }
+  if value[0] == 255 {
+    if len(value) < 18 { return r.fail(fmt.Errorf("batch operation too short")) }
+    bop, err := cdc.BatchOperationFromBytes(value, "", 0)
+    if err != nil { return r.fail(err) }
+    r.Type = "batch-" + opName(bop.Op)
+    r.set("batch", hexutil.Bytes(bop.Batch))
+    return decodeOperationData(r, bop.Op, bop.Data)
+  }
+  op, err := cdc.OperationFromBytes(value, "", 0)
+  if err != nil { return r.fail(err) }
+  if op.Op == cdc.OpBarrier {
+    if len(op.Data) < 8 { return r.fail(fmt.Errorf("invalid barrier")) }
+    r.set("barrier", binary.BigEndian.Uint64(op.Data[:8]))
+    if len(op.Data) == 8 {
+      r.Type = opName(op.Op)
+      return r
+    }
+    // Partition 0's copy of the barrier carries the barrier operation
+    op, err = cdc.OperationFromBytes(op.Data[8:], "", 0)
+    if err != nil { return r.fail(err) }
+  }
+  r.Type = opName(op.Op)
+  return decodeOperationData(r, op.Op, op.Data)
+}
+
+func decodeOperationData(r *record, op byte, data []byte) *record {
+  switch op {
+  case cdc.OpPut:
+    kv := &cdc.KeyValue{}
+    if err := rlp.DecodeBytes(data, kv); err != nil { return r.fail(err) }
+    r.setKey(kv.Key)
+    r.Value = kv.Value
+  case cdc.OpDelete, cdc.OpGet, cdc.OpHas:
+    r.setKey(data)
+  case cdc.OpWrite:
+    r.set("batch", hexutil.Bytes(data))
+  case cdc.OpAppendAncient:
+    a := &cdc.AncientData{}
+    if err := rlp.DecodeBytes(data, a); err != nil { return r.fail(err) }
+    r.set("number", a.Number)
+    r.set("hash", common.BytesToHash(a.Hash))
+  case cdc.OpTruncateAncients:
+    var n uint64
+    if err := rlp.DecodeBytes(data, &n); err != nil { return r.fail(err) }
+    r.set("items", n)
+  }
+  return r
+}
+
+// decodeEvent decodes a message from a replica chain event topic.
+func decodeEvent(key, value []byte) *record {
+  r := &record{}
+  msg, err := replica.DecodeEventMessage(key, value)
+  if err != nil { return r.fail(err) }
+  r.Type = msg.Type.String()
+  r.set("block", msg.BlockHash)
+  switch msg.Type {
+  case replica.BlockMsg:
+    r.set("number", msg.Block.NumberU64())
+    r.set("parent", msg.Block.ParentHash())
+    r.set("txs", len(msg.Block.Transactions()))
+    r.set("timestamp", msg.Block.Time())
+  case replica.TdMsg:
+    r.set("td", msg.Td)
+  case replica.ReceiptMsg:
+    r.set("tx", msg.TxHash)
+    r.set("status", msg.Receipt.Status)
+    r.set("gasUsed", msg.Receipt.GasUsed)
+    r.set("cumulativeGasUsed", msg.Receipt.CumulativeGasUsed)
+    if msg.Receipt.ContractAddress != (common.Address{}) {
+      r.set("contractAddress", msg.Receipt.ContractAddress)
+      r.accounts = append(r.accounts, crypto.Keccak256Hash(msg.Receipt.ContractAddress.Bytes()))
+    }
+  case replica.LogMsg:
+    r.set("tx", msg.TxHash)
+    r.set("index", msg.Log.Index)
+    r.set("address", msg.Log.Address)
+    r.set("topics", msg.Log.Topics)
+    r.set("data", hexutil.Bytes(msg.Log.Data))
+    r.accounts = append(r.accounts, crypto.Keccak256Hash(msg.Log.Address.Bytes()))
+  }
+  return r
+}
+
+// decodeDelta decodes a message from a snapshot state delta topic.
+func decodeDelta(key, value []byte) *record {
+  r := &record{}
+  msg, err := snapshot.DecodeDeltaMessage(key, value)
+  if err != nil { return r.fail(err) }
+  r.Type = msg.Type.String()
+  r.set("root", msg.Root)
+  switch msg.Type {
+  case snapshot.DeltaMsg:
+    r.set("parent", msg.ParentRoot)
+    r.set("destructs", msg.Destructs)
+    r.set("accounts", msg.Accounts)
+    r.set("storage", msg.Storage)
+  case snapshot.StorageMsg:
+    r.set("slot", msg.Slot)
+    fallthrough
+  default:
+    r.set("account", msg.Account)
+    r.Value = msg.Value
+    r.accounts = append(r.accounts, msg.Account)
+  }
+  return r
+}
+
+// filter selects the records to show. Zero values match everything.
+type filter struct {
+  key []byte
+  prefix []byte
+  category string
+  account *common.Hash
+  types map[string]bool
+}
+
+func (f *filter) matches(r *record) bool {
+  if f.key != nil && !bytes.Equal(r.Key, f.key) { return false }
+  if f.prefix != nil && (r.Key == nil || !bytes.HasPrefix(r.Key, f.prefix)) { return false }
+  if f.category != "" && !strings.EqualFold(r.Category, f.category) { return false }
+  if len(f.types) > 0 && !f.types[r.Type] { return false }
+  if f.account != nil {
+    // Snapshot and preimage keys embed the account hash
+    if r.Key != nil && bytes.Contains(r.Key, f.account.Bytes()) { return true }
+    for _, account := range r.accounts {
+      if account == *f.account { return true }
+    }
+    return false
+  }
+  return true
+}
+
+// parseBytes reads a 0x prefixed hex string as bytes, and anything else as a
+// literal string, so that keys like LastBlock can be given by name.
+func parseBytes(s string) ([]byte, error) {
+  if strings.HasPrefix(s, "0x") {
+    return hexutil.Decode(s)
+  }
+  return []byte(s), nil
+}
+
+// parseAccount reads an account hash, or an address to be hashed.
+func parseAccount(s string) (common.Hash, error) {
+  data, err := hexutil.Decode(s)
+  if err != nil { return common.Hash{}, err }
+  switch len(data) {
+  case common.AddressLength:
+    return crypto.Keccak256Hash(data), nil
+  case common.HashLength:
+    return common.BytesToHash(data), nil
+  }
+  return common.Hash{}, fmt.Errorf("expected an address or account hash, got %v bytes", len(data))
+}
+
+// printable reports whether key is readable as text, like LastBlock.
+func printable(key []byte) bool {
+  for _, b := range key {
+    if b < 0x20 || b > 0x7e { return false }
+  }
+  return len(key) > 0
+}
+
+// String formats the record on a single line, for reading in a terminal.
+func (r *record) String() string {
+  var b strings.Builder
+  fmt.Fprintf(&b, "%v/%v %v %v", r.Partition, r.Offset, r.Time.UTC().Format(time.RFC3339Nano), r.Type)
+  if r.Key != nil {
+    if printable(r.Key) {
+      fmt.Fprintf(&b, " key=%q", string(r.Key))
+    } else {
+      fmt.Fprintf(&b, " key=%v", r.Key)
+    }
+    fmt.Fprintf(&b, " (%v)", r.Category)
+  }
+  if r.Value != nil {
+    fmt.Fprintf(&b, " value=%v", r.Value)
+  }
+  names := make([]string, 0, len(r.Fields))
+  for name := range r.Fields {
+    names = append(names, name)
+  }
+  sort.Strings(names)
+  for _, name := range names {
+    fmt.Fprintf(&b, " %v=%v", name, r.Fields[name])
+  }
+  if r.Error != "" {
+    fmt.Fprintf(&b, " error=%q", r.Error)
+  }
+  return b.String()
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+  "encoding/binary"
+  "testing"
+  "github.com/ethereum/go-ethereum/common"
+  "github.com/ethereum/go-ethereum/core/rawdb"
+  "github.com/ethereum/go-ethereum/crypto"
+  "github.com/ethereum/go-ethereum/ethdb/cdc"
+  "github.com/ethereum/go-ethereum/params"
+  "github.com/pborman/uuid"
+)
+
+func TestDecodeOperation(t *testing.T) {
+  head := common.HexToHash("0x1234")
+  put, _ := cdc.PutOperation([]byte("LastBlock"), head.Bytes())
+  id := cdc.ChainIdentity{Genesis: params.MainnetGenesisHash, ChainID: 1}
+  r := decodeOperation(nil, cdc.Seal(put.Bytes(), id))
+  if r.Error != "" { t.Fatalf(r.Error) }
+  if r.Type != "put" || string(r.Key) != "LastBlock" || common.BytesToHash(r.Value) != head {
+    t.Errorf("Unexpected record %v", r)
+  }
+  if r.Category != "Singleton metadata" || r.Fields["chain"] != id.String() {
+    t.Errorf("Unexpected category %v or chain %v", r.Category, r.Fields["chain"])
+  }
+
+  batch := uuid.NewRandom()
+  bop := &cdc.BatchOperation{Op: cdc.OpDelete, Batch: batch, Data: rawdb.SnapshotAccountPrefix}
+  r = decodeOperation(nil, bop.Bytes())
+  if r.Type != "batch-delete" || string(r.Key) != string(rawdb.SnapshotAccountPrefix) {
+    t.Errorf("Unexpected record %v", r)
+  }
+
+  // Partition 0's copy of a barrier carries the barrier operation
+  barrier := make([]byte, 9)
+  binary.BigEndian.PutUint64(barrier[1:], 7)
+  barrier[0] = cdc.OpBarrier
+  r = decodeOperation(nil, append(barrier, put.Bytes()...))
+  if r.Type != "put" || r.Fields["barrier"] != uint64(7) || string(r.Key) != "LastBlock" {
+    t.Errorf("Unexpected record %v", r)
+  }
+  r = decodeOperation(nil, barrier)
+  if r.Type != "barrier" || r.Fields["barrier"] != uint64(7) {
+    t.Errorf("Unexpected record %v", r)
+  }
+
+  if r := decodeOperation(nil, []byte{cdc.OpPut, 1, 2, 3}); r.Error == "" {
+    t.Errorf("Expected error decoding invalid put")
+  }
+}
+
+func TestFilter(t *testing.T) {
+  address := common.HexToAddress("0x01")
+  accountHash := crypto.Keccak256Hash(address.Bytes())
+  records := []*record{
+    {Type: "put", Key: []byte("LastBlock"), Category: "Singleton metadata"},
+    {Type: "batch-put", Key: append(append([]byte{}, rawdb.SnapshotAccountPrefix...), accountHash.Bytes()...), Category: "Account snapshot"},
+    {Type: "storage", accounts: []common.Hash{accountHash}},
+    {Type: "heartbeat"},
+  }
+  account, err := parseAccount(address.Hex())
+  if err != nil { t.Fatalf(err.Error()) }
+  lastBlock, _ := parseBytes("LastBlock")
+  prefix, _ := parseBytes("0x61")
+  for i, test := range []struct {
+    filter *filter
+    expected []bool
+  }{
+    {&filter{}, []bool{true, true, true, true}},
+    {&filter{key: lastBlock}, []bool{true, false, false, false}},
+    {&filter{prefix: prefix}, []bool{false, true, false, false}},
+    {&filter{category: "account snapshot"}, []bool{false, true, false, false}},
+    {&filter{account: &account}, []bool{false, true, true, false}},
+    {&filter{types: map[string]bool{"heartbeat": true, "put": true}}, []bool{true, false, false, true}},
+  } {
+    for j, r := range records {
+      if test.filter.matches(r) != test.expected[j] {
+        t.Errorf("Filter %v: expected %v for record %v", i, test.expected[j], j)
+      }
+    }
+  }
+  if _, err := parseAccount("0x1234"); err == nil {
+    t.Errorf("Expected error for short account")
+  }
+}
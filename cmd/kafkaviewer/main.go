@@ -1,28 +1,219 @@
+// kafkaviewer prints the messages on a CDC, chain event or state delta topic,
+// for debugging replicas that have diverged from their master.
 package main
 
 import (
-  "github.com/ethereum/go-ethereum/ethdb/cdc"
+  "encoding/json"
+  "flag"
   "fmt"
+  "log"
   "os"
   "os/signal"
-  "log"
+  "strings"
+  "sync"
+  "time"
+  "github.com/Shopify/sarama"
+  "github.com/ethereum/go-ethereum/ethdb/cdc"
+)
+
+var (
+  brokerFlag = flag.String("broker", "", "Kafka broker URL, as given to --kafka.broker (may also be the first argument)")
+  topicFlag = flag.String("topic", "geth", "Topic to read")
+  streamFlag = flag.String("stream", "cdc", "Kind of topic: cdc, events or deltas")
+  partitionFlag = flag.Int("partition", -1, "Partition to read (-1 for all)")
+  offsetFlag = flag.Int64("offset", sarama.OffsetOldest, "Offset to start from in each partition (-2 for oldest, -1 for newest)")
+  endFlag = flag.Int64("end", -1, "Offset to stop before in each partition (-1 for none)")
+  sinceFlag = flag.String("since", "", "Start from messages written at or after this time (RFC3339, or a duration ago like 10m)")
+  untilFlag = flag.String("until", "", "Stop at messages written after this time (RFC3339, or a duration ago)")
+  followFlag = flag.Bool("follow", false, "Keep waiting for new messages after reaching the end of the topic")
+  limitFlag = flag.Int("limit", 0, "Stop after printing this many messages (0 for no limit)")
+  jsonFlag = flag.Bool("json", false, "Print one JSON object per message")
+  keyFlag = flag.String("key", "", "Only show operations on this key (0x prefixed hex, or a name like LastBlock)")
+  prefixFlag = flag.String("prefix", "", "Only show operations on keys with this prefix (0x prefixed hex, or text)")
+  categoryFlag = flag.String("category", "", `Only show operations on keys in this category, as named by "geth db inspect"`)
+  accountFlag = flag.String("account", "", "Only show messages concerning this address or account hash")
+  typesFlag = flag.String("types", "", "Only show these comma separated message types (e.g. put,batch-put or account,storage)")
 )
 
+// message is a message read from a partition, before decoding.
+type message struct {
+  partition int32
+  offset int64
+  time time.Time
+  key []byte
+  value []byte
+}
+
+// parseTime reads an RFC3339 time, or a duration before now.
+func parseTime(s string) (time.Time, error) {
+  if s == "" { return time.Time{}, nil }
+  if d, err := time.ParseDuration(s); err == nil {
+    return time.Now().Add(-d), nil
+  }
+  return time.Parse(time.RFC3339, s)
+}
+
+func parseFilter() (*filter, error) {
+  f := &filter{category: *categoryFlag}
+  var err error
+  if *keyFlag != "" {
+    if f.key, err = parseBytes(*keyFlag); err != nil { return nil, fmt.Errorf("invalid key: %v", err) }
+  }
+  if *prefixFlag != "" {
+    if f.prefix, err = parseBytes(*prefixFlag); err != nil { return nil, fmt.Errorf("invalid prefix: %v", err) }
+  }
+  if *accountFlag != "" {
+    account, err := parseAccount(*accountFlag)
+    if err != nil { return nil, fmt.Errorf("invalid account: %v", err) }
+    f.account = &account
+  }
+  if *typesFlag != "" {
+    f.types = make(map[string]bool)
+    for _, t := range strings.Split(*typesFlag, ",") {
+      f.types[strings.TrimSpace(t)] = true
+    }
+  }
+  return f, nil
+}
+
+// partitionRange finds where to start and stop reading a partition. A stop
+// offset of -1 means reading continues indefinitely.
+func partitionRange(client sarama.Client, topic string, partition int32, since time.Time) (int64, int64, error) {
+  oldest, err := client.GetOffset(topic, partition, sarama.OffsetOldest)
+  if err != nil { return 0, 0, err }
+  newest, err := client.GetOffset(topic, partition, sarama.OffsetNewest)
+  if err != nil { return 0, 0, err }
+  start := *offsetFlag
+  switch {
+  case !since.IsZero():
+    start, err = client.GetOffset(topic, partition, since.UnixNano() / int64(time.Millisecond))
+    if err != nil { return 0, 0, err }
+    if start < 0 {
+      // No messages were written after since
+      start = newest
+    }
+  case start == sarama.OffsetOldest || start < oldest:
+    start = oldest
+  case start == sarama.OffsetNewest || start > newest:
+    start = newest
+  }
+  stop := int64(-1)
+  if !*followFlag {
+    stop = newest
+  }
+  if *endFlag >= 0 && (stop < 0 || *endFlag < stop) {
+    stop = *endFlag
+  }
+  return start, stop, nil
+}
+
+// consume sends the messages of a partition from start up to stop to output,
+// until the partition is done or quit is closed.
+func consume(consumer sarama.Consumer, topic string, partition int32, start, stop int64, until time.Time, output chan<- *message, quit <-chan struct{}) error {
+  if stop >= 0 && start >= stop { return nil }
+  partitionConsumer, err := consumer.ConsumePartition(topic, partition, start)
+  if err != nil { return err }
+  defer partitionConsumer.Close()
+  for {
+    select {
+    case msg, ok := <-partitionConsumer.Messages():
+      if !ok { return nil }
+      if stop >= 0 && msg.Offset >= stop { return nil }
+      if !until.IsZero() && msg.Timestamp.After(until) { return nil }
+      select {
+      case output <- &message{partition, msg.Offset, msg.Timestamp, msg.Key, msg.Value}:
+      case <-quit:
+        return nil
+      }
+      if stop >= 0 && msg.Offset + 1 >= stop { return nil }
+    case <-quit:
+      return nil
+    }
+  }
+}
+
 func main() {
-  consumer, err := cdc.NewKafkaLogConsumerFromURL(os.Args[1], "geth", 0)
-  if err != nil {
-    log.Fatalf("%v", err.Error())
+  flag.Usage = func() {
+    fmt.Fprintf(flag.CommandLine.Output(), "Usage: %v [flags] [broker]\n", os.Args[0])
+    flag.PrintDefaults()
+  }
+  flag.Parse()
+  brokerURL := *brokerFlag
+  if brokerURL == "" {
+    brokerURL = flag.Arg(0)
+  }
+  if brokerURL == "" {
+    flag.Usage()
+    os.Exit(2)
   }
-  c := make(chan os.Signal, 1)
-  messages := consumer.Messages()
-	signal.Notify(c, os.Interrupt)
+  decode, ok := decoders[*streamFlag]
+  if !ok {
+    log.Fatalf("Unknown stream %q, expected cdc, events or deltas", *streamFlag)
+  }
+  filter, err := parseFilter()
+  if err != nil { log.Fatalf("%v", err) }
+  since, err := parseTime(*sinceFlag)
+  if err != nil { log.Fatalf("Invalid --since: %v", err) }
+  until, err := parseTime(*untilFlag)
+  if err != nil { log.Fatalf("Invalid --until: %v", err) }
+
+  brokers, config := cdc.ParseKafkaURL(brokerURL)
+  client, err := sarama.NewClient(brokers, config)
+  if err != nil { log.Fatalf("Error connecting to %v: %v", brokerURL, err) }
+  defer client.Close()
+  consumer, err := sarama.NewConsumerFromClient(client)
+  if err != nil { log.Fatalf("Error creating consumer: %v", err) }
+  defer consumer.Close()
+  partitions, err := client.Partitions(*topicFlag)
+  if err != nil { log.Fatalf("Error listing partitions of %v: %v", *topicFlag, err) }
+  if *partitionFlag >= 0 {
+    partitions = []int32{int32(*partitionFlag)}
+  }
+
+  messages := make(chan *message)
+  quit := make(chan struct{})
+  var wg sync.WaitGroup
+  for _, partition := range partitions {
+    start, stop, err := partitionRange(client, *topicFlag, partition, since)
+    if err != nil { log.Fatalf("Error reading offsets of partition %v: %v", partition, err) }
+    wg.Add(1)
+    go func(partition int32, start, stop int64) {
+      defer wg.Done()
+      if err := consume(consumer, *topicFlag, partition, start, stop, until, messages, quit); err != nil {
+        log.Printf("Error consuming partition %v: %v", partition, err)
+      }
+    }(partition, start, stop)
+  }
+  go func() {
+    wg.Wait()
+    close(messages)
+  }()
+
+  interrupt := make(chan os.Signal, 1)
+  signal.Notify(interrupt, os.Interrupt)
+  encoder := json.NewEncoder(os.Stdout)
+  printed := 0
+  defer func() {
+    close(quit)
+    // Drain the remaining messages so the partition consumers can exit
+    for range messages {}
+  }()
   for {
     select {
-    case op := <-messages:
-      log.Printf("%v\n", op)
-    case _ = <-c:
-      break
+    case msg, ok := <-messages:
+      if !ok { return }
+      r := decode(msg.key, msg.value)
+      r.Partition, r.Offset, r.Time = msg.partition, msg.offset, msg.time
+      if !filter.matches(r) { continue }
+      if *jsonFlag {
+        if err := encoder.Encode(r); err != nil { log.Fatalf("%v", err) }
+      } else {
+        fmt.Println(r)
+      }
+      printed++
+      if *limitFlag > 0 && printed >= *limitFlag { return }
+    case <-interrupt:
+      return
     }
-    fmt.Scanln()
   }
 }
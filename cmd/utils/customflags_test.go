@@ -30,6 +30,7 @@ func TestPathExpansion(t *testing.T) {
 		"~thisOtherUser/b/":  "~thisOtherUser/b",
 		"$DDDXXX/a/b":        "/tmp/a/b",
 		"/a/b/":              "/a/b",
+		"s3://bucket/a?endpoint=http://localhost:9000": "s3://bucket/a?endpoint=http://localhost:9000",
 	}
 	os.Setenv("DDDXXX", "/tmp")
 	for test, expected := range tests {
@@ -688,7 +688,7 @@ var (
 		 // TODO: Make this into a list, and if the argument is provided multiple
 		 // times append each occurrence
 		 Name: "kafka.broker",
-		 Usage: "Kafka broker hostname and port",
+		 Usage: "Kafka broker hostname and port, or file:///path/to/dir to use local segment files",
 	}
 	KafkaLogTopicFlag = cli.StringFlag{
 		 Name: "kafka.topic",
@@ -700,6 +700,16 @@ var (
 		 Usage: "Kafka transaction topic name",
 		 Value: "geth-tx",
 	}
+	KafkaTransactionResultTopicFlag = cli.StringFlag{
+		 Name: "kafka.tx.result.topic",
+		 Usage: "Kafka topic on which the transaction relay reports whether the master accepted each transaction",
+		 Value: "",
+	}
+	KafkaTransactionDeadLetterTopicFlag = cli.StringFlag{
+		 Name: "kafka.tx.deadletter.topic",
+		 Usage: "Kafka topic on which the transaction relay records transactions it could not decode or send",
+		 Value: "",
+	}
 	KafkaTransactionPoolTopicFlag = cli.StringFlag{
 		 Name: "kafka.txpool.topic",
 		 Usage: "Kafka transaction pool topic name",
@@ -725,6 +735,26 @@ var (
 		 Usage: "Kafka transaction consumer group name",
 		 Value: "geth-tx",
 	}
+	TxRelayDedupeWindowFlag = cli.DurationFlag{
+		 Name: "txrelay.dedupe.window",
+		 Usage: "How long the transaction relay remembers a transaction, ignoring it if it is received again",
+		 Value: 10 * time.Minute,
+	}
+	TxRelayRetriesFlag = cli.IntFlag{
+		 Name: "txrelay.retries",
+		 Usage: "How many times the transaction relay attempts to send a transaction, failing over between endpoints",
+		 Value: 3,
+	}
+	TxRelaySenderRateFlag = cli.Float64Flag{
+		 Name: "txrelay.sender.rate",
+		 Usage: "Maximum transactions per second relayed from any one sender (0 = unlimited)",
+		 Value: 0,
+	}
+	TxRelaySenderBurstFlag = cli.IntFlag{
+		 Name: "txrelay.sender.burst",
+		 Usage: "Number of transactions a sender may relay at once before --txrelay.sender.rate applies",
+		 Value: 10,
+	}
 	// TODO: Consider consolidating this with exitwhensynced
 	ReplicaSyncShutdownFlag = cli.BoolFlag{
 		 Name: "replica.syncshutdown",
@@ -737,7 +767,7 @@ var (
 	}
 	ReplicaRuntimeMaxOffsetAgeFlag = cli.Int64Flag{
 		 Name: "replica.offset.age",
-		 Usage: "If the replica has not received a message in this number of seconds, shut down.",
+		 Usage: "If the replica has not received a message in this number of seconds, report it as not ready on /ready.",
 		 Value: 0,
 	}
 	ReplicaMaxOffsetFlag = cli.Int64Flag{
@@ -747,9 +777,14 @@ var (
 	}
 	ReplicaRuntimeMaxBlockAgeFlag = cli.Int64Flag{
 		 Name: "replica.block.age",
-		 Usage: "If the replica's current block is older than this number of seconds, shut down.",
+		 Usage: "If the replica's current block is older than this number of seconds, report it as not ready on /ready.",
 		 Value: 0,
 	}
+	ReplicaTransactionTimeoutFlag = cli.DurationFlag{
+		 Name: "replica.tx.timeout",
+		 Usage: "How long to wait for the result of a sent transaction from --kafka.tx.result.topic (0 = don't wait)",
+		 Value: 5 * time.Second,
+	}
 	ReplicaEVMConcurrencyFlag = cli.Int64Flag{
 		 Name: "replica.evm.concurrency",
 		 Usage: "How many EVM instances may run in parallel",
@@ -759,6 +794,32 @@ var (
 		 Name: "replica.warm.addresses",
 		 Usage: "A file containing a JSON list of addresses to warm before running the replica",
 	}
+	ReplicaBootstrapServeFlag = cli.BoolFlag{
+		 Name: "replica.bootstrap.serve",
+		 Usage: "Serve database exports for bootstrapping replicas on the HTTP server",
+	}
+	ReplicaBootstrapSkipAncientsFlag = cli.BoolFlag{
+		 Name: "replica.bootstrap.skipancients",
+		 Usage: "Do not download ancient data when bootstrapping (for replicas sharing a freezer with the source)",
+	}
+	ReplicaVerifySourceFlag = cli.StringFlag{
+		 Name: "replica.verify.source",
+		 Usage: "RPC endpoint or chaindata directory of the master to verify the replica against",
+	}
+	ReplicaVerifyFullFlag = cli.BoolFlag{
+		 Name: "replica.verify.full",
+		 Usage: "Walk the entire state trie when verifying, rather than sampling it",
+	}
+	ReplicaVerifySamplesFlag = cli.IntFlag{
+		 Name: "replica.verify.samples",
+		 Usage: "Number of state trie nodes to sample when verifying",
+		 Value: 1000,
+	}
+	ReplicaVerifyIntervalFlag = cli.Int64Flag{
+		 Name: "replica.verify.interval",
+		 Usage: "Verify the replica against --replica.verify.source every this number of seconds (0 = disabled)",
+		 Value: 0,
+	}
 
 
 	// Metrics flags
@@ -1280,6 +1341,7 @@ func SetNodeConfig(ctx *cli.Context, cfg *node.Config) {
 	cfg.KafkaLogTopic = ctx.GlobalString(KafkaLogTopicFlag.Name)
 	cfg.KafkaTransactionTopic = ctx.GlobalString(KafkaTransactionTopicFlag.Name)
 	cfg.ReplicaSyncShutdown = ctx.GlobalBool(ReplicaSyncShutdownFlag.Name)
+	cfg.ReplicaBootstrapServe = ctx.GlobalBool(ReplicaBootstrapServeFlag.Name)
 
 	setDataDir(ctx, cfg)
 	setSmartCard(ctx, cfg)
@@ -1568,7 +1630,7 @@ func SetEthConfig(ctx *cli.Context, stack *node.Node, cfg *ethconfig.Config) {
 		if strings.HasPrefix(cfg.DatabaseFreezer, "s3:/") && !strings.HasPrefix(cfg.DatabaseFreezer, "s3://") {
 			cfg.DatabaseFreezer = "s3://" + strings.TrimPrefix(cfg.DatabaseFreezer, "s3:/")
 		}
-		log.Info("Ancient flag", "value", cfg.DatabaseFreezer)
+		log.Info("Ancient flag", "value", rawdb.RedactFreezerURL(cfg.DatabaseFreezer))
 	}
 	if ctx.GlobalIsSet(OverlayFlag.Name) {
 		cfg.DatabaseOverlay = ctx.GlobalString(OverlayFlag.Name)
@@ -92,6 +92,23 @@ func DeleteStorageSnapshot(db ethdb.KeyValueWriter, accountHash, storageHash com
 	}
 }
 
+// DeleteStorageSnapshots removes the entire storage space of a specific account
+// from the snapshot with a single range deletion.
+func DeleteStorageSnapshots(db ethdb.RangeDeleter, accountHash common.Hash) {
+	start := storageSnapshotsKey(accountHash)
+
+	// The range ends at the first key past the account's prefix
+	end := common.CopyBytes(start)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i]++; end[i] != 0 {
+			break
+		}
+	}
+	if err := db.DeleteRange(start, end); err != nil {
+		log.Crit("Failed to delete storage snapshots", "err", err)
+	}
+}
+
 // IterateStorageSnapshots returns an iterator for walking the entire storage
 // space of a specific account.
 func IterateStorageSnapshots(db ethdb.Iteratee, accountHash common.Hash) ethdb.Iterator {
@@ -111,12 +111,28 @@ func (db *nofreezedb) Sync() error {
 	return errNotSupported
 }
 
+// rangedb exposes the range deletion of the key-value store underneath a
+// database, which the database wrappers would otherwise hide.
+type rangedb struct {
+	ethdb.Database
+	ethdb.RangeDeleter
+}
+
+// withRangeDeleter wraps db to implement ethdb.RangeDeleter if its key-value
+// store does.
+func withRangeDeleter(db ethdb.Database, kvdb ethdb.KeyValueStore) ethdb.Database {
+	if deleter, ok := kvdb.(ethdb.RangeDeleter); ok {
+		return &rangedb{Database: db, RangeDeleter: deleter}
+	}
+	return db
+}
+
 // NewDatabase creates a high level database on top of a given key-value data
 // store without a freezer moving immutable chain segments into cold storage.
 func NewDatabase(db ethdb.KeyValueStore) ethdb.Database {
-	return &nofreezedb{
+	return withRangeDeleter(&nofreezedb{
 		KeyValueStore: db,
-	}
+	}, db)
 }
 
 // NewDatabaseWithFreezer creates a high level database on top of a given key-
@@ -127,8 +143,9 @@ func NewDatabaseWithFreezer(db ethdb.KeyValueStore, freezerPath string, namespac
 	var frdb ethdb.AncientStore
 	var err error
 	if strings.HasPrefix(freezerPath, "s3://") {
-		frdb, err = NewS3Freezer(freezerPath, 128) // TODO: Configurable cache size?
-		log.Info("Creating s3 freezer", "path", freezerPath)
+		// The cache size can be set with the URL's cache parameter
+		frdb, err = NewS3Freezer(freezerPath, 128)
+		log.Info("Creating s3 freezer", "path", RedactFreezerURL(freezerPath))
 	} else {
 		frdb, err = newFreezer(freezerPath, namespace)
 	}
@@ -206,10 +223,10 @@ func NewDatabaseWithFreezer(db ethdb.KeyValueStore, freezerPath string, namespac
 	default:
 	}
 
-	return &freezerdb{
+	return withRangeDeleter(&freezerdb{
 		KeyValueStore: db,
 		AncientStore:  frdb,
-	}, nil
+	}, db), nil
 }
 
 // NewMemoryDatabase creates an ephemeral in-memory key-value database without a
@@ -280,6 +297,64 @@ func (s *stat) Count() string {
 	return s.count.String()
 }
 
+// KeyCategory returns the name of the category a key-value store key falls
+// in, using the same categories as InspectDatabase.
+func KeyCategory(key []byte) string {
+	switch {
+	case bytes.HasPrefix(key, headerPrefix) && len(key) == (len(headerPrefix)+8+common.HashLength):
+		return "Headers"
+	case bytes.HasPrefix(key, blockBodyPrefix) && len(key) == (len(blockBodyPrefix)+8+common.HashLength):
+		return "Bodies"
+	case bytes.HasPrefix(key, blockReceiptsPrefix) && len(key) == (len(blockReceiptsPrefix)+8+common.HashLength):
+		return "Receipt lists"
+	case bytes.HasPrefix(key, headerPrefix) && bytes.HasSuffix(key, headerTDSuffix):
+		return "Difficulties"
+	case bytes.HasPrefix(key, headerPrefix) && bytes.HasSuffix(key, headerHashSuffix):
+		return "Block number->hash"
+	case bytes.HasPrefix(key, headerNumberPrefix) && len(key) == (len(headerNumberPrefix)+common.HashLength):
+		return "Block hash->number"
+	case len(key) == common.HashLength:
+		return "Trie nodes"
+	case bytes.HasPrefix(key, CodePrefix) && len(key) == len(CodePrefix)+common.HashLength:
+		return "Contract codes"
+	case bytes.HasPrefix(key, txLookupPrefix) && len(key) == (len(txLookupPrefix)+common.HashLength):
+		return "Transaction index"
+	case bytes.HasPrefix(key, SnapshotAccountPrefix) && len(key) == (len(SnapshotAccountPrefix)+common.HashLength):
+		return "Account snapshot"
+	case bytes.HasPrefix(key, SnapshotStoragePrefix) && len(key) == (len(SnapshotStoragePrefix)+2*common.HashLength):
+		return "Storage snapshot"
+	case bytes.HasPrefix(key, preimagePrefix) && len(key) == (len(preimagePrefix)+common.HashLength):
+		return "Trie preimages"
+	case bytes.HasPrefix(key, bloomBitsPrefix) && len(key) == (len(bloomBitsPrefix)+10+common.HashLength):
+		return "Bloombit index"
+	case bytes.HasPrefix(key, BloomBitsIndexPrefix):
+		return "Bloombit index"
+	case bytes.HasPrefix(key, []byte("clique-")) && len(key) == 7+common.HashLength:
+		return "Clique snapshots"
+	case bytes.HasPrefix(key, []byte("cht-")) ||
+		bytes.HasPrefix(key, []byte("chtIndexV2-")) ||
+		bytes.HasPrefix(key, []byte("chtRootV2-")):
+		return "CHT trie nodes"
+	case bytes.HasPrefix(key, []byte("blt-")) ||
+		bytes.HasPrefix(key, []byte("bltIndex-")) ||
+		bytes.HasPrefix(key, []byte("bltRoot-")):
+		return "Bloom trie nodes"
+	case bytes.Equal(key, uncleanShutdownKey):
+		return "Shutdown metadata"
+	}
+	for _, meta := range [][]byte{
+		databaseVersionKey, headHeaderKey, headBlockKey, headFastBlockKey, lastPivotKey,
+		fastTrieProgressKey, snapshotRootKey, snapshotJournalKey, snapshotGeneratorKey,
+		snapshotRecoveryKey, txIndexTailKey, fastTxLookupLimitKey, uncleanShutdownKey,
+		badBlockKey,
+	} {
+		if bytes.Equal(key, meta) {
+			return "Singleton metadata"
+		}
+	}
+	return "Unaccounted"
+}
+
 // InspectDatabase traverses the entire database and checks the size
 // of all different categories of data.
 func InspectDatabase(db ethdb.Database, keyPrefix, keyStart []byte) error {
@@ -326,6 +401,28 @@ func InspectDatabase(db ethdb.Database, keyPrefix, keyStart []byte) error {
 		// Totals
 		total common.StorageSize
 	)
+	// Key categories, as named by KeyCategory
+	categories := map[string]*stat{
+		"Headers":            &headers,
+		"Bodies":             &bodies,
+		"Receipt lists":      &receipts,
+		"Difficulties":       &tds,
+		"Block number->hash": &numHashPairings,
+		"Block hash->number": &hashNumPairings,
+		"Trie nodes":         &tries,
+		"Contract codes":     &codes,
+		"Transaction index":  &txLookups,
+		"Account snapshot":   &accountSnaps,
+		"Storage snapshot":   &storageSnaps,
+		"Trie preimages":     &preimages,
+		"Bloombit index":     &bloomBits,
+		"Clique snapshots":   &cliqueSnaps,
+		"CHT trie nodes":     &chtTrieNodes,
+		"Bloom trie nodes":   &bloomTrieNodes,
+		"Shutdown metadata":  &shutdownInfo,
+		"Singleton metadata": &metadata,
+		"Unaccounted":        &unaccounted,
+	}
 	// Inspect key-value database first.
 	for it.Next() {
 		var (
@@ -333,65 +430,7 @@ func InspectDatabase(db ethdb.Database, keyPrefix, keyStart []byte) error {
 			size = common.StorageSize(len(key) + len(it.Value()))
 		)
 		total += size
-		switch {
-		case bytes.HasPrefix(key, headerPrefix) && len(key) == (len(headerPrefix)+8+common.HashLength):
-			headers.Add(size)
-		case bytes.HasPrefix(key, blockBodyPrefix) && len(key) == (len(blockBodyPrefix)+8+common.HashLength):
-			bodies.Add(size)
-		case bytes.HasPrefix(key, blockReceiptsPrefix) && len(key) == (len(blockReceiptsPrefix)+8+common.HashLength):
-			receipts.Add(size)
-		case bytes.HasPrefix(key, headerPrefix) && bytes.HasSuffix(key, headerTDSuffix):
-			tds.Add(size)
-		case bytes.HasPrefix(key, headerPrefix) && bytes.HasSuffix(key, headerHashSuffix):
-			numHashPairings.Add(size)
-		case bytes.HasPrefix(key, headerNumberPrefix) && len(key) == (len(headerNumberPrefix)+common.HashLength):
-			hashNumPairings.Add(size)
-		case len(key) == common.HashLength:
-			tries.Add(size)
-		case bytes.HasPrefix(key, CodePrefix) && len(key) == len(CodePrefix)+common.HashLength:
-			codes.Add(size)
-		case bytes.HasPrefix(key, txLookupPrefix) && len(key) == (len(txLookupPrefix)+common.HashLength):
-			txLookups.Add(size)
-		case bytes.HasPrefix(key, SnapshotAccountPrefix) && len(key) == (len(SnapshotAccountPrefix)+common.HashLength):
-			accountSnaps.Add(size)
-		case bytes.HasPrefix(key, SnapshotStoragePrefix) && len(key) == (len(SnapshotStoragePrefix)+2*common.HashLength):
-			storageSnaps.Add(size)
-		case bytes.HasPrefix(key, preimagePrefix) && len(key) == (len(preimagePrefix)+common.HashLength):
-			preimages.Add(size)
-		case bytes.HasPrefix(key, bloomBitsPrefix) && len(key) == (len(bloomBitsPrefix)+10+common.HashLength):
-			bloomBits.Add(size)
-		case bytes.HasPrefix(key, BloomBitsIndexPrefix):
-			bloomBits.Add(size)
-		case bytes.HasPrefix(key, []byte("clique-")) && len(key) == 7+common.HashLength:
-			cliqueSnaps.Add(size)
-		case bytes.HasPrefix(key, []byte("cht-")) ||
-			bytes.HasPrefix(key, []byte("chtIndexV2-")) ||
-			bytes.HasPrefix(key, []byte("chtRootV2-")): // Canonical hash trie
-			chtTrieNodes.Add(size)
-		case bytes.HasPrefix(key, []byte("blt-")) ||
-			bytes.HasPrefix(key, []byte("bltIndex-")) ||
-			bytes.HasPrefix(key, []byte("bltRoot-")): // Bloomtrie sub
-			bloomTrieNodes.Add(size)
-		case bytes.Equal(key, uncleanShutdownKey):
-			shutdownInfo.Add(size)
-		default:
-			var accounted bool
-			for _, meta := range [][]byte{
-				databaseVersionKey, headHeaderKey, headBlockKey, headFastBlockKey, lastPivotKey,
-				fastTrieProgressKey, snapshotRootKey, snapshotJournalKey, snapshotGeneratorKey,
-				snapshotRecoveryKey, txIndexTailKey, fastTxLookupLimitKey, uncleanShutdownKey,
-				badBlockKey,
-			} {
-				if bytes.Equal(key, meta) {
-					metadata.Add(size)
-					accounted = true
-					break
-				}
-			}
-			if !accounted {
-				unaccounted.Add(size)
-			}
-		}
+		categories[KeyCategory(key)].Add(size)
 		count++
 		if count%1000 == 0 && time.Since(logged) > 8*time.Second {
 			log.Info("Inspecting database", "count", count, "elapsed", common.PrettyDuration(time.Since(start)))
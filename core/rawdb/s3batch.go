@@ -0,0 +1,393 @@
+package rawdb
+
+import (
+  "bytes"
+  "encoding/binary"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "io/ioutil"
+  "path"
+  "strconv"
+  "strings"
+  "sync"
+  "sync/atomic"
+  "time"
+  "github.com/aws/aws-sdk-go/aws"
+  s3 "github.com/aws/aws-sdk-go/service/s3"
+  "github.com/golang/snappy"
+  "github.com/ethereum/go-ethereum/common"
+  "github.com/ethereum/go-ethereum/log"
+)
+
+// s3BatchPrefix is where batched objects are kept, beneath the freezer's root.
+const s3BatchPrefix = "batches/"
+
+// s3batch is a range of consecutive records stored as a single object, so
+// that archiving and scanning the freezer take one request per batch rather
+// than one per block. Before snappy compression, the object holds the number
+// of records and the end offset of each as big endian uint32s, followed by
+// the records' JSON.
+type s3batch struct {
+  first uint64
+  offsets []uint32
+  data []byte
+}
+
+func batchPath(first uint64) string {
+  return s3BatchPrefix + fmt.Sprintf("%0.12x", first)
+}
+
+func (b *s3batch) len() uint64 {
+  return uint64(len(b.offsets))
+}
+
+func (b *s3batch) record(number uint64) (*s3record, error) {
+  if number < b.first || number - b.first >= b.len() {
+    return nil, fmt.Errorf("record %v not in batch %v", number, b.first)
+  }
+  i := number - b.first
+  start := uint32(0)
+  if i > 0 { start = b.offsets[i - 1] }
+  record := &s3record{}
+  if err := json.Unmarshal(b.data[start:b.offsets[i]], record); err != nil {
+    return nil, fmt.Errorf("Error parsing record %v - %v", number, err.Error())
+  }
+  record.number = number
+  return record, nil
+}
+
+func encodeS3Batch(records []s3record) ([]byte, error) {
+  index := make([]byte, 4 * (len(records) + 1))
+  binary.BigEndian.PutUint32(index, uint32(len(records)))
+  data := &bytes.Buffer{}
+  for i, record := range records {
+    encoded, err := json.Marshal(record)
+    if err != nil { return nil, err }
+    data.Write(encoded)
+    binary.BigEndian.PutUint32(index[4 * (i + 1):], uint32(data.Len()))
+  }
+  return snappy.Encode(nil, append(index, data.Bytes()...)), nil
+}
+
+func decodeS3Batch(first uint64, compressed []byte) (*s3batch, error) {
+  content, err := snappy.Decode(nil, compressed)
+  if err != nil { return nil, err }
+  if len(content) < 4 { return nil, errors.New("batch too short") }
+  count := binary.BigEndian.Uint32(content)
+  header := 4 * (uint64(count) + 1)
+  if uint64(len(content)) < header { return nil, errors.New("batch index truncated") }
+  batch := &s3batch{first: first, offsets: make([]uint32, count), data: content[header:]}
+  last := uint32(0)
+  for i := range batch.offsets {
+    batch.offsets[i] = binary.BigEndian.Uint32(content[4 * (i + 1):])
+    if batch.offsets[i] < last || int(batch.offsets[i]) > len(batch.data) {
+      return nil, fmt.Errorf("invalid offset for record %v of batch %v", i, first)
+    }
+    last = batch.offsets[i]
+  }
+  return batch, nil
+}
+
+// batch retrieves the batch starting at first from the cache or S3.
+func (f *s3freezer) batch(first uint64) (*s3batch, error) {
+  key := batchPath(first)
+  if cached, ok := f.cache.Get(key); ok {
+    return cached.(*s3batch), nil
+  }
+  svc := s3.New(f.sess)
+  value, err := svc.GetObject(&s3.GetObjectInput{
+    Bucket: &f.bucket,
+    Key: aws.String(path.Join(f.root, key)),
+  })
+  if err != nil { return nil, err }
+  defer value.Body.Close()
+  compressed, err := ioutil.ReadAll(value.Body)
+  if err != nil { return nil, err }
+  batch, err := decodeS3Batch(first, compressed)
+  if err != nil { return nil, err }
+  f.cache.Add(key, batch)
+  return batch, nil
+}
+
+// putBatch uploads records as the batch starting at first, replacing any
+// partial batch uploaded by an earlier Sync.
+func (f *s3freezer) putBatch(first uint64, records []s3record) error {
+  compressed, err := encodeS3Batch(records)
+  if err != nil { return err }
+  svc := s3.New(f.sess)
+  key := batchPath(first)
+  if _, err := svc.PutObject(&s3.PutObjectInput{
+    Bucket: &f.bucket,
+    Key: aws.String(path.Join(f.root, key)),
+    Body: bytes.NewReader(compressed),
+  }); err != nil {
+    return err
+  }
+  // Replace any stale partial batch in the cache
+  batch, err := decodeS3Batch(first, compressed)
+  if err != nil { return err }
+  f.cache.Add(key, batch)
+  return nil
+}
+
+// s3batchUpload is a batch queued for the uploader threads.
+type s3batchUpload struct {
+  first uint64
+  records []s3record
+  key *s3batchKey
+}
+
+// s3batchKey serializes the uploads of a batch, so that a partial batch
+// uploaded by Sync can't overwrite a longer one queued after it.
+type s3batchKey struct {
+  lock sync.Mutex
+  // latest is the length of the newest upload queued, and queued the number
+  // of uploads not yet finished. Both are guarded by the freezer's batchLock.
+  latest int
+  queued int
+}
+
+// queueBatch prepares upload to be queued. The caller must hold batchLock.
+func (f *s3freezer) queueBatch(upload *s3batchUpload) {
+  key, ok := f.batchKeys[upload.first]
+  if !ok {
+    key = &s3batchKey{}
+    f.batchKeys[upload.first] = key
+  }
+  key.latest = len(upload.records)
+  key.queued++
+  upload.key = key
+  f.wg.Add(1)
+}
+
+func (f *s3freezer) uploadBatch(upload *s3batchUpload) {
+  upload.key.lock.Lock()
+  f.batchLock.Lock()
+  stale := len(upload.records) < upload.key.latest
+  f.batchLock.Unlock()
+  // Skip uploads superseded by a longer one, which will be uploaded next
+  for i := 0; !stale; i++ {
+    time.Sleep(100 * time.Duration(i) * time.Millisecond) // Backoff on failure
+    if err := f.putBatch(upload.first, upload.records); err != nil {
+      log.Error("Error recording batch", "first", upload.first, "count", len(upload.records), "bucket", f.bucket, "err", err)
+      continue
+    }
+    break
+  }
+  upload.key.lock.Unlock()
+  f.batchLock.Lock()
+  if uint64(len(upload.records)) == f.batchSize {
+    delete(f.uploading, upload.first)
+  }
+  if upload.key.queued--; upload.key.queued == 0 {
+    delete(f.batchKeys, upload.first)
+  }
+  f.batchLock.Unlock()
+}
+
+// appendBatched adds a record to the pending batch, queueing the batch for
+// upload once it's full.
+func (f *s3freezer) appendBatched(record s3record) error {
+  f.batchLock.Lock()
+  if len(f.pending) == 0 {
+    f.pendingFirst = record.number - record.number % f.batchSize
+  }
+  if expected := f.pendingFirst + uint64(len(f.pending)); record.number != expected {
+    f.batchLock.Unlock()
+    return fmt.Errorf("s3 freezer expected block %v, got %v", expected, record.number)
+  }
+  f.pending = append(f.pending, record)
+  if uint64(len(f.pending)) < f.batchSize {
+    f.batchLock.Unlock()
+    return nil
+  }
+  // Full batches stay readable from memory until they're uploaded
+  upload := &s3batchUpload{first: f.pendingFirst, records: f.pending}
+  f.uploading[upload.first] = upload.records
+  f.pending = nil
+  f.queueBatch(upload)
+  f.batchLock.Unlock()
+  f.batchCh <- upload
+  return nil
+}
+
+// flushBatch queues the pending partial batch for upload. The records stay
+// pending, and the batch is uploaded again once it's full.
+func (f *s3freezer) flushBatch() {
+  f.batchLock.Lock()
+  if len(f.pending) == 0 {
+    f.batchLock.Unlock()
+    return
+  }
+  upload := &s3batchUpload{first: f.pendingFirst, records: make([]s3record, len(f.pending))}
+  copy(upload.records, f.pending)
+  f.queueBatch(upload)
+  f.batchLock.Unlock()
+  f.batchCh <- upload
+}
+
+// pendingRecord returns number's record if it hasn't been uploaded in a full
+// batch yet.
+func (f *s3freezer) pendingRecord(number uint64) (*s3record, bool) {
+  f.batchLock.Lock()
+  defer f.batchLock.Unlock()
+  first := number - number % f.batchSize
+  records, ok := f.uploading[first]
+  if !ok && len(f.pending) > 0 && first == f.pendingFirst {
+    records, ok = f.pending, true
+  }
+  if !ok || number - first >= uint64(len(records)) {
+    return nil, false
+  }
+  record := records[number - first]
+  return &record, true
+}
+
+// batchCount returns the number of records covered by batches, from the last
+// batch in the bucket.
+func (f *s3freezer) batchCount() (uint64, error) {
+  last, err := f.lastKey(s3.New(f.sess), f.root + s3BatchPrefix, false, "")
+  if err != nil || last == "" { return 0, err }
+  first, err := strconv.ParseUint(strings.TrimPrefix(last, f.root + s3BatchPrefix), 16, 64)
+  if err != nil { return 0, err }
+  if first % f.batchSize != 0 {
+    return 0, fmt.Errorf("batch %v doesn't match batch size %v", first, f.batchSize)
+  }
+  batch, err := f.batch(first)
+  if err != nil { return 0, err }
+  return first + batch.len(), nil
+}
+
+// loadPending fills the pending batch with the records already frozen in the
+// batch that new records will be added to.
+func (f *s3freezer) loadPending() error {
+  first := f.count - f.count % f.batchSize
+  records := make([]s3record, 0, f.batchSize)
+  for number := first; number < f.count; number++ {
+    record, err := f.record(number)
+    if err != nil { return err }
+    records = append(records, *record)
+  }
+  f.pending, f.pendingFirst = records, first
+  return nil
+}
+
+// truncateBatched deletes the batches above n from the top down, along with
+// any per-block objects they replaced, then cuts short the batch n falls in.
+func (f *s3freezer) truncateBatched(n uint64) error {
+  for {
+    count := atomic.LoadUint64(&f.count)
+    first := (count - 1) - (count - 1) % f.batchSize
+    if first < n { break }
+    keys := []string{batchPath(first)}
+    for number := first; number < count; number++ {
+      keys = append(keys, numToPath(number))
+    }
+    if err := f.deleteKeys(keys); err != nil { return err }
+    f.batchLock.Lock()
+    if len(f.pending) > 0 && f.pendingFirst == first { f.pending = nil }
+    f.batchLock.Unlock()
+    atomic.StoreUint64(&f.count, first)
+    if first == 0 { return nil }
+  }
+  count := atomic.LoadUint64(&f.count)
+  if n == count { return nil }
+  first := n - n % f.batchSize
+  records := make([]s3record, 0, f.batchSize)
+  for number := first; number < n; number++ {
+    record, err := f.record(number)
+    if err != nil { return err }
+    records = append(records, *record)
+  }
+  if err := f.putBatch(first, records); err != nil { return err }
+  if err := f.deleteRecords(n, count); err != nil { return err }
+  f.batchLock.Lock()
+  f.pending, f.pendingFirst = records, first
+  f.batchLock.Unlock()
+  atomic.StoreUint64(&f.count, n)
+  return nil
+}
+
+// MigrateS3Freezer copies the records of an S3 freezer's per-block layout into
+// the batched layout set by the URL's batch parameter. Batches that are
+// already complete are skipped, so an interrupted migration can be resumed.
+// The per-block objects are left in place.
+func MigrateS3Freezer(freezerURL string) error {
+  f, err := openS3Freezer(freezerURL, 128)
+  if err != nil { return err }
+  defer f.Close()
+  if f.batchSize == 0 {
+    return errors.New("the freezer url needs a batch parameter to migrate to")
+  }
+  var (
+    count = f.count
+    firsts = make(chan uint64)
+    errs = make(chan error, f.concurrency)
+    wg sync.WaitGroup
+    migrated, skipped uint64
+    lock sync.Mutex
+    start = time.Now()
+    logged = time.Now()
+  )
+  log.Info("Migrating s3 freezer", "bucket", f.bucket, "prefix", f.root, "count", count, "batch", f.batchSize)
+  for i := 0; i < f.concurrency; i++ {
+    wg.Add(1)
+    go func() {
+      defer wg.Done()
+      for first := range firsts {
+        end := first + f.batchSize
+        if end > count { end = count }
+        if batch, err := f.batch(first); err == nil && first + batch.len() >= end {
+          lock.Lock()
+          skipped++
+          lock.Unlock()
+          continue
+        } else if err != nil && !isS3NotFound(err) {
+          errs <- err
+          return
+        }
+        records := make([]s3record, 0, end - first)
+        for number := first; number < end; number++ {
+          record, err := f.legacyRecord(number)
+          if err != nil {
+            errs <- fmt.Errorf("Error retrieving block %v: %v", number, err)
+            return
+          }
+          records = append(records, *record)
+        }
+        if err := f.putBatch(first, records); err != nil {
+          errs <- err
+          return
+        }
+        f.cache.Remove(batchPath(first))
+        lock.Lock()
+        migrated++
+        if time.Since(logged) > 8 * time.Second {
+          log.Info("Migrating s3 freezer", "migrated", migrated, "skipped", skipped, "elapsed", common.PrettyDuration(time.Since(start)))
+          logged = time.Now()
+        }
+        lock.Unlock()
+      }
+    }()
+  }
+  LOOP:
+  for first := uint64(0); first < count; first += f.batchSize {
+    select {
+    case firsts <- first:
+    case err = <-errs:
+      break LOOP
+    }
+  }
+  close(firsts)
+  wg.Wait()
+  if err == nil {
+    select {
+    case err = <-errs:
+    default:
+    }
+  }
+  if err != nil { return err }
+  log.Info("Migrated s3 freezer", "batches", migrated, "skipped", skipped, "elapsed", common.PrettyDuration(time.Since(start)))
+  return nil
+}
@@ -10,6 +10,8 @@ import (
   "sync"
   lru "github.com/hashicorp/golang-lru"
   "github.com/aws/aws-sdk-go/aws"
+  "github.com/aws/aws-sdk-go/aws/awserr"
+  "github.com/aws/aws-sdk-go/aws/credentials"
   "github.com/aws/aws-sdk-go/aws/session"
   s3 "github.com/aws/aws-sdk-go/service/s3"
 	// "github.com/aws/aws-sdk-go/service/s3/s3manager"
@@ -19,7 +21,10 @@ import (
   "github.com/ethereum/go-ethereum/log"
   "github.com/ethereum/go-ethereum/params"
   "io/ioutil"
+  "net/http"
+  "net/url"
   "path"
+  "sync/atomic"
   "time"
 )
 
@@ -38,6 +43,18 @@ type s3freezer struct {
   concurrency int
   wg sync.WaitGroup
   quit chan struct{}
+  prefetch int
+  lastRead uint64
+  prefetchLock sync.Mutex
+  prefetching map[uint64]struct{}
+  batchSize uint64
+  batchCh chan *s3batchUpload
+  batchLock sync.Mutex
+  pending []s3record
+  pendingFirst uint64
+  uploading map[uint64][]s3record
+  batchKeys map[uint64]*s3batchKey
+  truncateLock sync.Mutex
 }
 
 type s3record struct {
@@ -55,109 +72,291 @@ func numToPath(number uint64) string {
   return path.Join(h[:x-4], h[x-4:x-2], h[x-2:])
 }
 
-func NewS3Freezer(path string, cacheSize int) (ethdb.AncientStore, error) {
-  path = strings.TrimPrefix(path, "s3://")
-  parts := strings.SplitN(path, "/", 2)
-  cache, err := lru.New(cacheSize)
+// s3FreezerConfig is the configuration of an S3 freezer, parsed from a URL of
+// the form:
+//
+//   s3://[accessKey:secretKey@]bucket/path[?endpoint=...&region=...&pathstyle=1&cache=...&prefetch=...&batch=...]
+//
+// Without credentials in the URL, the AWS SDK's default credential chain is
+// used. endpoint and pathstyle allow S3-compatible services other than AWS.
+// batch selects the batched layout, packing that many blocks per object.
+type s3FreezerConfig struct {
+  bucket string
+  root string
+  cacheSize int
+  prefetch int
+  batchSize uint64
+  aws *aws.Config
+}
+
+func parseS3FreezerURL(freezerURL string, cacheSize int) (*s3FreezerConfig, error) {
+  parsedURL, err := url.Parse(freezerURL)
+  if err != nil { return nil, err }
+  if parsedURL.Scheme != "s3" || parsedURL.Host == "" {
+    return nil, fmt.Errorf("invalid s3 freezer url %q", freezerURL)
+  }
+  config := &s3FreezerConfig{
+    bucket: parsedURL.Host,
+    root: strings.Trim(parsedURL.Path, "/") + "/",
+    cacheSize: cacheSize,
+    aws: aws.NewConfig(),
+  }
+  query := parsedURL.Query()
+  if val := query.Get("endpoint"); val != "" {
+    config.aws.WithEndpoint(val)
+  }
+  if val := query.Get("region"); val != "" {
+    config.aws.WithRegion(val)
+  }
+  if query.Get("pathstyle") == "1" {
+    config.aws.WithS3ForcePathStyle(true)
+  }
+  if val := query.Get("cache"); val != "" {
+    size, err := strconv.Atoi(val)
+    if err != nil || size <= 0 {
+      log.Warn("cache set, but not a positive number", "cache", val)
+    } else {
+      config.cacheSize = size
+    }
+  }
+  if val := query.Get("prefetch"); val != "" {
+    prefetch, err := strconv.Atoi(val)
+    if err != nil || prefetch < 0 {
+      log.Warn("prefetch set, but not a number", "prefetch", val)
+    } else {
+      config.prefetch = prefetch
+    }
+  }
+  if val := query.Get("batch"); val != "" {
+    batchSize, err := strconv.ParseUint(val, 10, 32)
+    if err != nil || batchSize == 0 {
+      return nil, fmt.Errorf("invalid batch size %q", val)
+    }
+    config.batchSize = batchSize
+  }
+  if parsedURL.User != nil {
+    secret, _ := parsedURL.User.Password()
+    config.aws.WithCredentials(credentials.NewStaticCredentials(parsedURL.User.Username(), secret, query.Get("token")))
+  }
+  return config, nil
+}
+
+// RedactFreezerURL masks any secret key and session token in an s3:// freezer
+// URL, for logging.
+func RedactFreezerURL(freezerURL string) string {
+  parsedURL, err := url.Parse(freezerURL)
+  if err != nil { return freezerURL }
+  if parsedURL.User != nil {
+    if _, ok := parsedURL.User.Password(); ok {
+      parsedURL.User = url.UserPassword(parsedURL.User.Username(), "xxxxx")
+    }
+  }
+  if query := parsedURL.Query(); query.Get("token") != "" {
+    query.Set("token", "xxxxx")
+    parsedURL.RawQuery = query.Encode()
+  }
+  return parsedURL.String()
+}
+
+// NewS3Freezer returns an ancient store backed by the S3 bucket in the given
+// URL. cacheSize is the number of objects kept in memory, unless the URL sets
+// its own.
+//
+// By default each block is stored as its own object. With the batched layout,
+// blocks are packed into objects of consecutive blocks, and blocks that
+// haven't been migrated to batches are still read from their own objects.
+func NewS3Freezer(freezerURL string, cacheSize int) (ethdb.AncientStore, error) {
+  return openS3Freezer(freezerURL, cacheSize)
+}
+
+func openS3Freezer(freezerURL string, cacheSize int) (*s3freezer, error) {
+  config, err := parseS3FreezerURL(freezerURL, cacheSize)
+  if err != nil { return nil, err }
+  cache, err := lru.New(config.cacheSize)
+  if err != nil { return nil, err }
+  sess, err := session.NewSession(config.aws)
   if err != nil { return nil, err }
   freezer := &s3freezer{
     cache: cache,
-    sess: session.Must(session.NewSession()),
-    bucket: parts[0],
-    root: strings.TrimSuffix(parts[1], "/") + "/",
+    sess: sess,
+    bucket: config.bucket,
+    root: config.root,
     concurrency: runtime.NumCPU(),
     uploadCh: make(chan s3record),
     quit: make(chan struct{}),
+    prefetch: config.prefetch,
+    prefetching: make(map[uint64]struct{}),
+    batchSize: config.batchSize,
+    batchCh: make(chan *s3batchUpload),
+    uploading: make(map[uint64][]s3record),
+    batchKeys: make(map[uint64]*s3batchKey),
   }
-  svc := s3.New(freezer.sess)
-  output, err := svc.ListObjectsV2(&s3.ListObjectsV2Input{
-    Bucket: &freezer.bucket,
-    Delimiter: aws.String("/"),
-    Prefix: &freezer.root,
-  })
   log.Info("Getting ancient count:", "bucket", freezer.bucket, "prefix", freezer.root)
-  if len(output.CommonPrefixes) == 0 {
-    // Fresh freezer
-    freezer.count = 0
-    freezer.uploader()
-    return freezer, nil
-  }
-  for output.NextContinuationToken != nil {
+  count, err := freezer.findCount()
+  if err != nil { return nil, err }
+  if freezer.batchSize > 0 {
+    batchCount, err := freezer.batchCount()
     if err != nil { return nil, err }
-    output, err = svc.ListObjectsV2(&s3.ListObjectsV2Input{
-      Bucket: &freezer.bucket,
-      Delimiter: aws.String("/"),
-      Prefix: &freezer.root,
-      ContinuationToken: output.NextContinuationToken,
-    })
+    if batchCount > count { count = batchCount }
+  }
+  freezer.count = count
+  if freezer.batchSize > 0 {
+    if err := freezer.loadPending(); err != nil { return nil, err }
   }
-  l1prefix := output.CommonPrefixes[len(output.CommonPrefixes) - 1].Prefix
-  output, err = svc.ListObjectsV2(&s3.ListObjectsV2Input{
-    Bucket: &freezer.bucket,
-    Delimiter: aws.String("/"),
-    Prefix: l1prefix,
-  })
-  l2prefix := output.CommonPrefixes[len(output.CommonPrefixes)-1].Prefix
-  output, err = svc.ListObjectsV2(&s3.ListObjectsV2Input{
-    Bucket: &freezer.bucket,
-    Delimiter: aws.String("/"),
-    Prefix: l2prefix,
-  })
-  highest := output.Contents[len(output.Contents) - 1].Key
-  count, err := strconv.ParseInt(strings.Join(strings.Split(strings.TrimPrefix(*highest, freezer.root), "/"), ""), 16, 64)
-  if err != nil { return nil, err }
-  freezer.count = uint64(count) + 1
   freezer.uploader()
   return freezer, nil
 }
 
+// findCount returns the number of records in the per-block layout, one more
+// than the highest record number, by descending through the last prefix at
+// each level of the key hierarchy.
+func (f *s3freezer) findCount() (uint64, error) {
+  svc := s3.New(f.sess)
+  prefix := f.root
+  for level := 0; level < 3; level++ {
+    exclude := ""
+    if level == 0 { exclude = f.root + s3BatchPrefix }
+    last, err := f.lastKey(svc, prefix, level < 2, exclude)
+    if err != nil { return 0, err }
+    if last == "" {
+      if level == 0 { return 0, nil } // Fresh freezer
+      return 0, fmt.Errorf("empty s3 freezer prefix %v", prefix)
+    }
+    prefix = last
+  }
+  highest, err := strconv.ParseUint(strings.Join(strings.Split(strings.TrimPrefix(prefix, f.root), "/"), ""), 16, 64)
+  if err != nil { return 0, err }
+  return highest + 1, nil
+}
+
+// lastKey lists prefix, returning the last common prefix beneath it other than
+// exclude if prefixes is set, or the last object key otherwise. It returns ""
+// if there are none.
+func (f *s3freezer) lastKey(svc *s3.S3, prefix string, prefixes bool, exclude string) (string, error) {
+  var (
+    last string
+    token *string
+  )
+  for {
+    output, err := svc.ListObjectsV2(&s3.ListObjectsV2Input{
+      Bucket: &f.bucket,
+      Delimiter: aws.String("/"),
+      Prefix: &prefix,
+      ContinuationToken: token,
+    })
+    if err != nil { return "", err }
+    if prefixes {
+      for _, commonPrefix := range output.CommonPrefixes {
+        if *commonPrefix.Prefix != exclude { last = *commonPrefix.Prefix }
+      }
+    }
+    if !prefixes && len(output.Contents) > 0 {
+      last = *output.Contents[len(output.Contents) - 1].Key
+    }
+    if output.NextContinuationToken == nil { return last, nil }
+    token = output.NextContinuationToken
+  }
+}
+
 // HasAncient returns an indicator whether the specified data exists in the
 // ancient store.
 func (f *s3freezer) HasAncient(kind string, number uint64) (bool, error) {
-  if number > f.count + uint64(f.concurrency) {
+  if count := atomic.LoadUint64(&f.count); number > count + uint64(f.concurrency) {
     // If the requested number is too high, we definitely won't have it
-    return false, fmt.Errorf("Requested %v (%v) exceeds max (%v)", kind, number, f.count)
+    return false, fmt.Errorf("Requested %v (%v) exceeds max (%v)", kind, number, count)
+  }
+  if f.batchSize > 0 {
+    if _, err := f.record(number); err != nil {
+      if isS3NotFound(err) { return false, nil }
+      return false, err
+    }
+    return true, nil
   }
   key := numToPath(number)
-  svc := s3.New(f.sess)
   if _, ok := f.cache.Get(key); ok { return true, nil }
+  svc := s3.New(f.sess)
   _, err := svc.HeadObject(&s3.HeadObjectInput{
     Bucket: &f.bucket,
     Key: aws.String(path.Join(f.root, key)),
   })
-  return err == nil, nil
+  if err != nil {
+    if isS3NotFound(err) { return false, nil }
+    return false, err
+  }
+  return true, nil
+}
+
+func isS3NotFound(err error) bool {
+  aerr, ok := err.(awserr.RequestFailure)
+  return ok && aerr.StatusCode() == http.StatusNotFound
+}
+
+// fetch retrieves a record from S3 and adds it to the cache.
+func (f *s3freezer) fetch(number uint64) ([]byte, error) {
+  key := numToPath(number)
+  svc := s3.New(f.sess)
+  value, err := svc.GetObject(&s3.GetObjectInput{
+    Bucket: &f.bucket,
+    Key: aws.String(path.Join(f.root, key)),
+  })
+  if err != nil {
+    return nil, err
+  }
+  defer value.Body.Close()
+  content, err := ioutil.ReadAll(snappy.NewReader(value.Body))
+  if err != nil {
+    return nil, err
+  }
+  f.cache.Add(key, content)
+  return content, nil
+}
+
+// prefetchFrom fetches the records following number in the background, so
+// sequential reads don't wait on S3 for every record.
+func (f *s3freezer) prefetchFrom(number uint64) {
+  f.prefetchLock.Lock()
+  defer f.prefetchLock.Unlock()
+  step := uint64(1)
+  if f.batchSize > 0 { step = f.batchSize }
+  next := number + 1
+  next -= next % step
+  for n := next; n <= number + uint64(f.prefetch) && n < atomic.LoadUint64(&f.count); n += step {
+    key := numToPath(n)
+    if f.batchSize > 0 { key = batchPath(n) }
+    if _, ok := f.prefetching[n]; ok || f.cache.Contains(key) { continue }
+    f.prefetching[n] = struct{}{}
+    go func(n uint64) {
+      var err error
+      if f.batchSize > 0 {
+        _, err = f.batch(n)
+      } else {
+        _, err = f.fetch(n)
+      }
+      if err != nil {
+        log.Debug("Error prefetching ancient", "number", n, "err", err)
+      }
+      f.prefetchLock.Lock()
+      delete(f.prefetching, n)
+      f.prefetchLock.Unlock()
+    }(n)
+  }
 }
 
 // Ancient retrieves an ancient binary blob from the append-only immutable files.
 func (f *s3freezer) Ancient(kind string, number uint64) ([]byte, error) {
-  if number > f.count + uint64(f.concurrency) {
+  if count := atomic.LoadUint64(&f.count); number > count + uint64(f.concurrency) {
     // If the requested number is too high, we definitely won't have it.
-    return []byte{}, fmt.Errorf("Requested %v (%v) exceeds max (%v)", kind, number, f.count)
+    return []byte{}, fmt.Errorf("Requested %v (%v) exceeds max (%v)", kind, number, count)
   }
-  key := numToPath(number)
-  var content []byte
-  svc := s3.New(f.sess)
-  cacheContent, ok := f.cache.Get(key)
-  if ok {
-    content = cacheContent.([]byte)
-  } else {
-    value, err := svc.GetObject(&s3.GetObjectInput{
-      Bucket: &f.bucket,
-      Key: aws.String(path.Join(f.root, key)),
-    })
-    if err != nil {
-      return nil, err
-    }
-    content, err = ioutil.ReadAll(snappy.NewReader(value.Body))
-    if err != nil {
-      return nil, err
+  if f.prefetch > 0 {
+    // Only prefetch for sequential reads, such as exports and re-syncs
+    if last := atomic.SwapUint64(&f.lastRead, number); number == last + 1 {
+      f.prefetchFrom(number)
     }
-    f.cache.Add(key, content)
   }
-  record := &s3record{}
-  err := json.Unmarshal(content, &record)
+  record, err := f.record(number)
   if err != nil {
-    return []byte{}, fmt.Errorf("Error parsing '%v' - %v", string(content), err.Error())
+    return nil, err
   }
   switch kind {
   case freezerHeaderTable:
@@ -175,20 +374,61 @@ func (f *s3freezer) Ancient(kind string, number uint64) ([]byte, error) {
   }
 }
 
+// record retrieves a block's record, from the batched layout if it's enabled
+// and the block has been batched, or from the per-block layout otherwise.
+func (f *s3freezer) record(number uint64) (*s3record, error) {
+  if f.batchSize > 0 {
+    if record, ok := f.pendingRecord(number); ok {
+      return record, nil
+    }
+    first := number - number % f.batchSize
+    batch, err := f.batch(first)
+    if err == nil && number - first < batch.len() {
+      return batch.record(number)
+    }
+    if err != nil && !isS3NotFound(err) {
+      return nil, err
+    }
+    // Not migrated to a batch yet
+  }
+  return f.legacyRecord(number)
+}
+
+// legacyRecord retrieves a block's record from the per-block layout.
+func (f *s3freezer) legacyRecord(number uint64) (*s3record, error) {
+  var content []byte
+  cacheContent, ok := f.cache.Get(numToPath(number))
+  if ok {
+    content = cacheContent.([]byte)
+  } else {
+    var err error
+    if content, err = f.fetch(number); err != nil {
+      return nil, err
+    }
+  }
+  record := &s3record{number: number}
+  if err := json.Unmarshal(content, record); err != nil {
+    return nil, fmt.Errorf("Error parsing '%v' - %v", string(content), err.Error())
+  }
+  return record, nil
+}
+
 // Ancients returns the ancient item numbers in the ancient store.
 func (f *s3freezer) Ancients() (uint64, error) {
-  return f.count, nil
+  return atomic.LoadUint64(&f.count), nil
 }
 
 // AncientSize returns the ancient size of the specified category.
 func (f *s3freezer) AncientSize(kind string) (uint64, error) {
-  return f.count, nil
+  return atomic.LoadUint64(&f.count), nil
 }
 // AppendAncient injects all binary blobs belong to block at the end of the
 // append-only immutable table files.
 func (f *s3freezer) AppendAncient(number uint64, hash, header, body, receipt, td []byte) error {
+  f.truncateLock.Lock()
+  defer f.truncateLock.Unlock()
   log.Debug("Appending")
-  f.uploadCh <- s3record{
+  record := s3record{
     Hash: hash,
     Header: header,
     Body: body,
@@ -196,8 +436,15 @@ func (f *s3freezer) AppendAncient(number uint64, hash, header, body, receipt, td
     Td: td,
     number: number,
   }
+  if f.batchSize > 0 {
+    if err := f.appendBatched(record); err != nil { return err }
+  } else {
+    // Added before the record is handed off, so Sync can't miss it
+    f.wg.Add(1)
+    f.uploadCh <- record
+  }
   log.Debug("Appended")
-  f.count++
+  atomic.AddUint64(&f.count, 1)
   return nil
 }
 
@@ -207,15 +454,26 @@ func (f *s3freezer) uploader() {
       log.Info("Starting uploader thread", "id", i)
       defer log.Info("Stopping uploader thread", "id", i)
 
-      for record := range f.uploadCh {
-        f.wg.Add(1)
+      for {
+        var record s3record
+        select {
+        case upload, ok := <-f.batchCh:
+          if !ok { return }
+          f.uploadBatch(upload)
+          f.wg.Done()
+          continue
+        case r, ok := <-f.uploadCh:
+          if !ok { return }
+          record = r
+        }
         for i := 0; true; i++ {
           time.Sleep(100 * time.Duration(i) * time.Millisecond) // Backoff on failure
           log.Debug("Processing record")
           if exists, _ := f.HasAncient("bodies", record.number); !exists {
             data, err := json.Marshal(record)
             if err != nil {
-              log.Error("Error marshalling record", "number", record.number)
+              log.Error("Error marshalling record", "number", record.number, "err", err)
+              break
             }
             buff := &bytes.Buffer{}
             writer := snappy.NewWriter(buff)
@@ -241,28 +499,88 @@ func (f *s3freezer) uploader() {
   }
 }
 
-// TruncateAncients discards all but the first n ancient data from the ancient store.
+// TruncateAncients discards all but the first n ancient data from the ancient
+// store, deleting the objects above n. Objects are deleted from the top down,
+// lowering the count as they go, so an error leaves a consistent if not fully
+// truncated freezer.
 func (f *s3freezer) TruncateAncients(n uint64) error {
-  if n < f.count {
-    f.count = n
+  f.truncateLock.Lock()
+  defer f.truncateLock.Unlock()
+  // Let in-flight uploads finish, so they can't recreate deleted objects
+  f.wg.Wait()
+  if n >= atomic.LoadUint64(&f.count) {
+    return nil
+  }
+  if f.batchSize > 0 {
+    return f.truncateBatched(n)
+  }
+  for end := atomic.LoadUint64(&f.count); end > n; {
+    start := n
+    if end - n > s3DeleteLimit { start = end - s3DeleteLimit }
+    if err := f.deleteRecords(start, end); err != nil { return err }
+    atomic.StoreUint64(&f.count, start)
+    end = start
   }
   return nil
 }
 
-// Sync is a no-op, as we will write content as AppendAncient is called
+// s3DeleteLimit is the most objects S3 deletes in a single request.
+const s3DeleteLimit = 1000
+
+// deleteRecords deletes the per-block objects from start up to end.
+func (f *s3freezer) deleteRecords(start, end uint64) error {
+  keys := make([]string, 0, end - start)
+  for number := start; number < end; number++ {
+    keys = append(keys, numToPath(number))
+  }
+  return f.deleteKeys(keys)
+}
+
+// deleteKeys deletes objects, given relative to the root, and drops them from
+// the cache. Keys are deleted s3DeleteLimit at a time.
+func (f *s3freezer) deleteKeys(keys []string) error {
+  for len(keys) > s3DeleteLimit {
+    if err := f.deleteKeys(keys[:s3DeleteLimit]); err != nil { return err }
+    keys = keys[s3DeleteLimit:]
+  }
+  objects := make([]*s3.ObjectIdentifier, len(keys))
+  for i, key := range keys {
+    objects[i] = &s3.ObjectIdentifier{Key: aws.String(path.Join(f.root, key))}
+  }
+  svc := s3.New(f.sess)
+  output, err := svc.DeleteObjects(&s3.DeleteObjectsInput{
+    Bucket: &f.bucket,
+    Delete: &s3.Delete{Objects: objects, Quiet: aws.Bool(true)},
+  })
+  for _, key := range keys {
+    f.cache.Remove(key)
+  }
+  if err != nil { return err }
+  if len(output.Errors) > 0 {
+    return fmt.Errorf("Error deleting %v: %v", aws.StringValue(output.Errors[0].Key), aws.StringValue(output.Errors[0].Message))
+  }
+  return nil
+}
+
+// Sync waits for uploads to finish. With the batched layout it also uploads
+// the pending partial batch.
 func (f *s3freezer) Sync() error {
   defer func() {
     if err := recover(); err != nil {
       log.Warn("s3freezer.Sync() issue", "err", err)
     }
   }()
+  if f.batchSize > 0 {
+    f.flushBatch()
+  }
   f.wg.Wait()
   return nil
 }
 
 func (f *s3freezer) Close() error {
-  f.quit <- struct{}{}
+  close(f.quit)
   close(f.uploadCh)
+  close(f.batchCh)
   return nil
 }
 
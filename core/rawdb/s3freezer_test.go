@@ -0,0 +1,383 @@
+package rawdb
+
+import (
+  "bytes"
+  "encoding/xml"
+  "io/ioutil"
+  "net/http"
+  "net/http/httptest"
+  "sort"
+  "strings"
+  "sync"
+  "testing"
+  "time"
+  "github.com/ethereum/go-ethereum/ethdb"
+)
+
+// mockS3 is a minimal path-style S3-compatible server, supporting the requests
+// the freezer makes.
+type mockS3 struct {
+  lock sync.Mutex
+  objects map[string][]byte
+  fail bool
+  // beforePut, if set, is called with each object put before it's stored
+  beforePut func(key string, data []byte)
+}
+
+type mockS3List struct {
+  XMLName xml.Name `xml:"ListBucketResult"`
+  IsTruncated bool
+  Contents []struct{ Key string }
+  CommonPrefixes []struct{ Prefix string }
+}
+
+func (s *mockS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+  if s.beforePut != nil && r.Method == http.MethodPut {
+    data, _ := ioutil.ReadAll(r.Body)
+    s.beforePut(strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)[1], data)
+    r.Body = ioutil.NopCloser(bytes.NewReader(data))
+  }
+  s.lock.Lock()
+  defer s.lock.Unlock()
+  if s.fail {
+    w.WriteHeader(http.StatusInternalServerError)
+    return
+  }
+  parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+  if len(parts) == 1 || parts[1] == "" {
+    if _, ok := r.URL.Query()["delete"]; ok && r.Method == http.MethodPost {
+      request := struct{ Object []struct{ Key string } }{}
+      data, _ := ioutil.ReadAll(r.Body)
+      xml.Unmarshal(data, &request)
+      if len(request.Object) > s3DeleteLimit {
+        w.WriteHeader(http.StatusBadRequest)
+        w.Write([]byte("<Error><Code>MalformedXML</Code></Error>"))
+        return
+      }
+      for _, object := range request.Object {
+        delete(s.objects, object.Key)
+      }
+      w.Write([]byte("<DeleteResult></DeleteResult>"))
+      return
+    }
+    s.list(w, r.URL.Query().Get("prefix"), r.URL.Query().Get("delimiter"))
+    return
+  }
+  key := parts[1]
+  switch r.Method {
+  case http.MethodPut:
+    data, _ := ioutil.ReadAll(r.Body)
+    s.objects[key] = data
+  case http.MethodGet, http.MethodHead:
+    data, ok := s.objects[key]
+    if !ok {
+      w.WriteHeader(http.StatusNotFound)
+      if r.Method == http.MethodGet {
+        w.Write([]byte("<Error><Code>NoSuchKey</Code></Error>"))
+      }
+      return
+    }
+    if r.Method == http.MethodGet { w.Write(data) }
+  }
+}
+
+func (s *mockS3) list(w http.ResponseWriter, prefix, delimiter string) {
+  keys := []string{}
+  prefixes := map[string]struct{}{}
+  for key := range s.objects {
+    if !strings.HasPrefix(key, prefix) { continue }
+    rest := strings.TrimPrefix(key, prefix)
+    if i := strings.Index(rest, delimiter); delimiter != "" && i >= 0 {
+      prefixes[prefix + rest[:i+1]] = struct{}{}
+    } else {
+      keys = append(keys, key)
+    }
+  }
+  sort.Strings(keys)
+  result := mockS3List{}
+  for _, key := range keys {
+    result.Contents = append(result.Contents, struct{ Key string }{key})
+  }
+  sortedPrefixes := []string{}
+  for p := range prefixes { sortedPrefixes = append(sortedPrefixes, p) }
+  sort.Strings(sortedPrefixes)
+  for _, p := range sortedPrefixes {
+    result.CommonPrefixes = append(result.CommonPrefixes, struct{ Prefix string }{p})
+  }
+  data, _ := xml.Marshal(result)
+  w.Write(data)
+}
+
+func newMockS3() (*mockS3, *httptest.Server, string) {
+  backend := &mockS3{objects: make(map[string][]byte)}
+  server := httptest.NewServer(backend)
+  return backend, server, "s3://key:secret@bucket/ancients?region=us-east-1&pathstyle=1&endpoint=" + server.URL
+}
+
+func TestParseS3FreezerURL(t *testing.T) {
+  config, err := parseS3FreezerURL("s3://key:secret@bucket/some/path/?endpoint=http://localhost:9000&region=eu-west-1&pathstyle=1&cache=1024&prefetch=8", 128)
+  if err != nil { t.Fatalf(err.Error()) }
+  if config.bucket != "bucket" || config.root != "some/path/" {
+    t.Errorf("Unexpected location %v / %v", config.bucket, config.root)
+  }
+  if config.cacheSize != 1024 || config.prefetch != 8 {
+    t.Errorf("Unexpected cache %v, prefetch %v", config.cacheSize, config.prefetch)
+  }
+  if *config.aws.Endpoint != "http://localhost:9000" || *config.aws.Region != "eu-west-1" || !*config.aws.S3ForcePathStyle {
+    t.Errorf("Unexpected aws config %v", config.aws)
+  }
+  creds, err := config.aws.Credentials.Get()
+  if err != nil || creds.AccessKeyID != "key" || creds.SecretAccessKey != "secret" {
+    t.Errorf("Unexpected credentials %v (%v)", creds, err)
+  }
+  config, err = parseS3FreezerURL("s3://bucket/path?cache=lots", 128)
+  if err != nil { t.Fatalf(err.Error()) }
+  if config.cacheSize != 128 || config.aws.Credentials != nil {
+    t.Errorf("Expected defaults, got cache %v, credentials %v", config.cacheSize, config.aws.Credentials)
+  }
+  if _, err := parseS3FreezerURL("/var/ancients", 128); err == nil {
+    t.Errorf("Expected error for non-s3 url")
+  }
+  if redacted := RedactFreezerURL("s3://key:secret@bucket/path"); strings.Contains(redacted, "secret") {
+    t.Errorf("Secret not redacted: %v", redacted)
+  }
+  if redacted := RedactFreezerURL("s3://key:secret@bucket/path?region=us-east-1&token=sessiontoken"); strings.Contains(redacted, "secret") || strings.Contains(redacted, "sessiontoken") || !strings.Contains(redacted, "region=us-east-1") {
+    t.Errorf("Token not redacted: %v", redacted)
+  }
+}
+
+func TestS3FreezerLocal(t *testing.T) {
+  _, server, freezerURL := newMockS3()
+  defer server.Close()
+  freezer, err := NewS3Freezer(freezerURL, 16)
+  if err != nil { t.Fatalf(err.Error()) }
+  if count, _ := freezer.Ancients(); count != 0 {
+    t.Fatalf("Expected fresh freezer, got %v", count)
+  }
+  for i := uint64(0); i < 5; i++ {
+    if err := freezer.AppendAncient(i, []byte{byte(i)}, []byte{1}, []byte{2}, []byte{3}, []byte{4}); err != nil { t.Fatalf(err.Error()) }
+  }
+  freezer.Sync()
+  freezer.Close()
+
+  // A new freezer sees the records written by the last one
+  freezer, err = NewS3Freezer(freezerURL + "&prefetch=2", 16)
+  if err != nil { t.Fatalf(err.Error()) }
+  defer freezer.Close()
+  if count, _ := freezer.Ancients(); count != 5 {
+    t.Fatalf("Expected 5 ancients, got %v", count)
+  }
+  if ok, err := freezer.HasAncient(freezerHashTable, 6); ok || err != nil {
+    t.Errorf("Unexpected ancient 6: %v (%v)", ok, err)
+  }
+  for i := uint64(0); i < 2; i++ {
+    hash, err := freezer.Ancient(freezerHashTable, i)
+    if err != nil { t.Fatalf(err.Error()) }
+    if !bytes.Equal(hash, []byte{byte(i)}) {
+      t.Errorf("Unexpected hash %#x for %v", hash, i)
+    }
+  }
+  // Reading 0 then 1 prefetches 2 and 3
+  cache := freezer.(*s3freezer).cache
+  for deadline := time.Now().Add(time.Second); !(cache.Contains(numToPath(2)) && cache.Contains(numToPath(3))); {
+    if time.Now().After(deadline) {
+      t.Fatalf("Expected records to be prefetched")
+    }
+    time.Sleep(10 * time.Millisecond)
+  }
+  if cache.Contains(numToPath(4)) {
+    t.Errorf("Prefetched beyond the prefetch limit")
+  }
+}
+
+func TestS3FreezerListError(t *testing.T) {
+  backend, server, freezerURL := newMockS3()
+  defer server.Close()
+  backend.fail = true
+  if _, err := NewS3Freezer(freezerURL, 16); err == nil {
+    t.Errorf("Expected error listing bucket")
+  }
+}
+
+func appendS3Records(t *testing.T, freezer ethdb.AncientStore, from, to uint64) {
+  for i := from; i < to; i++ {
+    if err := freezer.AppendAncient(i, []byte{byte(i)}, []byte{1}, []byte{2}, []byte{3}, []byte{4}); err != nil { t.Fatalf(err.Error()) }
+  }
+  freezer.Sync()
+}
+
+func checkS3Records(t *testing.T, freezer ethdb.AncientStore, count uint64) {
+  if n, _ := freezer.Ancients(); n != count {
+    t.Fatalf("Expected %v ancients, got %v", count, n)
+  }
+  for i := uint64(0); i < count; i++ {
+    hash, err := freezer.Ancient(freezerHashTable, i)
+    if err != nil { t.Fatalf("Error reading %v: %v", i, err) }
+    if !bytes.Equal(hash, []byte{byte(i)}) {
+      t.Errorf("Unexpected hash %#x for %v", hash, i)
+    }
+  }
+}
+
+func TestS3FreezerBatched(t *testing.T) {
+  backend, server, freezerURL := newMockS3()
+  defer server.Close()
+  freezerURL += "&batch=4"
+  freezer, err := NewS3Freezer(freezerURL, 16)
+  if err != nil { t.Fatalf(err.Error()) }
+  appendS3Records(t, freezer, 0, 10)
+  checkS3Records(t, freezer, 10)
+  freezer.Close()
+  if len(backend.objects) != 3 {
+    t.Errorf("Expected 3 batch objects, got %v", len(backend.objects))
+  }
+  for _, first := range []uint64{0, 4, 8} {
+    if _, ok := backend.objects["ancients/" + batchPath(first)]; !ok {
+      t.Errorf("Missing batch %v", first)
+    }
+  }
+
+  // Reopening picks up the partial batch, and completes it
+  freezer, err = NewS3Freezer(freezerURL, 16)
+  if err != nil { t.Fatalf(err.Error()) }
+  defer freezer.Close()
+  checkS3Records(t, freezer, 10)
+  appendS3Records(t, freezer, 10, 13)
+  checkS3Records(t, freezer, 13)
+  batch, err := decodeS3Batch(8, backend.objects["ancients/" + batchPath(8)])
+  if err != nil || batch.len() != 4 {
+    t.Errorf("Expected full batch, got %v (%v)", batch, err)
+  }
+}
+
+func TestS3FreezerMigrate(t *testing.T) {
+  backend, server, freezerURL := newMockS3()
+  defer server.Close()
+  freezer, err := NewS3Freezer(freezerURL, 16)
+  if err != nil { t.Fatalf(err.Error()) }
+  appendS3Records(t, freezer, 0, 6)
+  freezer.Close()
+
+  // Unmigrated blocks are read from the per-block layout
+  freezer, err = NewS3Freezer(freezerURL + "&batch=4", 16)
+  if err != nil { t.Fatalf(err.Error()) }
+  checkS3Records(t, freezer, 6)
+  freezer.Close()
+
+  if err := MigrateS3Freezer(freezerURL + "&batch=4"); err != nil { t.Fatalf(err.Error()) }
+  // Drop the per-block objects, leaving only the batches
+  for key := range backend.objects {
+    if !strings.HasPrefix(key, "ancients/" + s3BatchPrefix) { delete(backend.objects, key) }
+  }
+  if len(backend.objects) != 2 {
+    t.Fatalf("Expected 2 batch objects, got %v", len(backend.objects))
+  }
+  freezer, err = NewS3Freezer(freezerURL + "&batch=4", 16)
+  if err != nil { t.Fatalf(err.Error()) }
+  defer freezer.Close()
+  checkS3Records(t, freezer, 6)
+  // Migrating again has nothing to do
+  if err := MigrateS3Freezer(freezerURL + "&batch=4"); err != nil { t.Fatalf(err.Error()) }
+}
+
+func TestS3FreezerTruncate(t *testing.T) {
+  backend, server, freezerURL := newMockS3()
+  defer server.Close()
+  freezer, err := NewS3Freezer(freezerURL, 16)
+  if err != nil { t.Fatalf(err.Error()) }
+  defer freezer.Close()
+  appendS3Records(t, freezer, 0, 8)
+  if err := freezer.TruncateAncients(5); err != nil { t.Fatalf(err.Error()) }
+  checkS3Records(t, freezer, 5)
+  if len(backend.objects) != 5 {
+    t.Errorf("Expected 5 objects after truncation, got %v", len(backend.objects))
+  }
+  // Truncated blocks can be frozen again
+  for i := uint64(5); i < 7; i++ {
+    if err := freezer.AppendAncient(i, []byte{byte(i)}, []byte{1}, []byte{2}, []byte{3}, []byte{4}); err != nil { t.Fatalf(err.Error()) }
+  }
+  freezer.Sync()
+  checkS3Records(t, freezer, 7)
+}
+
+func TestS3FreezerTruncateBatched(t *testing.T) {
+  backend, server, freezerURL := newMockS3()
+  defer server.Close()
+  freezerURL += "&batch=4"
+  freezer, err := NewS3Freezer(freezerURL, 16)
+  if err != nil { t.Fatalf(err.Error()) }
+  appendS3Records(t, freezer, 0, 11)
+  if err := freezer.TruncateAncients(6); err != nil { t.Fatalf(err.Error()) }
+  checkS3Records(t, freezer, 6)
+  if _, ok := backend.objects["ancients/" + batchPath(8)]; ok {
+    t.Errorf("Expected batch 8 to be deleted")
+  }
+  batch, err := decodeS3Batch(4, backend.objects["ancients/" + batchPath(4)])
+  if err != nil || batch.len() != 2 {
+    t.Errorf("Expected batch 4 to be cut to 2 blocks, got %v (%v)", batch, err)
+  }
+  appendS3Records(t, freezer, 6, 9)
+  checkS3Records(t, freezer, 9)
+  freezer.Close()
+
+  freezer, err = NewS3Freezer(freezerURL, 16)
+  if err != nil { t.Fatalf(err.Error()) }
+  defer freezer.Close()
+  checkS3Records(t, freezer, 9)
+  if err := freezer.TruncateAncients(0); err != nil { t.Fatalf(err.Error()) }
+  if len(backend.objects) != 0 {
+    t.Errorf("Expected no objects after truncating to 0, got %v", len(backend.objects))
+  }
+}
+
+func TestS3FreezerTruncateLargeBatches(t *testing.T) {
+  backend, server, freezerURL := newMockS3()
+  defer server.Close()
+  freezerURL += "&batch=1100"
+  freezer, err := NewS3Freezer(freezerURL, 16)
+  if err != nil { t.Fatalf(err.Error()) }
+  defer freezer.Close()
+  appendS3Records(t, freezer, 0, 1200)
+  // Cutting batch 0 short deletes more per-block keys than one request allows
+  if err := freezer.TruncateAncients(50); err != nil { t.Fatalf(err.Error()) }
+  checkS3Records(t, freezer, 50)
+  appendS3Records(t, freezer, 50, 1100)
+  // As does deleting the full batch along with its per-block keys
+  if err := freezer.TruncateAncients(0); err != nil { t.Fatalf(err.Error()) }
+  if len(backend.objects) != 0 {
+    t.Errorf("Expected no objects after truncating to 0, got %v", len(backend.objects))
+  }
+}
+
+func TestS3FreezerPartialBatchUpload(t *testing.T) {
+  backend, server, freezerURL := newMockS3()
+  defer server.Close()
+  // Hold up partial batches, so the full batch queued after one could
+  // otherwise be uploaded first
+  backend.beforePut = func(key string, data []byte) {
+    if batch, err := decodeS3Batch(0, data); err == nil && batch.len() < 4 {
+      time.Sleep(200 * time.Millisecond)
+    }
+  }
+  freezerURL += "&batch=4"
+  ancients, err := NewS3Freezer(freezerURL, 16)
+  if err != nil { t.Fatalf(err.Error()) }
+  defer ancients.Close()
+  freezer := ancients.(*s3freezer)
+  // Start more uploader threads, so uploads can overlap on a single CPU
+  freezer.uploader()
+  for i := uint64(0); i < 4; i++ {
+    if err := freezer.AppendAncient(i, []byte{byte(i)}, []byte{1}, []byte{2}, []byte{3}, []byte{4}); err != nil { t.Fatalf(err.Error()) }
+    if i == 2 {
+      freezer.flushBatch()
+    }
+  }
+  freezer.Sync()
+  checkS3Records(t, freezer, 4)
+  backend.lock.Lock()
+  defer backend.lock.Unlock()
+  batch, err := decodeS3Batch(0, backend.objects["ancients/" + batchPath(0)])
+  if err != nil || batch.len() != 4 {
+    t.Errorf("Expected full batch, got %v (%v)", batch, err)
+  }
+}
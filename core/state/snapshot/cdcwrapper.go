@@ -401,13 +401,7 @@ func (dt *deltaTracker) handleUpdate(blockRoot common.Hash) error {
     if err := dt.tree.Update(blockRoot, delta.parentRoot, delta.destructs, delta.accounts, delta.storage); err != nil {
       return err
     }
-    dt.finished[blockRoot] = true
-    if children, ok := dt.pendingEmits[blockRoot]; ok {
-      for _, child := range children {
-        if err := dt.handleUpdate(child); err != nil { return err }
-      }
-      delete(dt.pendingEmits, blockRoot)
-    }
+    return dt.finish(blockRoot)
   } else {
     if _, ok := dt.pendingEmits[delta.parentRoot]; !ok {
       dt.pendingEmits[delta.parentRoot] = []common.Hash{}
@@ -416,3 +410,16 @@ func (dt *deltaTracker) handleUpdate(blockRoot common.Hash) error {
   }
   return nil
 }
+
+// finish records that blockRoot is in the tree, and applies any deltas that
+// were waiting on it.
+func (dt *deltaTracker) finish(blockRoot common.Hash) error {
+  dt.finished[blockRoot] = true
+  if children, ok := dt.pendingEmits[blockRoot]; ok {
+    for _, child := range children {
+      if err := dt.handleUpdate(child); err != nil { return err }
+    }
+    delete(dt.pendingEmits, blockRoot)
+  }
+  return nil
+}
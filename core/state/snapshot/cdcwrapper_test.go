@@ -20,6 +20,8 @@ func (e *mockStateDeltaEmitter) Emit(m []stateDeltaMessage) error {
   return nil
 }
 
+func (e *mockStateDeltaEmitter) Flush() {}
+
 func getMockCDCTrie() (*CDCTree, chan []stateDeltaMessage) {
   base := &diskLayer{
 		diskdb: rawdb.NewMemoryDatabase(),
@@ -164,10 +166,10 @@ func TestUnpopulatedCDCTreeUpdate(t *testing.T) {
   tree.Update(common.HexToHash("0x02"), common.HexToHash("0x01"), map[common.Hash]struct{}{common.HexToHash("0xff"): struct{}{}}, map[common.Hash][]byte{common.HexToHash("0xEE"): []byte{0, 1, 2}}, map[common.Hash]map[common.Hash][]byte{common.HexToHash("0xEE"): map[common.Hash][]byte{common.HexToHash("AA"): []byte{20, 30, 40}}})
   select {
   case msgs := <-ch:
-    if MsgType(msgs[0].key[0]) != DeltaMsg { t.Errorf("Unexpected message type: %v", msgs[0].key[0]) }
-    if MsgType(msgs[1].key[0]) != DestructMsg { t.Errorf("Unexpected message type: %v", msgs[1].key[0]) }
-    if MsgType(msgs[2].key[0]) != AccountMsg { t.Errorf("Unexpected message type: %v", msgs[2].key[0]) }
-    if MsgType(msgs[3].key[0]) != StorageMsg { t.Errorf("Unexpected message type: %v", msgs[3].key[0]) }
+    if MsgType(msgs[0].Key[0]) != DeltaMsg { t.Errorf("Unexpected message type: %v", msgs[0].Key[0]) }
+    if MsgType(msgs[1].Key[0]) != DestructMsg { t.Errorf("Unexpected message type: %v", msgs[1].Key[0]) }
+    if MsgType(msgs[2].Key[0]) != AccountMsg { t.Errorf("Unexpected message type: %v", msgs[2].Key[0]) }
+    if MsgType(msgs[3].Key[0]) != StorageMsg { t.Errorf("Unexpected message type: %v", msgs[3].Key[0]) }
   default:
     t.Errorf("Channel message missing")
   }
@@ -177,10 +179,10 @@ func TestPopulatedCDCTreeUpdate(t *testing.T) {
   tree.Update(common.HexToHash("0x02"), common.HexToHash("0x01"), map[common.Hash]struct{}{common.HexToHash("0xff"): struct{}{}}, map[common.Hash][]byte{common.HexToHash("0xEE"): []byte{0, 1, 2}}, map[common.Hash]map[common.Hash][]byte{common.HexToHash("0xEE"): map[common.Hash][]byte{common.HexToHash("AA"): []byte{20, 30, 40}}})
   select {
   case msgs := <-ch:
-    if MsgType(msgs[0].key[0]) != DeltaMsg { t.Errorf("Unexpected message type: %v", msgs[0].key[0]) }
-    if MsgType(msgs[1].key[0]) != DestructMsg { t.Errorf("Unexpected message type: %v", msgs[1].key[0]) }
-    if MsgType(msgs[2].key[0]) != AccountMsg { t.Errorf("Unexpected message type: %v", msgs[2].key[0]) }
-    if MsgType(msgs[3].key[0]) != StorageMsg { t.Errorf("Unexpected message type: %v", msgs[3].key[0]) }
+    if MsgType(msgs[0].Key[0]) != DeltaMsg { t.Errorf("Unexpected message type: %v", msgs[0].Key[0]) }
+    if MsgType(msgs[1].Key[0]) != DestructMsg { t.Errorf("Unexpected message type: %v", msgs[1].Key[0]) }
+    if MsgType(msgs[2].Key[0]) != AccountMsg { t.Errorf("Unexpected message type: %v", msgs[2].Key[0]) }
+    if MsgType(msgs[3].Key[0]) != StorageMsg { t.Errorf("Unexpected message type: %v", msgs[3].Key[0]) }
   default:
     t.Errorf("Channel message missing")
   }
@@ -240,7 +242,7 @@ func TestDeltaTracker(t *testing.T) {
     dt, tree2 := getDeltaTracker()
     emitCount := 0
     for j, i := range order {
-      emitted, err := dt.handleMessage(messages[i].key, messages[i].value, 0, int64(j))
+      emitted, err := dt.handleMessage(messages[i].Key, messages[i].Value, 0, int64(j))
       if err != nil { t.Errorf("error handling message: %v", err.Error()) }
       if emitted { emitCount++ }
     }
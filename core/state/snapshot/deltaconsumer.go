@@ -0,0 +1,123 @@
+package snapshot
+
+import (
+  "sync"
+  "time"
+  "github.com/ethereum/go-ethereum/common"
+)
+
+// DeltaConsumer applies the state deltas published by a CDCTree to a snapshot
+// tree, so that replicas can maintain snapshots without diffing tries.
+type DeltaConsumer struct {
+  tracker *deltaTracker
+  lock sync.Mutex
+  waiters map[common.Hash][]chan struct{}
+}
+
+// notifyingTree wakes anyone waiting on a root once its delta is applied.
+type notifyingTree struct {
+  SnapshotTree
+  consumer *DeltaConsumer
+}
+
+func (t *notifyingTree) Update(blockRoot common.Hash, parentRoot common.Hash, destructs map[common.Hash]struct{}, accounts map[common.Hash][]byte, storage map[common.Hash]map[common.Hash][]byte) error {
+  if err := t.SnapshotTree.Update(blockRoot, parentRoot, destructs, accounts, storage); err != nil {
+    return err
+  }
+  // The consumer's lock is already held by HandleMessage or Applied
+  t.consumer.notify(blockRoot)
+  return nil
+}
+
+// NewDeltaConsumer returns a DeltaConsumer applying deltas to tree, which
+// currently has a layer for root.
+func NewDeltaConsumer(tree SnapshotTree, root common.Hash) *DeltaConsumer {
+  consumer := &DeltaConsumer{waiters: make(map[common.Hash][]chan struct{})}
+  consumer.tracker = &deltaTracker{
+    tree: &notifyingTree{tree, consumer},
+    deltas: make(map[common.Hash]*delta),
+    pendingEmits: make(map[common.Hash][]common.Hash),
+    deltaPartitions: make(map[int32]int64),
+    finished: make(map[common.Hash]bool),
+    oldFinished: make(map[common.Hash]bool),
+    finishedLimit: 1024,
+    earlyDestructs: make(map[common.Hash]map[common.Hash]struct{}),
+    earlyAccounts: make(map[common.Hash]map[common.Hash][]byte),
+    earlyStorage: make(map[common.Hash]map[common.Hash]map[common.Hash][]byte),
+  }
+  consumer.tracker.finished[root] = true
+  return consumer
+}
+
+// HandleMessage processes a message from the state delta topic, applying the
+// delta it completes, if any, once its parent is in the tree. It returns
+// whether a delta was completed.
+func (c *DeltaConsumer) HandleMessage(key, value []byte, partition int32, offset int64) (bool, error) {
+  c.lock.Lock()
+  defer c.lock.Unlock()
+  return c.tracker.handleMessage(key, value, partition, offset)
+}
+
+// Applied records that root was added to the tree by other means (such as
+// diffing tries when its delta was missing), so that deltas building on it
+// can be applied.
+func (c *DeltaConsumer) Applied(root common.Hash) error {
+  c.lock.Lock()
+  defer c.lock.Unlock()
+  if c.applied(root) {
+    return nil
+  }
+  err := c.tracker.finish(root)
+  c.notify(root)
+  return err
+}
+
+// Wait waits up to timeout for the delta for root to be applied, returning
+// whether it was.
+func (c *DeltaConsumer) Wait(root common.Hash, timeout time.Duration) bool {
+  c.lock.Lock()
+  if c.applied(root) {
+    c.lock.Unlock()
+    return true
+  }
+  if timeout <= 0 {
+    c.lock.Unlock()
+    return false
+  }
+  ch := make(chan struct{})
+  c.waiters[root] = append(c.waiters[root], ch)
+  c.lock.Unlock()
+  timer := time.NewTimer(timeout)
+  defer timer.Stop()
+  select {
+  case <-ch:
+    return true
+  case <-timer.C:
+  }
+  c.lock.Lock()
+  defer c.lock.Unlock()
+  waiters := c.waiters[root]
+  for i, waiter := range waiters {
+    if waiter == ch {
+      c.waiters[root] = append(waiters[:i], waiters[i+1:]...)
+      break
+    }
+  }
+  if len(c.waiters[root]) == 0 {
+    delete(c.waiters, root)
+  }
+  // The delta may have arrived as the timer fired
+  return c.applied(root)
+}
+
+func (c *DeltaConsumer) applied(root common.Hash) bool {
+  return c.tracker.finished[root] || c.tracker.oldFinished[root]
+}
+
+// notify wakes the waiters for root. The caller must hold the lock.
+func (c *DeltaConsumer) notify(root common.Hash) {
+  for _, ch := range c.waiters[root] {
+    close(ch)
+  }
+  delete(c.waiters, root)
+}
@@ -0,0 +1,79 @@
+package snapshot
+
+import (
+  "testing"
+  "time"
+  "github.com/ethereum/go-ethereum/common"
+)
+
+// deltaMessages returns the messages emitted for the deltas of 0x02 (on 0x01)
+// and 0x03 (on 0x02).
+func deltaMessages(t *testing.T) ([]stateDeltaMessage, []stateDeltaMessage) {
+  tree, ch := getMockCDCTrie()
+  tree.Update(
+    common.HexToHash("0x02"),
+    common.HexToHash("0x01"),
+    map[common.Hash]struct{}{},
+    map[common.Hash][]byte{common.HexToHash("0xEE"): []byte{0, 1, 2}},
+    map[common.Hash]map[common.Hash][]byte{},
+  )
+  first := <-ch
+  tree.Update(
+    common.HexToHash("0x03"),
+    common.HexToHash("0x02"),
+    map[common.Hash]struct{}{},
+    map[common.Hash][]byte{common.HexToHash("0xEF"): []byte{0, 1, 3}},
+    map[common.Hash]map[common.Hash][]byte{},
+  )
+  second := <-ch
+  if len(first) != 2 || len(second) != 2 {
+    t.Fatalf("Unexpected message counts %v, %v", len(first), len(second))
+  }
+  return first, second
+}
+
+func TestDeltaConsumerWait(t *testing.T) {
+  first, _ := deltaMessages(t)
+  _, tree := getDeltaTracker()
+  consumer := NewDeltaConsumer(tree, common.HexToHash("0x01"))
+  result := make(chan bool)
+  go func() { result <- consumer.Wait(common.HexToHash("0x02"), 5 * time.Second) }()
+  for i, msg := range first {
+    if _, err := consumer.HandleMessage(msg.Key, msg.Value, 0, int64(i)); err != nil { t.Fatalf(err.Error()) }
+  }
+  if !<-result {
+    t.Fatalf("Expected delta to be applied")
+  }
+  data, err := tree.Snapshot(common.HexToHash("0x02")).AccountRLP(common.HexToHash("0xEE"))
+  if err != nil || len(data) != 3 {
+    t.Errorf("Unexpected account %#x (%v)", data, err)
+  }
+  if consumer.Wait(common.HexToHash("0x04"), 10 * time.Millisecond) {
+    t.Errorf("Unexpected delta for unknown root")
+  }
+}
+
+func TestDeltaConsumerApplied(t *testing.T) {
+  _, second := deltaMessages(t)
+  _, tree := getDeltaTracker()
+  consumer := NewDeltaConsumer(tree, common.HexToHash("0x01"))
+  // 0x02's delta is missing, so 0x03's waits for its parent
+  for i, msg := range second {
+    if _, err := consumer.HandleMessage(msg.Key, msg.Value, 0, int64(i)); err != nil { t.Fatalf(err.Error()) }
+  }
+  if consumer.Wait(common.HexToHash("0x03"), 0) {
+    t.Fatalf("Delta applied without its parent")
+  }
+  // The replica diffs tries for 0x02 instead
+  if err := tree.Update(common.HexToHash("0x02"), common.HexToHash("0x01"), map[common.Hash]struct{}{}, map[common.Hash][]byte{}, map[common.Hash]map[common.Hash][]byte{}); err != nil {
+    t.Fatalf(err.Error())
+  }
+  if err := consumer.Applied(common.HexToHash("0x02")); err != nil { t.Fatalf(err.Error()) }
+  if !consumer.Wait(common.HexToHash("0x03"), 0) {
+    t.Errorf("Expected pending delta to be applied once its parent was")
+  }
+  data, err := tree.Snapshot(common.HexToHash("0x03")).AccountRLP(common.HexToHash("0xEF"))
+  if err != nil || len(data) != 3 {
+    t.Errorf("Unexpected account %#x (%v)", data, err)
+  }
+}
@@ -0,0 +1,150 @@
+package snapshot
+
+import (
+  "bufio"
+  "compress/gzip"
+  "encoding/base64"
+  "fmt"
+  "io"
+  "github.com/ethereum/go-ethereum/common"
+  "github.com/ethereum/go-ethereum/rlp"
+)
+
+// StateDelta is one block's changes to the snapshot, as emitted by a CDCTree.
+type StateDelta struct {
+  Root common.Hash
+  ParentRoot common.Hash
+  Destructs map[common.Hash]struct{}
+  Accounts map[common.Hash][]byte
+  Storage map[common.Hash]map[common.Hash][]byte
+}
+
+// DeltaFileReader reads the state deltas written by FileCDCTree, in the order
+// they were written.
+type DeltaFileReader struct {
+  compressed *gzip.Reader
+  reader *bufio.Reader
+}
+
+// NewDeltaFileReader returns a DeltaFileReader for r. Files that were appended
+// to across several runs hold several gzip streams, which are read in turn.
+func NewDeltaFileReader(r io.Reader) (*DeltaFileReader, error) {
+  compressed, err := gzip.NewReader(r)
+  if err != nil { return nil, err }
+  return &DeltaFileReader{compressed: compressed, reader: bufio.NewReader(compressed)}, nil
+}
+
+// Next returns the next delta in the file, or io.EOF when there are no more.
+// A file left by a process that didn't shut down cleanly ends with
+// io.ErrUnexpectedEOF after its last complete delta.
+func (r *DeltaFileReader) Next() (*StateDelta, error) {
+  line, err := r.reader.ReadBytes('\n')
+  if err == io.EOF && len(line) > 0 {
+    err = io.ErrUnexpectedEOF
+  }
+  if err != nil { return nil, err }
+  data, err := base64.StdEncoding.DecodeString(string(line[:len(line) - 1]))
+  if err != nil { return nil, err }
+  messages := []stateDeltaMessage{}
+  if err := rlp.DecodeBytes(data, &messages); err != nil { return nil, err }
+  return decodeStateDelta(messages)
+}
+
+// Close closes the decompressor, but not the underlying reader.
+func (r *DeltaFileReader) Close() error {
+  return r.compressed.Close()
+}
+
+// decodeStateDelta assembles the messages emitted by a single CDCTree.Update.
+func decodeStateDelta(messages []stateDeltaMessage) (*StateDelta, error) {
+  if len(messages) == 0 || len(messages[0].Key) != 33 || MsgType(messages[0].Key[0]) != DeltaMsg {
+    return nil, fmt.Errorf("state delta does not start with a header")
+  }
+  header := cdcHeader{}
+  if err := rlp.DecodeBytes(messages[0].Value, &header); err != nil { return nil, err }
+  if len(messages) != header.size() {
+    return nil, fmt.Errorf("state delta has %v messages, header expects %v", len(messages), header.size())
+  }
+  delta := &StateDelta{
+    Root: common.BytesToHash(messages[0].Key[1:]),
+    ParentRoot: header.ParentRoot,
+    Destructs: make(map[common.Hash]struct{}),
+    Accounts: make(map[common.Hash][]byte),
+    Storage: make(map[common.Hash]map[common.Hash][]byte),
+  }
+  for _, msg := range messages[1:] {
+    if len(msg.Key) < 33 || common.BytesToHash(msg.Key[1:33]) != delta.Root {
+      return nil, fmt.Errorf("unexpected message in state delta %#x", delta.Root)
+    }
+    switch MsgType(msg.Key[0]) {
+    case DestructMsg:
+      delta.Destructs[common.BytesToHash(msg.Value)] = struct{}{}
+    case AccountMsg:
+      if len(msg.Key) != 65 { return nil, fmt.Errorf("invalid account key %#x", msg.Key) }
+      delta.Accounts[common.BytesToHash(msg.Key[33:])] = msg.Value
+    case StorageMsg:
+      if len(msg.Key) != 97 { return nil, fmt.Errorf("invalid storage key %#x", msg.Key) }
+      accountHash := common.BytesToHash(msg.Key[33:65])
+      if _, ok := delta.Storage[accountHash]; !ok {
+        delta.Storage[accountHash] = make(map[common.Hash][]byte)
+      }
+      delta.Storage[accountHash][common.BytesToHash(msg.Key[65:])] = msg.Value
+    default:
+      return nil, fmt.Errorf("unknown message type %v in state delta %#x", msg.Key[0], delta.Root)
+    }
+  }
+  return delta, nil
+}
+
+// DeltaMessage is a single message from a state delta topic. Root is set for
+// every type. The header fields are set for DeltaMsg, Account for the other
+// types, Slot for StorageMsg and Value for AccountMsg and StorageMsg.
+type DeltaMessage struct {
+  Type MsgType
+  Root common.Hash
+  ParentRoot common.Hash
+  Destructs uint
+  Accounts uint
+  Storage uint
+  Account common.Hash
+  Slot common.Hash
+  Value []byte
+}
+
+// DecodeDeltaMessage decodes a single message from a state delta topic, for
+// inspecting topics without assembling whole deltas.
+func DecodeDeltaMessage(key, value []byte) (*DeltaMessage, error) {
+  if len(key) < 33 { return nil, fmt.Errorf("invalid state delta key %#x", key) }
+  msg := &DeltaMessage{Type: MsgType(key[0]), Root: common.BytesToHash(key[1:33])}
+  switch msg.Type {
+  case DeltaMsg:
+    header := cdcHeader{}
+    if err := rlp.DecodeBytes(value, &header); err != nil { return nil, err }
+    msg.ParentRoot, msg.Destructs, msg.Accounts, msg.Storage = header.ParentRoot, header.Destructs, header.Accounts, header.Storage
+  case DestructMsg:
+    msg.Account = common.BytesToHash(value)
+  case AccountMsg:
+    if len(key) != 65 { return nil, fmt.Errorf("invalid account key %#x", key) }
+    msg.Account, msg.Value = common.BytesToHash(key[33:]), value
+  case StorageMsg:
+    if len(key) != 97 { return nil, fmt.Errorf("invalid storage key %#x", key) }
+    msg.Account, msg.Slot, msg.Value = common.BytesToHash(key[33:65]), common.BytesToHash(key[65:]), value
+  default:
+    return nil, fmt.Errorf("unknown message type %v in state delta %#x", key[0], msg.Root)
+  }
+  return msg, nil
+}
+
+func (t MsgType) String() string {
+  switch t {
+  case DeltaMsg:
+    return "delta"
+  case DestructMsg:
+    return "destruct"
+  case AccountMsg:
+    return "account"
+  case StorageMsg:
+    return "storage"
+  }
+  return fmt.Sprintf("unknown(%d)", byte(t))
+}
@@ -0,0 +1,86 @@
+package snapshot
+
+import (
+  "bytes"
+  "io"
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "testing"
+  "github.com/ethereum/go-ethereum/common"
+)
+
+func TestDeltaFileReader(t *testing.T) {
+  dir, err := ioutil.TempDir("", "deltafile")
+  if err != nil { t.Fatalf(err.Error()) }
+  defer os.RemoveAll(dir)
+  path := filepath.Join(dir, "deltas.gz")
+  // Write across two runs, so the file holds two gzip streams
+  for i, root := range []common.Hash{common.HexToHash("0x02"), common.HexToHash("0x03")} {
+    tree, err, closer := FileCDCTree(nil, path)
+    if err != nil { t.Fatalf(err.Error()) }
+    tree.Update(
+      root,
+      common.HexToHash("0x01"),
+      map[common.Hash]struct{}{common.HexToHash("0xDD"): struct{}{}},
+      map[common.Hash][]byte{common.HexToHash("0xEE"): []byte{0, 1, byte(i)}},
+      map[common.Hash]map[common.Hash][]byte{common.HexToHash("0xEE"): {common.HexToHash("0xFF"): []byte{byte(i)}}},
+    )
+    closer()
+  }
+  fi, err := os.Open(path)
+  if err != nil { t.Fatalf(err.Error()) }
+  defer fi.Close()
+  reader, err := NewDeltaFileReader(fi)
+  if err != nil { t.Fatalf(err.Error()) }
+  for i, root := range []common.Hash{common.HexToHash("0x02"), common.HexToHash("0x03")} {
+    delta, err := reader.Next()
+    if err != nil { t.Fatalf(err.Error()) }
+    if delta.Root != root || delta.ParentRoot != common.HexToHash("0x01") {
+      t.Errorf("Unexpected roots %#x / %#x", delta.Root, delta.ParentRoot)
+    }
+    if _, ok := delta.Destructs[common.HexToHash("0xDD")]; !ok || len(delta.Destructs) != 1 {
+      t.Errorf("Unexpected destructs %v", delta.Destructs)
+    }
+    if !bytes.Equal(delta.Accounts[common.HexToHash("0xEE")], []byte{0, 1, byte(i)}) {
+      t.Errorf("Unexpected accounts %v", delta.Accounts)
+    }
+    if !bytes.Equal(delta.Storage[common.HexToHash("0xEE")][common.HexToHash("0xFF")], []byte{byte(i)}) {
+      t.Errorf("Unexpected storage %v", delta.Storage)
+    }
+  }
+  if _, err := reader.Next(); err != io.EOF {
+    t.Errorf("Expected EOF, got %v", err)
+  }
+}
+
+func TestDecodeDeltaMessage(t *testing.T) {
+  tree, ch := getEmptyMockCDCTrie()
+  root, account, slot := common.HexToHash("0x02"), common.HexToHash("0xEE"), common.HexToHash("0xAA")
+  tree.Update(root, common.HexToHash("0x01"), map[common.Hash]struct{}{common.HexToHash("0xff"): struct{}{}}, map[common.Hash][]byte{account: []byte{0, 1, 2}}, map[common.Hash]map[common.Hash][]byte{account: {slot: []byte{20, 30, 40}}})
+  msgs := <-ch
+  decoded := make([]*DeltaMessage, len(msgs))
+  for i, msg := range msgs {
+    var err error
+    decoded[i], err = DecodeDeltaMessage(msg.Key, msg.Value)
+    if err != nil { t.Fatalf(err.Error()) }
+    if decoded[i].Root != root {
+      t.Errorf("Unexpected root %#x", decoded[i].Root)
+    }
+  }
+  if header := decoded[0]; header.Type != DeltaMsg || header.ParentRoot != common.HexToHash("0x01") || header.Destructs != 1 || header.Accounts != 1 || header.Storage != 1 {
+    t.Errorf("Unexpected header %+v", header)
+  }
+  if destruct := decoded[1]; destruct.Type != DestructMsg || destruct.Account != common.HexToHash("0xff") {
+    t.Errorf("Unexpected destruct %+v", destruct)
+  }
+  if acct := decoded[2]; acct.Type != AccountMsg || acct.Account != account || !bytes.Equal(acct.Value, []byte{0, 1, 2}) {
+    t.Errorf("Unexpected account %+v", acct)
+  }
+  if storage := decoded[3]; storage.Type != StorageMsg || storage.Account != account || storage.Slot != slot || !bytes.Equal(storage.Value, []byte{20, 30, 40}) {
+    t.Errorf("Unexpected storage %+v", storage)
+  }
+  if _, err := DecodeDeltaMessage([]byte{byte(DeltaMsg)}, nil); err == nil {
+    t.Errorf("Expected error for short key")
+  }
+}
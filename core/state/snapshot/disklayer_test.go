@@ -28,6 +28,7 @@ import (
 	"github.com/ethereum/go-ethereum/ethdb"
 	"github.com/ethereum/go-ethereum/ethdb/leveldb"
 	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+	"github.com/ethereum/go-ethereum/ethdb/overlay"
 	"github.com/ethereum/go-ethereum/rlp"
 )
 
@@ -585,3 +586,78 @@ func TestDiskSeek(t *testing.T) {
 		}
 	}
 }
+
+// Tests that flattening a diff layer into a database that supports range
+// deletion drops the storage of destructed accounts with a range tombstone
+// rather than a deletion per slot.
+func TestDiskMergeRangeDelete(t *testing.T) {
+	var (
+		overlaydb = memorydb.New()
+		underlay  = memorydb.New()
+		db        = rawdb.NewDatabase(overlay.NewOverlayWrapperDB(overlaydb, underlay))
+
+		accNuke  = common.Hash{0x1}
+		accKeep  = common.Hash{0x2}
+		slotA    = common.Hash{0x10}
+		slotB    = common.Hash{0x20}
+		baseRoot = randomHash()
+		diffRoot = randomHash()
+	)
+	if _, ok := db.(ethdb.RangeDeleter); !ok {
+		t.Fatalf("database does not expose range deletion")
+	}
+	rawdb.WriteAccountSnapshot(underlay, accNuke, accNuke[:])
+	rawdb.WriteStorageSnapshot(underlay, accNuke, slotA, slotA[:])
+	rawdb.WriteStorageSnapshot(underlay, accNuke, slotB, slotB[:])
+	rawdb.WriteAccountSnapshot(underlay, accKeep, accKeep[:])
+	rawdb.WriteStorageSnapshot(underlay, accKeep, slotA, slotA[:])
+	rawdb.WriteSnapshotRoot(underlay, baseRoot)
+
+	snaps := &Tree{
+		layers: map[common.Hash]snapshot{
+			baseRoot: &diskLayer{
+				diskdb: db,
+				cache:  fastcache.New(500 * 1024),
+				root:   baseRoot,
+			},
+		},
+	}
+	snaps.Snapshot(baseRoot).Storage(accNuke, slotA)
+
+	// Destruct the account and recreate it with a single slot
+	if err := snaps.Update(diffRoot, baseRoot, map[common.Hash]struct{}{
+		accNuke: {},
+	}, map[common.Hash][]byte{
+		accNuke: reverse(accNuke[:]),
+	}, map[common.Hash]map[common.Hash][]byte{
+		accNuke: {slotB: reverse(slotB[:])},
+	}); err != nil {
+		t.Fatalf("failed to update snapshot tree: %v", err)
+	}
+	if err := snaps.Cap(diffRoot, 0); err != nil {
+		t.Fatalf("failed to flatten snapshot tree: %v", err)
+	}
+	if root := rawdb.ReadSnapshotRoot(db); root != diffRoot {
+		t.Fatalf("snapshot root mismatch: have %x, want %x", root, diffRoot)
+	}
+	snap := snaps.Snapshot(diffRoot)
+	if blob, err := snap.Storage(accNuke, slotA); err != nil || len(blob) != 0 {
+		t.Errorf("destructed slot: have %x, %v, want empty", blob, err)
+	}
+	if blob := rawdb.ReadStorageSnapshot(db, accNuke, slotA); len(blob) != 0 {
+		t.Errorf("destructed slot in database: have %x, want empty", blob)
+	}
+	if blob := rawdb.ReadStorageSnapshot(db, accNuke, slotB); !bytes.Equal(blob, reverse(slotB[:])) {
+		t.Errorf("recreated slot: have %x, want %x", blob, reverse(slotB[:]))
+	}
+	if blob := rawdb.ReadStorageSnapshot(db, accKeep, slotA); !bytes.Equal(blob, slotA[:]) {
+		t.Errorf("untouched slot: have %x, want %x", blob, slotA[:])
+	}
+	it := overlaydb.NewIterator([]byte("deleted/"), nil)
+	defer it.Release()
+	for it.Next() {
+		if bytes.HasPrefix(it.Key()[len("deleted/"):], rawdb.SnapshotStoragePrefix) {
+			t.Errorf("storage slot deleted one key at a time: %x", it.Key())
+		}
+	}
+}
@@ -469,6 +469,13 @@ func diffToDisk(bottom *diffLayer) *diskLayer {
 	base.stale = true
 	base.lock.Unlock()
 
+	// Storage of destructed accounts is range deleted where the database can,
+	// which bypasses the batch. Drop the root right away so that a crash before
+	// the batch is flushed leaves no snapshot rather than a corrupted one.
+	deleter, ranged := base.diskdb.(ethdb.RangeDeleter)
+	if ranged && len(bottom.destructSet) > 0 {
+		rawdb.DeleteSnapshotRoot(base.diskdb)
+	}
 	// Destroy all the destructed accounts from the database
 	for hash := range bottom.destructSet {
 		// Skip any account not covered yet by the snapshot
@@ -482,13 +489,18 @@ func diffToDisk(bottom *diffLayer) *diskLayer {
 		it := rawdb.IterateStorageSnapshots(base.diskdb, hash)
 		for it.Next() {
 			if key := it.Key(); len(key) == 65 { // TODO(karalabe): Yuck, we should move this into the iterator
-				batch.Delete(key)
+				if !ranged {
+					batch.Delete(key)
+				}
 				base.cache.Del(key[1:])
 
 				snapshotFlushStorageItemMeter.Mark(1)
 			}
 		}
 		it.Release()
+		if ranged {
+			rawdb.DeleteStorageSnapshots(deleter, hash)
+		}
 	}
 	// Push all updated accounts into the database
 	for hash, data := range bottom.accountData {
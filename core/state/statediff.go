@@ -0,0 +1,247 @@
+// Copyright 2021 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package state
+
+import (
+	"bytes"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+)
+
+// BalanceDiff is the balance of an account before and after a change.
+type BalanceDiff struct {
+	From *hexutil.Big `json:"from"`
+	To   *hexutil.Big `json:"to"`
+}
+
+// NonceDiff is the nonce of an account before and after a change.
+type NonceDiff struct {
+	From hexutil.Uint64 `json:"from"`
+	To   hexutil.Uint64 `json:"to"`
+}
+
+// CodeDiff is the code of an account before and after a change.
+type CodeDiff struct {
+	From hexutil.Bytes `json:"from"`
+	To   hexutil.Bytes `json:"to"`
+}
+
+// StorageDiff is a storage slot before and after a change.
+type StorageDiff struct {
+	From common.Hash `json:"from"`
+	To   common.Hash `json:"to"`
+}
+
+// AccountDiff is the change to an account. Fields that didn't change are
+// left out.
+type AccountDiff struct {
+	Balance *BalanceDiff                 `json:"balance,omitempty"`
+	Nonce   *NonceDiff                   `json:"nonce,omitempty"`
+	Code    *CodeDiff                    `json:"code,omitempty"`
+	Storage map[common.Hash]*StorageDiff `json:"storage,omitempty"`
+}
+
+// StateDiff is the change to each account a span of execution modified.
+type StateDiff map[common.Address]*AccountDiff
+
+// accountOrigin is an account's values before the journal's first change to
+// each of them.
+type accountOrigin struct {
+	balance *big.Int
+	nonce   *uint64
+	code    []byte
+	hasCode bool
+	storage map[common.Hash]common.Hash
+	// prev is the account an account creation replaced, which holds the
+	// original values of slots written after the creation.
+	prev *stateObject
+}
+
+// Diff returns the changes to the state since it was last finalised, built
+// from the journal. Reverted changes are left out, as they are removed from
+// the journal. Only the storage slots that were written are reported, so an
+// account that is destroyed or recreated may lose slots that don't appear.
+//
+// Diff must be called before Finalise or IntermediateRoot, which clear the
+// journal.
+func (s *StateDB) Diff() StateDiff {
+	origins := make(map[common.Address]*accountOrigin)
+	origin := func(addr common.Address) *accountOrigin {
+		o, ok := origins[addr]
+		if !ok {
+			o = &accountOrigin{storage: make(map[common.Hash]common.Hash)}
+			origins[addr] = o
+		}
+		return o
+	}
+	setBalance := func(o *accountOrigin, balance *big.Int) {
+		if o.balance == nil {
+			o.balance = new(big.Int).Set(balance)
+		}
+	}
+	setNonce := func(o *accountOrigin, nonce uint64) {
+		if o.nonce == nil {
+			o.nonce = &nonce
+		}
+	}
+	setCode := func(o *accountOrigin, code []byte) {
+		if !o.hasCode {
+			o.code, o.hasCode = code, true
+		}
+	}
+	for _, entry := range s.journal.entries {
+		switch ch := entry.(type) {
+		case createObjectChange:
+			o := origin(*ch.account)
+			setBalance(o, new(big.Int))
+			setNonce(o, 0)
+			setCode(o, nil)
+		case resetObjectChange:
+			o := origin(ch.prev.address)
+			setBalance(o, ch.prev.Balance())
+			setNonce(o, ch.prev.Nonce())
+			setCode(o, ch.prev.Code(s.db))
+			if o.prev == nil {
+				o.prev = ch.prev
+			}
+		case suicideChange:
+			// Suicide doesn't journal the nonce and code it clears, so take
+			// them from the object, which keeps them until it's finalised.
+			o := origin(*ch.account)
+			setBalance(o, ch.prevbalance)
+			if obj := s.getDeletedStateObject(*ch.account); obj != nil {
+				setNonce(o, obj.Nonce())
+				setCode(o, obj.Code(s.db))
+			}
+		case balanceChange:
+			setBalance(origin(*ch.account), ch.prev)
+		case nonceChange:
+			setNonce(origin(*ch.account), ch.prev)
+		case codeChange:
+			setCode(origin(*ch.account), ch.prevcode)
+		case storageChange:
+			o := origin(*ch.account)
+			if _, ok := o.storage[ch.key]; !ok {
+				if o.prev != nil {
+					o.storage[ch.key] = o.prev.GetState(s.db, ch.key)
+				} else {
+					o.storage[ch.key] = ch.prevalue
+				}
+			}
+		}
+	}
+	diff := make(StateDiff)
+	for addr, o := range origins {
+		// Destroyed accounts are emptied when the state is finalised
+		var (
+			balance = new(big.Int)
+			nonce   uint64
+			code    []byte
+			obj     = s.getStateObject(addr)
+			account = &AccountDiff{}
+		)
+		if obj != nil && !obj.suicided {
+			balance, nonce, code = obj.Balance(), obj.Nonce(), obj.Code(s.db)
+		}
+		if o.balance != nil && o.balance.Cmp(balance) != 0 {
+			account.Balance = &BalanceDiff{From: (*hexutil.Big)(o.balance), To: (*hexutil.Big)(new(big.Int).Set(balance))}
+		}
+		if o.nonce != nil && *o.nonce != nonce {
+			account.Nonce = &NonceDiff{From: hexutil.Uint64(*o.nonce), To: hexutil.Uint64(nonce)}
+		}
+		if o.hasCode && !bytes.Equal(o.code, code) {
+			account.Code = &CodeDiff{From: common.CopyBytes(o.code), To: common.CopyBytes(code)}
+		}
+		for key, from := range o.storage {
+			var to common.Hash
+			if obj != nil && !obj.suicided {
+				to = obj.GetState(s.db, key)
+			}
+			if from != to {
+				if account.Storage == nil {
+					account.Storage = make(map[common.Hash]*StorageDiff)
+				}
+				account.Storage[key] = &StorageDiff{From: from, To: to}
+			}
+		}
+		if account.Balance != nil || account.Nonce != nil || account.Code != nil || account.Storage != nil {
+			diff[addr] = account
+		}
+	}
+	return diff
+}
+
+// Merge adds the changes in next, which were made after the ones in the diff,
+// to the diff, so that it holds the combined change of both.
+func (diff StateDiff) Merge(next StateDiff) {
+	for addr, n := range next {
+		d, ok := diff[addr]
+		if !ok {
+			d = &AccountDiff{}
+			diff[addr] = d
+		}
+		if n.Balance != nil {
+			if d.Balance == nil {
+				d.Balance = &BalanceDiff{From: n.Balance.From}
+			}
+			d.Balance = &BalanceDiff{From: d.Balance.From, To: n.Balance.To}
+			if d.Balance.From.ToInt().Cmp(d.Balance.To.ToInt()) == 0 {
+				d.Balance = nil
+			}
+		}
+		if n.Nonce != nil {
+			if d.Nonce == nil {
+				d.Nonce = &NonceDiff{From: n.Nonce.From}
+			}
+			d.Nonce = &NonceDiff{From: d.Nonce.From, To: n.Nonce.To}
+			if d.Nonce.From == d.Nonce.To {
+				d.Nonce = nil
+			}
+		}
+		if n.Code != nil {
+			if d.Code == nil {
+				d.Code = &CodeDiff{From: n.Code.From}
+			}
+			d.Code = &CodeDiff{From: d.Code.From, To: n.Code.To}
+			if bytes.Equal(d.Code.From, d.Code.To) {
+				d.Code = nil
+			}
+		}
+		for key, slot := range n.Storage {
+			if d.Storage == nil {
+				d.Storage = make(map[common.Hash]*StorageDiff)
+			}
+			from := slot.From
+			if prev, ok := d.Storage[key]; ok {
+				from = prev.From
+			}
+			if from == slot.To {
+				delete(d.Storage, key)
+			} else {
+				d.Storage[key] = &StorageDiff{From: from, To: slot.To}
+			}
+		}
+		if len(d.Storage) == 0 {
+			d.Storage = nil
+		}
+		if d.Balance == nil && d.Nonce == nil && d.Code == nil && d.Storage == nil {
+			delete(diff, addr)
+		}
+	}
+}
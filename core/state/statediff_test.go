@@ -0,0 +1,109 @@
+// Copyright 2021 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package state
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+)
+
+func TestStateDiff(t *testing.T) {
+	var (
+		db        = NewDatabase(rawdb.NewMemoryDatabase())
+		state, _  = New(common.Hash{}, db, nil)
+		sender    = common.Address{1}
+		contract  = common.Address{2}
+		created   = common.Address{3}
+		destroyed = common.Address{4}
+		slot      = common.Hash{1}
+		unchanged = common.Hash{2}
+	)
+	state.SetBalance(sender, big.NewInt(100))
+	state.SetCode(contract, []byte{1, 2, 3})
+	state.SetState(contract, slot, common.Hash{1})
+	state.SetState(contract, unchanged, common.Hash{2})
+	state.SetBalance(destroyed, big.NewInt(5))
+	state.SetNonce(destroyed, 1)
+	root, _ := state.Commit(false)
+	state, _ = New(root, db, nil)
+
+	state.SubBalance(sender, big.NewInt(10))
+	state.SetNonce(sender, 1)
+	state.SetState(contract, slot, common.Hash{3})
+	state.SetState(contract, unchanged, common.Hash{4})
+	state.SetState(contract, unchanged, common.Hash{2})
+	state.SetCode(created, []byte{4})
+	state.AddBalance(created, big.NewInt(10))
+	state.Suicide(destroyed)
+
+	// Reverted changes aren't reported
+	snapshot := state.Snapshot()
+	state.SetBalance(sender, big.NewInt(1000))
+	state.SetState(contract, common.Hash{5}, common.Hash{5})
+	state.RevertToSnapshot(snapshot)
+
+	diff := state.Diff()
+	if len(diff) != 4 {
+		t.Fatalf("Expected 4 changed accounts, got %v", len(diff))
+	}
+	if d := diff[sender]; d.Balance.From.ToInt().Int64() != 100 || d.Balance.To.ToInt().Int64() != 90 || d.Nonce.From != 0 || d.Nonce.To != 1 || d.Code != nil || d.Storage != nil {
+		t.Errorf("Unexpected sender diff %+v", d)
+	}
+	if d := diff[contract]; d.Balance != nil || d.Code != nil || len(d.Storage) != 1 || d.Storage[slot].From != (common.Hash{1}) || d.Storage[slot].To != (common.Hash{3}) {
+		t.Errorf("Unexpected contract diff %+v", d)
+	}
+	if d := diff[created]; d.Balance.From.ToInt().Sign() != 0 || d.Balance.To.ToInt().Int64() != 10 || len(d.Code.From) != 0 || len(d.Code.To) != 1 {
+		t.Errorf("Unexpected created account diff %+v", d)
+	}
+	if d := diff[destroyed]; d.Balance.From.ToInt().Int64() != 5 || d.Balance.To.ToInt().Sign() != 0 || d.Nonce.From != 1 || d.Nonce.To != 0 {
+		t.Errorf("Unexpected destroyed account diff %+v", d)
+	}
+	// Finalising clears the journal
+	state.Finalise(true)
+	if diff := state.Diff(); len(diff) != 0 {
+		t.Errorf("Expected no changes after finalising, got %v", len(diff))
+	}
+}
+
+func TestStateDiffMerge(t *testing.T) {
+	var (
+		a    = common.Address{1}
+		b    = common.Address{2}
+		slot = common.Hash{1}
+	)
+	balance := func(from, to int64) *BalanceDiff {
+		return &BalanceDiff{From: (*hexutil.Big)(big.NewInt(from)), To: (*hexutil.Big)(big.NewInt(to))}
+	}
+	diff := StateDiff{
+		a: {Balance: balance(10, 5), Nonce: &NonceDiff{From: 0, To: 1}},
+		b: {Storage: map[common.Hash]*StorageDiff{slot: {From: common.Hash{1}, To: common.Hash{2}}}},
+	}
+	diff.Merge(StateDiff{
+		a: {Balance: balance(5, 3)},
+		b: {Storage: map[common.Hash]*StorageDiff{slot: {From: common.Hash{2}, To: common.Hash{1}}}},
+	})
+	if len(diff) != 1 {
+		t.Fatalf("Expected accounts changed back to be dropped, got %v accounts", len(diff))
+	}
+	if d := diff[a]; d.Balance.From.ToInt().Int64() != 10 || d.Balance.To.ToInt().Int64() != 3 || d.Nonce.To != 1 {
+		t.Errorf("Unexpected merged diff %+v", d)
+	}
+}
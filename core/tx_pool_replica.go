@@ -85,3 +85,41 @@ func NewReplicaTxPool(config TxPoolConfig, chainconfig *params.ChainConfig, chai
 
 	return pool, nil
 }
+
+// RemoveTransactions drops the given transactions from the pool, as when a
+// replica learns that its master evicted them. Any pending transactions from
+// the same senders that depend on a removed transaction are moved back to the
+// queue. It returns the number of transactions removed.
+func (pool *TxPool) RemoveTransactions(hashes []common.Hash) int {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	removed := 0
+	for _, hash := range hashes {
+		if pool.all.Get(hash) != nil {
+			pool.removeTx(hash, true)
+			removed++
+		}
+	}
+	return removed
+}
+
+// RetainTransactions drops every remote transaction from the pool for which
+// keep returns false, as when a replica prunes its pool to match a snapshot
+// of its master's. It returns the number of transactions removed.
+func (pool *TxPool) RetainTransactions(keep func(hash common.Hash) bool) int {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	var drop []common.Hash
+	pool.all.Range(func(hash common.Hash, tx *types.Transaction, local bool) bool {
+		if !keep(hash) {
+			drop = append(drop, hash)
+		}
+		return true
+	}, false, true)
+	for _, hash := range drop {
+		pool.removeTx(hash, true)
+	}
+	return len(drop)
+}
@@ -0,0 +1,57 @@
+package core
+
+import (
+	"crypto/ecdsa"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// Tests that a replica's pool can be brought in line with its master's, by
+// removing evicted transactions and pruning to a snapshot.
+func TestReplicaPoolRemovals(t *testing.T) {
+	t.Parallel()
+
+	pool, key := setupTxPool()
+	defer pool.Stop()
+
+	other, _ := crypto.GenerateKey()
+	for _, k := range []*ecdsa.PrivateKey{key, other} {
+		pool.currentState.AddBalance(crypto.PubkeyToAddress(k.PublicKey), big.NewInt(1000000))
+	}
+	txs := []*types.Transaction{
+		transaction(0, 100000, key),
+		transaction(1, 100000, key),
+		transaction(2, 100000, key),
+		transaction(0, 100000, other),
+	}
+	for _, err := range pool.AddRemotesSync(txs) {
+		if err != nil {
+			t.Fatalf("failed to add transaction: %v", err)
+		}
+	}
+	// Removing a pending transaction demotes its successors
+	if removed := pool.RemoveTransactions([]common.Hash{txs[1].Hash(), common.Hash{}}); removed != 1 {
+		t.Errorf("removed count mismatch: have %d, want %d", removed, 1)
+	}
+	if pending, queued := pool.Stats(); pending != 2 || queued != 1 {
+		t.Errorf("pool stats mismatch: have %d/%d, want %d/%d", pending, queued, 2, 1)
+	}
+	if err := validateTxPoolInternals(pool); err != nil {
+		t.Fatalf("pool internal state corrupted: %v", err)
+	}
+	// Pruning to a snapshot drops everything else
+	keep := map[common.Hash]bool{txs[0].Hash(): true, txs[3].Hash(): true}
+	if removed := pool.RetainTransactions(func(hash common.Hash) bool { return keep[hash] }); removed != 1 {
+		t.Errorf("pruned count mismatch: have %d, want %d", removed, 1)
+	}
+	if pending, queued := pool.Stats(); pending != 2 || queued != 0 {
+		t.Errorf("pool stats mismatch: have %d/%d, want %d/%d", pending, queued, 2, 0)
+	}
+	if err := validateTxPoolInternals(pool); err != nil {
+		t.Fatalf("pool internal state corrupted: %v", err)
+	}
+}
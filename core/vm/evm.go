@@ -216,6 +216,11 @@ func (evm *EVM) Interpreter() Interpreter {
 	return evm.interpreter
 }
 
+// Config returns the configuration the EVM was created with
+func (evm *EVM) Config() Config {
+	return evm.vmConfig
+}
+
 // Call executes the contract associated with the addr with the given input as
 // parameters. It also handles any necessary value transfer required and takes
 // the necessary steps to create accounts and reverses the state in case of an
@@ -23,6 +23,7 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"math/big"
 	"os"
 	"runtime"
 	"sync"
@@ -31,6 +32,7 @@ import (
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/common/hexutil"
 	"github.com/ethereum/go-ethereum/consensus"
+	"github.com/ethereum/go-ethereum/consensus/misc"
 	"github.com/ethereum/go-ethereum/core"
 	"github.com/ethereum/go-ethereum/core/rawdb"
 	"github.com/ethereum/go-ethereum/core/state"
@@ -106,6 +108,27 @@ func (context *chainContext) GetHeader(hash common.Hash, number uint64) *types.H
 	return header
 }
 
+// Config, CurrentHeader, GetHeaderByNumber and GetHeaderByHash let the chain
+// context stand in as a consensus.ChainHeaderReader, to finalise blocks.
+func (context *chainContext) Config() *params.ChainConfig {
+	return context.api.backend.ChainConfig()
+}
+
+func (context *chainContext) CurrentHeader() *types.Header {
+	header, _ := context.api.backend.HeaderByNumber(context.ctx, rpc.LatestBlockNumber)
+	return header
+}
+
+func (context *chainContext) GetHeaderByNumber(number uint64) *types.Header {
+	header, _ := context.api.backend.HeaderByNumber(context.ctx, rpc.BlockNumber(number))
+	return header
+}
+
+func (context *chainContext) GetHeaderByHash(hash common.Hash) *types.Header {
+	header, _ := context.api.backend.HeaderByHash(context.ctx, hash)
+	return header
+}
+
 // chainContext construts the context reader which is used by the evm for reading
 // the necessary chain context.
 func (api *API) chainContext(ctx context.Context) core.ChainContext {
@@ -716,11 +739,200 @@ func (api *API) TraceCall(ctx context.Context, args ethapi.CallArgs, blockNrOrHa
 	return api.traceTx(ctx, msg, vmctx, statedb, config)
 }
 
+// TraceCallManyArgs is a call in a debug_traceCallMany bundle, along with
+// the state and block context overrides to apply before it runs.
+type TraceCallManyArgs struct {
+	ethapi.CallArgs
+	StateOverrides *ethapi.StateOverride  `json:"stateOverrides"`
+	BlockOverrides *ethapi.BlockOverrides `json:"blockOverrides"`
+}
+
+// TraceCallMany lets you trace a sequence of eth_calls on top of the provided
+// block, each executing on the state left by the ones before it. State
+// overrides accumulate along with the calls' own changes, while block
+// overrides only apply to the call they are given with. Each call's trace, or
+// the reason it couldn't run, is returned in order.
+func (api *API) TraceCallMany(ctx context.Context, calls []TraceCallManyArgs, blockNrOrHash rpc.BlockNumberOrHash, config *TraceConfig) ([]*txTraceResult, error) {
+	// Try to retrieve the specified block
+	var (
+		err   error
+		block *types.Block
+	)
+	if hash, ok := blockNrOrHash.Hash(); ok {
+		block, err = api.blockByHash(ctx, hash)
+	} else if number, ok := blockNrOrHash.Number(); ok {
+		block, err = api.blockByNumber(ctx, number)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// try to recompute the state
+	reexec := defaultTraceReexec
+	if config != nil && config.Reexec != nil {
+		reexec = *config.Reexec
+	}
+	statedb, release, err := api.backend.StateAtBlock(ctx, block, reexec)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	// Execute the calls one after the other
+	var (
+		blockCtx = core.NewEVMBlockContext(block.Header(), api.chainContext(ctx), nil)
+		results  = make([]*txTraceResult, len(calls))
+	)
+	for i, call := range calls {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if call.StateOverrides != nil {
+			if err := call.StateOverrides.Apply(statedb); err != nil {
+				return nil, fmt.Errorf("call %d: %v", i, err)
+			}
+		}
+		vmctx := blockCtx
+		call.BlockOverrides.Apply(&vmctx)
+
+		msg := call.ToMessage(api.backend.RPCGasCap())
+		res, err := api.traceTx(ctx, msg, vmctx, statedb, config)
+		if err != nil {
+			results[i] = &txTraceResult{Error: err.Error()}
+		} else {
+			results[i] = &txTraceResult{Result: res}
+		}
+		// Ensure the call's changes are visible to the next one
+		statedb.Finalise(api.backend.ChainConfig().IsEIP158(vmctx.BlockNumber))
+	}
+	return results, nil
+}
+
+// StateDiff returns the balance, nonce, code and storage of each account a
+// transaction or block changed, before and after it ran. A hash is taken as a
+// transaction's if one is known by it, and as a block's otherwise. Block diffs
+// include the block and uncle rewards.
+func (api *API) StateDiff(ctx context.Context, target rpc.BlockNumberOrHash) (state.StateDiff, error) {
+	if hash, ok := target.Hash(); ok {
+		// Some backends report unknown transactions as errors, so any failure
+		// falls back to looking for a block.
+		if tx, blockHash, blockNumber, index, err := api.backend.GetTransaction(ctx, hash); err == nil && tx != nil {
+			return api.transactionStateDiff(ctx, hash, blockHash, blockNumber, index)
+		}
+	}
+	var (
+		err   error
+		block *types.Block
+	)
+	if hash, ok := target.Hash(); ok {
+		block, err = api.blockByHash(ctx, hash)
+	} else if number, ok := target.Number(); ok {
+		block, err = api.blockByNumber(ctx, number)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return api.blockStateDiff(ctx, block)
+}
+
+// transactionStateDiff re-executes a transaction on the state before it, and
+// returns what it changed.
+func (api *API) transactionStateDiff(ctx context.Context, hash, blockHash common.Hash, blockNumber, index uint64) (state.StateDiff, error) {
+	// It shouldn't happen in practice.
+	if blockNumber == 0 {
+		return nil, errors.New("genesis has no transactions")
+	}
+	block, err := api.blockByNumberAndHash(ctx, rpc.BlockNumber(blockNumber), blockHash)
+	if err != nil {
+		return nil, err
+	}
+	msg, vmctx, statedb, release, err := api.backend.StateAtTransaction(ctx, block, int(index), defaultTraceReexec)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	vmenv := vm.NewEVM(vmctx, core.NewEVMTxContext(msg), statedb, api.backend.ChainConfig(), vm.Config{})
+	statedb.Prepare(hash, blockHash, int(index))
+	if _, err := core.ApplyMessage(vmenv, msg, new(core.GasPool).AddGas(msg.Gas())); err != nil {
+		return nil, fmt.Errorf("transaction %#x failed: %v", hash, err)
+	}
+	return statedb.Diff(), nil
+}
+
+// blockStateDiff re-executes a block on the state of its parent, and returns
+// what it changed.
+func (api *API) blockStateDiff(ctx context.Context, block *types.Block) (state.StateDiff, error) {
+	if block.NumberU64() == 0 {
+		return nil, errors.New("genesis has no state diff")
+	}
+	parent, err := api.blockByNumberAndHash(ctx, rpc.BlockNumber(block.NumberU64()-1), block.ParentHash())
+	if err != nil {
+		return nil, err
+	}
+	statedb, release, err := api.backend.StateAtBlock(ctx, parent, defaultTraceReexec)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	var (
+		config   = api.backend.ChainConfig()
+		signer   = types.MakeSigner(config, block.Number())
+		blockCtx = core.NewEVMBlockContext(block.Header(), api.chainContext(ctx), nil)
+		diff     = make(state.StateDiff)
+	)
+	// The hard-fork and reward balance changes aren't journaled as part of a
+	// transaction, so the balances of the accounts they touch are compared
+	// directly.
+	balanceChanges := func(addrs []common.Address, change func()) state.StateDiff {
+		balances := make(map[common.Address]*big.Int)
+		for _, addr := range addrs {
+			balances[addr] = new(big.Int).Set(statedb.GetBalance(addr))
+		}
+		change()
+		changes := make(state.StateDiff)
+		for addr, from := range balances {
+			if to := statedb.GetBalance(addr); from.Cmp(to) != 0 {
+				changes[addr] = &state.AccountDiff{Balance: &state.BalanceDiff{From: (*hexutil.Big)(from), To: (*hexutil.Big)(new(big.Int).Set(to))}}
+			}
+		}
+		return changes
+	}
+	if config.DAOForkSupport && config.DAOForkBlock != nil && config.DAOForkBlock.Cmp(block.Number()) == 0 {
+		diff.Merge(balanceChanges(append(params.DAODrainList(), params.DAORefundContract), func() {
+			misc.ApplyDAOHardFork(statedb)
+		}))
+		statedb.Finalise(config.IsEIP158(block.Number()))
+	}
+	for i, tx := range block.Transactions() {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		msg, _ := tx.AsMessage(signer)
+		vmenv := vm.NewEVM(blockCtx, core.NewEVMTxContext(msg), statedb, config, vm.Config{})
+		statedb.Prepare(tx.Hash(), block.Hash(), i)
+		if _, err := core.ApplyMessage(vmenv, msg, new(core.GasPool).AddGas(msg.Gas())); err != nil {
+			return nil, fmt.Errorf("transaction %#x failed: %v", tx.Hash(), err)
+		}
+		diff.Merge(statedb.Diff())
+		statedb.Finalise(config.IsEIP158(block.Number()))
+	}
+	// Rewards are paid when the block is finalised, which clears the journal
+	rewarded := []common.Address{block.Coinbase()}
+	for _, uncle := range block.Uncles() {
+		rewarded = append(rewarded, uncle.Coinbase)
+	}
+	diff.Merge(balanceChanges(rewarded, func() {
+		api.backend.Engine().Finalize(&chainContext{api: api, ctx: ctx}, types.CopyHeader(block.Header()), statedb, block.Transactions(), block.Uncles())
+	}))
+	return diff, nil
+}
+
 // traceTx configures a new tracer according to the provided configuration, and
 // executes the given message in the provided environment. The return value will
 // be tracer dependent.
 func (api *API) traceTx(ctx context.Context, message core.Message, vmctx vm.BlockContext, statedb *state.StateDB, config *TraceConfig) (interface{}, error) {
-	// Assemble the structured logger or the JavaScript tracer
+	// Assemble the structured logger or the native or JavaScript tracer
 	var (
 		tracer    vm.Tracer
 		err       error
@@ -735,15 +947,15 @@ func (api *API) traceTx(ctx context.Context, message core.Message, vmctx vm.Bloc
 				return nil, err
 			}
 		}
-		// Constuct the JavaScript tracer to execute with
-		if tracer, err = New(*config.Tracer, txContext); err != nil {
+		// Constuct the native or JavaScript tracer to execute with
+		if tracer, err = NewTracer(*config.Tracer, txContext); err != nil {
 			return nil, err
 		}
 		// Handle timeouts and RPC cancellations
 		deadlineCtx, cancel := context.WithTimeout(ctx, timeout)
 		go func() {
 			<-deadlineCtx.Done()
-			tracer.(*Tracer).Stop(errors.New("execution timeout"))
+			tracer.(ResultTracer).Stop(errors.New("execution timeout"))
 		}()
 		defer cancel()
 
@@ -756,6 +968,9 @@ func (api *API) traceTx(ctx context.Context, message core.Message, vmctx vm.Bloc
 
 	// Run the transaction with tracing enabled.
 	vmenv := vm.NewEVM(vmctx, txContext, statedb, api.backend.ChainConfig(), vm.Config{Debug: true, Tracer: tracer})
+	if tracer, ok := tracer.(envTracer); ok {
+		tracer.setEnv(vmenv)
+	}
 	result, err := core.ApplyMessage(vmenv, message, new(core.GasPool).AddGas(message.Gas()))
 	if err != nil {
 		return nil, fmt.Errorf("tracing failed: %v", err)
@@ -776,7 +991,7 @@ func (api *API) traceTx(ctx context.Context, message core.Message, vmctx vm.Bloc
 			StructLogs:  ethapi.FormatLogs(tracer.StructLogs()),
 		}, nil
 
-	case *Tracer:
+	case ResultTracer:
 		return tracer.GetResult()
 
 	default:
@@ -20,11 +20,13 @@ import (
 	"bytes"
 	"context"
 	"crypto/ecdsa"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"math/big"
 	"reflect"
 	"sort"
+	"strings"
 	"testing"
 	"time"
 
@@ -63,6 +65,9 @@ func newTestBackend(t *testing.T, n int, gspec *core.Genesis, generator func(i i
 		engine:      ethash.NewFaker(),
 		chaindb:     rawdb.NewMemoryDatabase(),
 	}
+	if gspec.Config != nil {
+		backend.chainConfig = gspec.Config
+	}
 	// Generate blocks for testing
 	gspec.Config = backend.chainConfig
 	var (
@@ -321,6 +326,58 @@ func TestTraceCall(t *testing.T) {
 	}
 }
 
+func TestTraceCallMany(t *testing.T) {
+	t.Parallel()
+
+	// Initialize test accounts
+	accounts := newAccounts(3)
+	genesis := &core.Genesis{Alloc: core.GenesisAlloc{
+		accounts[0].addr: {Balance: big.NewInt(params.Ether)},
+	}}
+	api := NewAPI(newTestBackend(t, 1, genesis, func(i int, b *core.BlockGen) {}))
+
+	var (
+		timestamp = hexutil.Uint64(0x1234)
+		balance   = (*hexutil.Big)(big.NewInt(1000))
+		// TIMESTAMP PUSH1 0 MSTORE PUSH1 32 PUSH1 0 RETURN
+		code = hexutil.Bytes(common.FromHex("0x4260005260206000f3"))
+	)
+	calls := []TraceCallManyArgs{
+		// A plain transfer
+		{CallArgs: ethapi.CallArgs{From: &accounts[0].addr, To: &accounts[1].addr, Value: balance}},
+		// Spending the transfer
+		{CallArgs: ethapi.CallArgs{From: &accounts[1].addr, To: &accounts[2].addr, Value: balance}},
+		// Spending it again fails
+		{CallArgs: ethapi.CallArgs{From: &accounts[1].addr, To: &accounts[2].addr, Value: balance}},
+		// Overridden code and timestamp
+		{
+			CallArgs:       ethapi.CallArgs{From: &accounts[0].addr, To: &accounts[2].addr},
+			StateOverrides: &ethapi.StateOverride{accounts[2].addr: ethapi.OverrideAccount{Code: &code}},
+			BlockOverrides: &ethapi.BlockOverrides{Time: &timestamp},
+		},
+		// Overrides persist, but block overrides only apply to their own call
+		{CallArgs: ethapi.CallArgs{From: &accounts[0].addr, To: &accounts[2].addr}},
+	}
+	results, err := api.TraceCallMany(context.Background(), calls, rpc.BlockNumberOrHashWithNumber(rpc.LatestBlockNumber), nil)
+	if err != nil {
+		t.Fatalf("Failed to trace calls: %v", err)
+	}
+	if len(results) != len(calls) {
+		t.Fatalf("Expected %v results, got %v", len(calls), len(results))
+	}
+	for i, failed := range []bool{false, false, true, false, false} {
+		if failed != (results[i].Error != "") {
+			t.Errorf("Call %v: unexpected error %q", i, results[i].Error)
+		}
+	}
+	if ret := results[3].Result.(*ethapi.ExecutionResult).ReturnValue; !strings.HasSuffix(ret, "1234") {
+		t.Errorf("Expected overridden timestamp, got %v", ret)
+	}
+	if ret := results[4].Result.(*ethapi.ExecutionResult).ReturnValue; strings.HasSuffix(ret, "1234") || len(ret) != 64 {
+		t.Errorf("Expected block timestamp, got %v", ret)
+	}
+}
+
 func TestTraceTransaction(t *testing.T) {
 	t.Parallel()
 
@@ -352,6 +409,127 @@ func TestTraceTransaction(t *testing.T) {
 	}) {
 		t.Error("Transaction tracing result is different")
 	}
+	// The native prestate tracer reports the accounts of plain transfers too
+	tracer := "prestateTracer"
+	result, err = api.TraceTransaction(context.Background(), target, &TraceConfig{Tracer: &tracer})
+	if err != nil {
+		t.Fatalf("Failed to trace transaction %v", err)
+	}
+	var prestate map[common.Address]struct {
+		Balance string `json:"balance"`
+		Nonce   uint64 `json:"nonce"`
+	}
+	if err := json.Unmarshal(result.(json.RawMessage), &prestate); err != nil {
+		t.Fatalf("Failed to unmarshal prestate: %v", err)
+	}
+	for _, account := range accounts {
+		if prestate[account.addr].Balance != "0xde0b6b3a7640000" || prestate[account.addr].Nonce != 0 {
+			t.Errorf("Unexpected prestate of %x: %+v", account.addr, prestate[account.addr])
+		}
+	}
+}
+
+func TestStateDiff(t *testing.T) {
+	t.Parallel()
+
+	// Initialize test accounts
+	accounts := newAccounts(3)
+	genesis := &core.Genesis{Alloc: core.GenesisAlloc{
+		accounts[0].addr: {Balance: big.NewInt(params.Ether)},
+	}}
+	var (
+		hashes   []common.Hash
+		blockNum = rpc.BlockNumberOrHashWithNumber(1)
+		coinbase = accounts[2].addr
+		signer   = types.HomesteadSigner{}
+	)
+	backend := newTestBackend(t, 1, genesis, func(i int, b *core.BlockGen) {
+		// Two transfers from account[0] to account[1]
+		//    value: 1000 wei
+		//    fee:   21000 wei
+		b.SetCoinbase(coinbase)
+		for nonce := uint64(0); nonce < 2; nonce++ {
+			tx, _ := types.SignTx(types.NewTransaction(nonce, accounts[1].addr, big.NewInt(1000), params.TxGas, big.NewInt(1), nil), signer, accounts[0].key)
+			b.AddTx(tx)
+			hashes = append(hashes, tx.Hash())
+		}
+	})
+	api := NewAPI(backend)
+	balance := func(diff state.StateDiff, addr common.Address) (int64, int64) {
+		if diff[addr] == nil || diff[addr].Balance == nil {
+			t.Fatalf("No balance change for %x", addr)
+		}
+		return diff[addr].Balance.From.ToInt().Int64(), diff[addr].Balance.To.ToInt().Int64()
+	}
+	diff, err := api.StateDiff(context.Background(), rpc.BlockNumberOrHashWithHash(hashes[1], false))
+	if err != nil {
+		t.Fatalf("Failed to diff transaction: %v", err)
+	}
+	if len(diff) != 3 {
+		t.Errorf("Expected 3 changed accounts, got %v", len(diff))
+	}
+	if from, to := balance(diff, accounts[0].addr); from != params.Ether-22000 || to != params.Ether-44000 || diff[accounts[0].addr].Nonce.To != 2 {
+		t.Errorf("Unexpected sender diff %+v", diff[accounts[0].addr])
+	}
+	if from, to := balance(diff, coinbase); from != 21000 || to != 42000 {
+		t.Errorf("Unexpected coinbase balance change %v -> %v", from, to)
+	}
+	block, _ := backend.BlockByNumber(context.Background(), 1)
+	for _, target := range []rpc.BlockNumberOrHash{blockNum, rpc.BlockNumberOrHashWithHash(block.Hash(), false)} {
+		diff, err := api.StateDiff(context.Background(), target)
+		if err != nil {
+			t.Fatalf("Failed to diff block: %v", err)
+		}
+		if from, to := balance(diff, accounts[0].addr); from != params.Ether || to != params.Ether-44000 || diff[accounts[0].addr].Nonce.From != 0 || diff[accounts[0].addr].Nonce.To != 2 {
+			t.Errorf("Unexpected sender diff %+v", diff[accounts[0].addr])
+		}
+		if from, to := balance(diff, accounts[1].addr); from != 0 || to != 2000 {
+			t.Errorf("Unexpected recipient balance change %v -> %v", from, to)
+		}
+		// The coinbase earns the fees and the block reward
+		if to := diff[coinbase].Balance.To.ToInt(); to.Cmp(new(big.Int).Add(ethash.ConstantinopleBlockReward, big.NewInt(42000))) != 0 {
+			t.Errorf("Unexpected coinbase balance %v", to)
+		}
+	}
+	if _, err := api.StateDiff(context.Background(), rpc.BlockNumberOrHashWithNumber(0)); err == nil {
+		t.Errorf("Expected error diffing genesis")
+	}
+}
+
+func TestStateDiffDAOFork(t *testing.T) {
+	t.Parallel()
+
+	config := params.ChainConfig{
+		ChainID:        big.NewInt(1),
+		HomesteadBlock: big.NewInt(0),
+		DAOForkBlock:   big.NewInt(1),
+		DAOForkSupport: true,
+		Ethash:         new(params.EthashConfig),
+	}
+
+	// Account[0] sends 1000 wei to the refund contract in the fork block,
+	// after a drained account's balance was moved into it.
+	accounts := newAccounts(1)
+	drained := params.DAODrainList()[0]
+	genesis := &core.Genesis{Config: &config, Alloc: core.GenesisAlloc{
+		accounts[0].addr: {Balance: big.NewInt(params.Ether)},
+		drained:          {Balance: big.NewInt(5000)},
+	}}
+	backend := newTestBackend(t, 1, genesis, func(i int, b *core.BlockGen) {
+		tx, _ := types.SignTx(types.NewTransaction(0, params.DAORefundContract, big.NewInt(1000), params.TxGas, big.NewInt(1), nil), types.HomesteadSigner{}, accounts[0].key)
+		b.AddTx(tx)
+	})
+	api := NewAPI(backend)
+	diff, err := api.StateDiff(context.Background(), rpc.BlockNumberOrHashWithNumber(1))
+	if err != nil {
+		t.Fatalf("Failed to diff block: %v", err)
+	}
+	if d := diff[drained]; d == nil || d.Balance == nil || d.Balance.From.ToInt().Int64() != 5000 || d.Balance.To.ToInt().Sign() != 0 {
+		t.Errorf("Unexpected drained account diff %+v", d)
+	}
+	if d := diff[params.DAORefundContract]; d == nil || d.Balance == nil || d.Balance.From.ToInt().Sign() != 0 || d.Balance.To.ToInt().Int64() != 6000 {
+		t.Errorf("Unexpected refund contract diff %+v", d)
+	}
 }
 
 func TestTraceBlock(t *testing.T) {
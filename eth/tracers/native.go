@@ -0,0 +1,89 @@
+// Copyright 2021 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package tracers
+
+import (
+	"encoding/json"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/holiman/uint256"
+)
+
+// ResultTracer is a vm.Tracer that assembles a JSON result, such as the
+// JavaScript tracers and their native Go counterparts.
+type ResultTracer interface {
+	vm.Tracer
+
+	// GetResult returns the trace, or any error raised while tracing.
+	GetResult() (json.RawMessage, error)
+
+	// Stop terminates tracing at the first opportune moment, failing the
+	// result with err.
+	Stop(err error)
+}
+
+// nativeTracers are the built-in tracers implemented in Go, keyed by the same
+// names as their JavaScript versions. They produce the same results without
+// the overhead of the JavaScript engine.
+var nativeTracers = map[string]func(vm.TxContext) ResultTracer{
+	"callTracer":     newCallTracer,
+	"prestateTracer": newPrestateTracer,
+}
+
+// envTracer is implemented by tracers that need the EVM before execution
+// starts, so they can read the state even if the transaction runs no code.
+type envTracer interface {
+	setEnv(env *vm.EVM)
+}
+
+// NewTracer returns the native implementation of the named tracer if there
+// is one, or else a JavaScript tracer running code.
+func NewTracer(code string, txCtx vm.TxContext) (ResultTracer, error) {
+	if constructor, ok := nativeTracers[code]; ok {
+		return constructor(txCtx), nil
+	}
+	return New(code, txCtx)
+}
+
+// peekStack returns the nth item from the top of the stack, or zero if the
+// stack isn't that deep, matching the JavaScript tracers' log.stack.peek.
+func peekStack(stack *vm.Stack, n int) *uint256.Int {
+	if len(stack.Data()) <= n {
+		return new(uint256.Int)
+	}
+	return stack.Back(n)
+}
+
+// memorySlice returns a copy of size bytes of memory from offset, or nothing
+// if that is out of bounds, matching the JavaScript tracers' log.memory.slice.
+func memorySlice(memory *vm.Memory, offset, size *uint256.Int) []byte {
+	if size.IsZero() || !offset.IsUint64() || !size.IsUint64() {
+		return nil
+	}
+	begin, end := offset.Uint64(), offset.Uint64()+size.Uint64()
+	if end < begin || end > uint64(memory.Len()) {
+		return nil
+	}
+	return memory.GetCopy(int64(begin), int64(end-begin))
+}
+
+// addressHex formats an address the way the JavaScript tracers' toHex does.
+func addressHex(addr common.Address) string {
+	return hexutil.Encode(addr.Bytes())
+}
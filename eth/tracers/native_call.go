@@ -0,0 +1,313 @@
+// Copyright 2021 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package tracers
+
+import (
+	"encoding/json"
+	"math/big"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/holiman/uint256"
+)
+
+// callFrame is a call in the callTracer's result. Fields are in the order
+// call_tracer.js's finalize gives them.
+type callFrame struct {
+	Type    string       `json:"type"`
+	From    string       `json:"from"`
+	To      string       `json:"to,omitempty"`
+	Value   string       `json:"value,omitempty"`
+	Gas     string       `json:"gas,omitempty"`
+	GasUsed string       `json:"gasUsed,omitempty"`
+	Input   string       `json:"input,omitempty"`
+	Output  string       `json:"output,omitempty"`
+	Error   string       `json:"error,omitempty"`
+	Time    string       `json:"time,omitempty"`
+	Calls   []*callFrame `json:"calls,omitempty"`
+
+	// Bookkeeping while the call is in progress
+	gasIn   uint64
+	gasCost uint64
+	gas     uint64
+	hasGas  bool
+	outOff  *uint256.Int
+	outLen  *uint256.Int
+}
+
+// finish formats the gas given to the call once it is complete.
+func (f *callFrame) finish() {
+	if f.hasGas {
+		f.Gas = hexUint(f.gas)
+	}
+}
+
+// hexUint formats a quantity the way call_tracer.js's bigInt(n).toString(16)
+// does.
+func hexUint(n uint64) string {
+	return "0x" + strconv.FormatUint(n, 16)
+}
+
+// hexInt is hexUint for gas usage computed from several gas readings, which
+// the JavaScript tracer formats as 0x-n if it comes out negative.
+func hexInt(n int64) string {
+	return "0x" + strconv.FormatInt(n, 16)
+}
+
+func hexBig(n *big.Int) string {
+	if n == nil {
+		return "0x0"
+	}
+	return "0x" + n.Text(16)
+}
+
+// callTracer is a native port of call_tracer.js, reporting the calls a
+// transaction makes as a tree.
+type callTracer struct {
+	callstack []*callFrame
+	// descended is set when execution has just entered a call, so its true gas
+	// allowance can be read from its first step.
+	descended bool
+
+	// Context of the outermost call
+	create  bool
+	from    common.Address
+	to      common.Address
+	input   []byte
+	gas     uint64
+	value   *big.Int
+	output  []byte
+	gasUsed uint64
+	time    time.Duration
+	ctxErr  error
+
+	interrupt uint32 // Atomic flag to signal execution interruption
+	reason    error  // Textual reason for the interruption
+	err       error  // Error, if one has occurred
+}
+
+func newCallTracer(txCtx vm.TxContext) ResultTracer {
+	return &callTracer{callstack: []*callFrame{{}}}
+}
+
+// CaptureStart implements the Tracer interface to initialize the tracing operation.
+func (t *callTracer) CaptureStart(from common.Address, to common.Address, create bool, input []byte, gas uint64, value *big.Int) error {
+	t.create, t.from, t.to, t.input, t.gas, t.value = create, from, to, input, gas, value
+	return nil
+}
+
+// CaptureState implements the Tracer interface to trace a single step of VM execution.
+func (t *callTracer) CaptureState(env *vm.EVM, pc uint64, op vm.OpCode, gas, cost uint64, memory *vm.Memory, stack *vm.Stack, rdata []byte, contract *vm.Contract, depth int, err error) error {
+	if t.err != nil {
+		return nil
+	}
+	// If tracing was interrupted, set the error and stop
+	if atomic.LoadUint32(&t.interrupt) > 0 {
+		t.err = t.reason
+		return nil
+	}
+	// Capture any errors immediately
+	if err != nil {
+		t.fault(err)
+		return nil
+	}
+	switch op {
+	case vm.CREATE, vm.CREATE2:
+		// If a new contract is being created, add to the call stack
+		t.callstack = append(t.callstack, &callFrame{
+			Type:    op.String(),
+			From:    addressHex(contract.Address()),
+			Input:   hexutil.Encode(memorySlice(memory, peekStack(stack, 1), peekStack(stack, 2))),
+			gasIn:   gas,
+			gasCost: cost,
+			Value:   hexBig(peekStack(stack, 0).ToBig()),
+		})
+		t.descended = true
+		return nil
+
+	case vm.SELFDESTRUCT:
+		// If a contract is being self destructed, gather that as a subcall too
+		parent := t.callstack[len(t.callstack)-1]
+		parent.Calls = append(parent.Calls, &callFrame{
+			Type:    op.String(),
+			From:    addressHex(contract.Address()),
+			To:      addressHex(common.Address(peekStack(stack, 0).Bytes20())),
+			gasIn:   gas,
+			gasCost: cost,
+			Value:   hexBig(env.StateDB.GetBalance(contract.Address())),
+		})
+		return nil
+
+	case vm.CALL, vm.CALLCODE, vm.DELEGATECALL, vm.STATICCALL:
+		// Skip any pre-compile invocations, those are just fancy opcodes
+		to := common.Address(peekStack(stack, 1).Bytes20())
+		if _, ok := vm.PrecompiledContractsIstanbul[to]; ok {
+			return nil
+		}
+		off := 1
+		if op == vm.DELEGATECALL || op == vm.STATICCALL {
+			off = 0
+		}
+		call := &callFrame{
+			Type:    op.String(),
+			From:    addressHex(contract.Address()),
+			To:      addressHex(to),
+			Input:   hexutil.Encode(memorySlice(memory, peekStack(stack, 2+off), peekStack(stack, 3+off))),
+			gasIn:   gas,
+			gasCost: cost,
+			outOff:  new(uint256.Int).Set(peekStack(stack, 4+off)),
+			outLen:  new(uint256.Int).Set(peekStack(stack, 5+off)),
+		}
+		if off == 1 {
+			call.Value = hexBig(peekStack(stack, 2).ToBig())
+		}
+		t.callstack = append(t.callstack, call)
+		t.descended = true
+		return nil
+	}
+	// If we've just descended into an inner call, retrieve its true allowance.
+	// We need to extract it from within the call as there may be funky gas
+	// dynamics with regard to requested and actually given gas (2300 stipend,
+	// 63/64 rule). Calls to plain accounts run no steps, so their gas is
+	// skipped.
+	if t.descended {
+		if depth >= len(t.callstack) {
+			call := t.callstack[len(t.callstack)-1]
+			call.gas, call.hasGas = gas, true
+		}
+		t.descended = false
+	}
+	// If an existing call is returning, pop off the call stack
+	if op == vm.REVERT {
+		t.callstack[len(t.callstack)-1].Error = "execution reverted"
+		return nil
+	}
+	if depth != len(t.callstack)-1 {
+		return nil
+	}
+	call := t.callstack[len(t.callstack)-1]
+	t.callstack = t.callstack[:len(t.callstack)-1]
+
+	ret := peekStack(stack, 0)
+	if call.Type == vm.CREATE.String() || call.Type == vm.CREATE2.String() {
+		// If the call was a CREATE, retrieve the contract address and output code
+		call.GasUsed = hexInt(int64(call.gasIn - call.gasCost - gas))
+		if !ret.IsZero() {
+			addr := common.Address(ret.Bytes20())
+			call.To = addressHex(addr)
+			call.Output = hexutil.Encode(env.StateDB.GetCode(addr))
+		} else if call.Error == "" {
+			call.Error = "internal failure" // TODO(karalabe): surface these faults somehow
+		}
+	} else {
+		// If the call was a contract call, retrieve the gas usage and output
+		if call.hasGas {
+			call.GasUsed = hexInt(int64(call.gasIn - call.gasCost + call.gas - gas))
+		}
+		if !ret.IsZero() {
+			call.Output = hexutil.Encode(memorySlice(memory, call.outOff, call.outLen))
+		} else if call.Error == "" {
+			call.Error = "internal failure" // TODO(karalabe): surface these faults somehow
+		}
+	}
+	call.finish()
+
+	// Inject the call into the previous one
+	parent := t.callstack[len(t.callstack)-1]
+	parent.Calls = append(parent.Calls, call)
+	return nil
+}
+
+// CaptureFault implements the Tracer interface to trace an execution fault
+// while running an opcode.
+func (t *callTracer) CaptureFault(env *vm.EVM, pc uint64, op vm.OpCode, gas, cost uint64, memory *vm.Memory, stack *vm.Stack, contract *vm.Contract, depth int, err error) error {
+	if t.err == nil {
+		t.fault(err)
+	}
+	return nil
+}
+
+// fault handles the failure of the current call.
+func (t *callTracer) fault(err error) {
+	// If the topmost call already reverted, don't handle the additional fault again
+	if t.callstack[len(t.callstack)-1].Error != "" {
+		return
+	}
+	// Pop off the just failed call, consuming all available gas
+	call := t.callstack[len(t.callstack)-1]
+	t.callstack = t.callstack[:len(t.callstack)-1]
+	call.Error = err.Error()
+	call.finish()
+	if call.hasGas {
+		call.GasUsed = call.Gas
+	}
+	// Flatten the failed call into its parent
+	if len(t.callstack) > 0 {
+		parent := t.callstack[len(t.callstack)-1]
+		parent.Calls = append(parent.Calls, call)
+		return
+	}
+	// Last call failed too, leave it in the stack
+	t.callstack = append(t.callstack, call)
+}
+
+// CaptureEnd is called after the call finishes to finalize the tracing.
+func (t *callTracer) CaptureEnd(output []byte, gasUsed uint64, d time.Duration, err error) error {
+	t.output, t.gasUsed, t.time, t.ctxErr = output, gasUsed, d, err
+	return nil
+}
+
+// GetResult returns the call tree of the traced transaction.
+func (t *callTracer) GetResult() (json.RawMessage, error) {
+	if t.err != nil {
+		return nil, t.err
+	}
+	result := &callFrame{
+		Type:    "CALL",
+		From:    addressHex(t.from),
+		To:      addressHex(t.to),
+		Value:   hexBig(t.value),
+		Gas:     hexUint(t.gas),
+		GasUsed: hexUint(t.gasUsed),
+		Input:   hexutil.Encode(t.input),
+		Output:  hexutil.Encode(t.output),
+		Time:    t.time.String(),
+		Calls:   t.callstack[0].Calls,
+	}
+	if t.create {
+		result.Type = "CREATE"
+	}
+	if t.callstack[0].Error != "" {
+		result.Error = t.callstack[0].Error
+	} else if t.ctxErr != nil {
+		result.Error = t.ctxErr.Error()
+	}
+	if result.Error != "" && (result.Error != "execution reverted" || result.Output == "0x") {
+		result.Output = ""
+	}
+	return json.Marshal(result)
+}
+
+// Stop terminates execution of the tracer at the first opportune moment.
+func (t *callTracer) Stop(err error) {
+	t.reason = err
+	atomic.StoreUint32(&t.interrupt, 1)
+}
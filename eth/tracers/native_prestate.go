@@ -0,0 +1,207 @@
+// Copyright 2021 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package tracers
+
+import (
+	"encoding/json"
+	"errors"
+	"math/big"
+	"sync/atomic"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// prestateAccount is an account in the prestateTracer's result.
+type prestateAccount struct {
+	Balance string                      `json:"balance"`
+	Nonce   uint64                      `json:"nonce"`
+	Code    string                      `json:"code"`
+	Storage map[common.Hash]common.Hash `json:"storage"`
+
+	balance *big.Int
+}
+
+// prestateTracer is a native port of prestate_tracer.js, reporting the state
+// of the accounts and storage slots a transaction touches before it ran, in
+// the format of a genesis allocation.
+//
+// Unlike the JavaScript tracer, it also works for transactions that run no
+// code, when it is given the EVM before execution starts.
+type prestateTracer struct {
+	env      *vm.EVM
+	prestate map[common.Address]*prestateAccount
+
+	// Context of the outermost call
+	gasPrice *big.Int
+	create   bool
+	from     common.Address
+	to       common.Address
+	input    []byte
+	value    *big.Int
+	gasUsed  uint64
+
+	interrupt uint32 // Atomic flag to signal execution interruption
+	reason    error  // Textual reason for the interruption
+	err       error  // Error, if one has occurred
+}
+
+func newPrestateTracer(txCtx vm.TxContext) ResultTracer {
+	gasPrice := txCtx.GasPrice
+	if gasPrice == nil {
+		gasPrice = new(big.Int)
+	}
+	return &prestateTracer{gasPrice: gasPrice}
+}
+
+func (t *prestateTracer) setEnv(env *vm.EVM) {
+	t.env = env
+}
+
+// lookupAccount injects the specified account into the prestate.
+func (t *prestateTracer) lookupAccount(addr common.Address) {
+	if t.prestate == nil {
+		t.prestate = make(map[common.Address]*prestateAccount)
+	}
+	if _, ok := t.prestate[addr]; ok {
+		return
+	}
+	db := t.env.StateDB
+	t.prestate[addr] = &prestateAccount{
+		balance: new(big.Int).Set(db.GetBalance(addr)),
+		Nonce:   db.GetNonce(addr),
+		Code:    hexutil.Encode(db.GetCode(addr)),
+		Storage: make(map[common.Hash]common.Hash),
+	}
+}
+
+// lookupStorage injects the specified storage entry of the given account into
+// the prestate.
+func (t *prestateTracer) lookupStorage(addr common.Address, key common.Hash) {
+	t.lookupAccount(addr)
+	if _, ok := t.prestate[addr].Storage[key]; !ok {
+		t.prestate[addr].Storage[key] = t.env.StateDB.GetState(addr, key)
+	}
+}
+
+// CaptureStart implements the Tracer interface to initialize the tracing operation.
+func (t *prestateTracer) CaptureStart(from common.Address, to common.Address, create bool, input []byte, gas uint64, value *big.Int) error {
+	t.create, t.from, t.to, t.input, t.value = create, from, to, input, value
+	return nil
+}
+
+// CaptureState implements the Tracer interface to trace a single step of VM execution.
+func (t *prestateTracer) CaptureState(env *vm.EVM, pc uint64, op vm.OpCode, gas, cost uint64, memory *vm.Memory, stack *vm.Stack, rdata []byte, contract *vm.Contract, depth int, err error) error {
+	if t.err != nil {
+		return nil
+	}
+	// If tracing was interrupted, set the error and stop
+	if atomic.LoadUint32(&t.interrupt) > 0 {
+		t.err = t.reason
+		return nil
+	}
+	// Add the current account if we just started tracing. Balance will
+	// potentially be wrong here, since this will include the value sent along
+	// with the message. We fix that in GetResult.
+	if t.prestate == nil {
+		t.env = env
+		t.lookupAccount(contract.Address())
+	}
+	// Whenever new state is accessed, add it to the prestate
+	switch op {
+	case vm.EXTCODECOPY, vm.EXTCODESIZE, vm.BALANCE:
+		t.lookupAccount(common.Address(peekStack(stack, 0).Bytes20()))
+	case vm.CREATE:
+		from := contract.Address()
+		t.lookupAccount(crypto.CreateAddress(from, env.StateDB.GetNonce(from)))
+	case vm.CREATE2:
+		// stack: salt, size, offset, endowment
+		code := memorySlice(memory, peekStack(stack, 1), peekStack(stack, 2))
+		salt := common.Hash(peekStack(stack, 3).Bytes32())
+		t.lookupAccount(crypto.CreateAddress2(contract.Address(), salt, crypto.Keccak256(code)))
+	case vm.CALL, vm.CALLCODE, vm.DELEGATECALL, vm.STATICCALL:
+		t.lookupAccount(common.Address(peekStack(stack, 1).Bytes20()))
+	case vm.SSTORE, vm.SLOAD:
+		t.lookupStorage(contract.Address(), common.Hash(peekStack(stack, 0).Bytes32()))
+	}
+	return nil
+}
+
+// CaptureFault implements the Tracer interface to trace an execution fault
+// while running an opcode.
+func (t *prestateTracer) CaptureFault(env *vm.EVM, pc uint64, op vm.OpCode, gas, cost uint64, memory *vm.Memory, stack *vm.Stack, contract *vm.Contract, depth int, err error) error {
+	return nil
+}
+
+// CaptureEnd is called after the call finishes to finalize the tracing.
+func (t *prestateTracer) CaptureEnd(output []byte, gasUsed uint64, d time.Duration, err error) error {
+	t.gasUsed = gasUsed
+	return nil
+}
+
+// GetResult returns the prestate of the accounts the traced transaction
+// touched.
+func (t *prestateTracer) GetResult() (json.RawMessage, error) {
+	if t.err != nil {
+		return nil, t.err
+	}
+	if t.env == nil {
+		return nil, errors.New("prestate tracer has no state to read")
+	}
+	// At this point, we need to deduct the 'value' from the outer transaction,
+	// and move it back to the origin
+	t.lookupAccount(t.from)
+	t.lookupAccount(t.to)
+
+	rules := t.env.ChainConfig().Rules(t.env.Context.BlockNumber)
+	intrinsicGas, err := core.IntrinsicGas(t.input, nil, t.create, rules.IsHomestead, rules.IsIstanbul)
+	if err != nil {
+		return nil, err
+	}
+	value := t.value
+	if value == nil {
+		value = new(big.Int)
+	}
+	to, from := t.prestate[t.to], t.prestate[t.from]
+	toBal, fromBal := new(big.Int).Set(to.balance), new(big.Int).Set(from.balance)
+	fee := new(big.Int).Mul(new(big.Int).SetUint64(t.gasUsed+intrinsicGas), t.gasPrice)
+	to.balance = toBal.Sub(toBal, value)
+	from.balance = fromBal.Add(fromBal, value).Add(fromBal, fee)
+
+	// Decrement the caller's nonce, and remove empty create targets
+	from.Nonce--
+	if t.create {
+		// We can blindly delete the contract prestate, as any existing state
+		// would have caused the transaction to be rejected as invalid in the
+		// first place.
+		delete(t.prestate, t.to)
+	}
+	for _, account := range t.prestate {
+		account.Balance = hexBig(account.balance)
+	}
+	return json.Marshal(t.prestate)
+}
+
+// Stop terminates execution of the tracer at the first opportune moment.
+func (t *prestateTracer) Stop(err error) {
+	t.reason = err
+	atomic.StoreUint32(&t.interrupt, 1)
+}
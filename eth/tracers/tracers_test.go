@@ -17,6 +17,7 @@
 package tracers
 
 import (
+	"bytes"
 	"crypto/ecdsa"
 	"crypto/rand"
 	"encoding/json"
@@ -24,6 +25,7 @@ import (
 	"math/big"
 	"path/filepath"
 	"reflect"
+	"regexp"
 	"strings"
 	"testing"
 
@@ -170,14 +172,83 @@ func TestPrestateTracerCreate2(t *testing.T) {
 		Code:    []byte{},
 		Balance: big.NewInt(500000000000000),
 	}
-	_, statedb := tests.MakePreState(rawdb.NewMemoryDatabase(), alloc, false)
+	// Run it with both the JavaScript and the native tracer
+	newJSTracer := func(code string, txCtx vm.TxContext) (ResultTracer, error) {
+		return New(code, txCtx)
+	}
+	for _, newTracer := range []func(string, vm.TxContext) (ResultTracer, error){newJSTracer, NewTracer} {
+		_, statedb := tests.MakePreState(rawdb.NewMemoryDatabase(), alloc, false)
+
+		// Create the tracer, the EVM environment and run it
+		tracer, err := newTracer("prestateTracer", txContext)
+		if err != nil {
+			t.Fatalf("failed to create call tracer: %v", err)
+		}
+		evm := vm.NewEVM(context, txContext, statedb, params.MainnetChainConfig, vm.Config{Debug: true, Tracer: tracer})
+
+		msg, err := tx.AsMessage(signer)
+		if err != nil {
+			t.Fatalf("failed to prepare transaction for tracing: %v", err)
+		}
+		st := core.NewStateTransition(evm, msg, new(core.GasPool).AddGas(tx.Gas()))
+		if _, err = st.TransitionDb(); err != nil {
+			t.Fatalf("failed to execute transaction: %v", err)
+		}
+		// Retrieve the trace result and compare against the etalon
+		res, err := tracer.GetResult()
+		if err != nil {
+			t.Fatalf("failed to retrieve trace result: %v", err)
+		}
+		ret := make(map[string]interface{})
+		if err := json.Unmarshal(res, &ret); err != nil {
+			t.Fatalf("failed to unmarshal trace result: %v", err)
+		}
+		if _, has := ret["0x60f3f640a8508fc6a86d45df051962668e1e8ac7"]; !has {
+			t.Fatalf("Expected 0x60f3f640a8508fc6a86d45df051962668e1e8ac7 in %T result", tracer)
+		}
+	}
+}
+
+// runCallTracerTest executes the transaction of a call tracer test dataset
+// with the given tracer and returns the trace.
+func runCallTracerTest(t *testing.T, file string, newTracer func(vm.TxContext) (ResultTracer, error)) (*callTracerTest, json.RawMessage) {
+	// Call tracer test found, read if from disk
+	blob, err := ioutil.ReadFile(filepath.Join("testdata", file))
+	if err != nil {
+		t.Fatalf("failed to read testcase: %v", err)
+	}
+	test := new(callTracerTest)
+	if err := json.Unmarshal(blob, test); err != nil {
+		t.Fatalf("failed to parse testcase: %v", err)
+	}
+	// Configure a blockchain with the given prestate
+	tx := new(types.Transaction)
+	if err := rlp.DecodeBytes(common.FromHex(test.Input), tx); err != nil {
+		t.Fatalf("failed to parse testcase input: %v", err)
+	}
+	signer := types.MakeSigner(test.Genesis.Config, new(big.Int).SetUint64(uint64(test.Context.Number)))
+	origin, _ := signer.Sender(tx)
+	txContext := vm.TxContext{
+		Origin:   origin,
+		GasPrice: tx.GasPrice(),
+	}
+	context := vm.BlockContext{
+		CanTransfer: core.CanTransfer,
+		Transfer:    core.Transfer,
+		Coinbase:    test.Context.Miner,
+		BlockNumber: new(big.Int).SetUint64(uint64(test.Context.Number)),
+		Time:        new(big.Int).SetUint64(uint64(test.Context.Time)),
+		Difficulty:  (*big.Int)(test.Context.Difficulty),
+		GasLimit:    uint64(test.Context.GasLimit),
+	}
+	_, statedb := tests.MakePreState(rawdb.NewMemoryDatabase(), test.Genesis.Alloc, false)
 
 	// Create the tracer, the EVM environment and run it
-	tracer, err := New("prestateTracer", txContext)
+	tracer, err := newTracer(txContext)
 	if err != nil {
 		t.Fatalf("failed to create call tracer: %v", err)
 	}
-	evm := vm.NewEVM(context, txContext, statedb, params.MainnetChainConfig, vm.Config{Debug: true, Tracer: tracer})
+	evm := vm.NewEVM(context, txContext, statedb, test.Genesis.Config, vm.Config{Debug: true, Tracer: tracer})
 
 	msg, err := tx.AsMessage(signer)
 	if err != nil {
@@ -187,23 +258,17 @@ func TestPrestateTracerCreate2(t *testing.T) {
 	if _, err = st.TransitionDb(); err != nil {
 		t.Fatalf("failed to execute transaction: %v", err)
 	}
-	// Retrieve the trace result and compare against the etalon
+	// Retrieve the trace result
 	res, err := tracer.GetResult()
 	if err != nil {
 		t.Fatalf("failed to retrieve trace result: %v", err)
 	}
-	ret := make(map[string]interface{})
-	if err := json.Unmarshal(res, &ret); err != nil {
-		t.Fatalf("failed to unmarshal trace result: %v", err)
-	}
-	if _, has := ret["0x60f3f640a8508fc6a86d45df051962668e1e8ac7"]; !has {
-		t.Fatalf("Expected 0x60f3f640a8508fc6a86d45df051962668e1e8ac7 in result")
-	}
+	return test, res
 }
 
-// Iterates over all the input-output datasets in the tracer test harness and
-// runs the JavaScript tracers against them.
-func TestCallTracer(t *testing.T) {
+// testCallTracer iterates over all the input-output datasets in the tracer
+// test harness and runs the given call tracer against them.
+func testCallTracer(t *testing.T, newTracer func(vm.TxContext) (ResultTracer, error)) {
 	files, err := ioutil.ReadDir("testdata")
 	if err != nil {
 		t.Fatalf("failed to retrieve tracer test suite: %v", err)
@@ -216,62 +281,12 @@ func TestCallTracer(t *testing.T) {
 		t.Run(camel(strings.TrimSuffix(strings.TrimPrefix(file.Name(), "call_tracer_"), ".json")), func(t *testing.T) {
 			t.Parallel()
 
-			// Call tracer test found, read if from disk
-			blob, err := ioutil.ReadFile(filepath.Join("testdata", file.Name()))
-			if err != nil {
-				t.Fatalf("failed to read testcase: %v", err)
-			}
-			test := new(callTracerTest)
-			if err := json.Unmarshal(blob, test); err != nil {
-				t.Fatalf("failed to parse testcase: %v", err)
-			}
-			// Configure a blockchain with the given prestate
-			tx := new(types.Transaction)
-			if err := rlp.DecodeBytes(common.FromHex(test.Input), tx); err != nil {
-				t.Fatalf("failed to parse testcase input: %v", err)
-			}
-			signer := types.MakeSigner(test.Genesis.Config, new(big.Int).SetUint64(uint64(test.Context.Number)))
-			origin, _ := signer.Sender(tx)
-			txContext := vm.TxContext{
-				Origin:   origin,
-				GasPrice: tx.GasPrice(),
-			}
-			context := vm.BlockContext{
-				CanTransfer: core.CanTransfer,
-				Transfer:    core.Transfer,
-				Coinbase:    test.Context.Miner,
-				BlockNumber: new(big.Int).SetUint64(uint64(test.Context.Number)),
-				Time:        new(big.Int).SetUint64(uint64(test.Context.Time)),
-				Difficulty:  (*big.Int)(test.Context.Difficulty),
-				GasLimit:    uint64(test.Context.GasLimit),
-			}
-			_, statedb := tests.MakePreState(rawdb.NewMemoryDatabase(), test.Genesis.Alloc, false)
-
-			// Create the tracer, the EVM environment and run it
-			tracer, err := New("callTracer", txContext)
-			if err != nil {
-				t.Fatalf("failed to create call tracer: %v", err)
-			}
-			evm := vm.NewEVM(context, txContext, statedb, test.Genesis.Config, vm.Config{Debug: true, Tracer: tracer})
-
-			msg, err := tx.AsMessage(signer)
-			if err != nil {
-				t.Fatalf("failed to prepare transaction for tracing: %v", err)
-			}
-			st := core.NewStateTransition(evm, msg, new(core.GasPool).AddGas(tx.Gas()))
-			if _, err = st.TransitionDb(); err != nil {
-				t.Fatalf("failed to execute transaction: %v", err)
-			}
-			// Retrieve the trace result and compare against the etalon
-			res, err := tracer.GetResult()
-			if err != nil {
-				t.Fatalf("failed to retrieve trace result: %v", err)
-			}
+			test, res := runCallTracerTest(t, file.Name(), newTracer)
 			ret := new(callTrace)
 			if err := json.Unmarshal(res, ret); err != nil {
 				t.Fatalf("failed to unmarshal trace result: %v", err)
 			}
-
+			// Compare against the etalon
 			if !jsonEqual(ret, test.Result) {
 				// uncomment this for easier debugging
 				//have, _ := json.MarshalIndent(ret, "", " ")
@@ -283,6 +298,71 @@ func TestCallTracer(t *testing.T) {
 	}
 }
 
+// Iterates over all the input-output datasets in the tracer test harness and
+// runs the JavaScript tracers against them.
+func TestCallTracer(t *testing.T) {
+	testCallTracer(t, func(txCtx vm.TxContext) (ResultTracer, error) {
+		return New("callTracer", txCtx)
+	})
+}
+
+// Runs the native call tracer against the same datasets.
+func TestNativeCallTracer(t *testing.T) {
+	testCallTracer(t, func(txCtx vm.TxContext) (ResultTracer, error) {
+		tracer, err := NewTracer("callTracer", txCtx)
+		if _, ok := tracer.(*callTracer); !ok {
+			t.Fatalf("expected native call tracer, got %T", tracer)
+		}
+		return tracer, err
+	})
+}
+
+// timeField matches the execution time in a call trace, which differs between
+// runs.
+var timeField = regexp.MustCompile(`"time":"[^"]*"`)
+
+// Tests that the native tracers produce the same JSON as the JavaScript ones,
+// down to the order of the fields.
+func TestNativeTracersMatchJavaScript(t *testing.T) {
+	files, err := ioutil.ReadDir("testdata")
+	if err != nil {
+		t.Fatalf("failed to retrieve tracer test suite: %v", err)
+	}
+	for _, file := range files {
+		if !strings.HasPrefix(file.Name(), "call_tracer_") {
+			continue
+		}
+		for _, name := range []string{"callTracer", "prestateTracer"} {
+			name := name
+			_, want := runCallTracerTest(t, file.Name(), func(txCtx vm.TxContext) (ResultTracer, error) {
+				return New(name, txCtx)
+			})
+			_, have := runCallTracerTest(t, file.Name(), func(txCtx vm.TxContext) (ResultTracer, error) {
+				return NewTracer(name, txCtx)
+			})
+			if name == "prestateTracer" {
+				// Accounts are listed in a different order, so compare the values
+				var wantAlloc, haveAlloc map[string]interface{}
+				if err := json.Unmarshal(want, &wantAlloc); err != nil {
+					t.Fatalf("%v %v: failed to unmarshal trace result: %v", file.Name(), name, err)
+				}
+				if err := json.Unmarshal(have, &haveAlloc); err != nil {
+					t.Fatalf("%v %v: failed to unmarshal trace result: %v", file.Name(), name, err)
+				}
+				if !reflect.DeepEqual(haveAlloc, wantAlloc) {
+					t.Errorf("%v %v: trace mismatch: \nhave %s\nwant %s", file.Name(), name, have, want)
+				}
+				continue
+			}
+			want = timeField.ReplaceAll(want, nil)
+			have = timeField.ReplaceAll(have, nil)
+			if !bytes.Equal(have, want) {
+				t.Errorf("%v %v: trace mismatch: \nhave %s\nwant %s", file.Name(), name, have, want)
+			}
+		}
+	}
+}
+
 // jsonEqual is similar to reflect.DeepEqual, but does a 'bounce' via json prior to
 // comparison
 func jsonEqual(x, y interface{}) bool {
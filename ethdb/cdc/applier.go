@@ -0,0 +1,120 @@
+package cdc
+
+import (
+  "time"
+  "github.com/ethereum/go-ethereum/ethdb"
+  "github.com/ethereum/go-ethereum/metrics"
+)
+
+const (
+  // ApplyCommitInterval is how often a BatchApplier working through a backlog
+  // commits at block boundaries. Operations emitted more recently than this
+  // are committed at every boundary, so a replica that is caught up makes each
+  // block visible as soon as it is applied.
+  ApplyCommitInterval = time.Second
+  // applyBatchSize is the size at which a BatchApplier commits, regardless of
+  // block boundaries.
+  applyBatchSize = 64 * ethdb.IdealBatchSize
+)
+
+var (
+  applyCommitMeter = metrics.NewRegisteredMeter("cdc/apply/commits", nil)
+  applyCommitTimer = metrics.NewRegisteredTimer("cdc/apply/commit", nil)
+)
+
+// BatchApplier applies consecutive operations to a single batch, which is
+// written along with the offset of the last operation in it. A crash never
+// leaves the database holding operations past its recorded offset, and
+// replicas catching up on a backlog of operations write far less often.
+//
+// Operations from partitioned topics are committed at barriers, where the
+// offsets of every partition are recorded.
+type BatchApplier struct {
+  db ethdb.Database
+  batch ethdb.Batch
+  // last is the last operation written to batch, and head the latest head
+  // block it holds.
+  last *Operation
+  head []byte
+  lastCommit time.Time
+}
+
+func NewBatchApplier(db ethdb.Database) *BatchApplier {
+  return &BatchApplier{db: db, batch: db.NewBatch(), lastCommit: time.Now()}
+}
+
+// Apply adds op to the batch, and returns the head block hash once a batch
+// that writes one has been committed. Until then, nothing op writes is
+// visible in the database.
+func (a *BatchApplier) Apply(op *Operation) ([]byte, error) {
+  if op.Err != nil {
+    return nil, op.Err
+  }
+  defer op.track()()
+  if !op.batchable() {
+    // Ancient operations can't be batched, so commit everything ahead of them
+    // first.
+    head, err := a.Flush()
+    if err != nil { return nil, err }
+    return head, op.applyAncient(a.db)
+  }
+  head, err := op.applyTo(a.batch)
+  if err != nil { return nil, err }
+  a.last = op
+  if head != nil {
+    a.head = head
+  }
+  switch {
+  case op.Partitioned:
+    if op.Barrier == 0 {
+      return nil, nil
+    }
+  case op.boundary(head):
+    if a.behind(op) && time.Since(a.lastCommit) < ApplyCommitInterval && a.batch.ValueSize() < applyBatchSize {
+      return nil, nil
+    }
+  case a.batch.ValueSize() < applyBatchSize:
+    return nil, nil
+  }
+  return a.commit()
+}
+
+// behind indicates whether op is part of a backlog, rather than one the
+// master emitted moments ago.
+func (a *BatchApplier) behind(op *Operation) bool {
+  return !op.Timestamp.IsZero() && time.Since(op.Timestamp) > ApplyCommitInterval
+}
+
+// Pending indicates whether the batch holds operations that will be written
+// by Flush.
+func (a *BatchApplier) Pending() bool {
+  return a.last != nil && !a.last.Partitioned
+}
+
+// Flush commits the operations in the batch, returning the head block hash it
+// wrote, if any. Operations from partitioned topics are discarded rather than
+// written without their offsets, as the consumer will deliver them again.
+func (a *BatchApplier) Flush() ([]byte, error) {
+  if a.last == nil {
+    return nil, nil
+  }
+  if a.last.Partitioned {
+    a.batch.Reset()
+    a.last, a.head = nil, nil
+    return nil, nil
+  }
+  return a.commit()
+}
+
+func (a *BatchApplier) commit() ([]byte, error) {
+  start := time.Now()
+  if err := updateOffset(a.batch, a.last); err != nil { return nil, err }
+  if err := a.batch.Write(); err != nil { return nil, err }
+  head := a.head
+  a.batch.Reset()
+  a.last, a.head = nil, nil
+  a.lastCommit = time.Now()
+  applyCommitMeter.Mark(1)
+  applyCommitTimer.UpdateSince(start)
+  return head, nil
+}
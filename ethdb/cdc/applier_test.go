@@ -0,0 +1,94 @@
+package cdc_test
+
+import (
+  "testing"
+  "time"
+  "github.com/ethereum/go-ethereum/core/rawdb"
+  "github.com/ethereum/go-ethereum/ethdb/cdc"
+)
+
+func TestBatchApplierBacklog(t *testing.T) {
+  db := rawdb.NewMemoryDatabase()
+  applier := cdc.NewBatchApplier(db)
+  emitted := time.Now().Add(-time.Minute)
+  put, _ := cdc.PutOperation([]byte("key"), []byte("value"))
+  put.Topic, put.Offset, put.Timestamp = "test", 5, emitted
+  head, _ := cdc.PutOperation([]byte("LastBlock"), []byte("backlog-head"))
+  head.Topic, head.Offset, head.Timestamp = "test", 6, emitted
+  for _, op := range []*cdc.Operation{put, head} {
+    if written, err := applier.Apply(op); err != nil || written != nil {
+      t.Fatalf("Expected old operations to be held, got %q (%v)", written, err)
+    }
+  }
+  if ok, _ := db.Has([]byte("key")); ok {
+    t.Errorf("Operation visible before its batch was committed")
+  }
+  if !applier.Pending() {
+    t.Errorf("Expected pending operations")
+  }
+  written, err := applier.Flush()
+  if err != nil { t.Fatalf(err.Error()) }
+  if string(written) != "backlog-head" {
+    t.Errorf("Unexpected head %q", written)
+  }
+  if value, _ := db.Get([]byte("key")); string(value) != "value" {
+    t.Errorf("Missing committed value")
+  }
+  if offset, _, err := cdc.ReadOffset(db, "test"); err != nil || offset != 6 {
+    t.Errorf("Expected offset 6, got %v (%v)", offset, err)
+  }
+}
+
+func TestBatchApplierCurrent(t *testing.T) {
+  db := rawdb.NewMemoryDatabase()
+  applier := cdc.NewBatchApplier(db)
+  put, _ := cdc.PutOperation([]byte("key"), []byte("value"))
+  put.Topic, put.Offset, put.Timestamp = "test", 7, time.Now()
+  if written, err := applier.Apply(put); err != nil || written != nil {
+    t.Fatalf("Unexpected result %q (%v)", written, err)
+  }
+  if offset, _, err := cdc.ReadOffset(db, "test"); err == nil {
+    t.Errorf("Offset %v recorded before a block boundary", offset)
+  }
+  head, _ := cdc.PutOperation([]byte("LastBlock"), []byte("current-head"))
+  head.Topic, head.Offset, head.Timestamp = "test", 8, time.Now().Add(-cdc.MinBlockAge)
+  written, err := applier.Apply(head)
+  if err != nil { t.Fatalf(err.Error()) }
+  if string(written) != "current-head" {
+    t.Errorf("Expected a current head to be committed immediately, got %q", written)
+  }
+  if offset, _, err := cdc.ReadOffset(db, "test"); err != nil || offset != 8 {
+    t.Errorf("Expected offset 8, got %v (%v)", offset, err)
+  }
+  if applier.Pending() {
+    t.Errorf("Unexpected pending operations")
+  }
+}
+
+func TestBatchApplierPartitioned(t *testing.T) {
+  db := rawdb.NewMemoryDatabase()
+  applier := cdc.NewBatchApplier(db)
+  put, _ := cdc.PutOperation([]byte("key"), []byte("value"))
+  put.Topic, put.Offset, put.Partitioned = "test", 3, true
+  if _, err := applier.Apply(put); err != nil { t.Fatalf(err.Error()) }
+  if applier.Pending() {
+    t.Errorf("Partitioned operations should wait for a barrier")
+  }
+  // Flushing discards partitioned operations, which have no offset to record
+  if _, err := applier.Flush(); err != nil { t.Fatalf(err.Error()) }
+  if ok, _ := db.Has([]byte("key")); ok {
+    t.Errorf("Partitioned operation committed without a barrier")
+  }
+  if _, err := applier.Apply(put); err != nil { t.Fatalf(err.Error()) }
+  barrier := cdc.BarrierOperation(1, nil)
+  barrier.Topic, barrier.Partitioned = "test", true
+  barrier.Offsets = map[int32]int64{0: 4, 1: 9}
+  if _, err := applier.Apply(barrier); err != nil { t.Fatalf(err.Error()) }
+  if ok, _ := db.Has([]byte("key")); !ok {
+    t.Errorf("Expected operations ahead of the barrier to be committed")
+  }
+  offsets, err := cdc.ReadPartitionOffsets(db, "test")
+  if err != nil || offsets[1] != 9 {
+    t.Errorf("Unexpected offsets %v (%v)", offsets, err)
+  }
+}
@@ -1,6 +1,8 @@
 package cdc
 
 import (
+  "encoding/binary"
+  "errors"
   "fmt"
   "github.com/ethereum/go-ethereum/rlp"
   "github.com/ethereum/go-ethereum/log"
@@ -10,38 +12,93 @@ import (
 type BatchHandler struct {
   outputChannel chan *Operation
   batches map[string][]BatchOperation
+  // identities tracks the chain identity of the first operation in each batch
+  identities map[string]ChainIdentity
+  // delivered is set once a write has been delivered. Before then, a write
+  // without a matching batch is the tail of a batch that began before the
+  // consumer's starting offset, such as the write a resuming replica applied
+  // last, and is skipped.
+  delivered bool
+}
+
+// fail passes a message that can't be processed along as an operation with
+// err set, so the replica can refuse to continue rather than skipping an
+// operation it can't read.
+func (consumer *BatchHandler) fail(topic string, offset int64, timestamp time.Time, err error) error {
+  consumer.outputChannel <- &Operation{Topic: topic, Offset: offset, Timestamp: timestamp, Err: err}
+  return err
 }
 
 func (consumer *BatchHandler) ProcessInput(value []byte, topic string, offset int64, timestamp time.Time) error {
+  value, identity, err := Unseal(value)
+  if err == nil && len(value) == 0 {
+    err = errors.New("Empty operation")
+  }
+  if err != nil {
+    return consumer.fail(topic, offset, timestamp, fmt.Errorf("Message(topic=%v, offset=%v) is not a valid operation: %w", topic, offset, err))
+  }
   if value[0] == 255 {
     batchValue := make([]byte, len(value))
     copy(batchValue[:], value[:])
     bop, err := BatchOperationFromBytes(batchValue, topic, offset)
     if err != nil {
-      return fmt.Errorf("Message(topic=%v, offset=%v) is not a valid operation: %v\n", topic, offset, err.Error())
+      return consumer.fail(topic, offset, timestamp, fmt.Errorf("Message(topic=%v, offset=%v) is not a valid operation: %w", topic, offset, err))
     }
     batch, ok := consumer.batches[string(bop.Batch[:])]
     if !ok {
       batch = []BatchOperation{}
+      consumer.identities[string(bop.Batch[:])] = identity
     }
     consumer.batches[string(bop.Batch[:])] = append(batch, bop)
   } else {
     op, err := OperationFromBytes(value, topic, offset)
+    if err != nil {
+      return consumer.fail(topic, offset, timestamp, fmt.Errorf("Message(topic=%v, offset=%v) is not a valid operation: %w", topic, offset, err))
+    }
+    if op.Op == OpBarrier {
+      if len(op.Data) < 8 {
+        return consumer.fail(topic, offset, timestamp, fmt.Errorf("Message(topic=%v, offset=%v) is not a valid barrier", topic, offset))
+      }
+      barrier := binary.BigEndian.Uint64(op.Data[:8])
+      if len(op.Data) > 8 {
+        // Partition 0's copy of the barrier carries the barrier operation
+        op, err = OperationFromBytes(op.Data[8:], topic, offset)
+        if err != nil {
+          return consumer.fail(topic, offset, timestamp, fmt.Errorf("Message(topic=%v, offset=%v) is not a valid barrier operation: %w", topic, offset, err))
+        }
+      }
+      op.Barrier = barrier
+    }
+    op.Identity = identity
+    if op.Op == OpWrite {
+      if _, ok := consumer.batches[string(op.Data)]; !ok && op.Barrier != 0 {
+        // When a replica resumes from a barrier, the batch items before it
+        // were already applied along with the barrier. The barrier must still
+        // be delivered so that the other partitions can pass it.
+        log.Debug("Barrier write batch not found, passing barrier", "topic", topic, "offset", offset)
+        op = &Operation{Op: OpBarrier, Topic: topic, Offset: offset, Barrier: op.Barrier, Identity: identity}
+      }
+    }
     if op.Op == OpWrite {
       if batch, ok := consumer.batches[string(op.Data)]; ok {
         data, err := rlp.EncodeToBytes(batch)
         if err != nil {
           log.Error("Failed to encode batch operation: %v", err)
         }
+        if batchIdentity := consumer.identities[string(op.Data)]; !batchIdentity.Matches(identity) {
+          op.Err = fmt.Errorf("%w: batch %v, write %v", ErrChainMismatch, batchIdentity, identity)
+        }
         delete(consumer.batches, string(op.Data))
+        delete(consumer.identities, string(op.Data))
         op.Data = append(op.Data, data...)
+        consumer.delivered = true
+      } else if !consumer.delivered {
+        log.Debug("Skipping write of batch started before the consumer", "topic", topic, "offset", offset, "batch", fmt.Sprintf("%#x", op.Data))
+        return nil
       } else {
-        return fmt.Errorf("Could not find matching batch: %#x, (%v known)", op.Data, len(consumer.batches))
+        return consumer.fail(topic, offset, timestamp, fmt.Errorf("Could not find matching batch: %#x, (%v known)", op.Data, len(consumer.batches)))
       }
     }
-    if err != nil {
-      return fmt.Errorf("Message(topic=%v, offset=%v) is not a valid operation: %v\n", topic, offset, err.Error())
-    }
     op.Timestamp = timestamp
     consumer.outputChannel <- op
   }
@@ -49,5 +106,5 @@ func (consumer *BatchHandler) ProcessInput(value []byte, topic string, offset in
 }
 
 func NewBatchHandler() (*BatchHandler) {
-  return &BatchHandler{make(chan *Operation), make(map[string][]BatchOperation)}
+  return &BatchHandler{outputChannel: make(chan *Operation), batches: make(map[string][]BatchOperation), identities: make(map[string]ChainIdentity)}
 }
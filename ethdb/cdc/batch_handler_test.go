@@ -0,0 +1,56 @@
+package cdc_test
+
+import (
+  "fmt"
+  "io/ioutil"
+  "os"
+  "testing"
+  "github.com/ethereum/go-ethereum/ethdb/cdc"
+  "github.com/pborman/uuid"
+)
+
+func TestBatchHandlerDeliversFailures(t *testing.T) {
+  dir, err := ioutil.TempDir("", "cdc-batch-handler")
+  if err != nil { t.Fatalf(err.Error()) }
+  defer os.RemoveAll(dir)
+  brokerURL := fmt.Sprintf("file://%v?poll.ms=10", dir)
+  producer, err := cdc.NewLogProducerFromURL(brokerURL, "test")
+  if err != nil { t.Fatalf(err.Error()) }
+  early, batch, missing := uuid.NewRandom(), uuid.NewRandom(), uuid.NewRandom()
+  put, err := cdc.PutOperation([]byte("key"), []byte("value"))
+  if err != nil { t.Fatalf(err.Error()) }
+  bop := cdc.BatchOperation{Op: cdc.OpPut, Batch: batch, Data: put.Data}
+  for _, message := range [][]byte{
+    // The tail of a batch that began before the consumer is skipped
+    (&cdc.Operation{Op: cdc.OpWrite, Data: early}).Bytes(),
+    bop.Bytes(),
+    (&cdc.Operation{Op: cdc.OpWrite, Data: batch}).Bytes(),
+    // Once a write has been delivered, a missing batch is a failure
+    (&cdc.Operation{Op: cdc.OpWrite, Data: missing}).Bytes(),
+    bop.Bytes()[:10],
+    (&cdc.Operation{Op: cdc.OpBarrier, Data: []byte{1, 2, 3}}).Bytes(),
+  } {
+    if err := producer.Emit(message); err != nil { t.Fatalf(err.Error()) }
+  }
+  producer.Close()
+
+  consumer, err := cdc.NewLogConsumerFromURL(brokerURL, "test", 0)
+  if err != nil { t.Fatalf(err.Error()) }
+  defer consumer.Close()
+  go func() { <-consumer.Ready() }()
+  op, err := getOpWithTimeout(consumer.Messages())
+  if err != nil { t.Fatalf(err.Error()) }
+  if op.Offset != 2 || op.Op != cdc.OpWrite || op.Err != nil {
+    t.Fatalf("Expected write at offset 2, got %v at %v (%v)", op.Op, op.Offset, op.Err)
+  }
+  for offset := int64(3); offset < 6; offset++ {
+    op, err := getOpWithTimeout(consumer.Messages())
+    if err != nil { t.Fatalf(err.Error()) }
+    if op.Offset != offset || op.Err == nil {
+      t.Errorf("Expected failure at offset %v, got %v at %v", offset, op.Err, op.Offset)
+    }
+    if _, err := op.Apply(nil); err == nil {
+      t.Errorf("Failed operation at offset %v should not apply", offset)
+    }
+  }
+}
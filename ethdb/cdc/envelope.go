@@ -0,0 +1,124 @@
+package cdc
+
+import (
+  "encoding/binary"
+  "errors"
+  "fmt"
+  "hash/crc32"
+  "sync"
+  "github.com/ethereum/go-ethereum/common"
+)
+
+// Producers seal each message in an envelope:
+//
+//   [0xFE][version][crc32c][genesis hash][chain id][operation bytes]
+//
+// The checksum covers everything after it. Messages written before envelopes
+// were introduced begin with an operation byte (or 0xFF for batch operations),
+// so they can still be read, but carry no identity or checksum.
+const (
+  envelopeMagic byte = 0xFE
+  EnvelopeVersion byte = 1
+
+  envelopeChecksumStart = 2
+  envelopeIdentityStart = envelopeChecksumStart + 4
+  envelopePayloadStart = envelopeIdentityStart + common.HashLength + 8
+)
+
+var (
+  envelopeTable = crc32.MakeTable(crc32.Castagnoli)
+
+  ErrCorruptOperation = errors.New("Operation checksum mismatch")
+  ErrUnsupportedVersion = errors.New("Unsupported operation envelope version")
+  ErrUnknownOperation = errors.New("Unknown operation")
+  ErrChainMismatch = errors.New("Operation is from a different chain")
+)
+
+// ChainIdentity identifies the chain a master is writing, so replicas can
+// refuse operations from a master on a different network.
+type ChainIdentity struct {
+  Genesis common.Hash
+  ChainID uint64
+}
+
+// IsZero indicates that the identity of the chain is unknown, as with legacy
+// messages or messages written before the master's genesis block.
+func (id ChainIdentity) IsZero() bool {
+  return id == ChainIdentity{}
+}
+
+func (id ChainIdentity) String() string {
+  return fmt.Sprintf("%#x/%v", id.Genesis, id.ChainID)
+}
+
+// Matches indicates whether operations tagged with id may be applied to the
+// chain identified by expected. Operations with an unknown identity match any
+// chain, and a chain ID of zero matches any chain ID.
+func (id ChainIdentity) Matches(expected ChainIdentity) bool {
+  if id.IsZero() || expected.IsZero() {
+    return true
+  }
+  if id.Genesis != expected.Genesis {
+    return false
+  }
+  return id.ChainID == 0 || expected.ChainID == 0 || id.ChainID == expected.ChainID
+}
+
+// IdentityProducer is implemented by LogProducers that seal the messages they
+// emit in an envelope carrying the chain identity.
+type IdentityProducer interface {
+  SetChainIdentity(ChainIdentity)
+}
+
+// sealer can be embedded in a LogProducer to implement IdentityProducer.
+type sealer struct {
+  lock sync.RWMutex
+  identity ChainIdentity
+}
+
+func (s *sealer) SetChainIdentity(id ChainIdentity) {
+  s.lock.Lock()
+  s.identity = id
+  s.lock.Unlock()
+}
+
+func (s *sealer) seal(payload []byte) []byte {
+  s.lock.RLock()
+  id := s.identity
+  s.lock.RUnlock()
+  return Seal(payload, id)
+}
+
+// Seal wraps payload in an envelope tagged with id.
+func Seal(payload []byte, id ChainIdentity) []byte {
+  data := make([]byte, envelopePayloadStart + len(payload))
+  data[0] = envelopeMagic
+  data[1] = EnvelopeVersion
+  copy(data[envelopeIdentityStart:], id.Genesis[:])
+  binary.BigEndian.PutUint64(data[envelopeIdentityStart + common.HashLength:], id.ChainID)
+  copy(data[envelopePayloadStart:], payload)
+  binary.BigEndian.PutUint32(data[envelopeChecksumStart:], crc32.Checksum(data[envelopeIdentityStart:], envelopeTable))
+  return data
+}
+
+// Unseal verifies the envelope around data, returning the payload and chain
+// identity. Legacy messages without an envelope are returned as is, with a
+// zero identity.
+func Unseal(data []byte) ([]byte, ChainIdentity, error) {
+  id := ChainIdentity{}
+  if len(data) == 0 || data[0] != envelopeMagic {
+    return data, id, nil
+  }
+  if len(data) < envelopePayloadStart {
+    return nil, id, ErrCorruptOperation
+  }
+  if data[1] != EnvelopeVersion {
+    return nil, id, fmt.Errorf("%w: %v", ErrUnsupportedVersion, data[1])
+  }
+  if binary.BigEndian.Uint32(data[envelopeChecksumStart:]) != crc32.Checksum(data[envelopeIdentityStart:], envelopeTable) {
+    return nil, id, ErrCorruptOperation
+  }
+  copy(id.Genesis[:], data[envelopeIdentityStart:])
+  id.ChainID = binary.BigEndian.Uint64(data[envelopeIdentityStart + common.HashLength:])
+  return data[envelopePayloadStart:], id, nil
+}
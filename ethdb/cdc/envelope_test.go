@@ -0,0 +1,148 @@
+package cdc_test
+
+import (
+  "bytes"
+  "errors"
+  "fmt"
+  "io/ioutil"
+  "math/big"
+  "os"
+  "path/filepath"
+  "testing"
+  "github.com/ethereum/go-ethereum/common"
+  "github.com/ethereum/go-ethereum/core/rawdb"
+  "github.com/ethereum/go-ethereum/ethdb/cdc"
+  "github.com/ethereum/go-ethereum/params"
+)
+
+func TestSealUnseal(t *testing.T) {
+  id := cdc.ChainIdentity{Genesis: common.HexToHash("0x01"), ChainID: 5}
+  op, err := cdc.PutOperation([]byte("hello"), []byte("world"))
+  if err != nil { t.Fatalf(err.Error()) }
+  sealed := cdc.Seal(op.Bytes(), id)
+  payload, unsealedID, err := cdc.Unseal(sealed)
+  if err != nil { t.Fatalf(err.Error()) }
+  if !bytes.Equal(payload, op.Bytes()) {
+    t.Errorf("Unexpected payload %#x", payload)
+  }
+  if unsealedID != id {
+    t.Errorf("Unexpected identity %v", unsealedID)
+  }
+  // Every byte other than the magic byte and version is covered by the
+  // checksum
+  for i := 2; i < len(sealed); i++ {
+    corrupt := make([]byte, len(sealed))
+    copy(corrupt, sealed)
+    corrupt[i] ^= 0x10
+    if _, _, err := cdc.Unseal(corrupt); err != cdc.ErrCorruptOperation {
+      t.Errorf("Expected corruption at byte %v to be detected, got %v", i, err)
+    }
+  }
+  versioned := make([]byte, len(sealed))
+  copy(versioned, sealed)
+  versioned[1] = cdc.EnvelopeVersion + 1
+  if _, _, err := cdc.Unseal(versioned); !errors.Is(err, cdc.ErrUnsupportedVersion) {
+    t.Errorf("Expected unsupported version, got %v", err)
+  }
+  if _, _, err := cdc.Unseal(sealed[:10]); err != cdc.ErrCorruptOperation {
+    t.Errorf("Expected truncated envelope to be detected, got %v", err)
+  }
+  // Messages from before envelopes were introduced pass through unchanged
+  payload, unsealedID, err = cdc.Unseal(op.Bytes())
+  if err != nil { t.Fatalf(err.Error()) }
+  if !bytes.Equal(payload, op.Bytes()) || !unsealedID.IsZero() {
+    t.Errorf("Legacy operation not passed through: %#x %v", payload, unsealedID)
+  }
+}
+
+func TestIdentityMatches(t *testing.T) {
+  mainnet := cdc.ChainIdentity{Genesis: params.MainnetGenesisHash, ChainID: 1}
+  goerli := cdc.ChainIdentity{Genesis: params.GoerliGenesisHash, ChainID: 5}
+  if !mainnet.Matches(mainnet) {
+    t.Errorf("Identity should match itself")
+  }
+  if mainnet.Matches(goerli) {
+    t.Errorf("Different genesis should not match")
+  }
+  if (cdc.ChainIdentity{Genesis: params.MainnetGenesisHash, ChainID: 61}).Matches(mainnet) {
+    t.Errorf("Different chain ID should not match")
+  }
+  if !(cdc.ChainIdentity{}).Matches(mainnet) {
+    t.Errorf("Unknown identity should match")
+  }
+}
+
+func TestOperationIdentity(t *testing.T) {
+  writeProducer, writeConsumer := cdc.MockLogPair()
+  <-writeConsumer.Ready()
+  db := rawdb.NewMemoryDatabase()
+  wrapper := cdc.NewDBWrapper(db, writeProducer, nil)
+  defer wrapper.Close()
+  // Before the genesis block is written, operations have no identity
+  go wrapper.Put([]byte("a"), []byte("1"))
+  op, err := getOpWithTimeout(writeConsumer.Messages())
+  if err != nil { t.Fatalf(err.Error()) }
+  if !op.Identity.IsZero() {
+    t.Errorf("Expected unknown identity, got %v", op.Identity)
+  }
+  genesis := common.HexToHash("0x1234")
+  rawdb.WriteCanonicalHash(db, genesis, 0)
+  rawdb.WriteChainConfig(db, genesis, &params.ChainConfig{ChainID: big.NewInt(7)})
+  expected := cdc.ChainIdentity{Genesis: genesis, ChainID: 7}
+  go func() {
+    batch := wrapper.NewBatch()
+    batch.Put([]byte("b"), []byte("2"))
+    batch.Write()
+  }()
+  op, err = getOpWithTimeout(writeConsumer.Messages())
+  if err != nil { t.Fatalf(err.Error()) }
+  if op.Op != cdc.OpWrite || op.Identity != expected {
+    t.Errorf("Unexpected operation %v with identity %v", op.Op, op.Identity)
+  }
+  if err := op.Verify(expected); err != nil {
+    t.Errorf(err.Error())
+  }
+  if err := op.Verify(cdc.ChainIdentity{Genesis: params.MainnetGenesisHash, ChainID: 1}); !errors.Is(err, cdc.ErrChainMismatch) {
+    t.Errorf("Expected chain mismatch, got %v", err)
+  }
+}
+
+func TestCorruptOperationDelivered(t *testing.T) {
+  dir, err := ioutil.TempDir("", "cdc-envelope")
+  if err != nil { t.Fatalf(err.Error()) }
+  defer os.RemoveAll(dir)
+  brokerURL := fmt.Sprintf("file://%v?poll.ms=10", dir)
+  producer, err := cdc.NewLogProducerFromURL(brokerURL, "test")
+  if err != nil { t.Fatalf(err.Error()) }
+  for i := 0; i < 2; i++ {
+    if err := producer.Emit(fileTestOperation(t, i).Bytes()); err != nil { t.Fatalf(err.Error()) }
+  }
+  producer.Close()
+  // Flip a bit in the last byte of the second record's payload
+  segment := filepath.Join(dir, "test", fmt.Sprintf("%020d.log", 0))
+  data, err := ioutil.ReadFile(segment)
+  if err != nil { t.Fatalf(err.Error()) }
+  data[len(data) - 1] ^= 0x01
+  if err := ioutil.WriteFile(segment, data, 0644); err != nil { t.Fatalf(err.Error()) }
+
+  consumer, err := cdc.NewLogConsumerFromURL(brokerURL, "test", 0)
+  if err != nil { t.Fatalf(err.Error()) }
+  defer consumer.Close()
+  go func() { <-consumer.Ready() }()
+  op, err := getOpWithTimeout(consumer.Messages())
+  if err != nil { t.Fatalf(err.Error()) }
+  if op.Err != nil {
+    t.Fatalf("Unexpected error on valid operation: %v", op.Err)
+  }
+  op, err = getOpWithTimeout(consumer.Messages())
+  if err != nil { t.Fatalf(err.Error()) }
+  if op.Offset != 1 || !errors.Is(op.Err, cdc.ErrCorruptOperation) {
+    t.Errorf("Expected corrupt operation at offset 1, got %v at %v", op.Err, op.Offset)
+  }
+  if err := op.Verify(cdc.ChainIdentity{}); !errors.Is(err, cdc.ErrCorruptOperation) {
+    t.Errorf("Corrupt operations should not verify, got %v", err)
+  }
+  if _, err := op.Apply(rawdb.NewMemoryDatabase()); !errors.Is(err, cdc.ErrCorruptOperation) {
+    t.Errorf("Corrupt operations should not apply, got %v", err)
+  }
+}
@@ -0,0 +1,210 @@
+package cdc
+
+import (
+  "bufio"
+  "encoding/binary"
+  "errors"
+  "fmt"
+  "io"
+  "net/http"
+  "strconv"
+  "time"
+  "github.com/ethereum/go-ethereum/ethdb"
+  "github.com/ethereum/go-ethereum/log"
+  "github.com/ethereum/go-ethereum/rlp"
+  "github.com/golang/snappy"
+)
+
+// An export is a snappy compressed stream of RLP encoded values: an
+// exportHeader, followed by an exportRecord for each ancient item and each
+// key / value pair, followed by an exportRecord of kind exportEnd.
+const (
+  exportVersion = 1
+
+  exportKeyValue byte = 0
+  exportAncient byte = 1
+  exportEnd byte = 2
+)
+
+// ExportPath is the HTTP path on which exports are served for bootstrapping
+// replicas.
+const ExportPath = "/replica/bootstrap"
+
+// The names of the freezer tables, as defined in core/rawdb.
+var (
+  ancientHashes = "hashes"
+  ancientHeaders = "headers"
+  ancientBodies = "bodies"
+  ancientReceipts = "receipts"
+  ancientDiffs = "diffs"
+)
+
+type exportHeader struct {
+  Version uint
+  Topic string
+  // Offset is the offset of the first operation in the topic that is not
+  // reflected in the export.
+  Offset uint64
+  Ancients uint64
+}
+
+type exportRecord struct {
+  Kind byte
+  Key []byte
+  Value []byte
+}
+
+// SnapshotFunc provides a consistent view of a database for export: an
+// iterator over its key / value store, the number of ancient items that go
+// with it, and the offset of the first operation not reflected in it.
+type SnapshotFunc func() (ethdb.Iterator, uint64, int64, error)
+
+// WriteOffset records the offset from which a replica should resume consuming
+// topic.
+func WriteOffset(putter ethdb.KeyValueWriter, topic string, offset int64) error {
+  buf := make([]byte, binary.MaxVarintLen64*2)
+  binary.PutVarint(buf[0:binary.MaxVarintLen64], offset)
+  binary.PutVarint(buf[binary.MaxVarintLen64:], time.Now().Unix())
+  return putter.Put(OffsetKey(topic), buf)
+}
+
+// ReadOffset returns the offset from which a replica should resume consuming
+// topic, along with the time at which it was recorded.
+func ReadOffset(db ethdb.KeyValueReader, topic string) (int64, int64, error) {
+  buf, err := db.Get(OffsetKey(topic))
+  if err != nil { return 0, 0, err }
+  if len(buf) < binary.MaxVarintLen64 {
+    return 0, 0, errors.New("Offset buffer too small")
+  }
+  offset, n := binary.Varint(buf[:binary.MaxVarintLen64])
+  if n <= 0 { return 0, 0, errors.New("Offset buffer too small") }
+  timestamp, n := binary.Varint(buf[binary.MaxVarintLen64:])
+  if n <= 0 { return 0, 0, errors.New("Offset buffer too small") }
+  return offset, timestamp, nil
+}
+
+// OffsetKey returns the database key under which the offset of topic is
+// stored.
+func OffsetKey(topic string) []byte {
+  return []byte(fmt.Sprintf("cdc-log-%v-offset", topic))
+}
+
+// WriteExport writes the contents of it, followed by the first ancientCount
+// ancient items from ancients, to w. If ancients is nil, no ancient items are
+// exported.
+func WriteExport(w io.Writer, it ethdb.Iterator, ancients ethdb.AncientReader, ancientCount uint64, topic string, offset int64) error {
+  defer it.Release()
+  if offset < 0 {
+    return fmt.Errorf("Invalid export offset %v", offset)
+  }
+  if ancients == nil {
+    ancientCount = 0
+  }
+  sw := snappy.NewBufferedWriter(w)
+  if err := rlp.Encode(sw, exportHeader{exportVersion, topic, uint64(offset), ancientCount}); err != nil { return err }
+  for i := uint64(0); i < ancientCount; i++ {
+    a := AncientData{Number: i}
+    var err error
+    if a.Hash, err = ancients.Ancient(ancientHashes, i); err != nil { return err }
+    if a.Header, err = ancients.Ancient(ancientHeaders, i); err != nil { return err }
+    if a.Body, err = ancients.Ancient(ancientBodies, i); err != nil { return err }
+    if a.Receipt, err = ancients.Ancient(ancientReceipts, i); err != nil { return err }
+    if a.Td, err = ancients.Ancient(ancientDiffs, i); err != nil { return err }
+    data, err := rlp.EncodeToBytes(a)
+    if err != nil { return err }
+    if err := rlp.Encode(sw, exportRecord{Kind: exportAncient, Value: data}); err != nil { return err }
+  }
+  var count uint64
+  for it.Next() {
+    if err := rlp.Encode(sw, exportRecord{exportKeyValue, it.Key(), it.Value()}); err != nil { return err }
+    count++
+  }
+  if err := it.Error(); err != nil { return err }
+  countBytes, err := rlp.EncodeToBytes(count)
+  if err != nil { return err }
+  if err := rlp.Encode(sw, exportRecord{Kind: exportEnd, Value: countBytes}); err != nil { return err }
+  return sw.Close()
+}
+
+// ReadExport loads an export written by WriteExport into db, and records the
+// offset at which a replica should resume consuming the export's topic. It
+// returns the topic and offset.
+func ReadExport(r io.Reader, db ethdb.Database) (string, int64, error) {
+  stream := rlp.NewStream(snappy.NewReader(bufio.NewReader(r)), 0)
+  header := exportHeader{}
+  if err := stream.Decode(&header); err != nil { return "", 0, err }
+  if header.Version != exportVersion {
+    return "", 0, fmt.Errorf("Unsupported export version %v", header.Version)
+  }
+  batch := db.NewBatch()
+  var count, ancients uint64
+  lastLog := time.Now()
+  for {
+    record := exportRecord{}
+    if err := stream.Decode(&record); err != nil {
+      if err == io.EOF { err = errors.New("Export ended unexpectedly") }
+      return "", 0, err
+    }
+    switch record.Kind {
+    case exportAncient:
+      a := &AncientData{}
+      if err := rlp.DecodeBytes(record.Value, a); err != nil { return "", 0, err }
+      if err := db.AppendAncient(a.Number, a.Hash, a.Header, a.Body, a.Receipt, a.Td); err != nil { return "", 0, err }
+      ancients++
+    case exportKeyValue:
+      if err := batch.Put(record.Key, record.Value); err != nil { return "", 0, err }
+      if batch.ValueSize() >= ethdb.IdealBatchSize {
+        if err := batch.Write(); err != nil { return "", 0, err }
+        batch.Reset()
+      }
+      count++
+    case exportEnd:
+      var expected uint64
+      if err := rlp.DecodeBytes(record.Value, &expected); err != nil { return "", 0, err }
+      if expected != count || ancients != header.Ancients {
+        return "", 0, fmt.Errorf("Export incomplete: got %v/%v keys, %v/%v ancients", count, expected, ancients, header.Ancients)
+      }
+      if ancients > 0 {
+        if err := db.Sync(); err != nil { return "", 0, err }
+      }
+      if err := WriteOffset(batch, header.Topic, int64(header.Offset)); err != nil { return "", 0, err }
+      if err := batch.Write(); err != nil { return "", 0, err }
+      log.Info("Imported export", "topic", header.Topic, "offset", header.Offset, "keys", count, "ancients", ancients)
+      return header.Topic, int64(header.Offset), nil
+    default:
+      return "", 0, fmt.Errorf("Unknown export record kind %v", record.Kind)
+    }
+    if time.Since(lastLog) > 8 * time.Second {
+      log.Info("Importing export", "keys", count, "ancients", ancients)
+      lastLog = time.Now()
+    }
+  }
+}
+
+// NewExportHandler returns an http.Handler that streams an export of the
+// snapshot provided by snapshot. Ancient items are read from ancients, unless
+// the request includes the query parameter ancients=0, as replicas sharing an
+// ancient store with the source will not need them.
+func NewExportHandler(snapshot SnapshotFunc, ancients ethdb.AncientReader, topic string) http.Handler {
+  return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    it, ancientCount, offset, err := snapshot()
+    if err != nil {
+      http.Error(w, err.Error(), http.StatusServiceUnavailable)
+      return
+    }
+    source := ancients
+    if r.URL.Query().Get("ancients") == "0" {
+      source = nil
+    }
+    w.Header().Set("Content-Type", "application/octet-stream")
+    w.Header().Set("X-CDC-Topic", topic)
+    w.Header().Set("X-CDC-Offset", strconv.FormatInt(offset, 10))
+    log.Info("Serving export", "remote", r.RemoteAddr, "topic", topic, "offset", offset, "ancients", ancientCount)
+    start := time.Now()
+    if err := WriteExport(w, it, source, ancientCount, topic, offset); err != nil {
+      log.Warn("Error serving export", "remote", r.RemoteAddr, "err", err)
+      return
+    }
+    log.Info("Served export", "remote", r.RemoteAddr, "topic", topic, "offset", offset, "elapsed", time.Since(start))
+  })
+}
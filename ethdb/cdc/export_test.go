@@ -0,0 +1,107 @@
+package cdc_test
+
+import (
+  "bytes"
+  "fmt"
+  "io/ioutil"
+  "net/http"
+  "net/http/httptest"
+  "os"
+  "path/filepath"
+  "strconv"
+  "testing"
+  "github.com/ethereum/go-ethereum/core/rawdb"
+  "github.com/ethereum/go-ethereum/ethdb"
+  "github.com/ethereum/go-ethereum/ethdb/cdc"
+  "github.com/ethereum/go-ethereum/ethdb/memorydb"
+)
+
+func newFreezerDB(t *testing.T, dir string) ethdb.Database {
+  db, err := rawdb.NewDatabaseWithFreezer(memorydb.New(), dir, "")
+  if err != nil { t.Fatalf(err.Error()) }
+  return db
+}
+
+func TestExportRoundTrip(t *testing.T) {
+  dir, err := ioutil.TempDir("", "cdc-export")
+  if err != nil { t.Fatalf(err.Error()) }
+  defer os.RemoveAll(dir)
+  producer, err := cdc.NewLogProducerFromURL(fmt.Sprintf("file://%v", filepath.Join(dir, "log")), "test")
+  if err != nil { t.Fatalf(err.Error()) }
+  defer producer.Close()
+  source := newFreezerDB(t, filepath.Join(dir, "source"))
+  defer source.Close()
+  for i := uint64(0); i < 2; i++ {
+    b := []byte{byte(i)}
+    if err := source.AppendAncient(i, b, b, b, b, b); err != nil { t.Fatalf(err.Error()) }
+  }
+  wrapper := cdc.NewDBWrapper(source, producer, nil)
+  for i := 0; i < 3; i++ {
+    if err := wrapper.Put([]byte(fmt.Sprintf("key-%v", i)), []byte(fmt.Sprintf("value-%v", i))); err != nil { t.Fatalf(err.Error()) }
+  }
+  server := httptest.NewServer(cdc.NewExportHandler(wrapper.(*cdc.DBWrapper).Snapshot, source, "test"))
+  defer server.Close()
+  // Writes after the export is taken must not be included
+  resp, err := http.Get(server.URL + cdc.ExportPath)
+  if err != nil { t.Fatalf(err.Error()) }
+  defer resp.Body.Close()
+  if err := wrapper.Put([]byte("key-3"), []byte("value-3")); err != nil { t.Fatalf(err.Error()) }
+  if offset, _ := strconv.Atoi(resp.Header.Get("X-CDC-Offset")); offset != 3 {
+    t.Errorf("Unexpected offset header %v", resp.Header.Get("X-CDC-Offset"))
+  }
+
+  dest := newFreezerDB(t, filepath.Join(dir, "dest"))
+  defer dest.Close()
+  topic, offset, err := cdc.ReadExport(resp.Body, dest)
+  if err != nil { t.Fatalf(err.Error()) }
+  if topic != "test" || offset != 3 {
+    t.Errorf("Unexpected topic / offset %v / %v", topic, offset)
+  }
+  for i := 0; i < 3; i++ {
+    value, err := dest.Get([]byte(fmt.Sprintf("key-%v", i)))
+    if err != nil { t.Fatalf(err.Error()) }
+    if string(value) != fmt.Sprintf("value-%v", i) {
+      t.Errorf("Unexpected value %q for key-%v", value, i)
+    }
+  }
+  if ok, _ := dest.Has([]byte("key-3")); ok {
+    t.Errorf("Export included a write made after the snapshot")
+  }
+  if ancients, _ := dest.Ancients(); ancients != 2 {
+    t.Errorf("Expected 2 ancients, got %v", ancients)
+  }
+  if receipt, err := dest.Ancient("receipts", 1); err != nil || !bytes.Equal(receipt, []byte{1}) {
+    t.Errorf("Unexpected ancient receipt %v (%v)", receipt, err)
+  }
+  if stored, _, err := cdc.ReadOffset(dest, "test"); err != nil || stored != 3 {
+    t.Errorf("Unexpected stored offset %v (%v)", stored, err)
+  }
+}
+
+func TestExportSkipAncients(t *testing.T) {
+  source := rawdb.NewMemoryDatabase()
+  source.Put([]byte("key"), []byte("value"))
+  buf := &bytes.Buffer{}
+  if err := cdc.WriteExport(buf, source.NewIterator(nil, nil), nil, 10, "test", 5); err != nil { t.Fatalf(err.Error()) }
+  dest := rawdb.NewMemoryDatabase()
+  if _, _, err := cdc.ReadExport(bytes.NewReader(buf.Bytes()), dest); err != nil { t.Fatalf(err.Error()) }
+  if value, err := dest.Get([]byte("key")); err != nil || string(value) != "value" {
+    t.Errorf("Unexpected value %q (%v)", value, err)
+  }
+}
+
+func TestExportTruncated(t *testing.T) {
+  source := rawdb.NewMemoryDatabase()
+  for i := 0; i < 100; i++ {
+    source.Put([]byte(fmt.Sprintf("key-%v", i)), []byte(fmt.Sprintf("value-%v", i)))
+  }
+  buf := &bytes.Buffer{}
+  if err := cdc.WriteExport(buf, source.NewIterator(nil, nil), nil, 0, "test", 5); err != nil { t.Fatalf(err.Error()) }
+  dest := rawdb.NewMemoryDatabase()
+  if _, _, err := cdc.ReadExport(bytes.NewReader(buf.Bytes()[:buf.Len() / 2]), dest); err == nil {
+    t.Fatalf("Expected truncated export to fail")
+  }
+  if _, _, err := cdc.ReadOffset(dest, "test"); err == nil {
+    t.Errorf("Truncated export should not record an offset")
+  }
+}
@@ -0,0 +1,379 @@
+package cdc
+
+import (
+  "encoding/binary"
+  "fmt"
+  "io"
+  "io/ioutil"
+  "net/url"
+  "os"
+  "path/filepath"
+  "sort"
+  "strconv"
+  "strings"
+  "sync"
+  "time"
+  "github.com/ethereum/go-ethereum/log"
+)
+
+// Segment files hold a sequence of records, each consisting of a 4 byte
+// big-endian payload length, an 8 byte big-endian unix nanosecond timestamp,
+// and the payload itself. Each segment is named for the offset of its first
+// record, so offsets are contiguous across segments just as they are within a
+// Kafka partition.
+const (
+  segmentSuffix = ".log"
+  segmentHeaderSize = 12
+  defaultSegmentBytes = 64 * 1024 * 1024
+  defaultPollInterval = 100 * time.Millisecond
+)
+
+type fileLogConfig struct {
+  dir string
+  segmentBytes int64
+  retainSegments int
+  pollInterval time.Duration
+}
+
+// parseFileURL extracts the segment directory and options from a URL of the
+// form file:///path/to/dir?segment.bytes=N&retention.segments=N&poll.ms=N
+func parseFileURL(brokerURL, topic string) (*fileLogConfig, error) {
+  parsedURL, err := url.Parse(brokerURL)
+  if err != nil { return nil, err }
+  if topic == "" {
+    return nil, fmt.Errorf("Unspecified topic")
+  }
+  config := &fileLogConfig{
+    dir: filepath.Join(parsedURL.Host + parsedURL.Path, topic),
+    segmentBytes: defaultSegmentBytes,
+    pollInterval: defaultPollInterval,
+  }
+  if val := parsedURL.Query().Get("segment.bytes"); val != "" {
+    segmentBytes, err := strconv.ParseInt(val, 10, 64)
+    if err != nil { return nil, fmt.Errorf("segment.bytes set, but not number: %v", val) }
+    config.segmentBytes = segmentBytes
+  }
+  if val := parsedURL.Query().Get("retention.segments"); val != "" {
+    retainSegments, err := strconv.Atoi(val)
+    if err != nil { return nil, fmt.Errorf("retention.segments set, but not number: %v", val) }
+    config.retainSegments = retainSegments
+  }
+  if val := parsedURL.Query().Get("poll.ms"); val != "" {
+    pollMs, err := strconv.Atoi(val)
+    if err != nil { return nil, fmt.Errorf("poll.ms set, but not number: %v", val) }
+    config.pollInterval = time.Duration(pollMs) * time.Millisecond
+  }
+  return config, nil
+}
+
+func segmentName(dir string, offset int64) string {
+  return filepath.Join(dir, fmt.Sprintf("%020d%v", offset, segmentSuffix))
+}
+
+// listSegments returns the starting offsets of the segments in dir, in
+// ascending order.
+func listSegments(dir string) ([]int64, error) {
+  files, err := ioutil.ReadDir(dir)
+  if err != nil { return nil, err }
+  segments := []int64{}
+  for _, file := range files {
+    name := file.Name()
+    if !strings.HasSuffix(name, segmentSuffix) { continue }
+    offset, err := strconv.ParseInt(strings.TrimSuffix(name, segmentSuffix), 10, 64)
+    if err != nil { continue }
+    segments = append(segments, offset)
+  }
+  sort.Slice(segments, func(i, j int) bool { return segments[i] < segments[j] })
+  return segments, nil
+}
+
+// readRecord reads a single record from r. It returns io.EOF if r holds no
+// further complete records.
+func readRecord(r io.Reader) ([]byte, time.Time, error) {
+  header := make([]byte, segmentHeaderSize)
+  if _, err := io.ReadFull(r, header); err != nil {
+    return nil, time.Time{}, io.EOF
+  }
+  value := make([]byte, binary.BigEndian.Uint32(header[:4]))
+  if _, err := io.ReadFull(r, value); err != nil {
+    return nil, time.Time{}, io.EOF
+  }
+  return value, time.Unix(0, int64(binary.BigEndian.Uint64(header[4:]))), nil
+}
+
+// FileLogProducer writes operations to rotating segment files in a local
+// directory, which replicas on shared storage can tail with a FileLogConsumer.
+type FileLogProducer struct {
+  config *fileLogConfig
+  file *os.File
+  segmentStart int64
+  segmentSize int64
+  offset int64
+  closed bool
+  lock sync.Mutex
+  sealer
+}
+
+func (producer *FileLogProducer) Emit(data []byte) error {
+  data = producer.seal(data)
+  producer.lock.Lock()
+  defer producer.lock.Unlock()
+  if producer.closed {
+    return fmt.Errorf("Producer closed")
+  }
+  if producer.segmentSize >= producer.config.segmentBytes {
+    if err := producer.rotate(); err != nil { return err }
+  }
+  record := make([]byte, segmentHeaderSize + len(data))
+  binary.BigEndian.PutUint32(record[:4], uint32(len(data)))
+  binary.BigEndian.PutUint64(record[4:segmentHeaderSize], uint64(time.Now().UnixNano()))
+  copy(record[segmentHeaderSize:], data)
+  log.Debug("Emitting data", "dir", producer.config.dir, "bytes", len(data))
+  if _, err := producer.file.Write(record); err != nil {
+    log.Error("Error emitting", "err", err.Error())
+    return err
+  }
+  producer.segmentSize += int64(len(record))
+  producer.offset++
+  return nil
+}
+
+// NextOffset returns the offset that will be assigned to the next message
+// emitted.
+func (producer *FileLogProducer) NextOffset() (int64, error) {
+  producer.lock.Lock()
+  defer producer.lock.Unlock()
+  return producer.offset, nil
+}
+
+// rotate closes the current segment and starts a new one at the current
+// offset, removing old segments beyond the configured retention.
+func (producer *FileLogProducer) rotate() error {
+  if err := producer.file.Sync(); err != nil { return err }
+  if err := producer.file.Close(); err != nil { return err }
+  file, err := os.OpenFile(segmentName(producer.config.dir, producer.offset), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+  if err != nil { return err }
+  producer.file, producer.segmentStart, producer.segmentSize = file, producer.offset, 0
+  if producer.config.retainSegments > 0 {
+    segments, err := listSegments(producer.config.dir)
+    if err != nil { return err }
+    for len(segments) > producer.config.retainSegments {
+      if err := os.Remove(segmentName(producer.config.dir, segments[0])); err != nil {
+        log.Warn("Error removing segment", "offset", segments[0], "err", err)
+      }
+      segments = segments[1:]
+    }
+  }
+  return nil
+}
+
+func (producer *FileLogProducer) Close() {
+  producer.lock.Lock()
+  defer producer.lock.Unlock()
+  if producer.closed { return }
+  producer.closed = true
+  producer.file.Sync()
+  producer.file.Close()
+}
+
+func (producer *FileLogProducer) Start(duration time.Duration) {
+  go func() {
+    futureTimer := time.NewTicker(duration)
+    defer futureTimer.Stop()
+    heartbeatBytes := HeartbeatOperation().Bytes()
+    for range futureTimer.C {
+      producer.lock.Lock()
+      closed := producer.closed
+      producer.lock.Unlock()
+      if closed {
+        break
+      }
+      producer.Emit(heartbeatBytes)
+    }
+  }()
+}
+
+// NewFileLogProducer opens the latest segment in the configured directory for
+// appending, discarding any partially written record left by an earlier
+// crash.
+func NewFileLogProducer(brokerURL, topic string) (LogProducer, error) {
+  config, err := parseFileURL(brokerURL, topic)
+  if err != nil { return nil, err }
+  if err := os.MkdirAll(config.dir, 0755); err != nil { return nil, err }
+  segments, err := listSegments(config.dir)
+  if err != nil { return nil, err }
+  producer := &FileLogProducer{config: config}
+  if len(segments) > 0 {
+    producer.segmentStart = segments[len(segments) - 1]
+  }
+  path := segmentName(config.dir, producer.segmentStart)
+  file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+  if err != nil { return nil, err }
+  producer.offset = producer.segmentStart
+  for {
+    value, _, err := readRecord(file)
+    if err != nil { break }
+    producer.segmentSize += int64(segmentHeaderSize + len(value))
+    producer.offset++
+  }
+  if err := file.Truncate(producer.segmentSize); err != nil {
+    file.Close()
+    return nil, err
+  }
+  if _, err := file.Seek(producer.segmentSize, io.SeekStart); err != nil {
+    file.Close()
+    return nil, err
+  }
+  producer.file = file
+  // TODO: Make duration configurable?
+  producer.Start(30 * time.Second)
+  log.Info("Opened file log producer", "dir", config.dir, "offset", producer.offset)
+  return producer, nil
+}
+
+// FileLogConsumer tails the segment files written by a FileLogProducer.
+type FileLogConsumer struct {
+  config *fileLogConfig
+  topic string
+  offset int64
+  batchHandler *BatchHandler
+  ready chan struct{}
+  quit chan struct{}
+}
+
+func (consumer *FileLogConsumer) Messages() <-chan *Operation {
+  if consumer.batchHandler != nil {
+    return consumer.batchHandler.outputChannel
+  }
+  consumer.batchHandler = NewBatchHandler()
+  go func() {
+    if err := consumer.tail(); err != nil {
+      log.Error("File log consumer stopped", "dir", consumer.config.dir, "err", err)
+    }
+  }()
+  return consumer.batchHandler.outputChannel
+}
+
+// openSegment opens the segment containing the consumer's offset and positions
+// the file at that record, returning the starting offset of the segment. If
+// no segments have been written yet, the returned file is nil.
+func (consumer *FileLogConsumer) openSegment() (*os.File, int64, error) {
+  segments, err := listSegments(consumer.config.dir)
+  if err != nil { return nil, 0, err }
+  if len(segments) == 0 {
+    return nil, 0, nil
+  }
+  if consumer.offset < segments[0] {
+    if consumer.offset > 0 {
+      log.Warn("Requested offset no longer retained, starting from oldest", "offset", consumer.offset, "oldest", segments[0])
+    }
+    consumer.offset = segments[0]
+  }
+  i := sort.Search(len(segments), func(i int) bool { return segments[i] > consumer.offset }) - 1
+  file, err := os.Open(segmentName(consumer.config.dir, segments[i]))
+  if err != nil { return nil, 0, err }
+  for current := segments[i]; current < consumer.offset; current++ {
+    if _, _, err := readRecord(file); err != nil {
+      file.Close()
+      return nil, 0, fmt.Errorf("Offset %v not found in segment %v", consumer.offset, segments[i])
+    }
+  }
+  return file, segments[i], nil
+}
+
+// nextSegment returns the starting offset of the segment following start, or
+// -1 if start is the latest segment.
+func (consumer *FileLogConsumer) nextSegment(start int64) int64 {
+  segments, err := listSegments(consumer.config.dir)
+  if err != nil { return -1 }
+  for _, segment := range segments {
+    if segment > start { return segment }
+  }
+  return -1
+}
+
+func (consumer *FileLogConsumer) tail() error {
+  var file *os.File
+  var segmentStart, position int64
+  defer func() {
+    if file != nil { file.Close() }
+  }()
+  for {
+    select {
+    case <-consumer.quit:
+      return nil
+    default:
+    }
+    if file == nil {
+      var err error
+      file, segmentStart, err = consumer.openSegment()
+      if err != nil { return err }
+      if file != nil {
+        if position, err = file.Seek(0, io.SeekCurrent); err != nil { return err }
+      }
+    }
+    if file != nil {
+      value, timestamp, err := readRecord(file)
+      if err == nil {
+        position += int64(segmentHeaderSize + len(value))
+        if err := consumer.batchHandler.ProcessInput(value, consumer.topic, consumer.offset, timestamp); err != nil {
+          log.Error(err.Error())
+        }
+        consumer.offset++
+        continue
+      }
+      // We may have read part of a record that is still being written, so
+      // rewind to the end of the last complete record.
+      if _, err := file.Seek(position, io.SeekStart); err != nil { return err }
+      if next := consumer.nextSegment(segmentStart); next >= 0 {
+        // The producer only rotates once a segment is complete, so once a
+        // newer segment exists we either move on to it or retry the read.
+        if consumer.offset >= next {
+          file.Close()
+          file = nil
+        }
+        continue
+      }
+    }
+    if consumer.ready != nil {
+      consumer.ready <- struct{}{}
+      consumer.ready = nil
+    }
+    select {
+    case <-consumer.quit:
+      return nil
+    case <-time.After(consumer.config.pollInterval):
+    }
+  }
+}
+
+func (consumer *FileLogConsumer) Ready() <-chan struct{} {
+  return consumer.ready
+}
+
+func (consumer *FileLogConsumer) Close() {
+  close(consumer.quit)
+}
+
+func (consumer *FileLogConsumer) TopicName() string {
+  return consumer.topic
+}
+
+// NewFileLogConsumer creates a consumer that will begin reading the segments
+// at the specified offset. A negative offset starts with the oldest retained
+// segment.
+func NewFileLogConsumer(brokerURL, topic string, offset int64) (LogConsumer, error) {
+  config, err := parseFileURL(brokerURL, topic)
+  if err != nil { return nil, err }
+  if err := os.MkdirAll(config.dir, 0755); err != nil { return nil, err }
+  if offset < 0 {
+    offset = 0
+  }
+  return &FileLogConsumer{
+    config: config,
+    topic: topic,
+    offset: offset,
+    ready: make(chan struct{}),
+    quit: make(chan struct{}),
+  }, nil
+}
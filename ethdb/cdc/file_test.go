@@ -0,0 +1,131 @@
+package cdc_test
+
+import (
+  "bytes"
+  "fmt"
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "testing"
+  "time"
+  "github.com/ethereum/go-ethereum/ethdb/cdc"
+)
+
+func fileTestOperation(t *testing.T, i int) *cdc.Operation {
+  op, err := cdc.PutOperation([]byte(fmt.Sprintf("key-%v", i)), []byte(fmt.Sprintf("value-%v", i)))
+  if err != nil { t.Fatalf(err.Error()) }
+  return op
+}
+
+func expectFileOperations(t *testing.T, consumer cdc.LogConsumer, start, end int) {
+  for i := start; i < end; i++ {
+    select {
+    case op := <-consumer.Messages():
+      expected := fileTestOperation(t, i)
+      if op.Offset != int64(i) {
+        t.Fatalf("Unexpected offset %v, expected %v", op.Offset, i)
+      }
+      if op.Op != expected.Op || !bytes.Equal(op.Data, expected.Data) {
+        t.Fatalf("Unexpected operation at offset %v", i)
+      }
+      if op.Topic != "test" {
+        t.Errorf("Unexpected topic %v", op.Topic)
+      }
+    case <-time.After(2 * time.Second):
+      t.Fatalf("Timed out waiting for offset %v", i)
+    }
+  }
+}
+
+func TestFileLogRotation(t *testing.T) {
+  dir, err := ioutil.TempDir("", "cdc-file")
+  if err != nil { t.Fatalf(err.Error()) }
+  defer os.RemoveAll(dir)
+  brokerURL := fmt.Sprintf("file://%v?segment.bytes=100&poll.ms=10", dir)
+  producer, err := cdc.NewLogProducerFromURL(brokerURL, "test")
+  if err != nil { t.Fatalf(err.Error()) }
+  for i := 0; i < 10; i++ {
+    if err := producer.Emit(fileTestOperation(t, i).Bytes()); err != nil { t.Fatalf(err.Error()) }
+  }
+  consumer, err := cdc.NewLogConsumerFromURL(brokerURL, "test", -2)
+  if err != nil { t.Fatalf(err.Error()) }
+  defer consumer.Close()
+  ready := consumer.Ready()
+  expectFileOperations(t, consumer, 0, 10)
+  select {
+  case <-ready:
+  case <-time.After(2 * time.Second):
+    t.Fatalf("Consumer never became ready")
+  }
+  // Messages written after the consumer has caught up should still arrive,
+  // including across segment boundaries.
+  for i := 10; i < 20; i++ {
+    if err := producer.Emit(fileTestOperation(t, i).Bytes()); err != nil { t.Fatalf(err.Error()) }
+  }
+  expectFileOperations(t, consumer, 10, 20)
+  producer.Close()
+  segments, err := filepath.Glob(filepath.Join(dir, "test", "*.log"))
+  if err != nil { t.Fatalf(err.Error()) }
+  if len(segments) < 2 {
+    t.Errorf("Expected segments to rotate, got %v", segments)
+  }
+
+  // A producer restarted on the same directory should continue numbering
+  // where the last one left off, and a consumer should be able to resume from
+  // an offset in the middle of the log.
+  producer, err = cdc.NewLogProducerFromURL(brokerURL, "test")
+  if err != nil { t.Fatalf(err.Error()) }
+  defer producer.Close()
+  if err := producer.Emit(fileTestOperation(t, 20).Bytes()); err != nil { t.Fatalf(err.Error()) }
+  resumed, err := cdc.NewLogConsumerFromURL(brokerURL, "test", 15)
+  if err != nil { t.Fatalf(err.Error()) }
+  defer resumed.Close()
+  go func() { <-resumed.Ready() }()
+  expectFileOperations(t, resumed, 15, 21)
+}
+
+func TestFileLogPartialRecord(t *testing.T) {
+  dir, err := ioutil.TempDir("", "cdc-file")
+  if err != nil { t.Fatalf(err.Error()) }
+  defer os.RemoveAll(dir)
+  brokerURL := fmt.Sprintf("file://%v?poll.ms=10", dir)
+  producer, err := cdc.NewLogProducerFromURL(brokerURL, "test")
+  if err != nil { t.Fatalf(err.Error()) }
+  for i := 0; i < 3; i++ {
+    if err := producer.Emit(fileTestOperation(t, i).Bytes()); err != nil { t.Fatalf(err.Error()) }
+  }
+  producer.Close()
+  // Simulate a crash part way through writing a record
+  segment := filepath.Join(dir, "test", fmt.Sprintf("%020d.log", 0))
+  f, err := os.OpenFile(segment, os.O_WRONLY|os.O_APPEND, 0644)
+  if err != nil { t.Fatalf(err.Error()) }
+  f.Write([]byte{0, 0, 0, 100, 1, 2})
+  f.Close()
+  producer, err = cdc.NewLogProducerFromURL(brokerURL, "test")
+  if err != nil { t.Fatalf(err.Error()) }
+  defer producer.Close()
+  for i := 3; i < 5; i++ {
+    if err := producer.Emit(fileTestOperation(t, i).Bytes()); err != nil { t.Fatalf(err.Error()) }
+  }
+  consumer, err := cdc.NewLogConsumerFromURL(brokerURL, "test", 0)
+  if err != nil { t.Fatalf(err.Error()) }
+  defer consumer.Close()
+  go func() { <-consumer.Ready() }()
+  expectFileOperations(t, consumer, 0, 5)
+}
+
+func TestFileLogEmptyReady(t *testing.T) {
+  dir, err := ioutil.TempDir("", "cdc-file")
+  if err != nil { t.Fatalf(err.Error()) }
+  defer os.RemoveAll(dir)
+  consumer, err := cdc.NewLogConsumerFromURL(fmt.Sprintf("file://%v", dir), "test", -2)
+  if err != nil { t.Fatalf(err.Error()) }
+  defer consumer.Close()
+  ready := consumer.Ready()
+  consumer.Messages()
+  select {
+  case <-ready:
+  case <-time.After(2 * time.Second):
+    t.Fatalf("Consumer of an empty log never became ready")
+  }
+}
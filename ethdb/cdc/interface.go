@@ -20,3 +20,26 @@ type LogConsumer interface {
   Close()
   TopicName() string
 }
+
+// OffsetProducer is implemented by LogProducers that can report the offset
+// that will be assigned to the next message they emit.
+type OffsetProducer interface {
+  NextOffset() (int64, error)
+}
+
+// PartitionedProducer is implemented by LogProducers writing topics that may
+// have more than one partition. Emit writes a barrier across all partitions,
+// while EmitTo writes to a single partition.
+type PartitionedProducer interface {
+  Partitions() int32
+  EmitTo(data []byte, partition int32) error
+}
+
+// PartitionedConsumer is implemented by LogConsumers reading topics that may
+// have more than one partition. The operations of each partition may be
+// applied in parallel, but each channel must be applied in order, and the
+// next operation should only be read once the last has been applied.
+// Consumers must use either PartitionMessages or Messages, not both.
+type PartitionedConsumer interface {
+  PartitionMessages() []<-chan *Operation
+}
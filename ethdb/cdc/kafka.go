@@ -7,8 +7,10 @@ import (
   "github.com/ethereum/go-ethereum/log"
   coreLog "log"
   "net/url"
+  "sort"
   "strings"
   "strconv"
+  "sync"
   "time"
   "os"
 )
@@ -123,11 +125,31 @@ type KafkaLogProducer struct {
   producer sarama.AsyncProducer
   topic string
   closed bool
+  client sarama.Client
+  sealer
+  partitions int32
+}
+
+// NextOffset returns the high watermark of the topic. Messages that have been
+// passed to Emit but not yet acknowledged by Kafka will be assigned offsets at
+// or above this value, so it is a safe point from which to replay operations
+// that happen after it is called.
+func (producer *KafkaLogProducer) NextOffset() (int64, error) {
+  if producer.client == nil {
+    return 0, fmt.Errorf("Producer has no client")
+  }
+  if producer.partitions > 1 {
+    return 0, fmt.Errorf("Exports are not supported for partitioned topics")
+  }
+  return producer.client.GetOffset(producer.topic, 0, sarama.OffsetNewest)
 }
 
 func (producer *KafkaLogProducer) Close() {
   producer.closed = true
   producer.producer.Close()
+  if producer.client != nil {
+    producer.client.Close()
+  }
 }
 func (producer *KafkaLogProducer) Start(duration time.Duration) {
   go func() {
@@ -142,10 +164,20 @@ func (producer *KafkaLogProducer) Start(duration time.Duration) {
   }()
 }
 
+// Emit writes data to the topic. If the topic has more than one partition,
+// data is written as a barrier across all of them.
 func (producer *KafkaLogProducer) Emit(data []byte) error {
-  log.Debug("Emitting data", "topic", producer.topic, "bytes", len(data))
+  if producer.partitions > 1 {
+    return emitBarrier(producer.partitions, data, producer.EmitTo)
+  }
+  return producer.EmitTo(data, 0)
+}
+
+// EmitTo writes data to a single partition of the topic.
+func (producer *KafkaLogProducer) EmitTo(data []byte, partition int32) error {
+  log.Debug("Emitting data", "topic", producer.topic, "partition", partition, "bytes", len(data))
   select {
-  case producer.producer.Input() <- &sarama.ProducerMessage{Topic: producer.topic, Value: sarama.ByteEncoder(data)}:
+  case producer.producer.Input() <- &sarama.ProducerMessage{Topic: producer.topic, Partition: partition, Value: sarama.ByteEncoder(producer.seal(data))}:
   case err := <-producer.producer.Errors():
     // TODO: If we get an error here, that indicates a problem with an earlier
     // write.
@@ -155,6 +187,13 @@ func (producer *KafkaLogProducer) Emit(data []byte) error {
   return nil
 }
 
+func (producer *KafkaLogProducer) Partitions() int32 {
+  if producer.partitions < 1 {
+    return 1
+  }
+  return producer.partitions
+}
+
 func CreateTopicIfDoesNotExist(brokerAddr, topic string, numPartitions int32, configEntries map[string]*string) error {
   if topic == "" {
     return fmt.Errorf("Unspecified topic")
@@ -218,66 +257,123 @@ func CreateTopicIfDoesNotExist(brokerAddr, topic string, numPartitions int32, co
   return nil
 }
 
+// kafkaPartitions returns the number of partitions requested for new topics
+// by the partitions parameter of brokerURL.
+func kafkaPartitions(brokerURL string) int32 {
+  parsedURL, err := url.Parse("kafka://" + brokerURL)
+  if err != nil { return 1 }
+  if val, err := strconv.Atoi(parsedURL.Query().Get("partitions")); err == nil && val > 0 {
+    return int32(val)
+  }
+  return 1
+}
+
 func NewKafkaLogProducerFromURL(brokerURL, topic string) (LogProducer, error) {
   brokers, config := ParseKafkaURL(brokerURL)
-  if err := CreateTopicIfDoesNotExist(brokerURL, topic, 1, nil); err != nil {
+  requested := kafkaPartitions(brokerURL)
+  if err := CreateTopicIfDoesNotExist(brokerURL, topic, requested, nil); err != nil {
     return nil, err
   }
   config.Producer.MaxMessageBytes = 5000012
-  producer, err := sarama.NewAsyncProducer(brokers, config)
+  // Operations are routed to partitions by the DBWrapper, not by key
+  config.Producer.Partitioner = sarama.NewManualPartitioner
+  client, err := sarama.NewClient(brokers, config)
   if err != nil {
     return nil, err
   }
-  return NewKafkaLogProducer(producer, topic), nil
+  partitions, err := client.Partitions(topic)
+  if err != nil {
+    return nil, err
+  }
+  if int32(len(partitions)) != requested {
+    log.Warn("Existing topic has a different number of partitions than requested", "topic", topic, "partitions", len(partitions), "requested", requested)
+  }
+  producer, err := sarama.NewAsyncProducerFromClient(client)
+  if err != nil {
+    return nil, err
+  }
+  logPartitions(topic, len(partitions))
+  logProducer := NewKafkaLogProducer(producer, topic)
+  logProducer.(*KafkaLogProducer).client = client
+  logProducer.(*KafkaLogProducer).partitions = int32(len(partitions))
+  return logProducer, nil
 }
 
 func NewKafkaLogProducer(producer sarama.AsyncProducer, topic string) (LogProducer) {
-  logProducer := &KafkaLogProducer{producer, topic, false}
+  logProducer := &KafkaLogProducer{producer: producer, topic: topic, partitions: 1}
   // TODO: Make duration configurable?
   logProducer.Start(30 * time.Second)
   return logProducer
 }
 
 type KafkaLogConsumer struct {
-  consumer sarama.PartitionConsumer
+  consumers []sarama.PartitionConsumer
   topic string
-  batchHandler *BatchHandler
+  partitions *partitionSet
+  // waiting is set for each partition that must reach its high watermark
+  // before the consumer is ready.
+  waiting []bool
   ready chan struct{}
-  topicExists bool
+  startOnce sync.Once
+  tracker *progressTracker
 }
 
-func (consumer *KafkaLogConsumer) Messages() <-chan *Operation {
-  if consumer.batchHandler != nil {
-    return consumer.batchHandler.outputChannel
-  }
-  inputChannel := consumer.consumer.Messages()
-  consumer.batchHandler = NewBatchHandler()
-  if !consumer.topicExists {
-    consumer.ready <- struct{}{}
-    consumer.ready = nil
-  }
-  go func() {
-    for input := range inputChannel {
-      if consumer.ready != nil {
-        if consumer.consumer.HighWaterMarkOffset() - input.Offset <= 1 {
-          consumer.ready <- struct{}{}
-          consumer.ready = nil
-        }
-      }
-      if err := consumer.batchHandler.ProcessInput(input.Value, input.Topic, input.Offset, input.Timestamp); err != nil {
-        log.Error(err.Error())
+// start begins consuming every partition.
+func (consumer *KafkaLogConsumer) start() {
+  consumer.startOnce.Do(func() {
+    var readyWg sync.WaitGroup
+    for i, partitionConsumer := range consumer.consumers {
+      batchHandler := NewBatchHandler()
+      go consumer.partitions.run(int32(i), consumer.tracker.tap(batchHandler.outputChannel))
+      if consumer.waiting[i] {
+        readyWg.Add(1)
       }
+      go func(i int, partitionConsumer sarama.PartitionConsumer, batchHandler *BatchHandler, waiting bool) {
+        for input := range partitionConsumer.Messages() {
+          consumer.tracker.read(i, input.Offset + 1, partitionConsumer.HighWaterMarkOffset())
+          if waiting && partitionConsumer.HighWaterMarkOffset() - input.Offset <= 1 {
+            readyWg.Done()
+            waiting = false
+          }
+          if err := batchHandler.ProcessInput(input.Value, input.Topic, input.Offset, input.Timestamp); err != nil {
+            log.Error(err.Error())
+          }
+        }
+      }(i, partitionConsumer, batchHandler, consumer.waiting[i])
     }
-  }()
-  return consumer.batchHandler.outputChannel
+    go func() {
+      readyWg.Wait()
+      consumer.ready <- struct{}{}
+      consumer.ready = nil
+    }()
+  })
+}
+
+func (consumer *KafkaLogConsumer) Messages() <-chan *Operation {
+  consumer.start()
+  return consumer.partitions.Messages()
+}
+
+func (consumer *KafkaLogConsumer) PartitionMessages() []<-chan *Operation {
+  consumer.start()
+  return consumer.partitions.PartitionMessages()
 }
 
 func (consumer *KafkaLogConsumer) Ready() <-chan struct{} {
   return consumer.ready
 }
 
+// Progress reports the consumer's position in the topic, and the latest head
+// block it has read.
+func (consumer *KafkaLogConsumer) Progress() SyncProgress {
+  return consumer.tracker.progress()
+}
+
 func (consumer *KafkaLogConsumer) Close() {
-  consumer.consumer.Close()
+  for _, partitionConsumer := range consumer.consumers {
+    partitionConsumer.Close()
+  }
+  consumer.partitions.close()
 }
 
 func (consumer *KafkaLogConsumer) TopicName() string {
@@ -285,23 +381,76 @@ func (consumer *KafkaLogConsumer) TopicName() string {
 }
 
 func NewKafkaLogConsumer(consumer sarama.Consumer, topic string, offset int64, client sarama.Client) (LogConsumer, error) {
-  partitionConsumer, err := consumer.ConsumePartition(topic, 0, offset)
-  if err != nil {
-    return nil, err
-  }
-  var highOffset, lowOffset int64
+  return NewPartitionedKafkaLogConsumer(consumer, topic, map[int32]int64{0: offset}, client)
+}
+
+// NewPartitionedKafkaLogConsumer consumes every partition of topic, starting
+// from the offsets given for each partition, or the oldest available offset
+// for partitions without one.
+func NewPartitionedKafkaLogConsumer(consumer sarama.Consumer, topic string, offsets map[int32]int64, client sarama.Client) (LogConsumer, error) {
+  partitions := []int32{0}
   if client != nil {
-    highOffset, _ = client.GetOffset(topic, 0, sarama.OffsetNewest)
-    lowOffset, _ = client.GetOffset(topic, 0, sarama.OffsetOldest)
+    var err error
+    if partitions, err = client.Partitions(topic); err != nil {
+      return nil, err
+    }
+    sort.Slice(partitions, func(i, j int) bool { return partitions[i] < partitions[j] })
   }
-  return &KafkaLogConsumer{partitionConsumer, topic, nil, make(chan struct{}), (highOffset > lowOffset)}, nil
+  for i, partition := range partitions {
+    if partition != int32(i) {
+      return nil, fmt.Errorf("Unexpected partition %v of topic %v", partition, topic)
+    }
+  }
+  logConsumer := &KafkaLogConsumer{
+    topic: topic,
+    partitions: newPartitionSet(len(partitions)),
+    waiting: make([]bool, len(partitions)),
+    ready: make(chan struct{}),
+    tracker: newProgressTracker(len(partitions)),
+  }
+  topicExists := false
+  for _, partition := range partitions {
+    offset, ok := offsets[partition]
+    if !ok {
+      offset = sarama.OffsetOldest
+    }
+    partitionConsumer, err := consumer.ConsumePartition(topic, partition, offset)
+    if err != nil {
+      logConsumer.Close()
+      return nil, err
+    }
+    logConsumer.consumers = append(logConsumer.consumers, partitionConsumer)
+    var highOffset, lowOffset int64
+    if client != nil {
+      highOffset, _ = client.GetOffset(topic, partition, sarama.OffsetNewest)
+      lowOffset, _ = client.GetOffset(topic, partition, sarama.OffsetOldest)
+    }
+    start := offset
+    if offset == sarama.OffsetNewest {
+      start = highOffset
+    } else if start < lowOffset {
+      start = lowOffset
+    }
+    logConsumer.tracker.read(int(partition), start, highOffset)
+    // Partitions with nothing left to read are ready from the start
+    logConsumer.waiting[partition] = highOffset > lowOffset && (offset < 0 || offset < highOffset)
+    topicExists = topicExists || highOffset > lowOffset
+  }
+  if !topicExists {
+    for i := range logConsumer.waiting {
+      logConsumer.waiting[i] = false
+    }
+  }
+  logPartitions(topic, len(partitions))
+  return logConsumer, nil
 }
 
 func NewKafkaLogConsumerFromURL(brokerURL, topic string, offset int64) (LogConsumer, error) {
+  return NewPartitionedKafkaLogConsumerFromURL(brokerURL, topic, map[int32]int64{0: offset})
+}
+
+func NewPartitionedKafkaLogConsumerFromURL(brokerURL, topic string, offsets map[int32]int64) (LogConsumer, error) {
   brokers, config := ParseKafkaURL(brokerURL)
-  if err := CreateTopicIfDoesNotExist(brokerURL, topic, 1, nil); err != nil {
-    return nil, err
-  }
   client, err := sarama.NewClient(brokers, config)
   if err != nil {
     return nil, err
@@ -310,5 +459,5 @@ func NewKafkaLogConsumerFromURL(brokerURL, topic string, offset int64) (LogConsu
   if err != nil {
     return nil, err
   }
-  return NewKafkaLogConsumer(consumer, topic, offset, client)
+  return NewPartitionedKafkaLogConsumer(consumer, topic, offsets, client)
 }
@@ -2,15 +2,17 @@ package cdc
 
 import (
   "log"
+  "sync"
   "time"
 )
 
 type MockLogProducer struct {
   channel chan []byte
+  sealer
 }
 
 func (producer *MockLogProducer) Emit(data []byte) error {
-  producer.channel <- data
+  producer.channel <- producer.seal(data)
   return nil
 }
 
@@ -51,5 +53,86 @@ func (consumer *MockLogConsumer) TopicName() string {
 
 func MockLogPair() (LogProducer, LogConsumer) {
   channel := make(chan []byte, 2)
-  return &MockLogProducer{channel}, &MockLogConsumer{channel: channel}
+  return &MockLogProducer{channel: channel}, &MockLogConsumer{channel: channel}
+}
+
+// MockPartitionedLogProducer writes to an in-memory topic with several
+// partitions.
+type MockPartitionedLogProducer struct {
+  channels []chan []byte
+  sealer
+}
+
+func (producer *MockPartitionedLogProducer) Emit(data []byte) error {
+  return emitBarrier(producer.Partitions(), data, producer.EmitTo)
+}
+
+func (producer *MockPartitionedLogProducer) EmitTo(data []byte, partition int32) error {
+  producer.channels[partition] <- producer.seal(data)
+  return nil
+}
+
+func (producer *MockPartitionedLogProducer) Partitions() int32 {
+  return int32(len(producer.channels))
+}
+
+func (producer *MockPartitionedLogProducer) Close() {}
+
+type MockPartitionedLogConsumer struct {
+  channels []chan []byte
+  partitions *partitionSet
+  startOnce sync.Once
+}
+
+func (consumer *MockPartitionedLogConsumer) start() {
+  consumer.startOnce.Do(func() {
+    for i, channel := range consumer.channels {
+      handler := NewBatchHandler()
+      go consumer.partitions.run(int32(i), handler.outputChannel)
+      go func(channel chan []byte) {
+        counter := int64(0)
+        for value := range channel {
+          if err := handler.ProcessInput(value, "mock", counter, time.Now()); err != nil {
+            log.Printf(err.Error())
+          }
+          counter++
+        }
+      }(channel)
+    }
+  })
+}
+
+func (consumer *MockPartitionedLogConsumer) Messages() (<-chan *Operation) {
+  consumer.start()
+  return consumer.partitions.Messages()
+}
+
+func (consumer *MockPartitionedLogConsumer) PartitionMessages() []<-chan *Operation {
+  consumer.start()
+  return consumer.partitions.PartitionMessages()
+}
+
+func (consumer *MockPartitionedLogConsumer) Ready() (<-chan struct{}) {
+  channel := make(chan struct{})
+  go func () { channel <- struct{}{} }()
+  return channel
+}
+
+func (consumer *MockPartitionedLogConsumer) Close() {
+  consumer.partitions.close()
+}
+
+func (consumer *MockPartitionedLogConsumer) TopicName() string {
+  return "mock"
+}
+
+// MockPartitionedLogPair returns a producer and consumer for an in-memory
+// topic with the given number of partitions. Each partition buffers size
+// messages.
+func MockPartitionedLogPair(partitions, size int) (LogProducer, LogConsumer) {
+  channels := make([]chan []byte, partitions)
+  for i := range channels {
+    channels[i] = make(chan []byte, size)
+  }
+  return &MockPartitionedLogProducer{channels: channels}, &MockPartitionedLogConsumer{channels: channels, partitions: newPartitionSet(partitions)}
 }
@@ -3,11 +3,11 @@ package cdc
 import (
   "bytes"
   "fmt"
-  "encoding/binary"
   "github.com/ethereum/go-ethereum/common"
   "github.com/ethereum/go-ethereum/ethdb"
   "github.com/ethereum/go-ethereum/rlp"
   "github.com/ethereum/go-ethereum/log"
+  "github.com/ethereum/go-ethereum/metrics"
   "github.com/pborman/uuid"
   "errors"
   "time"
@@ -40,6 +40,7 @@ const (
   OpAppendAncient byte = 6
   OpTruncateAncients byte = 7
   OpSync byte = 8
+  OpBarrier byte = 9
   MinBlockAge = 80 * time.Millisecond
 )
 
@@ -54,6 +55,15 @@ var (
   applyTime = time.Since(time.Now())
   betweenTime = time.Since(time.Now())
   lastApply = time.Now()
+  // statsLock guards the above, as operations from different partitions may
+  // be applied concurrently.
+  statsLock sync.Mutex
+
+  applyMeter = metrics.NewRegisteredMeter("cdc/apply/operations", nil)
+  applyTimer = metrics.NewRegisteredTimer("cdc/apply/time", nil)
+  // applyDelayTimer tracks the time between the master emitting an operation
+  // and the replica applying it.
+  applyDelayTimer = metrics.NewRegisteredTimer("cdc/apply/delay", nil)
 )
 
 
@@ -120,6 +130,9 @@ func BatchOperationFromBytes(data []byte, topic string, offset int64) (BatchOper
   if data[0] != 255 {
     return bop, errors.New("Batch operations must begin with 0xFF")
   }
+  if len(data) < 18 {
+    return bop, errors.New("Batch operation is too short")
+  }
   bop.Op = data[1]
   bop.Batch = make(uuid.UUID, 16)
   copy(bop.Batch[:], data[2:18])
@@ -134,22 +147,35 @@ type Operation struct {
   Offset int64
   Topic string
   Timestamp time.Time
+  // Identity is the chain identity from the operation's envelope, if any.
+  Identity ChainIdentity
+  // Err is set if the message could not be decoded. Such operations must not
+  // be skipped, as the replica would silently diverge from the master.
+  Err error
+  // Barrier is set for operations that were emitted to every partition of a
+  // partitioned topic. See partition.go.
+  Barrier uint64
+  // Partitioned is set for operations consumed from a topic with more than
+  // one partition. Their offsets are only recorded at barriers, in Offsets.
+  Partitioned bool
+  Offsets map[int32]int64
 }
 
 func updateOffset(putter ethdb.KeyValueWriter, op *Operation) error {
+  if op.Partitioned {
+    if op.Offsets == nil {
+      return nil
+    }
+    return WritePartitionOffsets(putter, op.Topic, op.Offsets)
+  }
   if op.Offset != 0 {
-    buf := make([]byte, binary.MaxVarintLen64*2)
-    binary.PutVarint(buf[0:binary.MaxVarintLen64], op.Offset)
-    binary.PutVarint(buf[binary.MaxVarintLen64:], time.Now().Unix())
-    return putter.Put(
-      []byte(fmt.Sprintf("cdc-log-%v-offset", op.Topic)),
-      buf,
-    )
+    return WriteOffset(putter, op.Topic, op.Offset)
   }
   return nil
 }
 
 func logAndSleep(value []byte, timestamp time.Time, offset int64) {
+  statsLock.Lock()
   if time.Since(lastLog) > 1 * time.Second {
     log.Info("Recording LastBlock", "hash", common.BytesToHash(value), "delta", time.Since(timestamp), "lastBlock", time.Since(lastBlockUpdate), "offset", offset, "offsetDelta", offset - lastBlockOffset, "writes", lastBlockWrites, "blocks", blocksSinceLastLog, "applyTime", applyTime, "betweenTime", betweenTime)
     applyTime = time.Since(time.Now())
@@ -161,20 +187,103 @@ func logAndSleep(value []byte, timestamp time.Time, offset int64) {
   lastBlockUpdate = time.Now()
   lastBlockOffset = offset
   lastBlockWrites = 1
+  statsLock.Unlock()
   // To help ensure consistency across replicas, don't apply this operation
   // until MinBlockAge (80ms) after it was emitted by the master. If this
   // number is <= 0, it will not pause.
   time.Sleep(MinBlockAge - time.Since(timestamp))
 }
 
-func (op *Operation) Apply(db ethdb.Database) ([]byte, error) {
+// Verify checks that op was decoded successfully and comes from the chain
+// identified by id.
+func (op *Operation) Verify(id ChainIdentity) error {
+  if op.Err != nil {
+    return op.Err
+  }
+  if !op.Identity.Matches(id) {
+    return fmt.Errorf("%w: got %v, expected %v", ErrChainMismatch, op.Identity, id)
+  }
+  return nil
+}
+
+// track records the statistics and metrics for applying op. The returned
+// function should be called once op has been applied.
+func (op *Operation) track() func() {
+  statsLock.Lock()
   betweenTime += time.Since(lastApply)
+  lastBlockWrites++
+  statsLock.Unlock()
   applyStart := time.Now()
-  defer func() {
+  return func() {
+    statsLock.Lock()
     applyTime += time.Since(applyStart)
     lastApply = time.Now()
-  }()
-  lastBlockWrites++
+    statsLock.Unlock()
+    applyMeter.Mark(1)
+    applyTimer.UpdateSince(applyStart)
+    if !op.Timestamp.IsZero() {
+      applyDelayTimer.UpdateSince(op.Timestamp)
+    }
+  }
+}
+
+// batchable indicates whether op only writes keys, and so can be applied to
+// a batch by applyTo. Ancient operations go straight to the freezer.
+func (op *Operation) batchable() bool {
+  switch op.Op {
+  case OpAppendAncient, OpTruncateAncients, OpSync:
+    return false
+  }
+  return true
+}
+
+// boundary indicates whether the offset should be recorded once op has been
+// applied, given the head it wrote, if any.
+func (op *Operation) boundary(head []byte) bool {
+  return head != nil || op.Op == OpHeartbeat || op.Offsets != nil
+}
+
+func (op *Operation) Apply(db ethdb.Database) ([]byte, error) {
+  if op.Err != nil {
+    return nil, op.Err
+  }
+  defer op.track()()
+  if !op.batchable() {
+    return nil, op.applyAncient(db)
+  }
+  batch := db.NewBatch()
+  head, err := op.applyTo(batch)
+  if err != nil { return nil, err }
+  if op.boundary(head) {
+    if err := updateOffset(batch, op); err != nil { return nil, err }
+  }
+  return head, batch.Write()
+}
+
+// applyAncient applies operations on the freezer, which can't be batched.
+func (op *Operation) applyAncient(db ethdb.Database) error {
+  switch op.Op {
+  case OpAppendAncient:
+    a := &AncientData{}
+    if err := rlp.DecodeBytes(op.Data, a); err != nil { return err }
+    if err := db.AppendAncient(a.Number, a.Hash, a.Header, a.Body, a.Receipt, a.Td); err != nil { return err}
+  case OpTruncateAncients:
+    var n uint64
+    if err := rlp.DecodeBytes(op.Data, &n); err != nil { return err }
+    if err := db.TruncateAncients(n); err != nil { return err }
+  case OpSync:
+    if err := db.Sync(); err != nil { return err }
+  }
+  if op.Offsets != nil {
+    return updateOffset(db, op)
+  }
+  return nil
+}
+
+// applyTo writes the keys of a batchable operation to batch, returning the
+// head block hash if it writes LastBlock. Nothing is written if op can't be
+// decoded, so a batch holding several operations never holds part of one.
+func (op *Operation) applyTo(batch ethdb.KeyValueWriter) ([]byte, error) {
   switch op.Op {
   case OpPut:
     kv := &KeyValue{}
@@ -189,67 +298,60 @@ func (op *Operation) Apply(db ethdb.Database) ([]byte, error) {
       // inconsistencies.
       return nil, nil
     }
+    if err := batch.Put(kv.Key, kv.Value); err != nil { return nil, err }
     if bytes.Equal(kv.Key, []byte("LastBlock")) {
       logAndSleep(kv.Value, op.Timestamp, op.Offset)
-      batch := db.NewBatch()
-      if err := batch.Put(kv.Key, kv.Value); err != nil { return nil, err }
-      if err := updateOffset(batch, op); err != nil { return nil, err }
-      if err := batch.Write(); err != nil { return nil, err }
       return kv.Value, nil
     }
-    if err := db.Put(kv.Key, kv.Value); err != nil { return nil, err }
   case OpDelete:
     // For OpDelete, op.Data is the key to be deleted
-    db.Delete(op.Data)
-  case OpAppendAncient:
-    a := &AncientData{}
-    if err := rlp.DecodeBytes(op.Data, a); err != nil { return nil, err }
-    if err := db.AppendAncient(a.Number, a.Hash, a.Header, a.Body, a.Receipt, a.Td); err != nil { return nil, err}
-  case OpTruncateAncients:
-    var n uint64
-    if err := rlp.DecodeBytes(op.Data, &n); err != nil { return nil, err }
-    if err := db.TruncateAncients(n); err != nil { return nil, err }
-  case OpSync:
-    if err := db.Sync(); err != nil { return nil, err }
+    if err := batch.Delete(op.Data); err != nil { return nil, err }
   case OpWrite:
-    batch := db.NewBatch()
     var operations []BatchOperation
     if err := rlp.DecodeBytes(op.Data[16:], &operations); err != nil { return nil, err }
-    var headHash []byte
-    for _, bop := range operations {
+    // Decode every item before writing any of them
+    kvs := make([]*KeyValue, len(operations))
+    for i, bop := range operations {
       switch bop.Op {
       case OpPut:
-        kv := &KeyValue{}
-        if err := rlp.DecodeBytes(bop.Data, kv); err != nil { return nil, err }
-
-        if bytes.Equal(kv.Key, []byte("LastHeader")) && !headerTracker.add(kv.Value){
-          // We have already recorded this header. Recording it again could create
-          // inconsistencies.
-          continue
-        }
-        if bytes.Equal(kv.Key, []byte("LastBlock")) && !blockTracker.add(kv.Value){
-          // We have already recorded this block. Recording it again could create
-          // inconsistencies.
-          continue
-        }
-        if bytes.Equal(kv.Key, []byte("LastBlock")) {
-          logAndSleep(kv.Value, op.Timestamp, op.Offset)
-          if err := batch.Put(kv.Key, kv.Value); err != nil { return nil, err }
-          headHash = kv.Value
-        }
-        if err := batch.Put(kv.Key, kv.Value); err != nil { return nil, err }
+        kvs[i] = &KeyValue{}
+        if err := rlp.DecodeBytes(bop.Data, kvs[i]); err != nil { return nil, err }
       case OpDelete:
-        if err := batch.Delete(bop.Data); err != nil { return nil, err }
       default:
-        fmt.Printf("Unsupported operation: %#x", bop.Op)
+        return nil, fmt.Errorf("%w in batch: %#x", ErrUnknownOperation, bop.Op)
       }
-
     }
-    return headHash, batch.Write()
+    var headHash []byte
+    for i, bop := range operations {
+      kv := kvs[i]
+      if kv == nil {
+        if err := batch.Delete(bop.Data); err != nil { return nil, err }
+        continue
+      }
+      if bytes.Equal(kv.Key, []byte("LastHeader")) && !headerTracker.add(kv.Value){
+        // We have already recorded this header. Recording it again could create
+        // inconsistencies.
+        continue
+      }
+      if bytes.Equal(kv.Key, []byte("LastBlock")) && !blockTracker.add(kv.Value){
+        // We have already recorded this block. Recording it again could create
+        // inconsistencies.
+        continue
+      }
+      if bytes.Equal(kv.Key, []byte("LastBlock")) {
+        logAndSleep(kv.Value, op.Timestamp, op.Offset)
+        headHash = kv.Value
+      }
+      if err := batch.Put(kv.Key, kv.Value); err != nil { return nil, err }
+    }
+    return headHash, nil
   case OpHeartbeat:
-    return nil, updateOffset(db, op)
+    // Heartbeats only record the offset
+  case OpBarrier:
+    // Barriers only coordinate partitions; the consumer waits at them before
+    // delivering the operations that follow.
   default:
-    fmt.Printf("Unknown operation: %v \n", op)
+    return nil, fmt.Errorf("%w: %#x", ErrUnknownOperation, op.Op)
   }
   return nil, nil
 }
@@ -325,11 +427,11 @@ func SyncOperation() (*Operation, error) {
 }
 
 func DeleteOperation(key []byte) (*Operation, error) {
-  return &Operation{OpDelete, key, 0, "", time.Now()}, nil
+  return &Operation{Op: OpDelete, Data: key, Timestamp: time.Now()}, nil
 }
 
 func HeartbeatOperation() (*Operation) {
-  return &Operation{OpHeartbeat, []byte{}, 0, "", time.Now()}
+  return &Operation{Op: OpHeartbeat, Data: []byte{}, Timestamp: time.Now()}
 }
 
 func WriteOperation(batch Batch) (*Operation, error) {
@@ -340,9 +442,9 @@ func WriteOperation(batch Batch) (*Operation, error) {
 }
 
 func GetOperation(key []byte) (*Operation, error) {
-  return &Operation{OpGet, key, 0, "", time.Now()}, nil
+  return &Operation{Op: OpGet, Data: key, Timestamp: time.Now()}, nil
 }
 
 func HasOperation(key []byte) (*Operation, error) {
-  return &Operation{OpHas, key, 0, "", time.Now()}, nil
+  return &Operation{Op: OpHas, Data: key, Timestamp: time.Now()}, nil
 }
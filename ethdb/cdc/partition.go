@@ -0,0 +1,322 @@
+package cdc
+
+import (
+  "encoding/binary"
+  "errors"
+  "fmt"
+  "sort"
+  "sync"
+  "time"
+  "github.com/ethereum/go-ethereum/ethdb"
+  "github.com/ethereum/go-ethereum/log"
+  "github.com/ethereum/go-ethereum/rlp"
+)
+
+// Topics with more than one partition are written as follows:
+//
+// * Operations on a key (puts, deletes and batch items) are emitted to the
+//   partition for that key's range, so operations on any one key stay in
+//   order. A batch's OpWrite is emitted to each partition holding its items.
+// * Writes of LastBlock, and operations that don't concern a single key
+//   (ancients, syncs and heartbeats), are barriers. A barrier is an OpBarrier
+//   with the same id emitted to every partition, and the barrier operation
+//   itself is embedded in partition 0's copy. Batches containing LastBlock
+//   have all of their items emitted to partition 0.
+//
+// Replicas apply each partition in parallel. When a partition reaches a
+// barrier, it waits until partition 0 has applied the barrier operation, and
+// partition 0 only applies it once every other partition has reached it, so
+// a new head is never visible before the data written ahead of it. Consumers
+// batching operations (see BatchApplier) commit at every barrier. Partition
+// offsets are recorded with the barrier operation, so a restarted replica
+// resumes each partition from a consistent point.
+
+var (
+  // barrierID is the last barrier id issued. It is persisted in barrierStore,
+  // if the master has set one, so that ids increase across restarts of the
+  // master, which replicas rely on to recognize barriers they have passed.
+  barrierID uint64
+  barrierStore ethdb.KeyValueWriter
+  // barrierLock guards the above, and ensures concurrent barriers reach every
+  // partition in the same order.
+  barrierLock sync.Mutex
+  barrierIDKey = []byte("cdc-barrier-id")
+  headBlockKey = []byte("LastBlock")
+)
+
+// setBarrierStore loads the last barrier id issued from db, and persists the
+// ids issued from now on to it. Masters that issued barriers before their ids
+// were persisted seeded them from the clock, so the clock seeds a database
+// without one.
+func setBarrierStore(db ethdb.KeyValueStore) error {
+  barrierLock.Lock()
+  defer barrierLock.Unlock()
+  id := uint64(time.Now().UnixNano())
+  if data, err := db.Get(barrierIDKey); err == nil && len(data) == 8 {
+    id = binary.BigEndian.Uint64(data)
+  }
+  if id > barrierID {
+    barrierID = id
+  }
+  barrierStore = db
+  return putBarrierID(db, barrierID)
+}
+
+func putBarrierID(db ethdb.KeyValueWriter, id uint64) error {
+  var data [8]byte
+  binary.BigEndian.PutUint64(data[:], id)
+  return db.Put(barrierIDKey, data[:])
+}
+
+// nextBarrierID returns a new barrier id, persisting it before any barrier
+// carries it. barrierLock must be held.
+func nextBarrierID() (uint64, error) {
+  if barrierStore != nil {
+    if err := putBarrierID(barrierStore, barrierID + 1); err != nil {
+      return 0, err
+    }
+  }
+  barrierID++
+  return barrierID, nil
+}
+
+// KeyPartition returns the partition operations on key are emitted to,
+// dividing the keyspace into equal ranges.
+func KeyPartition(key []byte, partitions int32) int32 {
+  if partitions <= 1 {
+    return 0
+  }
+  var prefix [2]byte
+  copy(prefix[:], key)
+  return int32(uint32(binary.BigEndian.Uint16(prefix[:])) * uint32(partitions) >> 16)
+}
+
+// BarrierOperation constructs the barrier with the given id. Partition 0's
+// copy of a barrier embeds the barrier operation in data.
+func BarrierOperation(id uint64, data []byte) *Operation {
+  opData := make([]byte, 8 + len(data))
+  binary.BigEndian.PutUint64(opData, id)
+  copy(opData[8:], data)
+  return &Operation{Op: OpBarrier, Data: opData, Barrier: id, Timestamp: time.Now()}
+}
+
+// emitBarrier emits data as a barrier across all partitions.
+func emitBarrier(partitions int32, data []byte, emitTo func([]byte, int32) error) error {
+  barrierLock.Lock()
+  defer barrierLock.Unlock()
+  id, err := nextBarrierID()
+  if err != nil { return err }
+  for partition := partitions - 1; partition > 0; partition-- {
+    if err := emitTo(BarrierOperation(id, nil).Bytes(), partition); err != nil { return err }
+  }
+  return emitTo(BarrierOperation(id, data).Bytes(), 0)
+}
+
+// barriers tracks the progress of each partition through the barriers of a
+// topic.
+type barriers struct {
+  lock sync.Mutex
+  cond *sync.Cond
+  // arrived is the latest barrier each partition has reached, and offsets
+  // the offset at which it reached it.
+  arrived []uint64
+  offsets []int64
+  // leader is the barrier partition 0 has reached, and released the latest
+  // barrier operation it has applied.
+  leader uint64
+  released uint64
+  closed bool
+}
+
+func newBarriers(partitions int) *barriers {
+  b := &barriers{arrived: make([]uint64, partitions), offsets: make([]int64, partitions)}
+  b.cond = sync.NewCond(&b.lock)
+  return b
+}
+
+// arrive records that partition has applied everything before barrier id,
+// and waits until partition 0 has applied the barrier operation. Barriers
+// partition 0 has already passed (as when partitions resume from different
+// points) don't wait.
+func (b *barriers) arrive(partition int32, id uint64, offset int64) {
+  b.lock.Lock()
+  defer b.lock.Unlock()
+  b.arrived[partition] = id
+  b.offsets[partition] = offset
+  b.cond.Broadcast()
+  for !b.closed && b.released < id && b.leader <= id {
+    b.cond.Wait()
+  }
+}
+
+// wait is called when partition 0 reaches barrier id, and waits until every
+// other partition has reached it, returning the offsets to record when the
+// barrier operation is applied.
+func (b *barriers) wait(id uint64, offset int64) map[int32]int64 {
+  b.lock.Lock()
+  defer b.lock.Unlock()
+  if id > b.leader {
+    b.leader = id
+  }
+  b.arrived[0] = id
+  b.offsets[0] = offset
+  b.cond.Broadcast()
+  for !b.closed && !b.reached(id) {
+    b.cond.Wait()
+  }
+  offsets := make(map[int32]int64, len(b.offsets))
+  for partition, offset := range b.offsets {
+    offsets[int32(partition)] = offset
+  }
+  return offsets
+}
+
+func (b *barriers) reached(id uint64) bool {
+  for _, arrived := range b.arrived {
+    if arrived < id {
+      return false
+    }
+  }
+  return true
+}
+
+// release records that partition 0 has applied barrier id.
+func (b *barriers) release(id uint64) {
+  b.lock.Lock()
+  if id > b.released {
+    b.released = id
+  }
+  b.cond.Broadcast()
+  b.lock.Unlock()
+}
+
+func (b *barriers) close() {
+  b.lock.Lock()
+  b.closed = true
+  b.cond.Broadcast()
+  b.lock.Unlock()
+}
+
+// partitionSet delivers the operations of each partition of a topic,
+// coordinating them at barriers.
+type partitionSet struct {
+  outputs []chan *Operation
+  barriers *barriers
+  merged chan *Operation
+  mergeOnce sync.Once
+}
+
+func newPartitionSet(partitions int) *partitionSet {
+  ps := &partitionSet{outputs: make([]chan *Operation, partitions), barriers: newBarriers(partitions)}
+  for i := range ps.outputs {
+    ps.outputs[i] = make(chan *Operation)
+  }
+  return ps
+}
+
+// run delivers the operations from input for partition. The output channels
+// are unbuffered, so once an operation has been received, the consumer has
+// finished applying the one before it.
+func (ps *partitionSet) run(partition int32, input <-chan *Operation) {
+  output := ps.outputs[partition]
+  partitioned := len(ps.outputs) > 1
+  for op := range input {
+    op.Partitioned = partitioned
+    if op.Barrier == 0 || !partitioned {
+      output <- op
+      continue
+    }
+    if partition != 0 {
+      output <- op
+      // Receiving this indicates that the barrier has been applied, so anything
+      // the consumer batched ahead of it has been committed.
+      output <- &Operation{Op: OpBarrier, Topic: op.Topic, Offset: op.Offset, Barrier: op.Barrier, Partitioned: true}
+      ps.barriers.arrive(partition, op.Barrier, op.Offset)
+      continue
+    }
+    op.Offsets = ps.barriers.wait(op.Barrier, op.Offset)
+    output <- op
+    // Receiving this indicates that the barrier operation has been applied.
+    output <- &Operation{Op: OpBarrier, Topic: op.Topic, Offset: op.Offset, Barrier: op.Barrier, Partitioned: true}
+    ps.barriers.release(op.Barrier)
+  }
+}
+
+// Messages merges the operations of every partition, for consumers applying
+// them one at a time.
+func (ps *partitionSet) Messages() <-chan *Operation {
+  if len(ps.outputs) == 1 {
+    return ps.outputs[0]
+  }
+  ps.mergeOnce.Do(func() {
+    ps.merged = make(chan *Operation)
+    for _, output := range ps.outputs {
+      go func(output chan *Operation) {
+        for op := range output {
+          ps.merged <- op
+        }
+      }(output)
+    }
+  })
+  return ps.merged
+}
+
+func (ps *partitionSet) PartitionMessages() []<-chan *Operation {
+  outputs := make([]<-chan *Operation, len(ps.outputs))
+  for i, output := range ps.outputs {
+    outputs[i] = output
+  }
+  return outputs
+}
+
+func (ps *partitionSet) close() {
+  ps.barriers.close()
+}
+
+type partitionOffset struct {
+  Partition uint32
+  Offset uint64
+}
+
+// PartitionOffsetsKey is the database key under which replicas of
+// partitioned topics record the offset of each partition.
+func PartitionOffsetsKey(topic string) []byte {
+  return []byte(fmt.Sprintf("cdc-log-%v-offsets", topic))
+}
+
+// WritePartitionOffsets records the offsets from which a replica should
+// resume each partition of topic. Partition 0's offset is also recorded under
+// OffsetKey, along with the time, for health checks.
+func WritePartitionOffsets(putter ethdb.KeyValueWriter, topic string, offsets map[int32]int64) error {
+  records := make([]partitionOffset, 0, len(offsets))
+  for partition, offset := range offsets {
+    records = append(records, partitionOffset{uint32(partition), uint64(offset)})
+  }
+  sort.Slice(records, func(i, j int) bool { return records[i].Partition < records[j].Partition })
+  data, err := rlp.EncodeToBytes(records)
+  if err != nil { return err }
+  if err := putter.Put(PartitionOffsetsKey(topic), data); err != nil { return err }
+  return WriteOffset(putter, topic, offsets[0])
+}
+
+// ReadPartitionOffsets returns the offsets recorded by WritePartitionOffsets.
+func ReadPartitionOffsets(db ethdb.KeyValueReader, topic string) (map[int32]int64, error) {
+  data, err := db.Get(PartitionOffsetsKey(topic))
+  if err != nil { return nil, err }
+  if len(data) == 0 { return nil, errors.New("No partition offsets recorded") }
+  var records []partitionOffset
+  if err := rlp.DecodeBytes(data, &records); err != nil { return nil, err }
+  offsets := make(map[int32]int64, len(records))
+  for _, record := range records {
+    offsets[int32(record.Partition)] = int64(record.Offset)
+  }
+  return offsets, nil
+}
+
+// logPartitions logs the partition layout of a topic when a producer or
+// consumer starts.
+func logPartitions(topic string, partitions int) {
+  if partitions > 1 {
+    log.Info("Using partitioned CDC topic", "topic", topic, "partitions", partitions)
+  }
+}
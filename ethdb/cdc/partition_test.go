@@ -0,0 +1,179 @@
+package cdc_test
+
+import (
+  "encoding/binary"
+  "sync"
+  "testing"
+  "time"
+  "github.com/ethereum/go-ethereum/core/rawdb"
+  "github.com/ethereum/go-ethereum/ethdb"
+  "github.com/ethereum/go-ethereum/ethdb/cdc"
+)
+
+func TestKeyPartition(t *testing.T) {
+  for _, test := range []struct{
+    key []byte
+    partitions int32
+    partition int32
+  }{
+    {[]byte{0x00, 0x00}, 4, 0},
+    {[]byte{0x3f, 0xff}, 4, 0},
+    {[]byte{0x40}, 4, 1},
+    {[]byte{0xbf, 0xff, 0x01}, 4, 2},
+    {[]byte{0xff, 0xff}, 4, 3},
+    {[]byte{}, 4, 0},
+    {[]byte{0xff}, 1, 0},
+  } {
+    if partition := cdc.KeyPartition(test.key, test.partitions); partition != test.partition {
+      t.Errorf("KeyPartition(%x, %v) = %v, expected %v", test.key, test.partitions, partition, test.partition)
+    }
+  }
+}
+
+// applyPartitions applies each partition of consumer to db in parallel,
+// batching operations between barriers, and returns a channel of the heads
+// written.
+func applyPartitions(t *testing.T, consumer cdc.LogConsumer, db ethdb.Database) <-chan []byte {
+  heads := make(chan []byte, 10)
+  for _, messages := range consumer.(cdc.PartitionedConsumer).PartitionMessages() {
+    go func(messages <-chan *cdc.Operation) {
+      applier := cdc.NewBatchApplier(db)
+      for op := range messages {
+        head, err := applier.Apply(op)
+        if err != nil { t.Errorf(err.Error()) }
+        if head != nil {
+          heads <- head
+        }
+      }
+    }(messages)
+  }
+  return heads
+}
+
+func TestPartitionedBarrier(t *testing.T) {
+  producer, consumer := cdc.MockPartitionedLogPair(4, 1000)
+  defer consumer.Close()
+  master := cdc.NewDBWrapper(rawdb.NewMemoryDatabase(), producer, nil)
+  replica := rawdb.NewMemoryDatabase()
+  heads := applyPartitions(t, consumer, replica)
+
+  batch := master.NewBatch()
+  for i := 0; i < 256; i++ {
+    batch.Put([]byte{byte(i), 1}, []byte{byte(i)})
+  }
+  if err := batch.Write(); err != nil { t.Fatalf(err.Error()) }
+  for i := 0; i < 256; i += 16 {
+    if err := master.Put([]byte{byte(i), 2}, []byte{byte(i)}); err != nil { t.Fatalf(err.Error()) }
+  }
+  head := []byte("partitioned-head")
+  batch = master.NewBatch()
+  batch.Put([]byte("LastBlock"), head)
+  batch.Put([]byte("canonical"), head)
+  if err := batch.Write(); err != nil { t.Fatalf(err.Error()) }
+
+  select {
+  case written := <-heads:
+    if string(written) != string(head) {
+      t.Fatalf("Unexpected head %q", written)
+    }
+  case <-time.After(5 * time.Second):
+    t.Fatalf("Timed out waiting for head")
+  }
+  // Everything written before the head must be visible once it is
+  for i := 0; i < 256; i++ {
+    if ok, _ := replica.Has([]byte{byte(i), 1}); !ok {
+      t.Errorf("Missing batch item %v", i)
+    }
+  }
+  for i := 0; i < 256; i += 16 {
+    if ok, _ := replica.Has([]byte{byte(i), 2}); !ok {
+      t.Errorf("Missing put %v", i)
+    }
+  }
+  if value, _ := replica.Get([]byte("canonical")); string(value) != string(head) {
+    t.Errorf("Missing barrier batch item")
+  }
+  offsets, err := cdc.ReadPartitionOffsets(replica, "mock")
+  if err != nil { t.Fatalf(err.Error()) }
+  if len(offsets) != 4 {
+    t.Errorf("Expected offsets for 4 partitions, got %v", offsets)
+  }
+  if offset, _, err := cdc.ReadOffset(replica, "mock"); err != nil || offset != offsets[0] {
+    t.Errorf("Expected partition 0's offset %v to be recorded, got %v (%v)", offsets[0], offset, err)
+  }
+}
+
+func TestBarrierResume(t *testing.T) {
+  producer, consumer := cdc.MockPartitionedLogPair(3, 10)
+  defer consumer.Close()
+  emitter := producer.(cdc.PartitionedProducer)
+  // Partition 1 resumed before barrier 10, partition 2 after it, and
+  // partition 0 at it.
+  put, _ := cdc.PutOperation([]byte("key"), []byte("value"))
+  emitter.EmitTo(cdc.BarrierOperation(5, nil).Bytes(), 1)
+  emitter.EmitTo(put.Bytes(), 1)
+  emitter.EmitTo(cdc.BarrierOperation(10, nil).Bytes(), 1)
+  barrierPut, _ := cdc.PutOperation([]byte("barrier"), []byte("value"))
+  emitter.EmitTo(cdc.BarrierOperation(10, barrierPut.Bytes()).Bytes(), 0)
+  emitter.EmitTo(cdc.BarrierOperation(12, nil).Bytes(), 2)
+
+  var lock sync.Mutex
+  var order []string
+  barrierOp := make(chan *cdc.Operation, 1)
+  for _, messages := range consumer.(cdc.PartitionedConsumer).PartitionMessages() {
+    go func(messages <-chan *cdc.Operation) {
+      for op := range messages {
+        lock.Lock()
+        if op.Op == cdc.OpPut {
+          order = append(order, string(op.Data))
+          if op.Barrier != 0 {
+            barrierOp <- op
+          }
+        }
+        lock.Unlock()
+      }
+    }(messages)
+  }
+  var op *cdc.Operation
+  select {
+  case op = <-barrierOp:
+  case <-time.After(5 * time.Second):
+    t.Fatalf("Timed out waiting for barrier operation")
+  }
+  if op.Barrier != 10 || !op.Partitioned {
+    t.Errorf("Unexpected barrier operation %+v", op)
+  }
+  // Partition 1 resumes from barrier 10 and partition 2 from barrier 12
+  if len(op.Offsets) != 3 || op.Offsets[0] != 0 || op.Offsets[1] != 2 || op.Offsets[2] != 0 {
+    t.Errorf("Unexpected offsets %v", op.Offsets)
+  }
+  lock.Lock()
+  defer lock.Unlock()
+  if len(order) != 2 || order[1] != string(barrierPut.Data) {
+    t.Errorf("Barrier operation applied before the operations ahead of it")
+  }
+}
+
+func TestBarrierIDPersisted(t *testing.T) {
+  producer, consumer := cdc.MockPartitionedLogPair(2, 10)
+  defer consumer.Close()
+  db := rawdb.NewMemoryDatabase()
+  // A master that issued barriers up to this id before restarting
+  last := uint64(1) << 62
+  stored := make([]byte, 8)
+  binary.BigEndian.PutUint64(stored, last)
+  db.Put([]byte("cdc-barrier-id"), stored)
+  master := cdc.NewDBWrapper(db, producer, nil)
+  if err := master.Put([]byte("LastBlock"), []byte("head")); err != nil { t.Fatalf(err.Error()) }
+
+  op, err := getOpWithTimeout(consumer.(cdc.PartitionedConsumer).PartitionMessages()[1])
+  if err != nil { t.Fatalf(err.Error()) }
+  if op.Op != cdc.OpBarrier || op.Barrier != last + 1 {
+    t.Errorf("Expected barrier %v, got %v", last + 1, op.Barrier)
+  }
+  stored, err = db.Get([]byte("cdc-barrier-id"))
+  if err != nil { t.Fatalf(err.Error()) }
+  if id := binary.BigEndian.Uint64(stored); id != last + 1 {
+    t.Errorf("Expected barrier id %v to be persisted, got %v", last + 1, id)
+  }
+}
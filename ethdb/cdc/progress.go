@@ -0,0 +1,109 @@
+package cdc
+
+import (
+  "bytes"
+  "sync/atomic"
+  "github.com/ethereum/go-ethereum/common"
+  "github.com/ethereum/go-ethereum/rlp"
+)
+
+// SyncProgress describes how far a LogConsumer has read through its topic.
+// Offsets are summed over the topic's partitions, so the difference between
+// HighWatermark and Offset is the number of messages left to read.
+type SyncProgress struct {
+  Offset int64
+  HighWatermark int64
+  // LastBlock is the latest head block hash read from the topic. It may not
+  // have been applied yet.
+  LastBlock common.Hash
+}
+
+// Remaining returns the number of messages left to read.
+func (p SyncProgress) Remaining() int64 {
+  if p.HighWatermark < p.Offset { return 0 }
+  return p.HighWatermark - p.Offset
+}
+
+// ProgressConsumer is implemented by LogConsumers that can report their
+// progress through their topic.
+type ProgressConsumer interface {
+  Progress() SyncProgress
+}
+
+// HeadBlock returns the head block hash op writes, or nil if it doesn't write
+// LastBlock.
+func (op *Operation) HeadBlock() []byte {
+  // Only decode operations that could hold the key
+  if op.Err != nil || !bytes.Contains(op.Data, headBlockKey) {
+    return nil
+  }
+  switch op.Op {
+  case OpPut:
+    kv := &KeyValue{}
+    if err := rlp.DecodeBytes(op.Data, kv); err == nil && bytes.Equal(kv.Key, headBlockKey) {
+      return kv.Value
+    }
+  case OpWrite:
+    if len(op.Data) < 16 { return nil }
+    var operations []BatchOperation
+    if err := rlp.DecodeBytes(op.Data[16:], &operations); err != nil { return nil }
+    var head []byte
+    for _, bop := range operations {
+      if bop.Op != OpPut { continue }
+      kv := &KeyValue{}
+      if err := rlp.DecodeBytes(bop.Data, kv); err == nil && bytes.Equal(kv.Key, headBlockKey) {
+        head = kv.Value
+      }
+    }
+    return head
+  }
+  return nil
+}
+
+// progressTracker records a consumer's position in each partition of its
+// topic, and the latest head block it has read.
+type progressTracker struct {
+  offsets []int64
+  highWatermarks []int64
+  lastBlock atomic.Value
+}
+
+func newProgressTracker(partitions int) *progressTracker {
+  return &progressTracker{offsets: make([]int64, partitions), highWatermarks: make([]int64, partitions)}
+}
+
+// read records that the message before offset has been read from partition.
+// The high watermark is ignored until the consumer has fetched it.
+func (t *progressTracker) read(partition int, offset, highWatermark int64) {
+  atomic.StoreInt64(&t.offsets[partition], offset)
+  if highWatermark > 0 {
+    atomic.StoreInt64(&t.highWatermarks[partition], highWatermark)
+  }
+}
+
+// tap passes on the operations from input, noting head blocks as they go by.
+func (t *progressTracker) tap(input <-chan *Operation) <-chan *Operation {
+  output := make(chan *Operation)
+  go func() {
+    defer close(output)
+    for op := range input {
+      if head := op.HeadBlock(); head != nil {
+        t.lastBlock.Store(common.BytesToHash(head))
+      }
+      output <- op
+    }
+  }()
+  return output
+}
+
+func (t *progressTracker) progress() SyncProgress {
+  var p SyncProgress
+  for i := range t.offsets {
+    p.Offset += atomic.LoadInt64(&t.offsets[i])
+    p.HighWatermark += atomic.LoadInt64(&t.highWatermarks[i])
+  }
+  if hash, ok := t.lastBlock.Load().(common.Hash); ok {
+    p.LastBlock = hash
+  }
+  return p
+}
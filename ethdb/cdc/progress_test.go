@@ -0,0 +1,78 @@
+package cdc_test
+
+import (
+  "bytes"
+  "testing"
+  "time"
+  "github.com/ethereum/go-ethereum/common"
+  "github.com/ethereum/go-ethereum/ethdb/cdc"
+  "github.com/Shopify/sarama"
+  "github.com/Shopify/sarama/mocks"
+)
+
+func TestHeadBlock(t *testing.T) {
+  op, err := cdc.PutOperation([]byte("LastBlock"), []byte("put-head"))
+  if err != nil { t.Fatalf(err.Error()) }
+  if head := op.HeadBlock(); string(head) != "put-head" {
+    t.Errorf("Unexpected head %q", head)
+  }
+  op, err = cdc.PutOperation([]byte("LastHeader"), []byte("LastBlock"))
+  if err != nil { t.Fatalf(err.Error()) }
+  if head := op.HeadBlock(); head != nil {
+    t.Errorf("Expected no head from other keys, got %q", head)
+  }
+
+  db, writeStream, _ := getTestWrapper()
+  defer db.Close()
+  batch := db.NewBatch()
+  batch.Put([]byte("hello"), []byte("world"))
+  batch.Put([]byte("LastBlock"), []byte("batch-head"))
+  batch.Delete([]byte("gone"))
+  go batch.Write()
+  op, err = getOpWithTimeout(writeStream.Messages())
+  if err != nil { t.Fatalf(err.Error()) }
+  if op.Op != cdc.OpWrite {
+    t.Fatalf("Unexpected operation type %v", op.Op)
+  }
+  if head := op.HeadBlock(); string(head) != "batch-head" {
+    t.Errorf("Unexpected head %q", head)
+  }
+}
+
+func TestConsumerProgress(t *testing.T) {
+  consumer := mocks.NewConsumer(t, nil)
+  consumerPartition := consumer.ExpectConsumePartition("test", 0, 0)
+  logConsumer, err := cdc.NewKafkaLogConsumer(consumer, "test", 0, nil)
+  if err != nil { t.Fatalf(err.Error()) }
+  defer logConsumer.Close()
+  progressConsumer, ok := logConsumer.(cdc.ProgressConsumer)
+  if !ok {
+    t.Fatalf("Expected kafka consumer to report progress")
+  }
+  hash := common.HexToHash("0x1234")
+  ops := make([]*cdc.Operation, 3)
+  ops[0], _ = cdc.PutOperation([]byte("hello"), []byte("world"))
+  ops[1], _ = cdc.PutOperation([]byte("LastBlock"), hash.Bytes())
+  ops[2], _ = cdc.PutOperation([]byte("goodbye"), []byte("world"))
+  for _, op := range ops {
+    consumerPartition.YieldMessage(&sarama.ConsumerMessage{Topic: "test", Value: op.Bytes()})
+  }
+  go func() { <-logConsumer.Ready() }()
+  for i := range ops {
+    select {
+    case op := <-logConsumer.Messages():
+      if !bytes.Equal(op.Data, ops[i].Data) {
+        t.Errorf("Unexpected operation %v", i)
+      }
+    case <-time.After(5 * time.Second):
+      t.Fatalf("Timed out waiting for operation %v", i)
+    }
+  }
+  progress := progressConsumer.Progress()
+  if progress.LastBlock != hash {
+    t.Errorf("Unexpected last block %#x", progress.LastBlock)
+  }
+  if progress.Offset != 4 || progress.HighWatermark != 4 || progress.Remaining() != 0 {
+    t.Errorf("Unexpected progress %v/%v", progress.Offset, progress.HighWatermark)
+  }
+}
@@ -0,0 +1,49 @@
+package cdc
+
+import (
+  "fmt"
+  "strings"
+)
+
+// IsKafkaURL indicates whether brokerURL refers to a Kafka cluster, as opposed
+// to one of the other LogProducer / LogConsumer transports. Kafka broker lists
+// are given without a scheme (eg. "kafka:9092") or with the kafka:// scheme.
+func IsKafkaURL(brokerURL string) bool {
+  return !strings.HasPrefix(brokerURL, "file://")
+}
+
+// NewLogProducerFromURL constructs a LogProducer for the transport indicated
+// by the scheme of brokerURL. file:///path/to/dir URLs write rotating segment
+// files to the specified directory; anything else is treated as a Kafka broker
+// list.
+func NewLogProducerFromURL(brokerURL, topic string) (LogProducer, error) {
+  if IsKafkaURL(brokerURL) {
+    return NewKafkaLogProducerFromURL(strings.TrimPrefix(brokerURL, "kafka://"), topic)
+  }
+  return NewFileLogProducer(brokerURL, topic)
+}
+
+// NewLogConsumerFromURL constructs a LogConsumer for the transport indicated
+// by the scheme of brokerURL, starting at the specified offset. Negative
+// offsets have the same meaning as sarama.OffsetOldest and
+// sarama.OffsetNewest for Kafka, while the file transport treats any negative
+// offset as the oldest available.
+func NewLogConsumerFromURL(brokerURL, topic string, offset int64) (LogConsumer, error) {
+  if IsKafkaURL(brokerURL) {
+    return NewKafkaLogConsumerFromURL(strings.TrimPrefix(brokerURL, "kafka://"), topic, offset)
+  }
+  return NewFileLogConsumer(brokerURL, topic, offset)
+}
+
+// NewPartitionedLogConsumerFromURL constructs a LogConsumer resuming each
+// partition of topic from the given offsets, as recorded by
+// WritePartitionOffsets. Only Kafka topics may have more than one partition.
+func NewPartitionedLogConsumerFromURL(brokerURL, topic string, offsets map[int32]int64) (LogConsumer, error) {
+  if IsKafkaURL(brokerURL) {
+    return NewPartitionedKafkaLogConsumerFromURL(strings.TrimPrefix(brokerURL, "kafka://"), topic, offsets)
+  }
+  if len(offsets) > 1 {
+    return nil, fmt.Errorf("The file transport does not support partitioned topics")
+  }
+  return NewFileLogConsumer(brokerURL, topic, offsets[0])
+}
@@ -1,10 +1,15 @@
 package cdc
 import (
+  "bytes"
   "fmt"
   "github.com/ethereum/go-ethereum/ethdb"
   "github.com/ethereum/go-ethereum/rlp"
   "github.com/ethereum/go-ethereum/log"
+  "github.com/ethereum/go-ethereum/common"
+  "github.com/ethereum/go-ethereum/core/rawdb"
   "github.com/pborman/uuid"
+  "sync"
+  "sync/atomic"
 )
 
 type BatchWrapper struct {
@@ -12,6 +17,11 @@ type BatchWrapper struct {
   writeStream LogProducer
   operations []BatchOperation
   batchid uuid.UUID
+  db *DBWrapper
+  // keys holds the key of each of operations, to route them to partitions.
+  keys [][]byte
+  // barrier is set if the batch writes the head block.
+  barrier bool
 }
 
 func (batch *BatchWrapper) BatchId() ([]byte) {
@@ -24,12 +34,16 @@ func (batch *BatchWrapper) Put(key, value []byte) (error) {
     if err != nil { return err }
     op := BatchOperation{OpPut, batch.batchid, data}
     batch.operations = append(batch.operations, op)
+    batch.keys = append(batch.keys, key)
+    batch.barrier = batch.barrier || bytes.Equal(key, headBlockKey)
   }
   return batch.batch.Put(key, value)
 }
 
 func (batch *BatchWrapper) Reset() {
   batch.operations = []BatchOperation{}
+  batch.keys = nil
+  batch.barrier = false
   batch.batch.Reset()
 }
 
@@ -37,6 +51,7 @@ func (batch *BatchWrapper) Delete(key []byte) (error) {
   if batch.writeStream != nil {
     op := BatchOperation{OpDelete, batch.batchid, key}
     batch.operations = append(batch.operations, op)
+    batch.keys = append(batch.keys, key)
   }
   return batch.batch.Delete(key)
 }
@@ -46,10 +61,17 @@ func (batch *BatchWrapper) ValueSize() int {
 }
 
 func (batch *BatchWrapper) Write() error {
+  batch.db.lock.RLock()
+  defer batch.db.lock.RUnlock()
   if batch.writeStream != nil {
+    batch.db.identify()
     op, err := WriteOperation(batch)
     if err != nil { return err }
     if len(batch.operations) > 0 {
+      if producer, ok := batch.db.partitioned(); ok {
+        if err := batch.emitPartitioned(producer, op); err != nil { return err }
+        return batch.batch.Write()
+      }
       for _, bop := range batch.operations {
         if err := batch.writeStream.Emit(bop.Bytes()); err != nil {
           log.Warn("Failed to write batch item", "length", len(bop.Bytes()))
@@ -67,6 +89,35 @@ func (batch *BatchWrapper) Write() error {
   return batch.batch.Write()
 }
 
+// emitPartitioned emits the batch to a partitioned topic. Each item goes to
+// the partition for its key, followed by the write operation to each of those
+// partitions, unless the batch writes the head block. Such batches are
+// emitted to partition 0 with the write operation as a barrier.
+func (batch *BatchWrapper) emitPartitioned(producer PartitionedProducer, op *Operation) error {
+  partitions := make(map[int32]struct{})
+  for i, bop := range batch.operations {
+    partition := int32(0)
+    if !batch.barrier {
+      partition = KeyPartition(batch.keys[i], producer.Partitions())
+    }
+    if err := producer.EmitTo(bop.Bytes(), partition); err != nil {
+      log.Warn("Failed to write batch item", "length", len(bop.Bytes()), "partition", partition)
+      return err
+    }
+    partitions[partition] = struct{}{}
+  }
+  if batch.barrier {
+    return batch.writeStream.Emit(op.Bytes())
+  }
+  for partition := range partitions {
+    if err := producer.EmitTo(op.Bytes(), partition); err != nil {
+      log.Warn("Failed to write batch", "length", len(op.Bytes()), "partition", partition)
+      return err
+    }
+  }
+  return nil
+}
+
 // Replay replays the batch contents.
 func (batch *BatchWrapper) Replay(w ethdb.KeyValueWriter) error {
 	return batch.batch.Replay(w)
@@ -76,13 +127,64 @@ type DBWrapper struct {
   db ethdb.Database
   writeStream LogProducer
   readStream LogProducer
+  // lock is held for reading while a write is emitted and applied, so that
+  // Snapshot can find a point where every emitted write has been applied.
+  lock sync.RWMutex
+  identified int32
+}
+
+// identify tags the operations emitted by the write stream with the identity
+// of the chain once its genesis block and chain config have been written.
+func (db *DBWrapper) identify() {
+  if atomic.LoadInt32(&db.identified) == 1 {
+    return
+  }
+  producer, ok := db.writeStream.(IdentityProducer)
+  if !ok {
+    atomic.StoreInt32(&db.identified, 1)
+    return
+  }
+  genesis := rawdb.ReadCanonicalHash(db.db, 0)
+  if genesis == (common.Hash{}) {
+    return
+  }
+  config := rawdb.ReadChainConfig(db.db, genesis)
+  if config == nil {
+    return
+  }
+  id := ChainIdentity{Genesis: genesis}
+  if config.ChainID != nil {
+    id.ChainID = config.ChainID.Uint64()
+  }
+  producer.SetChainIdentity(id)
+  atomic.StoreInt32(&db.identified, 1)
+  log.Info("Tagging CDC operations with chain identity", "genesis", genesis, "chainid", id.ChainID)
+}
+
+// partitioned returns the write stream if it writes to more than one
+// partition.
+func (db *DBWrapper) partitioned() (PartitionedProducer, bool) {
+  producer, ok := db.writeStream.(PartitionedProducer)
+  return producer, ok && producer.Partitions() > 1
+}
+
+// emitKeyed emits an operation on key. On partitioned topics it is emitted to
+// the partition for key, unless it writes the head block, which is a barrier.
+func (db *DBWrapper) emitKeyed(key, data []byte) error {
+  if producer, ok := db.partitioned(); ok && !bytes.Equal(key, headBlockKey) {
+    return producer.EmitTo(data, KeyPartition(key, producer.Partitions()))
+  }
+  return db.writeStream.Emit(data)
 }
 
 func (db *DBWrapper) Put(key, value []byte) error {
+  db.lock.RLock()
+  defer db.lock.RUnlock()
   if db.writeStream != nil {
+    db.identify()
     op, err := PutOperation(key, value)
     if err != nil { return err }
-    if err = db.writeStream.Emit(op.Bytes()); err != nil {
+    if err = db.emitKeyed(key, op.Bytes()); err != nil {
       log.Warn("Failed to put item", "length", len(op.Bytes()))
       log.Warn(fmt.Sprintf("Item bytes: %#x", op.Bytes()))
       return err
@@ -108,10 +210,13 @@ func (db *DBWrapper) Has(key []byte) (bool, error) {
 }
 
 func (db *DBWrapper) Delete(key []byte) error {
+  db.lock.RLock()
+  defer db.lock.RUnlock()
   if db.writeStream != nil {
+    db.identify()
     op, err := DeleteOperation(key)
     if err != nil { return err }
-    if err = db.writeStream.Emit(op.Bytes()); err != nil {
+    if err = db.emitKeyed(key, op.Bytes()); err != nil {
       return err
     }
   }
@@ -121,7 +226,10 @@ func (db *DBWrapper) Delete(key []byte) error {
 // AppendAncient injects all binary blobs belong to block at the end of the
 // append-only immutable table files.
 func (db *DBWrapper) AppendAncient(number uint64, hash, header, body, receipt, td []byte) error {
+  db.lock.RLock()
+  defer db.lock.RUnlock()
   if db.writeStream != nil {
+    db.identify()
     op, err := AppendAncientOperation(number, hash, header, body, receipt, td)
     if err != nil { return err }
     if err = db.writeStream.Emit(op.Bytes()); err != nil {
@@ -135,7 +243,10 @@ func (db *DBWrapper) AppendAncient(number uint64, hash, header, body, receipt, t
 
 // TruncateAncients discards all but the first n ancient data from the ancient store.
 func (db *DBWrapper) TruncateAncients(n uint64) error {
+  db.lock.RLock()
+  defer db.lock.RUnlock()
   if db.writeStream != nil {
+    db.identify()
     op, err := TruncateAncientsOperation(n)
     if err != nil { return err }
     if err = db.writeStream.Emit(op.Bytes()); err != nil {
@@ -150,6 +261,7 @@ func (db *DBWrapper) TruncateAncients(n uint64) error {
 // Sync flushes all in-memory ancient store data to disk.
 func (db *DBWrapper) Sync() error {
   if db.writeStream != nil {
+    db.identify()
     op, err := SyncOperation()
     if err != nil { return err }
     if err = db.writeStream.Emit(op.Bytes()); err != nil {
@@ -207,7 +319,34 @@ func (db *DBWrapper) Close() error {
 
 func (db *DBWrapper) NewBatch() ethdb.Batch {
   dbBatch := db.db.NewBatch()
-  return &BatchWrapper{dbBatch, db.writeStream, []BatchOperation{}, uuid.NewRandom()}
+  return &BatchWrapper{dbBatch, db.writeStream, []BatchOperation{}, uuid.NewRandom(), db, nil, false}
+}
+
+// Snapshot briefly pauses writes to take a consistent snapshot of the
+// database for export, returning an iterator over the snapshot, the number of
+// ancient items, and the offset of the first write not reflected in it. The
+// write stream must implement OffsetProducer.
+func (db *DBWrapper) Snapshot() (ethdb.Iterator, uint64, int64, error) {
+  producer, ok := db.writeStream.(OffsetProducer)
+  if !ok {
+    return nil, 0, 0, fmt.Errorf("Write stream cannot report offsets")
+  }
+  db.lock.Lock()
+  defer db.lock.Unlock()
+  offset, err := producer.NextOffset()
+  if err != nil { return nil, 0, 0, err }
+  // Leveldb iterators read from an implicit snapshot, so the iterator will
+  // not reflect any writes that happen after it is created.
+  it := db.db.NewIterator(nil, nil)
+  // The freezer may move items from the key value store into the ancient
+  // store at any time, so count the ancients after creating the iterator to
+  // be sure that nothing is missed.
+  ancients, err := db.db.Ancients()
+  if err != nil {
+    // Databases without a freezer have no ancients to export
+    ancients = 0
+  }
+  return it, ancients, offset, nil
 }
 
 // NewIterator creates a binary-alphabetical iterator over the entire keyspace
@@ -217,5 +356,11 @@ func (db *DBWrapper) NewIterator(start, end []byte) ethdb.Iterator {
 }
 
 func NewDBWrapper(db ethdb.Database, writeStream, readStream LogProducer) ethdb.Database {
-  return &DBWrapper{db, writeStream, readStream}
+  wrapper := &DBWrapper{db: db, writeStream: writeStream, readStream: readStream}
+  if _, ok := wrapper.partitioned(); ok {
+    if err := setBarrierStore(db); err != nil {
+      log.Error("Failed to persist barrier id", "err", err)
+    }
+  }
+  return wrapper
 }
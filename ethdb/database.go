@@ -37,6 +37,15 @@ type KeyValueWriter interface {
 	Delete(key []byte) error
 }
 
+// RangeDeleter wraps the DeleteRange method of a backing data store. A range
+// only suits data that owns every key in it: legacy trie nodes are keyed by
+// bare hashes, so prefixes they share can't be range deleted.
+type RangeDeleter interface {
+	// DeleteRange removes all keys in the range [start, end) from the data
+	// store. An empty end is treated as a key after all keys in the data store.
+	DeleteRange(start, end []byte) error
+}
+
 // Stater wraps the Stat method of a backing data store.
 type Stater interface {
 	// Stat returns a particular internal stat of the database.
@@ -0,0 +1,91 @@
+package overlay
+
+import (
+  "bytes"
+  "github.com/ethereum/go-ethereum/common"
+  "github.com/ethereum/go-ethereum/ethdb"
+)
+
+var deletedPrefix = []byte("deleted/")
+
+// ForEach calls fn for each change recorded in an overlay database: a write
+// of value to key, or a deletion of key if deleted is set. Range tombstones
+// are left to ForEachRange.
+func ForEach(overlay ethdb.KeyValueStore, fn func(key, value []byte, deleted bool) error) error {
+  it := overlay.NewIterator(nil, nil)
+  defer it.Release()
+  for it.Next() {
+    key := it.Key()
+    var err error
+    if bytes.HasPrefix(key, deletedRangePrefix) {
+      continue
+    } else if bytes.HasPrefix(key, deletedPrefix) {
+      err = fn(key[len(deletedPrefix):], nil, true)
+    } else {
+      err = fn(key, it.Value(), false)
+    }
+    if err != nil { return err }
+  }
+  return it.Error()
+}
+
+// Commit folds the changes recorded in the overlay database into the
+// underlay, then empties the overlay. Range deletions are applied first, as
+// any overlay values in a deleted range were written after it. Applying the
+// changes twice has the same effect as applying them once, so an interrupted
+// commit can be rerun.
+func Commit(overlay, underlay ethdb.KeyValueStore) (puts, deletes int, err error) {
+  batch := underlay.NewBatch()
+  err = ForEachRange(overlay, func(start, end []byte) error {
+    r := keyRange{start, end}
+    it := underlay.NewIterator(nil, start)
+    defer it.Release()
+    for it.Next() && r.contains(it.Key()) {
+      deletes++
+      if err := batch.Delete(common.CopyBytes(it.Key())); err != nil { return err }
+      if batch.ValueSize() >= ethdb.IdealBatchSize {
+        if err := batch.Write(); err != nil { return err }
+        batch.Reset()
+      }
+    }
+    return it.Error()
+  })
+  if err != nil { return puts, deletes, err }
+  err = ForEach(overlay, func(key, value []byte, deleted bool) error {
+    if deleted {
+      deletes++
+      if err := batch.Delete(key); err != nil { return err }
+    } else {
+      puts++
+      if err := batch.Put(key, value); err != nil { return err }
+    }
+    if batch.ValueSize() >= ethdb.IdealBatchSize {
+      if err := batch.Write(); err != nil { return err }
+      batch.Reset()
+    }
+    return nil
+  })
+  if err != nil { return puts, deletes, err }
+  if err := batch.Write(); err != nil { return puts, deletes, err }
+  _, err = Discard(overlay)
+  return puts, deletes, err
+}
+
+// Discard empties the overlay database, dropping the changes it recorded. It
+// returns the number of keys removed.
+func Discard(overlay ethdb.KeyValueStore) (int, error) {
+  it := overlay.NewIterator(nil, nil)
+  defer it.Release()
+  batch := overlay.NewBatch()
+  count := 0
+  for it.Next() {
+    if err := batch.Delete(it.Key()); err != nil { return count, err }
+    count++
+    if batch.ValueSize() >= ethdb.IdealBatchSize {
+      if err := batch.Write(); err != nil { return count, err }
+      batch.Reset()
+    }
+  }
+  if err := it.Error(); err != nil { return count, err }
+  return count, batch.Write()
+}
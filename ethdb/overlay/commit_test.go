@@ -0,0 +1,56 @@
+package overlay
+
+import (
+	"testing"
+)
+
+func TestCommit(t *testing.T) {
+	wrapper, overlay, underlay := GetWrapperNoCache()
+	underlay.Put([]byte("a"), []byte("A"))
+	underlay.Put([]byte("b"), []byte("B"))
+	wrapper.Put([]byte("a"), []byte("A2"))
+	wrapper.Put([]byte("c"), []byte("C"))
+	wrapper.Delete([]byte("b"))
+
+	puts, deletes, err := Commit(overlay, underlay)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if puts != 2 || deletes != 1 {
+		t.Errorf("Unexpected changes: %v puts, %v deletes", puts, deletes)
+	}
+	for key, expected := range map[string]string{"a": "A2", "c": "C"} {
+		if val, err := underlay.Get([]byte(key)); err != nil || string(val) != expected {
+			t.Errorf("Unexpected value for %v: %v (%v)", key, string(val), err)
+		}
+	}
+	if ok, _ := underlay.Has([]byte("b")); ok {
+		t.Errorf("Expected b to be deleted")
+	}
+	if ok, _ := underlay.Has(deleted([]byte("b"))); ok {
+		t.Errorf("Tombstone committed to the underlay")
+	}
+	it := overlay.NewIterator(nil, nil)
+	defer it.Release()
+	if it.Next() {
+		t.Errorf("Expected empty overlay, found %v", string(it.Key()))
+	}
+}
+
+func TestDiscard(t *testing.T) {
+	wrapper, overlay, underlay := GetWrapperNoCache()
+	underlay.Put([]byte("a"), []byte("A"))
+	wrapper.Put([]byte("a"), []byte("A2"))
+	wrapper.Delete([]byte("b"))
+
+	count, err := Discard(overlay)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if count != 2 {
+		t.Errorf("Expected 2 keys discarded, got %v", count)
+	}
+	if val, err := wrapper.Get([]byte("a")); err != nil || string(val) != "A" {
+		t.Errorf("Expected underlay value after discard, got %v (%v)", string(val), err)
+	}
+}
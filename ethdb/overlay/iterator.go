@@ -2,9 +2,13 @@ package overlay
 
 import (
   "bytes"
+  "github.com/ethereum/go-ethereum/common"
   "github.com/ethereum/go-ethereum/ethdb"
 )
 
+// WrappedIterator merges the overlay's values with the underlay's, in key
+// order. Where both databases hold a key the overlay's value wins, and
+// underlay keys hidden by point or range tombstones are skipped.
 type WrappedIterator struct {
   wrapper *OverlayWrapperDB
   overlayIterator ethdb.Iterator
@@ -16,49 +20,58 @@ type WrappedIterator struct {
   val []byte
 }
 
+func (wi *WrappedIterator) setErr(err error) {
+  if wi.err == nil { wi.err = err }
+}
+
+func (wi *WrappedIterator) nextOverlay() {
+  if !wi.overlayIterator.Next() {
+    wi.overlayDone = true
+    wi.setErr(wi.overlayIterator.Error())
+  }
+}
+
+func (wi *WrappedIterator) nextUnderlay() {
+  if !wi.underlayIterator.Next() {
+    wi.underlayDone = true
+    wi.setErr(wi.underlayIterator.Error())
+  }
+}
+
 func (wi *WrappedIterator) Next() bool {
-  if (wi.overlayDone && wi.underlayDone) || wi.err != nil {
+  if wi.err != nil {
     return false
   }
-  oKey := wi.overlayIterator.Key()
-  for !wi.overlayDone && bytes.HasPrefix(oKey, []byte("deleted/")) {
-    if !wi.overlayIterator.Next() {
-      wi.overlayDone = true
-      wi.err = wi.overlayIterator.Error()
-    }
-    oKey = wi.overlayIterator.Key()
+  for !wi.overlayDone && isTombstone(wi.overlayIterator.Key()) {
+    wi.nextOverlay()
   }
-  uKey := wi.underlayIterator.Key()
-  for !wi.underlayDone {
-    if isDeleted, _ := wi.wrapper.overlay.Has(deleted(uKey)); !isDeleted {
-      break
-    }
-    if !wi.underlayIterator.Next() {
-      wi.underlayDone = true
-      wi.err = wi.underlayIterator.Error()
-    }
+  for !wi.underlayDone && wi.wrapper.isDeleted(wi.underlayIterator.Key()) {
+    wi.nextUnderlay()
   }
+  if (wi.overlayDone && wi.underlayDone) || wi.err != nil {
+    return false
+  }
+  // Keys are copied, as the source iterators may reuse their buffers
   if !wi.overlayDone {
-    if wi.underlayDone || (bytes.Compare(oKey, uKey) < 0) {
-      wi.key = oKey
-      wi.val = wi.overlayIterator.Value()
-      if !wi.overlayIterator.Next() {
-        wi.overlayDone = true
-        wi.err = wi.overlayIterator.Error()
+    cmp := -1
+    if !wi.underlayDone {
+      cmp = bytes.Compare(wi.overlayIterator.Key(), wi.underlayIterator.Key())
+    }
+    if cmp <= 0 {
+      wi.key = common.CopyBytes(wi.overlayIterator.Key())
+      wi.val = common.CopyBytes(wi.overlayIterator.Value())
+      wi.nextOverlay()
+      if cmp == 0 {
+        // The overlay's value shadows the underlay's
+        wi.nextUnderlay()
       }
       return true
     }
   }
-  if !wi.underlayDone {
-    wi.key = uKey
-    wi.val = wi.underlayIterator.Value()
-    if !wi.underlayIterator.Next() {
-      wi.underlayDone = true
-      wi.err = wi.underlayIterator.Error()
-    }
-    return true
-  }
-  return false
+  wi.key = common.CopyBytes(wi.underlayIterator.Key())
+  wi.val = common.CopyBytes(wi.underlayIterator.Value())
+  wi.nextUnderlay()
+  return true
 }
 func (wi *WrappedIterator) Error() error {
   return wi.err
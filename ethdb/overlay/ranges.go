@@ -0,0 +1,160 @@
+package overlay
+
+import (
+  "bytes"
+  "sort"
+  "github.com/ethereum/go-ethereum/common"
+  "github.com/ethereum/go-ethereum/ethdb"
+)
+
+// deletedRangePrefix marks range tombstones in the overlay. Each maps the
+// start of a deleted range to its end, with an empty end for a range that
+// runs to the end of the keyspace.
+var deletedRangePrefix = []byte("deletedrange/")
+
+// keyRange is the range of keys [start, end). An empty end has no upper bound.
+type keyRange struct {
+  start []byte
+  end []byte
+}
+
+func (r keyRange) contains(key []byte) bool {
+  return bytes.Compare(key, r.start) >= 0 && (len(r.end) == 0 || bytes.Compare(key, r.end) < 0)
+}
+
+// overlaps reports whether r and other overlap or touch, so that they can be
+// merged into a single range.
+func (r keyRange) overlaps(other keyRange) bool {
+  return (len(r.end) == 0 || bytes.Compare(other.start, r.end) <= 0) &&
+    (len(other.end) == 0 || bytes.Compare(r.start, other.end) <= 0)
+}
+
+func deletedRange(start []byte) []byte {
+  return append(append([]byte{}, deletedRangePrefix...), start...)
+}
+
+// isTombstone reports whether an overlay key is a point or range tombstone,
+// rather than a value written to the overlay.
+func isTombstone(key []byte) bool {
+  return bytes.HasPrefix(key, deletedPrefix) || bytes.HasPrefix(key, deletedRangePrefix)
+}
+
+// ForEachRange calls fn for each range tombstone recorded in an overlay
+// database, in order.
+func ForEachRange(overlay ethdb.KeyValueStore, fn func(start, end []byte) error) error {
+  it := overlay.NewIterator(deletedRangePrefix, nil)
+  defer it.Release()
+  for it.Next() {
+    if err := fn(common.CopyBytes(it.Key()[len(deletedRangePrefix):]), common.CopyBytes(it.Value())); err != nil {
+      return err
+    }
+  }
+  return it.Error()
+}
+
+// loadRanges reads the overlay's range tombstones into memory. Ranges are
+// merged as they're written, so they're disjoint and sorted by start.
+func (wrapper *OverlayWrapperDB) loadRanges() error {
+  var ranges []keyRange
+  err := ForEachRange(wrapper.overlay, func(start, end []byte) error {
+    ranges = append(ranges, keyRange{start, end})
+    return nil
+  })
+  if err != nil { return err }
+  wrapper.rangeLock.Lock()
+  wrapper.ranges = ranges
+  wrapper.rangeLock.Unlock()
+  return nil
+}
+
+// rangeDeleted reports whether key falls in a range tombstone.
+func (wrapper *OverlayWrapperDB) rangeDeleted(key []byte) bool {
+  wrapper.rangeLock.RLock()
+  defer wrapper.rangeLock.RUnlock()
+  i := sort.Search(len(wrapper.ranges), func(i int) bool {
+    return bytes.Compare(wrapper.ranges[i].start, key) > 0
+  })
+  return i > 0 && wrapper.ranges[i - 1].contains(key)
+}
+
+// isDeleted reports whether an underlay key is hidden by a point or range
+// tombstone.
+func (wrapper *OverlayWrapperDB) isDeleted(key []byte) bool {
+  if ok, _ := wrapper.overlay.Has(deleted(key)); ok {
+    return true
+  }
+  return wrapper.rangeDeleted(key)
+}
+
+// DeleteRange removes every key in [start, end), writing a single range
+// tombstone to hide the underlay's keys rather than one tombstone per key. An
+// empty end deletes through the end of the keyspace. Keys written after the
+// range is deleted are visible as usual.
+func (wrapper *OverlayWrapperDB) DeleteRange(start, end []byte) error {
+  r := keyRange{common.CopyBytes(start), common.CopyBytes(end)}
+  if len(r.end) > 0 && bytes.Compare(r.start, r.end) >= 0 {
+    return nil
+  }
+  wrapper.rangeLock.Lock()
+  defer wrapper.rangeLock.Unlock()
+
+  // Drop the overlay's own values and point tombstones in the range, which
+  // the range tombstone supersedes.
+  batch := wrapper.overlay.NewBatch()
+  flush := func() error {
+    if batch.ValueSize() < ethdb.IdealBatchSize { return nil }
+    if err := batch.Write(); err != nil { return err }
+    batch.Reset()
+    return nil
+  }
+  it := wrapper.overlay.NewIterator(nil, r.start)
+  for it.Next() {
+    key := it.Key()
+    if !r.contains(key) { break }
+    if isTombstone(key) { continue }
+    batch.Delete(common.CopyBytes(key))
+    if err := flush(); err != nil {
+      it.Release()
+      return err
+    }
+  }
+  it.Release()
+  if err := it.Error(); err != nil { return err }
+  it = wrapper.overlay.NewIterator(deletedPrefix, r.start)
+  for it.Next() {
+    if !r.contains(it.Key()[len(deletedPrefix):]) { break }
+    batch.Delete(common.CopyBytes(it.Key()))
+    if err := flush(); err != nil {
+      it.Release()
+      return err
+    }
+  }
+  it.Release()
+  if err := it.Error(); err != nil { return err }
+
+  // Merge the range with any it overlaps, so ranges stay disjoint
+  ranges := make([]keyRange, 0, len(wrapper.ranges) + 1)
+  for _, existing := range wrapper.ranges {
+    if !existing.overlaps(r) {
+      ranges = append(ranges, existing)
+      continue
+    }
+    batch.Delete(deletedRange(existing.start))
+    if bytes.Compare(existing.start, r.start) < 0 {
+      r.start = existing.start
+    }
+    if len(r.end) > 0 && (len(existing.end) == 0 || bytes.Compare(existing.end, r.end) > 0) {
+      r.end = existing.end
+    }
+  }
+  batch.Put(deletedRange(r.start), r.end)
+  if err := batch.Write(); err != nil { return err }
+  i := sort.Search(len(ranges), func(i int) bool {
+    return bytes.Compare(ranges[i].start, r.start) > 0
+  })
+  ranges = append(ranges, keyRange{})
+  copy(ranges[i + 1:], ranges[i:])
+  ranges[i] = r
+  wrapper.ranges = ranges
+  return nil
+}
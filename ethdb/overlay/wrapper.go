@@ -3,12 +3,19 @@ package overlay
 import (
   "github.com/ethereum/go-ethereum/ethdb"
   "github.com/ethereum/go-ethereum/log"
+  "github.com/ethereum/go-ethereum/metrics"
   "time"
   "strings"
+  "sync"
   "sync/atomic"
   // "fmt"
 )
 
+var (
+  overlayHitMeter = metrics.NewRegisteredMeter("ethdb/overlay/hits/overlay", nil)
+  cacheHitMeter = metrics.NewRegisteredMeter("ethdb/overlay/hits/cache", nil)
+  underlayHitMeter = metrics.NewRegisteredMeter("ethdb/overlay/hits/underlay", nil)
+)
 
 // OverlayWrapperDB muxes an overlay database with an underlay database and an
 // optional cache database. Write operations go into the overlay database. The
@@ -22,34 +29,54 @@ type OverlayWrapperDB struct {
   overlayHits  uint64
   cacheHits    uint64
   underlayHits uint64
+  ranges []keyRange
+  rangeLock sync.RWMutex
+  quit chan struct{}
+  closeOnce sync.Once
 }
 
 func NewOverlayWrapperDB(overlay, underlay ethdb.KeyValueStore) ethdb.KeyValueStore {
-  kv := &OverlayWrapperDB{overlay, nil, underlay, 0, 0, 0}
-  go func() {
-    for _ = range time.NewTicker(60 * time.Second).C {
-      log.Info("Overlay statistics", "overlay", atomic.LoadUint64(&kv.overlayHits), "underlay", atomic.LoadUint64(&kv.underlayHits))
-      atomic.StoreUint64(&kv.cacheHits, 0)
-      atomic.StoreUint64(&kv.underlayHits, 0)
-      atomic.StoreUint64(&kv.overlayHits, 0)
-    }
-  }()
-  return kv
+  return NewCachedOverlayWrapperDB(overlay, nil, underlay)
 }
 
 func NewCachedOverlayWrapperDB(overlay, cache, underlay ethdb.KeyValueStore) ethdb.KeyValueStore {
-  kv := &OverlayWrapperDB{overlay, cache, underlay, 0, 0, 0}
-  go func() {
-    for _ = range time.NewTicker(60 * time.Second).C {
-      log.Info("Overlay statistics", "overlay", atomic.LoadUint64(&kv.overlayHits), "underlay", atomic.LoadUint64(&kv.underlayHits), "cache", atomic.LoadUint64(&kv.cacheHits))
-      atomic.StoreUint64(&kv.cacheHits, 0)
-      atomic.StoreUint64(&kv.underlayHits, 0)
-      atomic.StoreUint64(&kv.overlayHits, 0)
-    }
-  }()
+  kv := &OverlayWrapperDB{
+    overlay: overlay,
+    cache: cache,
+    underlay: underlay,
+    quit: make(chan struct{}),
+  }
+  if err := kv.loadRanges(); err != nil {
+    log.Error("Error loading overlay range tombstones", "err", err)
+  }
+  go kv.logStats()
   return kv
 }
 
+// logStats logs the hits on each database every minute until the wrapper is
+// closed.
+func (wrapper *OverlayWrapperDB) logStats() {
+  ticker := time.NewTicker(60 * time.Second)
+  defer ticker.Stop()
+  for {
+    select {
+    case <-ticker.C:
+      if wrapper.cache != nil {
+        log.Info("Overlay statistics", "overlay", atomic.SwapUint64(&wrapper.overlayHits, 0), "underlay", atomic.SwapUint64(&wrapper.underlayHits, 0), "cache", atomic.SwapUint64(&wrapper.cacheHits, 0))
+      } else {
+        log.Info("Overlay statistics", "overlay", atomic.SwapUint64(&wrapper.overlayHits, 0), "underlay", atomic.SwapUint64(&wrapper.underlayHits, 0))
+      }
+    case <-wrapper.quit:
+      return
+    }
+  }
+}
+
+func (wrapper *OverlayWrapperDB) hit(counter *uint64, meter metrics.Meter) {
+  atomic.AddUint64(counter, 1)
+  meter.Mark(1)
+}
+
 func deleted(key []byte) ([]byte) {
   return append([]byte("deleted/"), key...)
 }
@@ -71,16 +98,15 @@ func (wrapper *OverlayWrapperDB) Delete(key []byte) error {
 func (wrapper *OverlayWrapperDB) Get(key []byte) ([]byte, error) {
   val, err := wrapper.overlay.Get(key)
   if err != nil && strings.HasSuffix(err.Error(), "not found") {
-    isDeleted, _ := wrapper.overlay.Has(deleted(key))
-    if isDeleted {
-      atomic.AddUint64(&wrapper.overlayHits, 1)
+    if wrapper.isDeleted(key) {
+      wrapper.hit(&wrapper.overlayHits, overlayHitMeter)
       return val, err
     }
     // Not in overlay, not deleted in overlay
     if wrapper.cache != nil {
       val, err := wrapper.cache.Get(key)
       if err == nil || !strings.HasSuffix(err.Error(), "not found") {
-        atomic.AddUint64(&wrapper.cacheHits, 1)
+        wrapper.hit(&wrapper.cacheHits, cacheHitMeter)
         return val, err
       }
     }
@@ -88,33 +114,32 @@ func (wrapper *OverlayWrapperDB) Get(key []byte) ([]byte, error) {
     if err == nil && wrapper.cache != nil {
       wrapper.cache.Put(key, val)
     }
-    atomic.AddUint64(&wrapper.underlayHits, 1)
+    wrapper.hit(&wrapper.underlayHits, underlayHitMeter)
     return val, err
   }
-  atomic.AddUint64(&wrapper.overlayHits, 1)
+  wrapper.hit(&wrapper.overlayHits, overlayHitMeter)
   return val, err
 }
 
 func (wrapper *OverlayWrapperDB) Has(key []byte) (bool, error) {
   val, err := wrapper.overlay.Has(key)
   if !val {
-    isDeleted, _ := wrapper.overlay.Has(deleted(key))
-    if isDeleted {
-      atomic.AddUint64(&wrapper.overlayHits, 1)
+    if wrapper.isDeleted(key) {
+      wrapper.hit(&wrapper.overlayHits, overlayHitMeter)
       return false, nil
     }
     // Not in overlay, not deleted in overlay
     if wrapper.cache != nil {
       val, err := wrapper.cache.Has(key)
       if val {
-        atomic.AddUint64(&wrapper.cacheHits, 1)
+        wrapper.hit(&wrapper.cacheHits, cacheHitMeter)
         return val, err
       }
     }
-    atomic.AddUint64(&wrapper.underlayHits, 1)
+    wrapper.hit(&wrapper.underlayHits, underlayHitMeter)
     return wrapper.underlay.Has(key)
   }
-  atomic.AddUint64(&wrapper.overlayHits, 1)
+  wrapper.hit(&wrapper.overlayHits, overlayHitMeter)
   return val, err
 }
 
@@ -127,6 +152,9 @@ func (wrapper *OverlayWrapperDB) Compact(start []byte, limit []byte) error {
 }
 
 func (wrapper *OverlayWrapperDB) Close() error {
+  wrapper.closeOnce.Do(func() {
+    if wrapper.quit != nil { close(wrapper.quit) }
+  })
   err1 := wrapper.overlay.Close()
   err2 := wrapper.underlay.Close()
   var err3 error
@@ -143,16 +171,16 @@ func (wrapper *OverlayWrapperDB) NewBatch() ethdb.Batch {
 func (wrapper *OverlayWrapperDB) NewIterator(start, end []byte) ethdb.Iterator {
   oiterator := wrapper.overlay.NewIterator(start, end)
   uiterator := wrapper.underlay.NewIterator(start, end)
-  oiterator.Next()
-  uiterator.Next()
-  return &WrappedIterator{
-    wrapper,
-    oiterator,
-    false,
-    uiterator,
-    false,
-    nil,
-    []byte{},
-    []byte{},
+  wi := &WrappedIterator{
+    wrapper: wrapper,
+    overlayIterator: oiterator,
+    underlayIterator: uiterator,
+    key: []byte{},
+    val: []byte{},
   }
+  wi.overlayDone = !oiterator.Next()
+  wi.underlayDone = !uiterator.Next()
+  wi.setErr(oiterator.Error())
+  wi.setErr(uiterator.Error())
+  return wi
 }
@@ -137,7 +137,7 @@ func TestIterator(t *testing.T) {
 
 	for _, db := range([]ethdb.KeyValueStore{wrapper, wrapper2}) {
 		defer wrapper.Close()
-		iter := db.NewIterator()
+		iter := db.NewIterator(nil, nil)
 
 		if !iter.Next() {
 			t.Fatalf("Iterator terminated unexpectedly")
@@ -203,3 +203,89 @@ func TestBatch(t *testing.T) {
 		t.Errorf("Expected key to be deleted")
 	}
 }
+
+func TestDeleteRange(t *testing.T) {
+	wrapper, overlay, underlay := GetWrapperNoCache()
+	defer wrapper.Close()
+	for _, key := range []string{"a", "b", "c", "d", "e"} {
+		underlay.Put([]byte(key), []byte(strings.ToUpper(key)))
+	}
+	wrapper.Put([]byte("bb"), []byte("BB"))
+	wrapper.Delete([]byte("c"))
+	rd := wrapper.(ethdb.RangeDeleter)
+	if err := rd.DeleteRange([]byte("b"), []byte("d")); err != nil {
+		t.Fatalf(err.Error())
+	}
+	// Overlapping ranges are merged into one tombstone
+	if err := rd.DeleteRange([]byte("c"), []byte("cc")); err != nil {
+		t.Fatalf(err.Error())
+	}
+	wrapper.Put([]byte("c"), []byte("C2"))
+	for key, expected := range map[string]string{"a": "A", "b": "", "bb": "", "c": "C2", "d": "D", "e": "E"} {
+		val, err := wrapper.Get([]byte(key))
+		ok, _ := wrapper.Has([]byte(key))
+		if expected == "" {
+			if err == nil || ok {
+				t.Errorf("Expected %v to be deleted, got %v", key, string(val))
+			}
+		} else if string(val) != expected || !ok {
+			t.Errorf("Unexpected value for %v: %v (%v)", key, string(val), err)
+		}
+	}
+	tombstones := 0
+	it := overlay.NewIterator(deletedRangePrefix, nil)
+	for it.Next() {
+		tombstones++
+	}
+	it.Release()
+	if tombstones != 1 {
+		t.Errorf("Expected 1 range tombstone, got %v", tombstones)
+	}
+	if ok, _ := overlay.Has(deleted([]byte("c"))); ok {
+		t.Errorf("Point tombstone in range should be dropped")
+	}
+	var keys []string
+	iter := wrapper.NewIterator(nil, nil)
+	for iter.Next() {
+		keys = append(keys, string(iter.Key()))
+	}
+	iter.Release()
+	if strings.Join(keys, ",") != "a,c,d,e" {
+		t.Errorf("Unexpected keys %v", keys)
+	}
+	// Range tombstones are reloaded when the overlay is reopened
+	reopened := NewOverlayWrapperDB(overlay, underlay)
+	if ok, _ := reopened.Has([]byte("b")); ok {
+		t.Errorf("Expected b to stay deleted after reopening")
+	}
+	puts, deletes, err := Commit(overlay, underlay)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if puts != 1 || deletes != 2 {
+		t.Errorf("Unexpected changes: %v puts, %v deletes", puts, deletes)
+	}
+	for key, expected := range map[string]string{"a": "A", "c": "C2", "d": "D", "e": "E"} {
+		if val, _ := underlay.Get([]byte(key)); string(val) != expected {
+			t.Errorf("Unexpected committed value for %v: %v", key, string(val))
+		}
+	}
+	if ok, _ := underlay.Has([]byte("b")); ok {
+		t.Errorf("Expected b to be committed as deleted")
+	}
+}
+
+func TestIteratorShadowsUnderlay(t *testing.T) {
+	wrapper, _, underlay := GetWrapperNoCache()
+	defer wrapper.Close()
+	underlay.Put([]byte("a"), []byte("A"))
+	wrapper.Put([]byte("a"), []byte("A2"))
+	iter := wrapper.NewIterator(nil, nil)
+	defer iter.Release()
+	if !iter.Next() || string(iter.Value()) != "A2" {
+		t.Errorf("Expected overlay value, got %v", string(iter.Value()))
+	}
+	if iter.Next() {
+		t.Errorf("Expected one key, got another %v", string(iter.Key()))
+	}
+}
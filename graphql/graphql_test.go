@@ -17,6 +17,8 @@
 package graphql
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"math/big"
@@ -25,8 +27,13 @@ import (
 	"testing"
 	"time"
 
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
 	"github.com/ethereum/go-ethereum/consensus/ethash"
 	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/eth"
 	"github.com/ethereum/go-ethereum/eth/ethconfig"
 	"github.com/ethereum/go-ethereum/node"
@@ -133,6 +140,12 @@ func TestGraphQLBlockSerialization(t *testing.T) {
 			want: `{"data":{"block":{"estimateGas":53000}}}`,
 			code: 200,
 		},
+		// should return no receipts for a block without transactions
+		{
+			body: `{"query": "{block{number receipts{status}}}"}`,
+			want: `{"data":{"block":{"number":10,"receipts":[]}}}`,
+			code: 200,
+		},
 		// should return `status` as decimal
 		{
 			body: `{"query": "{block {number call (data : {from : \"0xa94f5374fce5edbc8e2a8697c15331677e6ebf0b\", to: \"0x6295ee1b4f6dd65047762f924ecd367c17eabf8f\", data :\"0x12a7b914\"}){data status}}}"}`,
@@ -157,6 +170,128 @@ func TestGraphQLBlockSerialization(t *testing.T) {
 	}
 }
 
+// Tests that the receipts of a block match the ones eth_getBlockReceipts returns
+func TestGraphQLBlockReceipts(t *testing.T) {
+	stack := createNode(t, false)
+	defer stack.Close()
+
+	var (
+		key, _  = crypto.HexToECDSA("b71c71a67e1177ad4e901695e1b4b9ee17ae16c6668d313eac2f96dbcda3f291")
+		address = crypto.PubkeyToAddress(key.PublicKey)
+		signer  = types.HomesteadSigner{}
+		genesis = &core.Genesis{
+			Config:     params.AllEthashProtocolChanges,
+			GasLimit:   11500000,
+			Difficulty: big.NewInt(1048576),
+			Alloc:      core.GenesisAlloc{address: {Balance: big.NewInt(params.Ether)}},
+		}
+	)
+	// Every block has a transfer, and a contract creation that logs
+	ethBackend := createGQLService(t, stack, genesis, 2, func(i int, gen *core.BlockGen) {
+		transfer, _ := types.SignTx(types.NewTransaction(gen.TxNonce(address), common.Address{1}, big.NewInt(1000), params.TxGas, big.NewInt(1), nil), signer, key)
+		gen.AddTx(transfer)
+		create, _ := types.SignTx(types.NewContractCreation(gen.TxNonce(address), new(big.Int), 100000, big.NewInt(1), common.FromHex("0x60ff60005260206000a000")), signer, key)
+		gen.AddTx(create)
+	})
+	// Drop the receipts of the first block, which the resolver must notice
+	block := ethBackend.BlockChain().GetBlockByNumber(1)
+	rawdb.DeleteReceipts(ethBackend.ChainDb(), block.Hash(), block.NumberU64())
+
+	if err := stack.Start(); err != nil {
+		t.Fatalf("could not start node: %v", err)
+	}
+	query := func(body string) []byte {
+		resp, err := http.Post(fmt.Sprintf("%s/graphql", stack.HTTPEndpoint()), "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("could not post: %v", err)
+		}
+		bodyBytes, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("could not read from response body: %v", err)
+		}
+		return bodyBytes
+	}
+	missing := string(query(`{"query": "{block(number:1){receipts{status}}}"}`))
+	if want := "receipts length mismatch: 2 vs 0"; !strings.Contains(missing, want) {
+		t.Errorf("expected %q error for missing receipts, got %v", want, missing)
+	}
+	var result struct {
+		Data struct {
+			Block struct {
+				Receipts []struct {
+					Status            *uint64
+					Root              *hexutil.Bytes
+					GasUsed           uint64
+					CumulativeGasUsed uint64
+					LogsBloom         hexutil.Bytes
+					Logs              []struct {
+						Index  uint
+						Topics []common.Hash
+						Data   hexutil.Bytes
+					}
+					CreatedContract *struct{ Address common.Address }
+					Transaction     struct{ Hash common.Hash }
+				}
+			}
+		}
+	}
+	body := query(`{"query": "{block(number:2){receipts{status root gasUsed cumulativeGasUsed logsBloom logs{index topics data} createdContract{address} transaction{hash}}}}"}`)
+	if err := json.Unmarshal(body, &result); err != nil {
+		t.Fatalf("could not decode %s: %v", body, err)
+	}
+	client, err := stack.Attach()
+	if err != nil {
+		t.Fatalf("could not attach to node: %v", err)
+	}
+	defer client.Close()
+	var receipts []struct {
+		Status            hexutil.Uint64
+		Root              hexutil.Bytes
+		GasUsed           hexutil.Uint64
+		CumulativeGasUsed hexutil.Uint64
+		LogsBloom         hexutil.Bytes
+		Logs              []*types.Log
+		ContractAddress   *common.Address
+		TransactionHash   common.Hash
+	}
+	if err := client.Call(&receipts, "eth_getBlockReceipts", "0x2"); err != nil {
+		t.Fatalf("could not get block receipts: %v", err)
+	}
+	gqlReceipts := result.Data.Block.Receipts
+	if len(gqlReceipts) != 2 || len(receipts) != 2 {
+		t.Fatalf("expected 2 receipts, got %d from graphql and %d from rpc", len(gqlReceipts), len(receipts))
+	}
+	for i, want := range receipts {
+		have := gqlReceipts[i]
+		if have.Status == nil || *have.Status != uint64(want.Status) || have.Root != nil {
+			t.Errorf("receipt %d: status %v, root %v, want status %d", i, have.Status, have.Root, want.Status)
+		}
+		if have.GasUsed != uint64(want.GasUsed) || have.CumulativeGasUsed != uint64(want.CumulativeGasUsed) {
+			t.Errorf("receipt %d: gas used %d of %d, want %d of %d", i, have.GasUsed, have.CumulativeGasUsed, want.GasUsed, want.CumulativeGasUsed)
+		}
+		if !bytes.Equal(have.LogsBloom, want.LogsBloom) {
+			t.Errorf("receipt %d: logs bloom mismatch", i)
+		}
+		if len(have.Logs) != len(want.Logs) {
+			t.Fatalf("receipt %d: %d logs, want %d", i, len(have.Logs), len(want.Logs))
+		}
+		for j, log := range want.Logs {
+			if have.Logs[j].Index != log.Index || !bytes.Equal(have.Logs[j].Data, log.Data) || len(have.Logs[j].Topics) != len(log.Topics) {
+				t.Errorf("receipt %d: log %d is %+v, want %+v", i, j, have.Logs[j], log)
+			}
+		}
+		if (have.CreatedContract == nil) != (want.ContractAddress == nil) || (want.ContractAddress != nil && have.CreatedContract.Address != *want.ContractAddress) {
+			t.Errorf("receipt %d: created contract %v, want %v", i, have.CreatedContract, want.ContractAddress)
+		}
+		if have.Transaction.Hash != want.TransactionHash {
+			t.Errorf("receipt %d: transaction %x, want %x", i, have.Transaction.Hash, want.TransactionHash)
+		}
+	}
+	if len(gqlReceipts[1].Logs) != 1 || gqlReceipts[1].CreatedContract == nil {
+		t.Errorf("expected the contract creation to log and create a contract")
+	}
+}
+
 // Tests that a graphQL request is not handled successfully when graphql is not enabled on the specified endpoint
 func TestGraphQLHTTPOnSamePort_GQLRequest_Unsuccessful(t *testing.T) {
 	stack := createNode(t, false)
@@ -174,7 +309,12 @@ func TestGraphQLHTTPOnSamePort_GQLRequest_Unsuccessful(t *testing.T) {
 }
 
 func createNode(t *testing.T, gqlEnabled bool) *node.Node {
+	ddir, err := ioutil.TempDir("", "graphql-node")
+	if err != nil {
+		t.Fatalf("failed to create temporary datadir: %v", err)
+	}
 	stack, err := node.New(&node.Config{
+		DataDir:  ddir,
 		HTTPHost: "127.0.0.1",
 		HTTPPort: 0,
 		WSHost:   "127.0.0.1",
@@ -186,18 +326,19 @@ func createNode(t *testing.T, gqlEnabled bool) *node.Node {
 	if !gqlEnabled {
 		return stack
 	}
-	createGQLService(t, stack)
+	genesis := &core.Genesis{
+		Config:     params.AllEthashProtocolChanges,
+		GasLimit:   11500000,
+		Difficulty: big.NewInt(1048576),
+	}
+	createGQLService(t, stack, genesis, 10, func(i int, gen *core.BlockGen) {})
 	return stack
 }
 
-func createGQLService(t *testing.T, stack *node.Node) {
+func createGQLService(t *testing.T, stack *node.Node, genesis *core.Genesis, genBlocks int, genfunc func(i int, gen *core.BlockGen)) *eth.Ethereum {
 	// create backend
 	ethConf := &ethconfig.Config{
-		Genesis: &core.Genesis{
-			Config:     params.AllEthashProtocolChanges,
-			GasLimit:   11500000,
-			Difficulty: big.NewInt(1048576),
-		},
+		Genesis: genesis,
 		Ethash: ethash.Config{
 			PowMode: ethash.ModeFake,
 		},
@@ -208,14 +349,15 @@ func createGQLService(t *testing.T, stack *node.Node) {
 		TrieDirtyCache:          5,
 		TrieTimeout:             60 * time.Minute,
 		SnapshotCache:           5,
+		RPCGasCap:               ethconfig.Defaults.RPCGasCap,
 	}
 	ethBackend, err := eth.New(stack, ethConf)
 	if err != nil {
 		t.Fatalf("could not create eth backend: %v", err)
 	}
 	// Create some blocks and import them
-	chain, _ := core.GenerateChain(params.AllEthashProtocolChanges, ethBackend.BlockChain().Genesis(),
-		ethash.NewFaker(), ethBackend.ChainDb(), 10, func(i int, gen *core.BlockGen) {})
+	chain, _ := core.GenerateChain(genesis.Config, ethBackend.BlockChain().Genesis(),
+		ethash.NewFaker(), ethBackend.ChainDb(), genBlocks, genfunc)
 	_, err = ethBackend.BlockChain().InsertChain(chain)
 	if err != nil {
 		t.Fatalf("could not create import blocks: %v", err)
@@ -225,4 +367,5 @@ func createGQLService(t *testing.T, stack *node.Node) {
 	if err != nil {
 		t.Fatalf("could not create graphql service: %v", err)
 	}
+	return ethBackend
 }
@@ -120,6 +120,32 @@ const schema string = `
         v: BigInt!
     }
 
+    # Receipt is the outcome of a mined transaction.
+    type Receipt {
+        # Transaction is the transaction this receipt is for.
+        transaction: Transaction!
+        # Status is the return status of the transaction. This will be 1 if the
+        # transaction succeeded, or 0 if it failed. Transactions from before
+        # Byzantium have a root instead, and this field will be null.
+        status: Long
+        # Root is the state root after the transaction, for transactions from
+        # before Byzantium. Otherwise this field will be null.
+        root: Bytes
+        # GasUsed is the amount of gas that was used processing this transaction.
+        gasUsed: Long!
+        # CumulativeGasUsed is the total gas used in the block up to and including
+        # this transaction.
+        cumulativeGasUsed: Long!
+        # CreatedContract is the account that was created by a contract creation
+        # transaction. If the transaction was not a contract creation transaction,
+        # this field will be null.
+        createdContract(block: Long): Account
+        # Logs is a list of log entries emitted by this transaction.
+        logs: [Log!]!
+        # LogsBloom is a bloom filter of the logs emitted by this transaction.
+        logsBloom: Bytes!
+    }
+
     # BlockFilterCriteria encapsulates log filter criteria for a filter applied
     # to a single block.
     input BlockFilterCriteria {
@@ -200,6 +226,10 @@ const schema string = `
         # transactions are unavailable for this block, or if the index is out of
         # bounds, this field will be null.
         transactionAt(index: Int!): Transaction
+        # Receipts is a list of the receipts of the transactions in this block,
+        # in the same order. If receipts are unavailable for this block, this
+        # field will be null.
+        receipts: [Receipt!]
         # Logs returns a filtered set of logs from this block.
         logs(filter: BlockFilterCriteria!): [Log!]!
         # Account fetches an Ethereum account at the current block's state.
@@ -0,0 +1,184 @@
+// Copyright 2021 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package ethapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+// bundleTimeout is the shortest time a bundle may run for. Like eth_call,
+// bundles are given a second for every ten million gas on top of it.
+const bundleTimeout = 5 * time.Second
+
+// BundleTransaction is a transaction in an eth_callBundle bundle, given either
+// as a signed raw transaction or as the fields of eth_call.
+type BundleTransaction struct {
+	Tx   *types.Transaction
+	Call *CallArgs
+}
+
+// UnmarshalJSON decodes a hex string as a signed transaction, and an object as
+// call arguments.
+func (t *BundleTransaction) UnmarshalJSON(input []byte) error {
+	if len(input) > 0 && input[0] == '"' {
+		var raw hexutil.Bytes
+		if err := json.Unmarshal(input, &raw); err != nil {
+			return err
+		}
+		t.Tx = new(types.Transaction)
+		return t.Tx.UnmarshalBinary(raw)
+	}
+	t.Call = new(CallArgs)
+	return json.Unmarshal(input, t.Call)
+}
+
+// BundleResult is the outcome of a transaction in an eth_callBundle bundle.
+type BundleResult struct {
+	TxHash       *common.Hash    `json:"txHash,omitempty"`
+	GasUsed      hexutil.Uint64  `json:"gasUsed"`
+	ReturnData   hexutil.Bytes   `json:"returnData"`
+	Error        string          `json:"error,omitempty"`
+	RevertReason string          `json:"revertReason,omitempty"`
+	Logs         []*types.Log    `json:"logs"`
+	StateDiff    state.StateDiff `json:"stateDiff"`
+}
+
+// CallBundle executes the given transactions in order on the state of the
+// given block, each on the state left by the ones before it, and returns the
+// outcome of each. Signed transactions must have the sender's next nonce,
+// while calls are executed without nonce checks like eth_call. Invalid
+// transactions are reported and leave the state unchanged, while reverted ones
+// still pay for their gas.
+//
+// The block overrides replace the context of the block every transaction in
+// the bundle is executed in, and the bundle is limited to the block's gas
+// limit.
+func (s *PublicBlockChainAPI) CallBundle(ctx context.Context, txs []BundleTransaction, blockNrOrHash rpc.BlockNumberOrHash, overrides *BlockOverrides) ([]*BundleResult, error) {
+	if len(txs) == 0 {
+		return nil, errors.New("bundle has no transactions")
+	}
+	statedb, header, err := s.b.StateAndHeaderByNumberOrHash(ctx, blockNrOrHash)
+	if statedb == nil || err != nil {
+		return nil, err
+	}
+	var (
+		config = s.b.ChainConfig()
+		signer = types.MakeSigner(config, header.Number)
+		msgs   = make([]core.Message, len(txs))
+		gas    uint64
+	)
+	if overrides != nil && overrides.Number != nil {
+		signer = types.MakeSigner(config, overrides.Number.ToInt())
+	}
+	for i, tx := range txs {
+		switch {
+		case tx.Tx != nil:
+			if msgs[i], err = tx.Tx.AsMessage(signer); err != nil {
+				return nil, fmt.Errorf("transaction %d: %v", i, err)
+			}
+		case tx.Call != nil:
+			msgs[i] = tx.Call.ToMessage(s.b.RPCGasCap())
+		default:
+			return nil, fmt.Errorf("transaction %d is empty", i)
+		}
+		gas += msgs[i].Gas()
+	}
+	timeout := time.Duration(gas/10000000) * time.Second
+	if timeout < bundleTimeout {
+		timeout = bundleTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	// The first EVM holds the backend's EVM slot for the whole bundle, and
+	// provides the block context and VM config the others share.
+	evm, vmError, err := s.b.GetEVM(ctx, msgs[0], statedb, header)
+	if err != nil {
+		return nil, err
+	}
+	blockCtx, vmConfig := evm.Context, evm.Config()
+	overrides.Apply(&blockCtx)
+
+	var (
+		gp      = new(core.GasPool).AddGas(blockCtx.GasLimit)
+		results = make([]*BundleResult, len(txs))
+	)
+	for i, msg := range msgs {
+		var (
+			txHash common.Hash
+			res    = &BundleResult{Logs: []*types.Log{}}
+		)
+		if tx := txs[i].Tx; tx != nil {
+			txHash = tx.Hash()
+			res.TxHash = &txHash
+		}
+		evm = vm.NewEVM(blockCtx, core.NewEVMTxContext(msg), statedb, config, vmConfig)
+		go func(evm *vm.EVM) {
+			<-ctx.Done()
+			evm.Cancel()
+		}(evm)
+
+		// Calls all share the empty hash, so their logs are told apart by
+		// how many were there before.
+		statedb.Prepare(txHash, header.Hash(), i)
+		logs := len(statedb.GetLogs(txHash))
+		snapshot, available := statedb.Snapshot(), gp.Gas()
+		result, err := core.ApplyMessage(evm, msg, gp)
+		if evm.Cancelled() {
+			vmError()
+			return nil, fmt.Errorf("execution aborted (timeout = %v)", timeout)
+		}
+		switch {
+		case err != nil:
+			// The gas is bought before some of the checks, so give it back
+			statedb.RevertToSnapshot(snapshot)
+			gp.AddGas(available - gp.Gas())
+			res.Error = err.Error()
+		case result.Failed():
+			res.GasUsed = hexutil.Uint64(result.UsedGas)
+			res.ReturnData = result.Revert()
+			res.Error = result.Err.Error()
+			if reason, errUnpack := abi.UnpackRevert(result.Revert()); errUnpack == nil {
+				res.RevertReason = reason
+			}
+		default:
+			res.GasUsed = hexutil.Uint64(result.UsedGas)
+			res.ReturnData = result.Return()
+			res.Logs = append(res.Logs, statedb.GetLogs(txHash)[logs:]...)
+		}
+		res.StateDiff = statedb.Diff()
+		statedb.Finalise(config.IsEIP158(blockCtx.BlockNumber))
+		results[i] = res
+	}
+	if err := vmError(); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
@@ -198,6 +198,9 @@ type Config struct {
 	KafkaLogTopic string `toml:",omitempty"`
 	KafkaTransactionTopic string `toml:",omitempty"`
 	ReplicaSyncShutdown bool `toml:",omitempty"`
+	// ReplicaBootstrapServe serves exports of the chain database on the HTTP
+	// server for bootstrapping replicas.
+	ReplicaBootstrapServe bool `toml:",omitempty"`
 }
 
 // IPCEndpoint resolves an IPC endpoint based on a configured value, taking into
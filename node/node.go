@@ -566,15 +566,9 @@ func (n *Node) OpenDatabase(name string, cache, handles int, namespace string) (
 		db, err = rawdb.NewLevelDBDatabase(n.ResolvePath(name), cache, handles, namespace)
 	}
 
- if n.config.KafkaLogBroker != "" && n.config.KafkaLogTopic != "" {
-		producer, err := cdc.NewKafkaLogProducerFromURL(
-						n.config.KafkaLogBroker,
-						n.config.KafkaLogTopic,
-				)
-		if err != nil { return nil, err }
-		// TODO: Add options for a readStream
-		db = cdc.NewDBWrapper(db, producer, nil)
-	}
+	if err == nil && n.config.KafkaLogBroker != "" && n.config.KafkaLogTopic != "" {
+    if db, err = n.wrapCDC(name, db); err != nil { return nil, err }
+  }
 
 	if err == nil {
 		db = n.wrapDatabase(db)
@@ -611,7 +605,7 @@ func (n *Node) OpenDatabaseWithOverlayAndFreezer(name string, underlayCache, ove
 	case freezer == "":
 		freezer = filepath.Join(root, "ancient")
 	case strings.HasPrefix(freezer, "s3://"):
-		log.Info("S3 freezer", "path", freezer)
+		log.Info("S3 freezer", "path", rawdb.RedactFreezerURL(freezer))
 	case strings.HasPrefix(freezer, "s3:/"):
 		// For some reason the flags system is dropping the second slash
 		freezer = "s3://" + strings.TrimPrefix(freezer, "s3:/")
@@ -621,14 +615,11 @@ func (n *Node) OpenDatabaseWithOverlayAndFreezer(name string, underlayCache, ove
 	}
 	db, err := rawdb.NewDatabaseWithFreezer(chainKv, freezer, "eth/db/chaindata")
 	if err != nil { return nil, err }
-	if n.config.KafkaLogBroker != "" && n.config.KafkaLogTopic != ""{
-    producer, err := cdc.NewKafkaLogProducerFromURL(
-            n.config.KafkaLogBroker,
-            n.config.KafkaLogTopic,
-    )
+	if n.config.KafkaLogBroker != "" && n.config.KafkaLogTopic != "" {
+    n.lock.Lock()
+    db, err = n.wrapCDC(name, db)
+    n.lock.Unlock()
     if err != nil { return nil, err }
-    // TODO: Add options for a readStream
-    db = cdc.NewDBWrapper(db, producer, nil)
   }
 	return db, nil
 }
@@ -655,24 +646,18 @@ func (n *Node) OpenDatabaseWithFreezer(name string, cache, handles int, freezer,
 		case freezer == "":
 			freezer = filepath.Join(root, "ancient")
 		case strings.HasPrefix(freezer, "s3://"):
-			log.Info("S3 freezer", "path", freezer)
+			log.Info("S3 freezer", "path", rawdb.RedactFreezerURL(freezer))
 		case strings.HasPrefix(freezer, "s3:/"):
 			freezer = fmt.Sprintf("s3://%v", strings.TrimPrefix(freezer, "s3:/"))
-			log.Info("S3 freezer", "path", freezer)
+			log.Info("S3 freezer", "path", rawdb.RedactFreezerURL(freezer))
 		case !filepath.IsAbs(freezer):
 			log.Info("Non-s3 path", "path", freezer)
 			freezer = n.ResolvePath(freezer)
 		}
 		db, err = rawdb.NewLevelDBDatabaseWithFreezer(root, cache, handles, freezer, namespace)
 	}
-  if n.config.KafkaLogBroker != "" && n.config.KafkaLogTopic != "" {
-    producer, err := cdc.NewKafkaLogProducerFromURL(
-            n.config.KafkaLogBroker,
-            n.config.KafkaLogTopic,
-    )
-    if err != nil { return nil, err }
-    // TODO: Add options for a readStream
-    db = cdc.NewDBWrapper(db, producer, nil)
+  if err == nil && n.config.KafkaLogBroker != "" && n.config.KafkaLogTopic != "" {
+    if db, err = n.wrapCDC(name, db); err != nil { return nil, err }
   }
 	if err == nil {
 		db = n.wrapDatabase(db)
@@ -680,6 +665,27 @@ func (n *Node) OpenDatabaseWithFreezer(name string, cache, handles int, freezer,
 	return db, err
 }
 
+// wrapCDC wraps db so that its writes are emitted to the configured CDC log,
+// and if ReplicaBootstrapServe is set, serves exports of the chaindata database
+// for bootstrapping replicas. The caller must hold n.lock.
+func (n *Node) wrapCDC(name string, db ethdb.Database) (ethdb.Database, error) {
+  producer, err := cdc.NewLogProducerFromURL(
+          n.config.KafkaLogBroker,
+          n.config.KafkaLogTopic,
+  )
+  if err != nil { return nil, err }
+  // TODO: Add options for a readStream
+  wrapper := cdc.NewDBWrapper(db, producer, nil)
+  if n.config.ReplicaBootstrapServe && name == "chaindata" {
+    if _, ok := n.http.handlerNames[cdc.ExportPath]; !ok {
+      snapshot := wrapper.(*cdc.DBWrapper).Snapshot
+      n.http.mux.Handle(cdc.ExportPath, cdc.NewExportHandler(snapshot, db, n.config.KafkaLogTopic))
+      n.http.handlerNames[cdc.ExportPath] = "Replica bootstrap"
+    }
+  }
+  return wrapper, nil
+}
+
 // ResolvePath returns the absolute path of a resource in the instance directory.
 func (n *Node) ResolvePath(x string) string {
 	return n.config.ResolvePath(x)
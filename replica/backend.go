@@ -56,6 +56,17 @@ type ReplicaBackend struct {
   evmSemaphore chan struct{}
   txPool *core.TxPool
   snaps snapshot.SnapshotTree
+  // stateDeltas applies the master's state deltas to snaps, if the replica
+  // consumes them.
+  stateDeltas *snapshot.DeltaConsumer
+  // stateDeltaMissing is set when a block's state delta didn't arrive in
+  // time, so that later blocks don't wait for theirs until one is found.
+  stateDeltaMissing bool
+  eventConsumer EventConsumer
+  eventTopic string
+  // syncProgress reports the replica's progress through the master's write
+  // log, in place of the downloader's.
+  syncProgress func() *SyncProgress
 }
 
 	// General Ethereum API
@@ -261,6 +272,15 @@ func (backend *ReplicaBackend) SendTx(ctx context.Context, signedTx *types.Trans
   if signedTx.Gas() < gas {
     return core.ErrIntrinsicGas
   }
+  if waiter, ok := backend.transactionProducer.(TransactionResultWaiter); ok {
+    // Surface the master's errors (such as underpriced transactions) rather
+    // than reporting success once the transaction reaches Kafka.
+    result, err := waiter.EmitAndWait(ctx, signedTx)
+    if err != nil || result == nil {
+      return err
+    }
+    return result.Err()
+  }
   return backend.transactionProducer.Emit(signedTx)
 }
 
@@ -339,19 +359,15 @@ func (backend *ReplicaBackend) GetPoolTransaction(txHash common.Hash) *types.Tra
   return backend.txPool.Get(txHash)
 }
 
-	// Generate core.state.managed_state object from current state, and get nonce from that
-	// It won't account for have pending transactions
+	// GetPoolNonce returns the next nonce for addr, accounting for the
+	// transactions in the replica's copy of the master's pool
 func (backend *ReplicaBackend) GetPoolNonce(ctx context.Context, addr common.Address) (uint64, error) {
   if ctx != nil { if err := ctx.Err(); err != nil { return 0, err } }
-  state, _, err := backend.StateAndHeaderByNumber(ctx, rpc.LatestBlockNumber)
-  if err != nil {return 0, err}
-  nonce := state.GetNonce(addr)
-  return nonce, state.Error()
+  return backend.txPool.Nonce(addr), nil
 }
 
-	// 0,0
 func (backend *ReplicaBackend) Stats() (pending int, queued int) {
-  return 0, 0
+  return backend.txPool.Stats()
 }
 
 func (backend *ReplicaBackend) RPCGasCap() uint64 {
@@ -485,6 +501,20 @@ func (backend *ReplicaBackend) handleBlockUpdates() {
     if err != nil {
       log.Warn("Error finding common ancestor", "head", headHash, "old", lastBlock.Hash(), "err", err.Error())
     }
+    if backend.eventConsumer != nil {
+      // Log and chain event feeds are populated from the event topic by
+      // handleChainEvents. The chain head feed still tracks the database, as
+      // the transaction pool expects head blocks to be available locally.
+      for _, block := range revertedBlocks {
+        backend.chainSideFeed.Send(core.ChainSideEvent{Block: block})
+      }
+      for _, block := range newBlocks {
+        backend.updateSnapshot(block)
+        backend.chainHeadFeed.Send(core.ChainHeadEvent{Block: block})
+        lastBlock = block
+      }
+      continue
+    }
     for _, block := range revertedBlocks {
       logs, err := backend.GetLogs(context.Background(), block.Hash())
       if err != nil {
@@ -504,31 +534,11 @@ func (backend *ReplicaBackend) handleBlockUpdates() {
     }
     for _, block := range newBlocks {
       var wg sync.WaitGroup
-      if backend.snaps != nil {
-        wg.Add(1)
-        go func() {
-          defer wg.Done()
-          parentHeader, err := backend.HeaderByHash(context.Background(), block.ParentHash())
-          if err != nil {
-            log.Warn("Could not get parent block. Rebuilding.", "block", block.Hash(), "parent", block.ParentHash(), "err", err)
-            backend.snaps.Rebuild(block.Root())
-            return
-          }
-          destructs, accounts, storage, err := DiffTries(backend.db, block.Root(), parentHeader.Root)
-          if err != nil {
-            log.Warn("Could not generate diff. Rebuilding.", "block", block.Hash(), "parent", block.ParentHash(), "err", err)
-            backend.snaps.Rebuild(block.Root())
-            return
-          }
-          err = backend.snaps.Update(block.Root(), parentHeader.Root, destructs, accounts, storage)
-          if err != nil {
-            log.Warn("Could not apply diff. Rebuilding.", "block", block.Hash(), "parent", block.ParentHash(), "err", err)
-            backend.snaps.Rebuild(block.Root())
-            return
-          }
-          backend.snaps.Cap(block.Root(), 128)
-        }()
-      }
+      wg.Add(1)
+      go func(block *types.Block) {
+        defer wg.Done()
+        backend.updateSnapshot(block)
+      }(block)
       logs, err := backend.GetLogs(context.Background(), block.Hash())
       if err != nil {
         log.Warn("Error getting logs", "block", block.Hash(), "err", err.Error())
@@ -551,6 +561,140 @@ func (backend *ReplicaBackend) handleBlockUpdates() {
   }
 }
 
+// updateSnapshot applies the state changes between block and its parent to
+// the snapshot tree. If the master's state delta for block is available it is
+// used, otherwise the changes are found by diffing tries, rebuilding the tree
+// if that fails. It is a no-op if snapshots are not enabled.
+func (backend *ReplicaBackend) updateSnapshot(block *types.Block) {
+  if backend.snaps == nil { return }
+  if backend.stateDeltas != nil {
+    wait := stateDeltaWait
+    if time.Since(time.Unix(int64(block.Time()), 0)) > stateDeltaRollback || backend.stateDeltaMissing {
+      // Deltas for blocks this old were emitted before the replica started
+      // consuming them, and after a delta has gone missing the master may
+      // not be emitting them at all, so only use one if it has already been
+      // applied.
+      wait = 0
+    }
+    if backend.stateDeltas.Wait(block.Root(), wait) {
+      stateDeltaHitMeter.Mark(1)
+      backend.stateDeltaMissing = false
+      backend.snaps.Cap(block.Root(), 128)
+      return
+    }
+    stateDeltaMissMeter.Mark(1)
+    backend.stateDeltaMissing = true
+    log.Debug("No state delta for block. Diffing tries.", "block", block.Hash(), "root", block.Root())
+    defer func() {
+      // Deltas for this block's children can now be applied
+      if err := backend.stateDeltas.Applied(block.Root()); err != nil {
+        log.Warn("Error applying pending state deltas", "block", block.Hash(), "err", err)
+      }
+    }()
+  }
+  parentHeader, err := backend.HeaderByHash(context.Background(), block.ParentHash())
+  if err != nil || parentHeader == nil {
+    log.Warn("Could not get parent block. Rebuilding.", "block", block.Hash(), "parent", block.ParentHash(), "err", err)
+    backend.snaps.Rebuild(block.Root())
+    return
+  }
+  destructs, accounts, storage, err := DiffTries(backend.db, block.Root(), parentHeader.Root)
+  if err != nil {
+    log.Warn("Could not generate diff. Rebuilding.", "block", block.Hash(), "parent", block.ParentHash(), "err", err)
+    backend.snaps.Rebuild(block.Root())
+    return
+  }
+  err = backend.snaps.Update(block.Root(), parentHeader.Root, destructs, accounts, storage)
+  if err != nil {
+    log.Warn("Could not apply diff. Rebuilding.", "block", block.Hash(), "parent", block.ParentHash(), "err", err)
+    backend.snaps.Rebuild(block.Root())
+    return
+  }
+  backend.snaps.Cap(block.Root(), 128)
+}
+
+// consumeStateDeltas applies the state deltas from consumer to the snapshot
+// tree, starting shortly before the current head block.
+func (backend *ReplicaBackend) consumeStateDeltas(consumer StateDeltaConsumer) error {
+  if backend.snaps == nil { return nil }
+  header, err := backend.HeaderByNumber(context.Background(), rpc.LatestBlockNumber)
+  if err != nil { return err }
+  messages, err := consumer.Messages(time.Unix(int64(header.Time), 0).Add(-stateDeltaRollback))
+  if err != nil { return err }
+  backend.stateDeltas = snapshot.NewDeltaConsumer(backend.snaps, header.Root)
+  go func() {
+    for msg := range messages {
+      if _, err := backend.stateDeltas.HandleMessage(msg.Key, msg.Value, msg.Partition, msg.Offset); err != nil {
+        log.Warn("Error applying state delta", "partition", msg.Partition, "offset", msg.Offset, "err", err)
+      }
+    }
+  }()
+  return nil
+}
+
+// chainEventLogs returns the logs of a ChainEvent in block order.
+func chainEventLogs(ce *ChainEvent) []*types.Log {
+  logs := []*types.Log{}
+  for _, tx := range ce.Block.Transactions() {
+    logs = append(logs, ce.Logs[tx.Hash()]...)
+  }
+  return logs
+}
+
+// handleChainEvents feeds the log, removed log and chain event feeds from an
+// EventConsumer rather than reading receipts back out of the database,
+// recording the consumer's partition offsets after each batch of events is
+// sent.
+func (backend *ReplicaBackend) handleChainEvents() {
+  ch := make(chan *ChainEvents, 100)
+  sub := backend.eventConsumer.SubscribeChainEvents(ch)
+  defer sub.Unsubscribe()
+  if ready := backend.eventConsumer.Ready(); ready != nil {
+    go func() {
+      <-ready
+      log.Info("Event consumer up to date with master", "topic", backend.eventTopic)
+    }()
+  }
+  backend.eventConsumer.Start()
+  for {
+    select {
+    case events := <-ch:
+      for _, ce := range events.Reverted {
+        allLogs := []*types.Log{}
+        for _, l := range chainEventLogs(ce) {
+          removed := *l
+          removed.Removed = true
+          allLogs = append(allLogs, &removed)
+        }
+        if len(allLogs) > 0 {
+          backend.removedLogsFeed.Send(core.RemovedLogsEvent{Logs: allLogs})
+        }
+      }
+      var lastEmitted common.Hash
+      for _, ce := range events.New {
+        allLogs := chainEventLogs(ce)
+        if len(allLogs) > 0 {
+          backend.logsFeed.Send(allLogs)
+        }
+        backend.chainFeed.Send(core.ChainEvent{Block: ce.Block, Hash: ce.Block.Hash(), Logs: allLogs})
+        lastEmitted = ce.Block.Hash()
+      }
+      if lastEmitted != (common.Hash{}) {
+        if err := WriteEventOffsets(backend.db, backend.eventTopic, lastEmitted, events.Partitions); err != nil {
+          log.Warn("Error recording event offsets", "topic", backend.eventTopic, "err", err)
+        }
+      }
+    case err := <-sub.Err():
+      if err != nil {
+        log.Warn("Chain event subscription failed", "err", err)
+      }
+      return
+    case <-backend.shutdownChan:
+      return
+    }
+  }
+}
+
 func (backend *ReplicaBackend) consumeTransactions(transactionConsumer TransactionConsumer) error {
   pool, err := core.NewReplicaTxPool(core.DefaultTxPoolConfig, backend.chainConfig, backend.bc, backend)
   backend.txPool = pool
@@ -558,13 +702,20 @@ func (backend *ReplicaBackend) consumeTransactions(transactionConsumer Transacti
     return err
   }
   if transactionConsumer != nil {
+    poolSync := newTxPoolSync(pool)
     go func() {
       for tx := range transactionConsumer.Messages() {
+        poolSync.receivedTx(tx)
         if err := backend.txPool.AddRemote(tx); err != nil && !strings.HasPrefix(err.Error(), "known transaction") {
           log.Debug("Error adding tx to pool", "tx", tx.Hash(), "error", err)
         }
       }
       }()
+    go func() {
+      for update := range transactionConsumer.PoolUpdates() {
+        poolSync.apply(update)
+      }
+    }()
   }
   return nil
 }
@@ -13,9 +13,12 @@ import (
   "github.com/ethereum/go-ethereum/core/rawdb"
   "github.com/ethereum/go-ethereum/core/types"
   "github.com/ethereum/go-ethereum/core/vm"
+  "github.com/ethereum/go-ethereum/event"
+  "github.com/ethereum/go-ethereum/internal/ethapi"
   "github.com/ethereum/go-ethereum/params"
   // "github.com/ethereum/go-ethereum/node"
   "github.com/ethereum/go-ethereum/rpc"
+  "reflect"
   "testing"
   "time"
   "log"
@@ -292,6 +295,31 @@ func TestGetEVM(t *testing.T) {
   }
 }
 
+func TestGetBlockReceipts(t *testing.T) {
+  backend, hashes, _ := testTraceBackend(t)
+  api := ethapi.NewPublicBlockChainAPI(backend)
+  receipts, err := api.GetBlockReceipts(context.Background(), rpc.BlockNumberOrHashWithNumber(1))
+  if err != nil {
+    t.Fatalf(err.Error())
+  }
+  if len(receipts) != len(hashes) {
+    t.Fatalf("Expected %v receipts, got %v", len(hashes), len(receipts))
+  }
+  txapi := ethapi.NewPublicTransactionPoolAPI(backend, new(ethapi.AddrLocker))
+  for i, hash := range hashes {
+    receipt, err := txapi.GetTransactionReceipt(context.Background(), hash)
+    if err != nil {
+      t.Fatalf(err.Error())
+    }
+    if !reflect.DeepEqual(receipts[i], receipt) {
+      t.Errorf("Receipt %v differs from eth_getTransactionReceipt: %v != %v", i, receipts[i], receipt)
+    }
+  }
+  if receipts, err := api.GetBlockReceipts(context.Background(), rpc.BlockNumberOrHashWithNumber(2)); receipts != nil || err != nil {
+    t.Errorf("Expected no receipts for a missing block, got %v (%v)", receipts, err)
+  }
+}
+
 func TestGetLogs(t *testing.T) {
   backend, _, err := testReplicaBackend()
   if err != nil {
@@ -384,6 +412,82 @@ func TestSubscribeChainSideEvent(t *testing.T) {
 //     t.Errorf("Expected 1 transaction")
 //   }
 // }
+type mockEventConsumer struct {
+  feed event.Feed
+}
+
+func (consumer *mockEventConsumer) SubscribeChainEvents(ch chan<- *ChainEvents) event.Subscription {
+  return consumer.feed.Subscribe(ch)
+}
+func (consumer *mockEventConsumer) Start() {}
+func (consumer *mockEventConsumer) Ready() chan struct{} { return nil }
+func (consumer *mockEventConsumer) Close() {}
+
+func TestHandleChainEvents(t *testing.T) {
+  backend, _, err := testReplicaBackend()
+  if err != nil {
+    t.Fatalf(err.Error())
+  }
+  consumer := &mockEventConsumer{}
+  backend.eventConsumer = consumer
+  backend.eventTopic = "events"
+  logsCh := make(chan []*types.Log, 1)
+  removedCh := make(chan core.RemovedLogsEvent, 1)
+  chainCh := make(chan core.ChainEvent, 2)
+  defer backend.SubscribeLogsEvent(logsCh).Unsubscribe()
+  defer backend.SubscribeRemovedLogsEvent(removedCh).Unsubscribe()
+  defer backend.SubscribeChainEvent(chainCh).Unsubscribe()
+  go backend.handleChainEvents()
+  defer close(backend.shutdownChan)
+  for consumer.feed.Send(&ChainEvents{}) == 0 {
+    time.Sleep(10 * time.Millisecond)
+  }
+  reverted := getTestChainEvent(1, 1, nil)
+  newCE := getTestChainEvent(1, 2, nil)
+  consumer.feed.Send(&ChainEvents{
+    Reverted: []*ChainEvent{reverted},
+    New: []*ChainEvent{newCE},
+    Partitions: map[int32]int64{0: 7},
+  })
+  select {
+  case ev := <-removedCh:
+    if len(ev.Logs) != 1 || !ev.Logs[0].Removed {
+      t.Errorf("Expected one removed log, got %v", ev.Logs)
+    }
+  case <-time.After(time.Second):
+    t.Fatalf("Timed out waiting for removed logs")
+  }
+  select {
+  case logs := <-logsCh:
+    if len(logs) != 1 || logs[0].BlockHash != newCE.Block.Hash() {
+      t.Errorf("Unexpected logs %v", logs)
+    }
+  case <-time.After(time.Second):
+    t.Fatalf("Timed out waiting for logs")
+  }
+  select {
+  case ce := <-chainCh:
+    if ce.Hash != newCE.Block.Hash() || len(ce.Logs) != 1 {
+      t.Errorf("Unexpected chain event %#x", ce.Hash)
+    }
+  case <-time.After(time.Second):
+    t.Fatalf("Timed out waiting for chain event")
+  }
+  if reverted.Logs[reverted.Block.Transactions()[0].Hash()][0].Removed {
+    t.Errorf("Reverted chain event logs should not be modified")
+  }
+  for i := 0; i < 100; i++ {
+    if hash, offsets, _ := ReadEventOffsets(backend.db, "events"); hash == newCE.Block.Hash() {
+      if offsets[0] != 7 {
+        t.Errorf("Unexpected offsets %v", offsets)
+      }
+      return
+    }
+    time.Sleep(10 * time.Millisecond)
+  }
+  t.Errorf("Event offsets were not recorded")
+}
+
 func TestBloomStatus(t *testing.T) {
   backend, _, err := testReplicaBackend()
   if err != nil {
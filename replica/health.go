@@ -0,0 +1,121 @@
+package replica
+
+import (
+  "encoding/json"
+  "fmt"
+  "net/http"
+  "sync/atomic"
+  "time"
+  "github.com/ethereum/go-ethereum/common"
+  "github.com/ethereum/go-ethereum/core/rawdb"
+  "github.com/ethereum/go-ethereum/ethdb/cdc"
+  "github.com/ethereum/go-ethereum/metrics"
+)
+
+const (
+  HealthPath = "/health"
+  ReadyPath = "/ready"
+
+  // statusInterval is how often the replica's status metrics are updated.
+  statusInterval = 5 * time.Second
+  // statusLogInterval is how often the replica's status is logged.
+  statusLogInterval = 30 * time.Second
+)
+
+var (
+  headNumberGauge = metrics.NewRegisteredGauge("replica/head/number", nil)
+  headAgeGauge = metrics.NewRegisteredGauge("replica/head/age", nil)
+  offsetGauge = metrics.NewRegisteredGauge("replica/cdc/offset", nil)
+  offsetAgeGauge = metrics.NewRegisteredGauge("replica/cdc/offset/age", nil)
+  readyGauge = metrics.NewRegisteredGauge("replica/ready", nil)
+)
+
+// ReplicaStatus describes how far a replica is behind its master. Ages are in
+// seconds.
+type ReplicaStatus struct {
+  Number uint64 `json:"number"`
+  Hash common.Hash `json:"hash"`
+  BlockAge int64 `json:"blockAge"`
+  Offset int64 `json:"offset"`
+  OffsetAge int64 `json:"offsetAge"`
+  // Healthy is false if the replica has stopped applying operations, and
+  // should be replaced.
+  Healthy bool `json:"healthy"`
+  // Ready is false if the replica is healthy but too far behind the master to
+  // serve requests.
+  Ready bool `json:"ready"`
+  Reason string `json:"reason,omitempty"`
+}
+
+// Status reports the replica's current block and CDC offset, and whether they
+// are within the configured maximum ages.
+func (r *Replica) Status() *ReplicaStatus {
+  status := &ReplicaStatus{Healthy: true, Ready: true}
+  now := time.Now().Unix()
+  status.Hash = rawdb.ReadHeadBlockHash(r.db)
+  if number := rawdb.ReadHeaderNumber(r.db, status.Hash); number != nil {
+    status.Number = *number
+    if header := rawdb.ReadHeader(r.db, status.Hash, *number); header != nil {
+      status.BlockAge = now - int64(header.Time)
+    }
+  }
+  offset, offsetTime, err := cdc.ReadOffset(r.db, r.topic)
+  if err == nil {
+    status.Offset = offset
+    status.OffsetAge = now - offsetTime
+  }
+  switch {
+  case atomic.LoadInt32(&r.rejected) != 0:
+    status.Healthy, status.Ready = false, false
+    status.Reason = "replica halted on a rejected operation"
+  case err != nil:
+    status.Ready = false
+    status.Reason = fmt.Sprintf("no offset recorded for %v", r.topic)
+  case r.maxBlockAge > 0 && status.BlockAge > r.maxBlockAge:
+    status.Ready = false
+    status.Reason = fmt.Sprintf("block age %vs exceeds %vs", status.BlockAge, r.maxBlockAge)
+  case r.maxOffsetAge > 0 && status.OffsetAge > r.maxOffsetAge:
+    status.Ready = false
+    status.Reason = fmt.Sprintf("offset age %vs exceeds %vs", status.OffsetAge, r.maxOffsetAge)
+  }
+  return status
+}
+
+func (r *Replica) updateStatusMetrics(status *ReplicaStatus) {
+  headNumberGauge.Update(int64(status.Number))
+  headAgeGauge.Update(status.BlockAge)
+  offsetGauge.Update(status.Offset)
+  offsetAgeGauge.Update(status.OffsetAge)
+  if status.Ready {
+    readyGauge.Update(1)
+  } else {
+    readyGauge.Update(0)
+  }
+}
+
+func serveStatus(w http.ResponseWriter, status *ReplicaStatus, ok bool) {
+  w.Header().Set("Content-Type", "application/json")
+  if !ok {
+    w.WriteHeader(http.StatusServiceUnavailable)
+  }
+  json.NewEncoder(w).Encode(status)
+}
+
+// HealthHandler returns an http.Handler that responds 200 while the replica is
+// applying operations from the master, and 503 once it has halted.
+func (r *Replica) HealthHandler() http.Handler {
+  return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+    status := r.Status()
+    serveStatus(w, status, status.Healthy)
+  })
+}
+
+// ReadyHandler returns an http.Handler that responds 200 while the replica's
+// block and offset ages are within their configured limits, and 503
+// otherwise, so that load balancers can drain lagging replicas.
+func (r *Replica) ReadyHandler() http.Handler {
+  return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+    status := r.Status()
+    serveStatus(w, status, status.Ready)
+  })
+}
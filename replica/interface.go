@@ -1,6 +1,7 @@
 package replica
 
 import (
+  "time"
   "github.com/ethereum/go-ethereum/core"
   "github.com/ethereum/go-ethereum/core/types"
   "github.com/ethereum/go-ethereum/event"
@@ -27,5 +28,11 @@ type TransactionProducer interface {
 
 type TransactionConsumer interface {
   Messages() <-chan *types.Transaction
+  PoolUpdates() <-chan *TxPoolUpdate
+  Close()
+}
+
+type StateDeltaConsumer interface {
+  Messages(since time.Time) (<-chan *StateDeltaMessage, error)
   Close()
 }
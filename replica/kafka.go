@@ -4,6 +4,7 @@ import (
   "github.com/Shopify/sarama"
   // "log"
   "fmt"
+  "sync"
   "github.com/ethereum/go-ethereum/core"
   "github.com/ethereum/go-ethereum/core/types"
   "github.com/ethereum/go-ethereum/rlp"
@@ -16,12 +17,22 @@ type KafkaTransactionProducer struct {
   producer sarama.SyncProducer
   // TODO;  sarama.SyncProducer
   topic string
+  quit chan struct{}
+  closeOnce sync.Once
 }
 
 func (producer *KafkaTransactionProducer) Close() {
+  producer.closeOnce.Do(func() { close(producer.quit) })
   producer.producer.Close()
 }
 
+// send emits a keyed message, for pool updates other than new transactions.
+func (producer *KafkaTransactionProducer) send(key string, value []byte) error {
+  msg := &sarama.ProducerMessage{Topic: producer.topic, Key: sarama.StringEncoder(key), Value: sarama.ByteEncoder(value)}
+  _, _, err := producer.producer.SendMessage(msg)
+  return err
+}
+
 func (producer *KafkaTransactionProducer) Emit(tx *types.Transaction) error {
   txBytes, err := rlp.EncodeToBytes(tx)
   if err != nil {
@@ -52,6 +63,7 @@ func (producer *KafkaTransactionProducer) RelayTransactions(txpool *core.TxPool)
     log.Warn("Transaction emitter shutting down")
     subscription.Unsubscribe()
   }()
+  go producer.relayPoolState(txpool)
 }
 
 func NewKafkaTransactionProducerFromURLs(brokerURL, topic string) (TransactionProducer, error) {
@@ -70,45 +82,68 @@ func NewKafkaTransactionProducerFromURLs(brokerURL, topic string) (TransactionPr
 }
 
 func NewKafkaTransactionProducer(producer sarama.SyncProducer, topic string) (TransactionProducer) {
-  return &KafkaTransactionProducer{producer, topic}
+  return &KafkaTransactionProducer{producer: producer, topic: topic, quit: make(chan struct{})}
 }
 
 
 type KafkaTransactionConsumer struct {
   txs chan *types.Transaction
+  updates chan *TxPoolUpdate
   consumer sarama.Consumer
   topic string
+  startOnce sync.Once
 }
 
-func (consumer *KafkaTransactionConsumer) Messages() <-chan *types.Transaction {
-  if consumer.txs == nil {
-    partitions, err := consumer.consumer.Partitions(consumer.topic)
+// start consumes every partition of the topic, routing new transactions to
+// Messages and other pool updates to PoolUpdates.
+func (consumer *KafkaTransactionConsumer) start() {
+  partitions, err := consumer.consumer.Partitions(consumer.topic)
+  if err != nil {
+    log.Error("Failed to list partitions - Cannot consume transactions", "topic", consumer.topic, "error", err)
+    return
+  }
+  txs := make(chan *types.Transaction, 100)
+  updates := make(chan *TxPoolUpdate, 100)
+  for _, partition := range partitions {
+    partitionConsumer, err := consumer.consumer.ConsumePartition(consumer.topic, partition, sarama.OffsetNewest)
     if err != nil {
-      log.Error("Failed to list partitions - Cannot consume transactions", "topic", consumer.topic, "error", err)
-      return nil
+      log.Error("Failed to consume partition", "topic", consumer.topic, "partition", partition, "error", err)
+      return
     }
-    consumer.txs = make(chan *types.Transaction, 100)
-    for _, partition := range partitions {
-      partitionConsumer, err := consumer.consumer.ConsumePartition(consumer.topic, partition, sarama.OffsetNewest)
-      if err != nil {
-        log.Error("Failed to consume partition", "topic", consumer.topic, "partition", partition, "error", err)
-        consumer.txs = nil
-        return nil
-      }
-      go func() {
-        for msg := range partitionConsumer.Messages() {
-          transaction := &types.Transaction{}
-          if err := rlp.DecodeBytes(msg.Value, transaction); err != nil {
-            fmt.Printf("Error decoding: %v\n", err.Error())
+    go func() {
+      for msg := range partitionConsumer.Messages() {
+        if len(msg.Key) > 0 {
+          update, err := decodeTxPoolUpdate(string(msg.Key), msg.Value)
+          if err != nil {
+            log.Warn("Error decoding transaction pool update", "key", string(msg.Key), "err", err)
+          } else if update != nil {
+            updates <- update
           }
-          consumer.txs <- transaction
+          continue
         }
-      }()
-    }
+        transaction := &types.Transaction{}
+        if err := rlp.DecodeBytes(msg.Value, transaction); err != nil {
+          log.Warn("Error decoding transaction", "err", err)
+          continue
+        }
+        txs <- transaction
+      }
+    }()
   }
+  consumer.txs, consumer.updates = txs, updates
+}
+
+func (consumer *KafkaTransactionConsumer) Messages() <-chan *types.Transaction {
+  consumer.startOnce.Do(consumer.start)
   return consumer.txs
 }
 
+// PoolUpdates returns the master's pool snapshots and removals.
+func (consumer *KafkaTransactionConsumer) PoolUpdates() <-chan *TxPoolUpdate {
+  consumer.startOnce.Do(consumer.start)
+  return consumer.updates
+}
+
 func (consumer *KafkaTransactionConsumer) Close() {
   consumer.consumer.Close()
 }
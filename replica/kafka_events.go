@@ -9,6 +9,7 @@ import (
   "math/big"
   "fmt"
   "compress/zlib"
+  "encoding/binary"
   "github.com/ethereum/go-ethereum/common"
   "github.com/ethereum/go-ethereum/core"
   "github.com/ethereum/go-ethereum/core/rawdb"
@@ -618,6 +619,66 @@ type rlpLog struct {
 	TxIndex uint `json:"transactionIndex" gencodec:"required"`
 }
 
+func (t MsgType) String() string {
+  switch t {
+  case BlockMsg:
+    return "block"
+  case ReceiptMsg:
+    return "receipt"
+  case LogMsg:
+    return "log"
+  case TdMsg:
+    return "td"
+  }
+  return fmt.Sprintf("unknown(%d)", byte(t))
+}
+
+// EventMessage is a single message from a chain event topic. BlockHash is set
+// for every type, along with Block, Td, TxHash and Receipt, or Log for its
+// type.
+type EventMessage struct {
+  Type MsgType
+  BlockHash common.Hash
+  Block *types.Block
+  Td *big.Int
+  TxHash common.Hash
+  Receipt *ReceiptMeta
+  Log *types.Log
+}
+
+// DecodeEventMessage decodes a single message from a chain event topic, for
+// inspecting topics without assembling whole chain events.
+func DecodeEventMessage(key, value []byte) (*EventMessage, error) {
+  if len(key) < 33 { return nil, fmt.Errorf("invalid chain event key %#x", key) }
+  msg := &EventMessage{Type: MsgType(key[0]), BlockHash: common.BytesToHash(key[1:33])}
+  switch msg.Type {
+  case BlockMsg:
+    msg.Block = &types.Block{}
+    if err := rlp.DecodeBytes(value, msg.Block); err != nil { return nil, fmt.Errorf("Error decoding block: %v", err) }
+  case TdMsg:
+    msg.Td = new(big.Int)
+    if err := rlp.DecodeBytes(value, msg.Td); err != nil { return nil, fmt.Errorf("Error decoding td: %v", err) }
+  case ReceiptMsg:
+    if len(key) != 65 { return nil, fmt.Errorf("invalid receipt key %#x", key) }
+    msg.TxHash = common.BytesToHash(key[33:])
+    msg.Receipt = &ReceiptMeta{}
+    if err := rlp.DecodeBytes(value, msg.Receipt); err != nil { return nil, fmt.Errorf("Error decoding receipt: %v", err) }
+  case LogMsg:
+    var logIndex big.Int
+    if err := rlp.DecodeBytes(key[33:], &logIndex); err != nil { return nil, fmt.Errorf("Error decoding log key: %v", err) }
+    logRlp := &rlpLog{}
+    if err := rlp.DecodeBytes(value, logRlp); err != nil { return nil, fmt.Errorf("Error decoding log: %v", err) }
+    msg.Log = logRlp.Log
+    msg.Log.BlockNumber, msg.Log.TxHash, msg.Log.TxIndex = logRlp.BlockNumber, logRlp.TxHash, logRlp.TxIndex
+    msg.Log.BlockHash = msg.BlockHash
+    msg.Log.Index = uint(logIndex.Int64())
+    msg.TxHash = logRlp.TxHash
+  default:
+    return nil, fmt.Errorf("unknown message type %v in chain event %#x", key[0], msg.BlockHash)
+  }
+  return msg, nil
+}
+
 func (producer *KafkaEventProducer) Emit(chainEvent core.ChainEvent) error {
   ce, err := producer.cep.GetFullChainEvent(chainEvent)
   if err != nil { return err }
@@ -898,6 +959,53 @@ func (consumer *KafkaEventConsumer) Start() {
 }
 
 
+// eventOffsetKey returns the database key under which a replica records the
+// last block it emitted from an event topic, along with the partition offsets
+// that produced it.
+func eventOffsetKey(topic string) []byte {
+  return []byte(fmt.Sprintf("cdc-events-%v-offsets", topic))
+}
+
+// WriteEventOffsets records the most recently emitted block hash and the
+// partition offsets of the event topic, so a restarted replica can resume the
+// KafkaEventConsumer where it left off.
+func WriteEventOffsets(db ethdb.KeyValueWriter, topic string, lastEmittedBlock common.Hash, offsets map[int32]int64) error {
+  buf := make([]byte, common.HashLength + len(offsets) * 2 * binary.MaxVarintLen64)
+  copy(buf, lastEmittedBlock[:])
+  n := common.HashLength
+  for partition, offset := range offsets {
+    n += binary.PutVarint(buf[n:], int64(partition))
+    n += binary.PutVarint(buf[n:], offset)
+  }
+  return db.Put(eventOffsetKey(topic), buf[:n])
+}
+
+// ReadEventOffsets retrieves the values stored by WriteEventOffsets. If
+// nothing has been recorded for the topic, it returns an empty hash and an
+// empty offset map.
+func ReadEventOffsets(db ethdb.KeyValueReader, topic string) (common.Hash, map[int32]int64, error) {
+  offsets := make(map[int32]int64)
+  data, err := db.Get(eventOffsetKey(topic))
+  if err != nil || len(data) == 0 {
+    return common.Hash{}, offsets, nil
+  }
+  if len(data) < common.HashLength {
+    return common.Hash{}, offsets, fmt.Errorf("Event offset record too short")
+  }
+  lastEmittedBlock := common.BytesToHash(data[:common.HashLength])
+  data = data[common.HashLength:]
+  for len(data) > 0 {
+    partition, n := binary.Varint(data)
+    if n <= 0 { return lastEmittedBlock, offsets, fmt.Errorf("Error decoding event partition") }
+    data = data[n:]
+    offset, n := binary.Varint(data)
+    if n <= 0 { return lastEmittedBlock, offsets, fmt.Errorf("Error decoding event offset") }
+    data = data[n:]
+    offsets[int32(partition)] = offset
+  }
+  return lastEmittedBlock, offsets, nil
+}
+
 func NewKafkaEventConsumerFromURLs(brokerURL, topic string, lastEmittedBlock common.Hash, offsets map[int32]int64, rollback int64, startingBlockNumber uint64, finishedLimit int) (EventConsumer, error) {
   brokers, config := cdc.ParseKafkaURL(brokerURL)
   if err := cdc.CreateTopicIfDoesNotExist(brokerURL, topic, -1, nil); err != nil {
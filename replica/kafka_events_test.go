@@ -7,6 +7,7 @@ import (
   "github.com/ethereum/go-ethereum/trie"
   // "github.com/ethereum/go-ethereum/event"
   "github.com/ethereum/go-ethereum/core/types"
+  "github.com/ethereum/go-ethereum/core/rawdb"
   gethLog "github.com/ethereum/go-ethereum/log"
   // "github.com/Shopify/sarama/mocks"
   "github.com/Shopify/sarama"
@@ -205,6 +206,36 @@ func TestGetProducerMessages(t *testing.T) {
   if MsgType(messages[3].key[0]) != LogMsg { t.Errorf("Message 3 should be log Msg, got %v", messages[3].key[0])}
 }
 
+func TestDecodeEventMessage(t *testing.T) {
+  event := getTestChainEvent(3, 0, nil)
+  messages := event.getMessages()
+  txHash := event.Block.Transactions()[0].Hash()
+  decoded := make([]*EventMessage, len(messages))
+  for i, msg := range messages {
+    var err error
+    decoded[i], err = DecodeEventMessage(msg.key, msg.value)
+    if err != nil { t.Fatalf(err.Error()) }
+    if decoded[i].BlockHash != event.Block.Hash() {
+      t.Errorf("Unexpected block hash %#x", decoded[i].BlockHash)
+    }
+  }
+  if decoded[0].Type != BlockMsg || decoded[0].Block.Hash() != event.Block.Hash() {
+    t.Errorf("Unexpected block message %+v", decoded[0])
+  }
+  if decoded[1].Type != TdMsg || decoded[1].Td.Int64() != 3 {
+    t.Errorf("Unexpected td message %+v", decoded[1])
+  }
+  if decoded[2].Type != ReceiptMsg || decoded[2].TxHash != txHash || decoded[2].Receipt.GasUsed != 21000 {
+    t.Errorf("Unexpected receipt message %+v", decoded[2])
+  }
+  if decoded[3].Type != LogMsg || decoded[3].TxHash != txHash || decoded[3].Log.BlockNumber != 3 || decoded[3].Log.BlockHash != event.Block.Hash() {
+    t.Errorf("Unexpected log message %+v", decoded[3])
+  }
+  if _, err := DecodeEventMessage([]byte{byte(BlockMsg)}, nil); err == nil {
+    t.Errorf("Expected error for short key")
+  }
+}
+
 func expectToConsume(name string, ch interface{}, count int, t *testing.T) {
   chanval := reflect.ValueOf(ch)
 
@@ -596,3 +627,25 @@ func TestDelayedMessages(t *testing.T) {
 //   default:
 //   }
 // }
+
+func TestEventOffsets(t *testing.T) {
+  db := rawdb.NewMemoryDatabase()
+  hash, offsets, err := ReadEventOffsets(db, "test")
+  if err != nil { t.Fatalf(err.Error()) }
+  if hash != (common.Hash{}) || len(offsets) != 0 {
+    t.Fatalf("Expected empty offsets, got %#x %v", hash, offsets)
+  }
+  expected := map[int32]int64{0: 12, 1: 0, 5: 1 << 40}
+  lastEmitted := common.HexToHash("0x1234")
+  if err := WriteEventOffsets(db, "test", lastEmitted, expected); err != nil {
+    t.Fatalf(err.Error())
+  }
+  hash, offsets, err = ReadEventOffsets(db, "test")
+  if err != nil { t.Fatalf(err.Error()) }
+  if hash != lastEmitted {
+    t.Errorf("Unexpected hash %#x", hash)
+  }
+  if !reflect.DeepEqual(offsets, expected) {
+    t.Errorf("Unexpected offsets: %v != %v", offsets, expected)
+  }
+}
@@ -45,3 +45,24 @@ func (api *PublicEthereumAPI) ChainId() hexutil.Uint64 {
 func (api *PublicEthereumAPI) Mining() bool {
 	return false
 }
+
+// Syncing returns false if the replica has caught up with its master.
+// Otherwise it returns the replica's progress through the master's write log:
+// its starting, current and highest known blocks, and its offset and the
+// topic's high watermark, summed over partitions.
+func (api *PublicEthereumAPI) Syncing() (interface{}, error) {
+	if api.e.syncProgress == nil {
+		return false, nil
+	}
+	progress := api.e.syncProgress()
+	if !progress.Syncing {
+		return false, nil
+	}
+	return map[string]interface{}{
+		"startingBlock": hexutil.Uint64(progress.StartingBlock),
+		"currentBlock":  hexutil.Uint64(progress.CurrentBlock),
+		"highestBlock":  hexutil.Uint64(progress.HighestBlock),
+		"offset":        hexutil.Uint64(progress.Offset),
+		"highWatermark": hexutil.Uint64(progress.HighWatermark),
+	}, nil
+}
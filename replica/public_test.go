@@ -46,3 +46,39 @@ func TestPublicChainID(t *testing.T) {
     t.Errorf("Unexpected chainid %v", publicAPI.ChainId())
   }
 }
+func TestPublicSyncing(t *testing.T) {
+  backend, _, err := testReplicaBackend()
+  if err != nil {
+    t.Fatalf(err.Error())
+  }
+  publicAPI := NewPublicEthereumAPI(backend)
+  if syncing, err := publicAPI.Syncing(); err != nil || syncing != false {
+    t.Errorf("Expected backend without progress to report not syncing, got %v (%v)", syncing, err)
+  }
+  progress := &SyncProgress{StartingBlock: 1, CurrentBlock: 5, HighestBlock: 5, Offset: 100, HighWatermark: 100}
+  backend.syncProgress = func() *SyncProgress { return progress }
+  if syncing, err := publicAPI.Syncing(); err != nil || syncing != false {
+    t.Errorf("Expected caught up replica to report not syncing, got %v (%v)", syncing, err)
+  }
+  progress.Syncing, progress.HighestBlock, progress.HighWatermark = true, 7, 5000
+  syncing, err := publicAPI.Syncing()
+  if err != nil {
+    t.Fatalf(err.Error())
+  }
+  fields, ok := syncing.(map[string]interface{})
+  if !ok {
+    t.Fatalf("Unexpected sync status %v", syncing)
+  }
+  expected := map[string]hexutil.Uint64{
+    "startingBlock": 1,
+    "currentBlock": 5,
+    "highestBlock": 7,
+    "offset": 100,
+    "highWatermark": 5000,
+  }
+  for key, value := range expected {
+    if fields[key] != value {
+      t.Errorf("Unexpected %v: %v != %v", key, fields[key], value)
+    }
+  }
+}
@@ -0,0 +1,300 @@
+package replica
+
+import (
+  "context"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "sync"
+  "time"
+  "github.com/Shopify/sarama"
+  "github.com/ethereum/go-ethereum"
+  "github.com/ethereum/go-ethereum/common"
+  "github.com/ethereum/go-ethereum/common/hexutil"
+  "github.com/ethereum/go-ethereum/core/types"
+  "github.com/ethereum/go-ethereum/ethdb/cdc"
+  "github.com/ethereum/go-ethereum/log"
+  "github.com/ethereum/go-ethereum/rlp"
+  "github.com/ethereum/go-ethereum/rpc"
+  "golang.org/x/time/rate"
+)
+
+const (
+  // relayRetryDelay is how long the relay waits before retrying a transaction
+  // on the next endpoint.
+  relayRetryDelay = 500 * time.Millisecond
+  // relayPruneInterval is how often expired transactions and idle senders
+  // are forgotten.
+  relayPruneInterval = time.Minute
+)
+
+var errRateLimited = errors.New("sender rate limit exceeded")
+
+// DeadLetter records a transaction the relay could not send to the master.
+type DeadLetter struct {
+  Hash *common.Hash `json:"hash,omitempty"`
+  Data hexutil.Bytes `json:"data"`
+  Reason string `json:"reason"`
+  Time time.Time `json:"time"`
+}
+
+type TransactionResultProducer interface {
+  Emit(*TransactionResult) error
+  Close()
+}
+
+type DeadLetterProducer interface {
+  Emit(*DeadLetter) error
+  Close()
+}
+
+type TransactionRelayConfig struct {
+  // DedupeWindow is how long a transaction is remembered, during which it
+  // will not be sent again.
+  DedupeWindow time.Duration
+  // Retries is how many times a transaction is attempted, across endpoints,
+  // before it is sent to the dead letter topic.
+  Retries int
+  // SenderRate is the number of transactions per second relayed from any one
+  // sender (0 = unlimited), allowing bursts of up to SenderBurst.
+  SenderRate float64
+  SenderBurst int
+}
+
+type relayedTransaction struct {
+  time time.Time
+  // result is nil while the transaction is being sent
+  result *TransactionResult
+}
+
+type senderLimiter struct {
+  limiter *rate.Limiter
+  lastUsed time.Time
+}
+
+// TransactionRelay sends transactions from replicas to the master's RPC
+// endpoints, failing over between them. Transactions that cannot be decoded
+// or sent are recorded on the dead letter producer, if there is one, and
+// results are reported to replicas on the result producer.
+type TransactionRelay struct {
+  senders []ethereum.TransactionSender
+  config TransactionRelayConfig
+  results TransactionResultProducer
+  deadLetters DeadLetterProducer
+
+  lock sync.Mutex
+  current int
+  seen map[common.Hash]*relayedTransaction
+  limiters map[common.Address]*senderLimiter
+  lastPrune time.Time
+}
+
+func NewTransactionRelay(senders []ethereum.TransactionSender, config TransactionRelayConfig, results TransactionResultProducer, deadLetters DeadLetterProducer) *TransactionRelay {
+  if config.Retries < 1 {
+    config.Retries = 1
+  }
+  if config.SenderBurst < 1 {
+    config.SenderBurst = 1
+  }
+  return &TransactionRelay{
+    senders: senders,
+    config: config,
+    results: results,
+    deadLetters: deadLetters,
+    seen: make(map[common.Hash]*relayedTransaction),
+    limiters: make(map[common.Address]*senderLimiter),
+    lastPrune: time.Now(),
+  }
+}
+
+// Relay decodes and sends a transaction emitted by a replica. Errors from the
+// master are reported as results; an error is only returned if a
+// transaction that failed could not be recorded.
+func (relay *TransactionRelay) Relay(ctx context.Context, data []byte) error {
+  tx := &types.Transaction{}
+  if err := rlp.DecodeBytes(data, tx); err != nil {
+    return relay.deadLetter(nil, data, fmt.Sprintf("undecodable transaction: %v", err))
+  }
+  hash := tx.Hash()
+  if duplicate, result := relay.track(hash); duplicate {
+    log.Debug("Skipping duplicate transaction", "hash", hash)
+    if result != nil {
+      // The replica may be waiting on this result, so report it again
+      relay.report(result)
+    }
+    return nil
+  }
+  sender, err := types.Sender(types.LatestSignerForChainID(tx.ChainId()), tx)
+  if err != nil {
+    relay.forget(hash)
+    return relay.deadLetter(&hash, data, fmt.Sprintf("invalid sender: %v", err))
+  }
+  if !relay.allow(sender) {
+    log.Warn("Rate limiting transaction", "hash", hash, "sender", sender)
+    relay.forget(hash)
+    relay.report(&TransactionResult{Hash: hash, Error: errRateLimited.Error()})
+    return nil
+  }
+  err = relay.send(ctx, tx)
+  if ctx.Err() != nil {
+    // The relay is shutting down, and the transaction will be consumed again
+    relay.forget(hash)
+    return ctx.Err()
+  }
+  result := &TransactionResult{Hash: hash, Accepted: err == nil}
+  if err != nil {
+    result.Error = err.Error()
+  }
+  if _, ok := err.(rpc.Error); err != nil && !ok {
+    // The master never answered, so the transaction may be retried later.
+    relay.forget(hash)
+    relay.report(result)
+    return relay.deadLetter(&hash, data, fmt.Sprintf("failed after %v attempts: %v", relay.config.Retries, err))
+  }
+  relay.record(hash, result)
+  relay.report(result)
+  return nil
+}
+
+// send sends tx, failing over to the next endpoint on errors other than the
+// master rejecting it.
+func (relay *TransactionRelay) send(ctx context.Context, tx *types.Transaction) error {
+  var err error
+  for attempt := 0; attempt < relay.config.Retries; attempt++ {
+    if attempt > 0 {
+      select {
+      case <-time.After(relayRetryDelay):
+      case <-ctx.Done():
+        return ctx.Err()
+      }
+    }
+    relay.lock.Lock()
+    index := relay.current
+    relay.lock.Unlock()
+    err = relay.senders[index].SendTransaction(ctx, tx)
+    if _, ok := err.(rpc.Error); err == nil || ok {
+      return err
+    }
+    log.Warn("Error sending transaction", "hash", tx.Hash(), "endpoint", index, "attempt", attempt + 1, "err", err)
+    relay.lock.Lock()
+    if relay.current == index {
+      relay.current = (index + 1) % len(relay.senders)
+    }
+    relay.lock.Unlock()
+  }
+  return err
+}
+
+// track records that hash is being relayed, returning whether it already has
+// been within the dedupe window, along with its result if one is known.
+func (relay *TransactionRelay) track(hash common.Hash) (bool, *TransactionResult) {
+  relay.lock.Lock()
+  defer relay.lock.Unlock()
+  relay.prune()
+  if seen, ok := relay.seen[hash]; ok && time.Since(seen.time) < relay.config.DedupeWindow {
+    return true, seen.result
+  }
+  relay.seen[hash] = &relayedTransaction{time: time.Now()}
+  return false, nil
+}
+
+func (relay *TransactionRelay) record(hash common.Hash, result *TransactionResult) {
+  relay.lock.Lock()
+  defer relay.lock.Unlock()
+  if seen, ok := relay.seen[hash]; ok {
+    seen.result = result
+  }
+}
+
+func (relay *TransactionRelay) forget(hash common.Hash) {
+  relay.lock.Lock()
+  delete(relay.seen, hash)
+  relay.lock.Unlock()
+}
+
+func (relay *TransactionRelay) allow(sender common.Address) bool {
+  if relay.config.SenderRate <= 0 {
+    return true
+  }
+  relay.lock.Lock()
+  defer relay.lock.Unlock()
+  limiter, ok := relay.limiters[sender]
+  if !ok {
+    limiter = &senderLimiter{limiter: rate.NewLimiter(rate.Limit(relay.config.SenderRate), relay.config.SenderBurst)}
+    relay.limiters[sender] = limiter
+  }
+  limiter.lastUsed = time.Now()
+  return limiter.limiter.Allow()
+}
+
+// prune forgets transactions older than the dedupe window, and senders that
+// have been idle as long. The caller must hold the lock.
+func (relay *TransactionRelay) prune() {
+  if time.Since(relay.lastPrune) < relayPruneInterval {
+    return
+  }
+  for hash, seen := range relay.seen {
+    if seen.result != nil && time.Since(seen.time) >= relay.config.DedupeWindow {
+      delete(relay.seen, hash)
+    }
+  }
+  for sender, limiter := range relay.limiters {
+    if time.Since(limiter.lastUsed) >= relay.config.DedupeWindow {
+      delete(relay.limiters, sender)
+    }
+  }
+  relay.lastPrune = time.Now()
+}
+
+func (relay *TransactionRelay) report(result *TransactionResult) {
+  if relay.results == nil {
+    return
+  }
+  if err := relay.results.Emit(result); err != nil {
+    log.Warn("Error reporting transaction result", "hash", result.Hash, "err", err)
+  }
+}
+
+func (relay *TransactionRelay) deadLetter(hash *common.Hash, data []byte, reason string) error {
+  if hash != nil {
+    log.Warn("Transaction could not be relayed", "hash", *hash, "reason", reason)
+  } else {
+    log.Warn("Transaction could not be relayed", "reason", reason)
+  }
+  if relay.deadLetters == nil {
+    return nil
+  }
+  return relay.deadLetters.Emit(&DeadLetter{Hash: hash, Data: data, Reason: reason, Time: time.Now()})
+}
+
+type KafkaDeadLetterProducer struct {
+  producer sarama.SyncProducer
+  topic string
+}
+
+func (producer *KafkaDeadLetterProducer) Emit(deadLetter *DeadLetter) error {
+  data, err := json.Marshal(deadLetter)
+  if err != nil {
+    return err
+  }
+  msg := &sarama.ProducerMessage{Topic: producer.topic, Value: sarama.ByteEncoder(data)}
+  _, _, err = producer.producer.SendMessage(msg)
+  return err
+}
+
+func (producer *KafkaDeadLetterProducer) Close() {
+  producer.producer.Close()
+}
+
+func NewKafkaDeadLetterProducerFromURLs(brokerURL, topic string) (*KafkaDeadLetterProducer, error) {
+  brokers, config := cdc.ParseKafkaURL(brokerURL)
+  if err := cdc.CreateTopicIfDoesNotExist(brokerURL, topic, 0, nil); err != nil {
+    return nil, err
+  }
+  config.Producer.Return.Successes=true
+  producer, err := sarama.NewSyncProducer(brokers, config)
+  if err != nil {
+    return nil, err
+  }
+  return &KafkaDeadLetterProducer{producer, topic}, nil
+}
@@ -0,0 +1,143 @@
+package replica
+
+import (
+  "context"
+  "errors"
+  "math/big"
+  "testing"
+  "time"
+  "github.com/ethereum/go-ethereum/common"
+  "github.com/ethereum/go-ethereum/core/types"
+  "github.com/ethereum/go-ethereum/crypto"
+  "github.com/ethereum/go-ethereum"
+  "github.com/ethereum/go-ethereum/rlp"
+)
+
+type mockSender struct {
+  sent []common.Hash
+  err error
+}
+
+func (sender *mockSender) SendTransaction(ctx context.Context, tx *types.Transaction) error {
+  sender.sent = append(sender.sent, tx.Hash())
+  return sender.err
+}
+
+// rejection is an error as returned by the master's RPC server
+type rejection string
+
+func (err rejection) Error() string { return string(err) }
+func (err rejection) ErrorCode() int { return -32000 }
+
+type mockResults struct {
+  results []*TransactionResult
+}
+
+func (producer *mockResults) Emit(result *TransactionResult) error {
+  producer.results = append(producer.results, result)
+  return nil
+}
+
+func (producer *mockResults) Close() {}
+
+type mockDeadLetters struct {
+  deadLetters []*DeadLetter
+}
+
+func (producer *mockDeadLetters) Emit(deadLetter *DeadLetter) error {
+  producer.deadLetters = append(producer.deadLetters, deadLetter)
+  return nil
+}
+
+func (producer *mockDeadLetters) Close() {}
+
+func signedTransaction(t *testing.T, nonce uint64) []byte {
+  key, _ := crypto.GenerateKey()
+  signer := types.NewEIP155Signer(big.NewInt(1))
+  tx, err := types.SignTx(types.NewTransaction(nonce, common.Address{}, big.NewInt(0), 21000, big.NewInt(1), nil), signer, key)
+  if err != nil { t.Fatalf(err.Error()) }
+  data, err := rlp.EncodeToBytes(tx)
+  if err != nil { t.Fatalf(err.Error()) }
+  return data
+}
+
+func TestRelayDedupe(t *testing.T) {
+  sender := &mockSender{err: rejection("nonce too low")}
+  results := &mockResults{}
+  relay := NewTransactionRelay([]ethereum.TransactionSender{sender}, TransactionRelayConfig{DedupeWindow: time.Minute, Retries: 3}, results, nil)
+  tx := signedTransaction(t, 0)
+  for i := 0; i < 2; i++ {
+    if err := relay.Relay(context.Background(), tx); err != nil { t.Fatalf(err.Error()) }
+  }
+  if len(sender.sent) != 1 {
+    t.Errorf("Expected the transaction to be sent once, got %v", len(sender.sent))
+  }
+  if len(results.results) != 2 {
+    t.Fatalf("Expected the result to be reported for each copy, got %v", len(results.results))
+  }
+  for _, result := range results.results {
+    if result.Accepted || result.Error != "nonce too low" {
+      t.Errorf("Unexpected result %+v", result)
+    }
+  }
+}
+
+func TestRelayFailover(t *testing.T) {
+  down := &mockSender{err: errors.New("connection refused")}
+  up := &mockSender{}
+  results := &mockResults{}
+  relay := NewTransactionRelay([]ethereum.TransactionSender{down, up}, TransactionRelayConfig{Retries: 2}, results, nil)
+  for nonce := uint64(0); nonce < 2; nonce++ {
+    if err := relay.Relay(context.Background(), signedTransaction(t, nonce)); err != nil { t.Fatalf(err.Error()) }
+  }
+  // The relay stays on the working endpoint after failing over
+  if len(down.sent) != 1 || len(up.sent) != 2 {
+    t.Errorf("Unexpected sends: %v down, %v up", len(down.sent), len(up.sent))
+  }
+  for _, result := range results.results {
+    if !result.Accepted {
+      t.Errorf("Unexpected result %+v", result)
+    }
+  }
+}
+
+func TestRelayDeadLetters(t *testing.T) {
+  sender := &mockSender{err: errors.New("connection refused")}
+  deadLetters := &mockDeadLetters{}
+  relay := NewTransactionRelay([]ethereum.TransactionSender{sender}, TransactionRelayConfig{DedupeWindow: time.Minute, Retries: 2}, nil, deadLetters)
+  if err := relay.Relay(context.Background(), []byte{0x01, 0x02}); err != nil { t.Fatalf(err.Error()) }
+  if err := relay.Relay(context.Background(), signedTransaction(t, 0)); err != nil { t.Fatalf(err.Error()) }
+  if len(deadLetters.deadLetters) != 2 {
+    t.Fatalf("Expected 2 dead letters, got %v", len(deadLetters.deadLetters))
+  }
+  if deadLetters.deadLetters[0].Hash != nil {
+    t.Errorf("Undecodable transaction should have no hash")
+  }
+  if deadLetters.deadLetters[1].Hash == nil || len(sender.sent) != 2 {
+    t.Errorf("Expected a failing transaction to be retried before its dead letter")
+  }
+}
+
+func TestRelaySenderRate(t *testing.T) {
+  sender := &mockSender{}
+  results := &mockResults{}
+  relay := NewTransactionRelay([]ethereum.TransactionSender{sender}, TransactionRelayConfig{SenderRate: 0.001, SenderBurst: 2}, results, nil)
+  key, _ := crypto.GenerateKey()
+  signer := types.NewEIP155Signer(big.NewInt(1))
+  for nonce := uint64(0); nonce < 3; nonce++ {
+    tx, _ := types.SignTx(types.NewTransaction(nonce, common.Address{}, big.NewInt(0), 21000, big.NewInt(1), nil), signer, key)
+    data, _ := rlp.EncodeToBytes(tx)
+    if err := relay.Relay(context.Background(), data); err != nil { t.Fatalf(err.Error()) }
+  }
+  if len(sender.sent) != 2 {
+    t.Errorf("Expected 2 transactions within the burst to be sent, got %v", len(sender.sent))
+  }
+  if result := results.results[2]; result.Accepted || result.Error != errRateLimited.Error() {
+    t.Errorf("Expected the third transaction to be rate limited, got %+v", result)
+  }
+  // Other senders are unaffected
+  if err := relay.Relay(context.Background(), signedTransaction(t, 0)); err != nil { t.Fatalf(err.Error()) }
+  if len(sender.sent) != 3 {
+    t.Errorf("Expected another sender's transaction to be sent")
+  }
+}
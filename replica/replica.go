@@ -11,6 +11,7 @@ import (
   "github.com/ethereum/go-ethereum/eth"
   "github.com/ethereum/go-ethereum/eth/ethconfig"
   "github.com/ethereum/go-ethereum/eth/filters"
+  "github.com/ethereum/go-ethereum/eth/tracers"
   "github.com/ethereum/go-ethereum/ethdb"
   "github.com/ethereum/go-ethereum/ethdb/cdc"
   "github.com/ethereum/go-ethereum/event"
@@ -21,6 +22,7 @@ import (
   "github.com/ethereum/go-ethereum/core/rawdb"
   "github.com/ethereum/go-ethereum/internal/ethapi"
   "github.com/ethereum/go-ethereum/log"
+  "github.com/ethereum/go-ethereum/metrics"
   "github.com/ethereum/go-ethereum/params"
   "github.com/Shopify/sarama"
   "time"
@@ -29,8 +31,23 @@ import (
   "strconv"
   "os"
   "io/ioutil"
+  "net/http"
+  "sync"
+  "sync/atomic"
 )
 
+const (
+  // eventRollback is how many messages per partition the event consumer
+  // re-reads before its recorded offsets, so that blocks spanning the offset
+  // boundary can be reassembled.
+  eventRollback = 5000
+  // eventFinishedLimit bounds how many emitted blocks the event consumer
+  // remembers for reorg detection.
+  eventFinishedLimit = 128
+)
+
+var rejectedOperationMeter = metrics.NewRegisteredMeter("replica/cdc/rejected", nil)
+
 type Replica struct {
   db ethdb.Database
   hc *core.HeaderChain
@@ -49,6 +66,17 @@ type Replica struct {
   quit chan struct{}
   halted chan struct{}
   enableSnapshot bool
+  eventConsumer EventConsumer
+  eventTopic string
+  applyLock *sync.RWMutex
+  // rejected is set once the replica halts on an operation it refused to
+  // apply.
+  rejected int32
+  stopped chan struct{}
+  stateDeltaConsumer StateDeltaConsumer
+  consumer cdc.LogConsumer
+  // startingBlock is the replica's head block when it started consuming.
+  startingBlock uint64
 }
 
 func (r *Replica) Protocols() []p2p.Protocol {
@@ -72,11 +100,19 @@ func (r *Replica) GetBackend() *ReplicaBackend {
       shutdownChan: r.shutdownChan,
       blockHeads: r.headChan,
       evmSemaphore: evmSemaphore,
+      eventConsumer: r.eventConsumer,
+      eventTopic: r.eventTopic,
+      syncProgress: r.SyncProgress,
     }
     if r.enableSnapshot {
       if err := r.backend.initSnapshot(); err != nil {
         log.Warn("Error initializing snapshot", "err", err)
       }
+      if r.stateDeltaConsumer != nil {
+        if err := r.backend.consumeStateDeltas(r.stateDeltaConsumer); err != nil {
+          log.Warn("Error consuming state deltas. Snapshots will be updated from tries.", "err", err)
+        }
+      }
     }
     if err := r.backend.consumeTransactions(r.transactionConsumer); err != nil {
       log.Warn("Error consuming transactions")
@@ -86,6 +122,9 @@ func (r *Replica) GetBackend() *ReplicaBackend {
       r.backend.handleBlockUpdates()
       r.halted <- struct{}{}
     }()
+    if r.eventConsumer != nil {
+      go r.backend.handleChainEvents()
+    }
     if r.warmAddressFile != "" {
       jsonFile, err := os.Open(r.warmAddressFile)
       if err != nil {
@@ -111,7 +150,7 @@ func (r *Replica) GetBackend() *ReplicaBackend {
 func (r *Replica) APIs() []rpc.API {
   apiBackend := r.GetBackend()
   nonceLock := new(ethapi.AddrLocker)
-	return []rpc.API{
+	apis := []rpc.API{
 		{
 			Namespace: "eth",
 			Version:   "1.0",
@@ -154,50 +193,48 @@ func (r *Replica) APIs() []rpc.API {
       Public:    true,
     },
 	}
+	// The debug_trace* methods, with native callTracer and prestateTracer
+	return append(apis, tracers.APIs(apiBackend)...)
 }
 func (r *Replica) Start() error {
   go func() {
-    for _ = range time.NewTicker(time.Second * 30).C { // TODO: Make interval configurable?
-      latestHash := rawdb.ReadHeadBlockHash(r.db)
-      currentBlock := r.bc.GetBlockByHash(latestHash)
-      offsetBytes, err := r.db.Get([]byte(fmt.Sprintf("cdc-log-%v-offset", r.topic)))
-      if err != nil {
-        log.Error(err.Error())
-        continue
-      }
-      var bytesRead int
-      var offset, offsetTimestamp int64
-      if err != nil || len(offsetBytes) == 0 {
-        offset = 0
-      } else {
-        offset, bytesRead = binary.Varint(offsetBytes[:binary.MaxVarintLen64])
-        if bytesRead <= 0 {
-          log.Error("Offset buffer too small")
-        }
-        offsetTimestamp, bytesRead = binary.Varint(offsetBytes[binary.MaxVarintLen64:])
-        if bytesRead <= 0 {
-          log.Error("Offset buffer too small")
-        }
+    ticker := time.NewTicker(statusInterval)
+    defer ticker.Stop()
+    lastLog := time.Time{}
+    wasReady := true
+    for {
+      select {
+      case <-ticker.C:
+      case <-r.stopped:
+        return
       }
-      now := time.Now().Unix()
-      if r.maxBlockAge > 0 && now - int64(currentBlock.Time()) > r.maxBlockAge {
-        log.Error("Max block age exceeded.", "maxAgeSec", r.maxBlockAge, "realAge", common.PrettyAge(time.Unix(int64(currentBlock.Time()), 0)))
-        r.Stop()
-        os.Exit(1)
+      status := r.Status()
+      r.updateStatusMetrics(status)
+      if wasReady && !status.Ready {
+        log.Warn("Replica not ready", "reason", status.Reason)
+      } else if !wasReady && status.Ready {
+        log.Info("Replica ready")
       }
-      if r.maxOffsetAge > 0 && now - offsetTimestamp > r.maxOffsetAge {
-        log.Error("Max offset age exceeded.", "maxAgeSec", r.maxBlockAge, "realAge", common.PrettyAge(time.Unix(offsetTimestamp, 0)))
-        r.Stop()
-        os.Exit(1)
+      wasReady = status.Ready
+      if time.Since(lastLog) >= statusLogInterval {
+        log.Info("Replica Sync", "num", status.Number, "hash", status.Hash, "blockAge", common.PrettyDuration(time.Duration(status.BlockAge) * time.Second), "offset", status.Offset, "offsetAge", common.PrettyDuration(time.Duration(status.OffsetAge) * time.Second), "ready", status.Ready)
+        lastLog = time.Now()
       }
-      log.Info("Replica Sync", "num", currentBlock.Number(), "hash", currentBlock.Hash(), "blockAge", common.PrettyAge(time.Unix(int64(currentBlock.Time()), 0)), "offset", offset, "offsetAge", common.PrettyAge(time.Unix(offsetTimestamp, 0)))
     }
   }()
   return nil
 }
 func (r *Replica) Stop() error {
+  close(r.stopped)
   r.quit <- struct{}{}
   <-r.halted
+  close(r.shutdownChan)
+  if r.eventConsumer != nil {
+    r.eventConsumer.Close()
+  }
+  if r.stateDeltaConsumer != nil {
+    r.stateDeltaConsumer.Close()
+  }
   r.db.Close()
   if r.transactionConsumer != nil {
     r.transactionConsumer.Close()
@@ -205,7 +242,35 @@ func (r *Replica) Stop() error {
   return nil
 }
 
-func NewReplica(db ethdb.Database, config *eth.Config, stack *node.Node, transactionProducer TransactionProducer, consumer cdc.LogConsumer, transactionConsumer TransactionConsumer, syncShutdown bool, startupAge, maxOffsetAge, maxBlockAge int64, timeout rpc.HTTPTimeouts, evmConcurrency int, warmAddressFile string, enableSnapshot bool, maxOffset int64) (*Replica, error) {
+// snapshot briefly pauses the application of operations to take a consistent
+// snapshot of the replica's database for export.
+func (r *Replica) snapshot() (ethdb.Iterator, uint64, int64, error) {
+  r.applyLock.Lock()
+  defer r.applyLock.Unlock()
+  // Exports carry a single offset, so a replica bootstrapped from a
+  // partitioned topic would replay every other partition from the start.
+  if offsets, err := cdc.ReadPartitionOffsets(r.db, r.topic); err == nil && len(offsets) > 1 {
+    return nil, 0, 0, fmt.Errorf("Exports of partitioned topic %v are not supported", r.topic)
+  }
+  offset, _, err := cdc.ReadOffset(r.db, r.topic)
+  if err != nil { return nil, 0, 0, fmt.Errorf("Replica has no offset for %v: %v", r.topic, err) }
+  it := r.db.NewIterator(nil, nil)
+  ancients, err := r.db.Ancients()
+  if err != nil {
+    // Databases without a freezer have no ancients to export
+    ancients = 0
+  }
+  // The stored offset is that of the last operation applied.
+  return it, ancients, offset + 1, nil
+}
+
+// ExportHandler returns an http.Handler serving exports of the replica's
+// database, so that other replicas can bootstrap from this one.
+func (r *Replica) ExportHandler() http.Handler {
+  return cdc.NewExportHandler(r.snapshot, r.db, r.topic)
+}
+
+func NewReplica(db ethdb.Database, config *eth.Config, stack *node.Node, transactionProducer TransactionProducer, consumer cdc.LogConsumer, transactionConsumer TransactionConsumer, eventConsumer EventConsumer, eventTopic string, stateDeltaConsumer StateDeltaConsumer, syncShutdown bool, startupAge, maxOffsetAge, maxBlockAge int64, timeout rpc.HTTPTimeouts, evmConcurrency int, warmAddressFile string, enableSnapshot bool, maxOffset int64) (*Replica, error) {
   var headChan chan []byte
   quit := make(chan struct{})
   halted := make(chan struct{})
@@ -225,33 +290,122 @@ func NewReplica(db ethdb.Database, config *eth.Config, stack *node.Node, transac
   } else {
     headChan = make(chan []byte, 10)
   }
-  replica := &Replica{db, hc, chainConfig, bc, transactionProducer, transactionConsumer, make(chan bool), consumer.TopicName(), maxOffsetAge, maxBlockAge, headChan, nil, evmConcurrency, warmAddressFile, quit, halted, enableSnapshot}
-  maxOffsetCh := make(chan struct{})
-  go func() {
-    for {
-      select {
-      case operation := <-consumer.Messages():
+  identity := cdc.ChainIdentity{Genesis: bc.Genesis().Hash()}
+  if chainConfig.ChainID != nil {
+    identity.ChainID = chainConfig.ChainID.Uint64()
+  }
+  applyLock := &sync.RWMutex{}
+  replica := &Replica{db, hc, chainConfig, bc, transactionProducer, transactionConsumer, make(chan bool), consumer.TopicName(), maxOffsetAge, maxBlockAge, headChan, nil, evmConcurrency, warmAddressFile, quit, halted, enableSnapshot, eventConsumer, eventTopic, applyLock, 0, make(chan struct{}), stateDeltaConsumer, consumer, bc.CurrentBlock().NumberU64()}
+  maxOffsetCh := make(chan struct{}, 1)
+  rejectedCh := make(chan error, 1)
+  // Partitions of the write log are applied in parallel. The consumer holds
+  // each partition at barriers, so heads are only reported once every
+  // partition has caught up to them.
+  partitions := []<-chan *cdc.Operation{}
+  if partitioned, ok := consumer.(cdc.PartitionedConsumer); ok {
+    partitions = partitioned.PartitionMessages()
+  } else {
+    partitions = append(partitions, consumer.Messages())
+  }
+  heads := make(chan []byte)
+  stop := make(chan struct{})
+  var stopOnce sync.Once
+  halt := func() { stopOnce.Do(func() { close(stop) }) }
+  // report passes heads on from the workers, unless the replica is halting.
+  report := func(head []byte) bool {
+    if head == nil {
+      return true
+    }
+    select {
+    case heads <- head:
+      return true
+    case <-stop:
+      return false
+    }
+  }
+  var workers sync.WaitGroup
+  for _, messages := range partitions {
+    workers.Add(1)
+    go func(messages <-chan *cdc.Operation) {
+      defer workers.Done()
+      // Each worker batches the operations it applies, committing them with
+      // their offset at block boundaries.
+      applier := cdc.NewBatchApplier(db)
+      commit := func() bool {
+        applyLock.RLock()
+        head, err := applier.Flush()
+        applyLock.RUnlock()
+        if err != nil {
+          log.Warn("Error committing operations", "err", err.Error())
+        }
+        return report(head)
+      }
+      defer commit()
+      ticker := time.NewTicker(cdc.ApplyCommitInterval)
+      defer ticker.Stop()
+      for {
+        var operation *cdc.Operation
+        select {
+        case operation = <-messages:
+        case <-ticker.C:
+          // Don't hold operations back waiting for the next block boundary
+          if applier.Pending() && !commit() {
+            return
+          }
+          continue
+        case <-stop:
+          return
+        }
+        if err := operation.Verify(identity); err != nil {
+          // Applying operations after this one would leave the replica
+          // silently diverged from the master, so stop here and leave it to
+          // the operator (or the offset / block age checks) to intervene.
+          log.Error("Refusing to apply operation. Replica halted.", "topic", operation.Topic, "offset", operation.Offset, "identity", identity, "err", err)
+          rejectedOperationMeter.Mark(1)
+          atomic.StoreInt32(&replica.rejected, 1)
+          select {
+          case rejectedCh <- err:
+          default:
+          }
+          halt()
+          return
+        }
         if maxOffset > 0 && operation.Offset  > maxOffset {
-          maxOffsetCh <- struct{}{}
-          // Once we've signalled that we've reached the max offset, wait for a
-          // signal on the quit channel, cleanup and shutdown. We don't want to
-          // consume any more messages, but the shutdown process expects this
-          // goroutine to consume from the quit channel.
-          <-quit
-          if headChan != nil {
-            close(headChan)
+          // Once we've signalled that we've reached the max offset, stop
+          // consuming messages. The shutdown process still expects the quit
+          // channel to be consumed below.
+          commit()
+          select {
+          case maxOffsetCh <- struct{}{}:
+          default:
           }
+          halt()
           return
         }
-        head, err := operation.Apply(db)
+        applyLock.RLock()
+        head, err := applier.Apply(operation)
+        applyLock.RUnlock()
         if err != nil {
           log.Warn("Error applying operation", "err", err.Error())
         }
-        if head != nil && headChan != nil {
+        if !report(head) {
+          return
+        }
+      }
+    }(messages)
+  }
+  go func() {
+    for {
+      select {
+      case head := <-heads:
+        if headChan != nil {
           headChan <- head
         }
       case <-quit:
         log.Warn("Operation consumer shutting down")
+        halt()
+        // Wait for the workers to commit what they've applied
+        workers.Wait()
         if headChan != nil {
           close(headChan)
         }
@@ -266,6 +420,10 @@ func NewReplica(db ethdb.Database, config *eth.Config, stack *node.Node, transac
       log.Info("Replica up to date with master")
     case <- maxOffsetCh:
       log.Info("Replica reached max offset")
+    case err := <-rejectedCh:
+      quit <- struct{}{}
+      <-halted
+      return nil, err
     }
   }
   log.Info("Replica up to date with master")
@@ -287,7 +445,7 @@ func NewReplica(db ethdb.Database, config *eth.Config, stack *node.Node, transac
   return replica, err
 }
 
-func NewKafkaReplica(db ethdb.Database, config *eth.Config, stack *node.Node, kafkaSourceBroker, kafkaTopic, transactionTopic, txPoolTopic string, syncShutdown bool, startupAge, offsetAge, blockAge int64, timeout rpc.HTTPTimeouts, evmConcurrency int, warmAddressFile string, enableSnapshot bool, maxOffset int64) (*Replica, error) {
+func NewKafkaReplica(db ethdb.Database, config *eth.Config, stack *node.Node, kafkaSourceBroker, kafkaTopic, transactionTopic, txResultTopic, txPoolTopic, eventTopic, stateDeltaTopic string, syncShutdown bool, startupAge, offsetAge, blockAge int64, timeout rpc.HTTPTimeouts, evmConcurrency int, warmAddressFile string, enableSnapshot bool, maxOffset int64, txResultTimeout time.Duration) (*Replica, error) {
   topicParts := strings.Split(kafkaTopic, ":")
   kafkaTopic = topicParts[0]
   var offset int64
@@ -311,17 +469,54 @@ func NewKafkaReplica(db ethdb.Database, config *eth.Config, stack *node.Node, ka
       if bytesRead <= 0 { return nil, errors.New("Offset buffer too small") }
     }
   }
-  consumer, err := cdc.NewKafkaLogConsumerFromURL(
-    kafkaSourceBroker,
-    kafkaTopic,
-    offset,
-  )
+  var consumer cdc.LogConsumer
+  var err error
+  if offsets, perr := cdc.ReadPartitionOffsets(db, kafkaTopic); perr == nil && len(topicParts) == 1 {
+    // Replicas of partitioned topics resume each partition from the last
+    // barrier applied.
+    log.Info("Resuming partitioned topic", "topic", kafkaTopic, "offsets", offsets)
+    consumer, err = cdc.NewPartitionedLogConsumerFromURL(kafkaSourceBroker, kafkaTopic, offsets)
+  } else {
+    consumer, err = cdc.NewLogConsumerFromURL(
+      kafkaSourceBroker,
+      kafkaTopic,
+      offset,
+    )
+  }
   if err != nil { return nil, err }
+  if !cdc.IsKafkaURL(kafkaSourceBroker) {
+    // The transaction and event topics are only available through Kafka.
+    if transactionTopic != "" || txPoolTopic != "" || eventTopic != "" || stateDeltaTopic != "" {
+      log.Warn("Transaction, event and state delta topics require a Kafka broker. Ignoring.", "broker", kafkaSourceBroker)
+    }
+    transactionTopic, txResultTopic, txPoolTopic, eventTopic, stateDeltaTopic = "", "", "", "", ""
+  }
   var transactionConsumer TransactionConsumer
   if txPoolTopic != "" {
     transactionConsumer, err = NewKafkaTransactionConsumerFromURLs(kafkaSourceBroker, txPoolTopic)
     if err != nil { return nil, err }
   }
+  var eventConsumer EventConsumer
+  if eventTopic != "" {
+    lastEmittedBlock, eventOffsets, err := ReadEventOffsets(db, eventTopic)
+    if err != nil { return nil, err }
+    var startingBlockNumber uint64
+    if lastEmittedBlock == (common.Hash{}) {
+      lastEmittedBlock = rawdb.ReadHeadBlockHash(db)
+    }
+    if number := rawdb.ReadHeaderNumber(db, lastEmittedBlock); number != nil {
+      startingBlockNumber = *number
+    }
+    eventConsumer, err = NewKafkaEventConsumerFromURLs(kafkaSourceBroker, eventTopic, lastEmittedBlock, eventOffsets, eventRollback, startingBlockNumber, eventFinishedLimit)
+    if err != nil { return nil, err }
+    log.Info("Populating subscriptions from event topic", "topic", eventTopic, "lastEmitted", lastEmittedBlock, "offsets", eventOffsets)
+  }
+  var stateDeltaConsumer StateDeltaConsumer
+  if stateDeltaTopic != "" && enableSnapshot {
+    stateDeltaConsumer, err = NewKafkaStateDeltaConsumerFromURLs(kafkaSourceBroker, stateDeltaTopic)
+    if err != nil { return nil, err }
+    log.Info("Updating snapshots from state delta topic", "topic", stateDeltaTopic)
+  }
   log.Info("Populating replica from topic", "topic", kafkaTopic, "offset", offset)
   var transactionProducer TransactionProducer
   if transactionTopic != "" {
@@ -332,8 +527,15 @@ func NewKafkaReplica(db ethdb.Database, config *eth.Config, stack *node.Node, ka
     if err != nil {
       return nil, err
     }
+    if txResultTopic != "" && txResultTimeout > 0 {
+      results, err := NewKafkaTransactionResultConsumerFromURLs(kafkaSourceBroker, txResultTopic)
+      if err != nil {
+        return nil, err
+      }
+      transactionProducer = NewWaitingTransactionProducer(transactionProducer, results, txResultTimeout)
+    }
   } else {
     log.Warn("No transaction topic specified. Replica will not have mempool data.")
   }
-  return NewReplica(db, config, stack, transactionProducer, consumer, transactionConsumer, syncShutdown, startupAge, offsetAge, blockAge, timeout, evmConcurrency, warmAddressFile, enableSnapshot, maxOffset)
+  return NewReplica(db, config, stack, transactionProducer, consumer, transactionConsumer, eventConsumer, eventTopic, stateDeltaConsumer, syncShutdown, startupAge, offsetAge, blockAge, timeout, evmConcurrency, warmAddressFile, enableSnapshot, maxOffset)
 }
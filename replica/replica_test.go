@@ -5,8 +5,13 @@ import (
   "github.com/ethereum/go-ethereum/eth/ethconfig"
   "github.com/ethereum/go-ethereum/core/rawdb"
   "github.com/ethereum/go-ethereum/ethdb/cdc"
+  "github.com/ethereum/go-ethereum/params"
   "github.com/ethereum/go-ethereum/rpc"
+  "net/http"
+  "net/http/httptest"
+  "sync"
   "testing"
+  "time"
 )
 
 
@@ -16,7 +21,7 @@ func TestReplicaConstants(t *testing.T) {
   db := rawdb.NewMemoryDatabase()
   config := ethconfig.Defaults
   config.Ethash.PowMode = ethash.ModeFake
-  replicaNode, err := NewReplica(db, &config, nil, transactionProducer, consumer, nil, false, 0, 0, 0, rpc.HTTPTimeouts{}, 0, "", true, -1)
+  replicaNode, err := NewReplica(db, &config, nil, transactionProducer, consumer, nil, nil, "", nil, false, 0, 0, 0, rpc.HTTPTimeouts{}, 0, "", true, -1)
   if err != nil {
     t.Errorf(err.Error())
   }
@@ -37,7 +42,7 @@ func TestReplicaAPIs(t *testing.T) {
   db := rawdb.NewMemoryDatabase()
   config := ethconfig.Defaults
   config.Ethash.PowMode = ethash.ModeFake
-  replicaNode, err := NewReplica(db, &config, nil, transactionProducer, consumer, nil, false, 0, 0, 0, rpc.HTTPTimeouts{}, 0, "", true, -1)
+  replicaNode, err := NewReplica(db, &config, nil, transactionProducer, consumer, nil, nil, "", nil, false, 0, 0, 0, rpc.HTTPTimeouts{}, 0, "", true, -1)
   if err != nil {
     t.Errorf(err.Error())
   }
@@ -46,3 +51,95 @@ func TestReplicaAPIs(t *testing.T) {
     t.Errorf("Fewer APIs than expected, got %v", apis)
   }
 }
+
+func TestReplicaRefusesForeignChain(t *testing.T) {
+  producer, consumer := cdc.MockLogPair()
+  transactionProducer := &MockTransactionProducer{}
+  db := rawdb.NewMemoryDatabase()
+  config := ethconfig.Defaults
+  config.Ethash.PowMode = ethash.ModeFake
+  replicaNode, err := NewReplica(db, &config, nil, transactionProducer, consumer, nil, nil, "", nil, false, 0, 0, 0, rpc.HTTPTimeouts{}, 0, "", true, -1)
+  if err != nil {
+    t.Fatalf(err.Error())
+  }
+  // Operations from another network must not be applied, nor anything after
+  // them.
+  producer.(cdc.IdentityProducer).SetChainIdentity(cdc.ChainIdentity{Genesis: params.GoerliGenesisHash, ChainID: 5})
+  op, _ := cdc.PutOperation([]byte("foreign"), []byte("value"))
+  producer.Emit(op.Bytes())
+  producer.(cdc.IdentityProducer).SetChainIdentity(cdc.ChainIdentity{Genesis: params.MainnetGenesisHash, ChainID: 1})
+  op, _ = cdc.PutOperation([]byte("local"), []byte("value"))
+  producer.Emit(op.Bytes())
+  time.Sleep(100 * time.Millisecond)
+  if ok, _ := db.Has([]byte("foreign")); ok {
+    t.Errorf("Operation from foreign chain was applied")
+  }
+  if ok, _ := db.Has([]byte("local")); ok {
+    t.Errorf("Operation after a refused operation was applied")
+  }
+  if err := replicaNode.Stop(); err != nil {
+    t.Errorf(err.Error())
+  }
+}
+
+func TestReplicaExportRefusesPartitionedTopic(t *testing.T) {
+  db := rawdb.NewMemoryDatabase()
+  replicaNode := &Replica{db: db, topic: "test", applyLock: &sync.RWMutex{}}
+  cdc.WriteOffset(db, "test", 5)
+  it, _, offset, err := replicaNode.snapshot()
+  if err != nil {
+    t.Fatalf(err.Error())
+  }
+  it.Release()
+  if offset != 6 {
+    t.Errorf("Expected export to resume after the last applied offset, got %v", offset)
+  }
+  cdc.WritePartitionOffsets(db, "test", map[int32]int64{0: 5, 1: 7})
+  if _, _, _, err := replicaNode.snapshot(); err == nil {
+    t.Errorf("Expected export of a partitioned topic to be refused")
+  }
+}
+
+func TestReplicaHealth(t *testing.T) {
+  producer, consumer := cdc.MockLogPair()
+  transactionProducer := &MockTransactionProducer{}
+  db := rawdb.NewMemoryDatabase()
+  config := ethconfig.Defaults
+  config.Ethash.PowMode = ethash.ModeFake
+  replicaNode, err := NewReplica(db, &config, nil, transactionProducer, consumer, nil, nil, "", nil, false, 0, 60, 0, rpc.HTTPTimeouts{}, 0, "", true, -1)
+  if err != nil {
+    t.Fatalf(err.Error())
+  }
+  defer replicaNode.Stop()
+  check := func(handler http.Handler, expected int) {
+    t.Helper()
+    recorder := httptest.NewRecorder()
+    handler.ServeHTTP(recorder, httptest.NewRequest("GET", ReadyPath, nil))
+    if recorder.Code != expected {
+      t.Errorf("Expected status %v, got %v: %v", expected, recorder.Code, recorder.Body)
+    }
+  }
+  // No operations have been applied yet
+  check(replicaNode.HealthHandler(), http.StatusOK)
+  check(replicaNode.ReadyHandler(), http.StatusServiceUnavailable)
+  if progress := replicaNode.SyncProgress(); !progress.Syncing {
+    t.Errorf("Expected replica without an offset to be syncing")
+  }
+
+  cdc.WriteOffset(db, consumer.TopicName(), 5)
+  check(replicaNode.ReadyHandler(), http.StatusOK)
+  if status := replicaNode.Status(); status.Offset != 5 || status.Number != 0 {
+    t.Errorf("Unexpected status %+v", status)
+  }
+  if progress := replicaNode.SyncProgress(); progress.Syncing || progress.Offset != 5 {
+    t.Errorf("Unexpected sync progress %+v", progress)
+  }
+
+  // A halted replica is neither healthy nor ready
+  producer.(cdc.IdentityProducer).SetChainIdentity(cdc.ChainIdentity{Genesis: params.GoerliGenesisHash, ChainID: 5})
+  op, _ := cdc.PutOperation([]byte("foreign"), []byte("value"))
+  producer.Emit(op.Bytes())
+  time.Sleep(100 * time.Millisecond)
+  check(replicaNode.HealthHandler(), http.StatusServiceUnavailable)
+  check(replicaNode.ReadyHandler(), http.StatusServiceUnavailable)
+}
@@ -0,0 +1,97 @@
+package replica
+
+import (
+  "sync"
+  "time"
+  "github.com/Shopify/sarama"
+  "github.com/ethereum/go-ethereum/ethdb/cdc"
+  "github.com/ethereum/go-ethereum/log"
+  "github.com/ethereum/go-ethereum/metrics"
+)
+
+const (
+  // stateDeltaRollback is how far before the replica's head block it starts
+  // consuming state deltas, as the master emits a block's delta before the
+  // block itself.
+  stateDeltaRollback = time.Minute
+  // stateDeltaWait is how long the replica waits for a recent block's delta
+  // before diffing tries instead.
+  stateDeltaWait = 2 * time.Second
+)
+
+var (
+  stateDeltaHitMeter = metrics.NewRegisteredMeter("replica/snapshot/delta/hit", nil)
+  stateDeltaMissMeter = metrics.NewRegisteredMeter("replica/snapshot/delta/miss", nil)
+)
+
+// StateDeltaMessage is a message from the state delta topic, as written by
+// snapshot.CDCTree.
+type StateDeltaMessage struct {
+  Key []byte
+  Value []byte
+  Partition int32
+  Offset int64
+}
+
+type KafkaStateDeltaConsumer struct {
+  client sarama.Client
+  consumer sarama.Consumer
+  topic string
+  partitionConsumers []sarama.PartitionConsumer
+}
+
+// Messages returns the messages of every partition of the state delta topic,
+// starting from the first emitted after since. The channel is closed once the
+// consumer is closed.
+func (consumer *KafkaStateDeltaConsumer) Messages(since time.Time) (<-chan *StateDeltaMessage, error) {
+  partitions, err := consumer.consumer.Partitions(consumer.topic)
+  if err != nil { return nil, err }
+  messages := make(chan *StateDeltaMessage, 100)
+  var wg sync.WaitGroup
+  for _, partition := range partitions {
+    offset, err := consumer.client.GetOffset(consumer.topic, partition, since.UnixNano() / int64(time.Millisecond))
+    if err != nil || offset < 0 {
+      // Nothing has been emitted since then
+      offset = sarama.OffsetNewest
+    }
+    pc, err := consumer.consumer.ConsumePartition(consumer.topic, partition, offset)
+    if err != nil { return nil, err }
+    consumer.partitionConsumers = append(consumer.partitionConsumers, pc)
+    log.Debug("Consuming state deltas", "topic", consumer.topic, "partition", partition, "offset", offset)
+    wg.Add(1)
+    go func(pc sarama.PartitionConsumer) {
+      defer wg.Done()
+      for msg := range pc.Messages() {
+        messages <- &StateDeltaMessage{Key: msg.Key, Value: msg.Value, Partition: msg.Partition, Offset: msg.Offset}
+      }
+    }(pc)
+  }
+  go func() {
+    wg.Wait()
+    close(messages)
+  }()
+  return messages, nil
+}
+
+func (consumer *KafkaStateDeltaConsumer) Close() {
+  for _, partitionConsumer := range consumer.partitionConsumers {
+    partitionConsumer.Close()
+  }
+  consumer.consumer.Close()
+  consumer.client.Close()
+}
+
+func NewKafkaStateDeltaConsumerFromURLs(brokerURL, topic string) (StateDeltaConsumer, error) {
+  brokers, config := cdc.ParseKafkaURL(brokerURL)
+  if err := cdc.CreateTopicIfDoesNotExist(brokerURL, topic, 0, nil); err != nil {
+    return nil, err
+  }
+  client, err := sarama.NewClient(brokers, config)
+  if err != nil { return nil, err }
+  consumer, err := sarama.NewConsumerFromClient(client)
+  if err != nil {
+    client.Close()
+    return nil, err
+  }
+  return &KafkaStateDeltaConsumer{client: client, consumer: consumer, topic: topic}, nil
+}
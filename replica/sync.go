@@ -0,0 +1,52 @@
+package replica
+
+import (
+  "github.com/ethereum/go-ethereum/core/rawdb"
+  "github.com/ethereum/go-ethereum/ethdb/cdc"
+)
+
+// syncingMessageThreshold is how many unread messages the replica may have
+// before it reports that it is syncing, even if it has applied the master's
+// latest head. The master writes many messages per block, so a few unread
+// messages are normal.
+const syncingMessageThreshold = 1000
+
+// SyncProgress describes a replica's progress through the master's write log.
+// HighestBlock is the master's head, as of the latest LastBlock the replica
+// has read, and is never less than CurrentBlock.
+type SyncProgress struct {
+  Syncing bool
+  StartingBlock uint64
+  CurrentBlock uint64
+  HighestBlock uint64
+  Offset int64
+  HighWatermark int64
+}
+
+// SyncProgress reports how far the replica is behind the master. A replica is
+// syncing if it isn't ready, hasn't applied the master's latest head, or has
+// more than a few messages left to read.
+func (r *Replica) SyncProgress() *SyncProgress {
+  status := r.Status()
+  progress := &SyncProgress{
+    StartingBlock: r.startingBlock,
+    CurrentBlock: status.Number,
+    HighestBlock: status.Number,
+    Offset: status.Offset,
+    HighWatermark: status.Offset,
+  }
+  var remaining int64
+  if consumer, ok := r.consumer.(cdc.ProgressConsumer); ok {
+    cdcProgress := consumer.Progress()
+    progress.Offset, progress.HighWatermark = cdcProgress.Offset, cdcProgress.HighWatermark
+    remaining = cdcProgress.Remaining()
+    if number := rawdb.ReadHeaderNumber(r.db, cdcProgress.LastBlock); number != nil && *number > progress.HighestBlock {
+      progress.HighestBlock = *number
+    }
+  }
+  if progress.StartingBlock > progress.CurrentBlock {
+    progress.StartingBlock = progress.CurrentBlock
+  }
+  progress.Syncing = !status.Ready || progress.HighestBlock > progress.CurrentBlock || remaining > syncingMessageThreshold
+  return progress
+}
@@ -0,0 +1,111 @@
+package replica
+
+import (
+  "context"
+  "errors"
+  "fmt"
+  "github.com/ethereum/go-ethereum/core"
+  "github.com/ethereum/go-ethereum/core/state"
+  "github.com/ethereum/go-ethereum/core/types"
+  "github.com/ethereum/go-ethereum/core/vm"
+)
+
+// Replicas have the state of every block they hold, so the tracers' state
+// accessors open it directly. Nothing is re-executed, and reexec is ignored.
+
+// acquireEVM takes a slot from the EVM semaphore, returning the function that
+// gives it back.
+func (backend *ReplicaBackend) acquireEVM(ctx context.Context) (func(), error) {
+  if backend.evmSemaphore == nil {
+    return func() {}, nil
+  }
+  select {
+  case backend.evmSemaphore <- struct{}{}:
+  case <-ctx.Done():
+    return nil, ctx.Err()
+  }
+  return func() { <-backend.evmSemaphore }, nil
+}
+
+func (backend *ReplicaBackend) stateAt(block *types.Block) (*state.StateDB, error) {
+  statedb, err := state.New(block.Root(), backend.bc.StateCache(), backend.snaps)
+  if err != nil {
+    return nil, fmt.Errorf("state of block %#x not available: %v", block.Hash(), err)
+  }
+  return statedb, nil
+}
+
+// StateAtBlock returns the state after block, holding an EVM slot until the
+// returned release function is called.
+func (backend *ReplicaBackend) StateAtBlock(ctx context.Context, block *types.Block, reexec uint64) (*state.StateDB, func(), error) {
+  release, err := backend.acquireEVM(ctx)
+  if err != nil { return nil, nil, err }
+  statedb, err := backend.stateAt(block)
+  if err != nil {
+    release()
+    return nil, nil, err
+  }
+  return statedb, release, nil
+}
+
+// StateAtTransaction returns the state of block before transaction txIndex
+// runs, along with the transaction and its execution context.
+func (backend *ReplicaBackend) StateAtTransaction(ctx context.Context, block *types.Block, txIndex int, reexec uint64) (core.Message, vm.BlockContext, *state.StateDB, func(), error) {
+  // Short circuit if it's genesis block.
+  if block.NumberU64() == 0 {
+    return nil, vm.BlockContext{}, nil, nil, errors.New("no transaction in genesis")
+  }
+  parent := backend.bc.GetBlock(block.ParentHash(), block.NumberU64() - 1)
+  if parent == nil {
+    return nil, vm.BlockContext{}, nil, nil, fmt.Errorf("parent %#x not found", block.ParentHash())
+  }
+  statedb, release, err := backend.StateAtBlock(ctx, parent, reexec)
+  if err != nil {
+    return nil, vm.BlockContext{}, nil, nil, err
+  }
+  if txIndex == 0 && len(block.Transactions()) == 0 {
+    return nil, vm.BlockContext{}, statedb, release, nil
+  }
+  // Recompute transactions up to the target index.
+  signer := types.MakeSigner(backend.chainConfig, block.Number())
+  context := core.NewEVMBlockContext(block.Header(), backend.bc, nil)
+  for idx, tx := range block.Transactions() {
+    msg, _ := tx.AsMessage(signer)
+    if idx == txIndex {
+      return msg, context, statedb, release, nil
+    }
+    vmenv := vm.NewEVM(context, core.NewEVMTxContext(msg), statedb, backend.chainConfig, vm.Config{})
+    if _, err := core.ApplyMessage(vmenv, msg, new(core.GasPool).AddGas(tx.Gas())); err != nil {
+      release()
+      return nil, vm.BlockContext{}, nil, nil, fmt.Errorf("transaction %#x failed: %v", tx.Hash(), err)
+    }
+    // Ensure any modifications are committed to the state
+    statedb.Finalise(vmenv.ChainConfig().IsEIP158(block.Number()))
+  }
+  release()
+  return nil, vm.BlockContext{}, nil, nil, fmt.Errorf("transaction index %d out of range for block %#x", txIndex, block.Hash())
+}
+
+// StatesInRange returns the states after each block from fromBlock to
+// toBlock inclusive.
+func (backend *ReplicaBackend) StatesInRange(ctx context.Context, fromBlock *types.Block, toBlock *types.Block, reexec uint64) ([]*state.StateDB, func(), error) {
+  release, err := backend.acquireEVM(ctx)
+  if err != nil { return nil, nil, err }
+  states := []*state.StateDB{}
+  for number := fromBlock.NumberU64(); number <= toBlock.NumberU64(); number++ {
+    block := fromBlock
+    if number != fromBlock.NumberU64() {
+      if block = backend.bc.GetBlockByNumber(number); block == nil {
+        release()
+        return nil, nil, fmt.Errorf("block #%d not found", number)
+      }
+    }
+    statedb, err := backend.stateAt(block)
+    if err != nil {
+      release()
+      return nil, nil, err
+    }
+    states = append(states, statedb)
+  }
+  return states, release, nil
+}
@@ -0,0 +1,170 @@
+package replica
+
+import (
+  "context"
+  "crypto/ecdsa"
+  "encoding/json"
+  "math/big"
+  "strings"
+  "testing"
+  "github.com/ethereum/go-ethereum/common"
+  "github.com/ethereum/go-ethereum/common/hexutil"
+  "github.com/ethereum/go-ethereum/consensus/ethash"
+  "github.com/ethereum/go-ethereum/core"
+  "github.com/ethereum/go-ethereum/core/rawdb"
+  "github.com/ethereum/go-ethereum/core/types"
+  "github.com/ethereum/go-ethereum/core/vm"
+  "github.com/ethereum/go-ethereum/crypto"
+  "github.com/ethereum/go-ethereum/eth/tracers"
+  "github.com/ethereum/go-ethereum/internal/ethapi"
+  "github.com/ethereum/go-ethereum/params"
+  "github.com/ethereum/go-ethereum/rpc"
+)
+
+// testTraceBackend returns a replica backend whose chain has a block with two
+// transfers, the hashes of the transfers and the key that signed them.
+func testTraceBackend(t *testing.T) (*ReplicaBackend, []common.Hash, *ecdsa.PrivateKey) {
+  key, _ := crypto.GenerateKey()
+  sender := crypto.PubkeyToAddress(key.PublicKey)
+  db := rawdb.NewMemoryDatabase()
+  gspec := &core.Genesis{
+    Config: params.AllEthashProtocolChanges,
+    Alloc: core.GenesisAlloc{sender: {Balance: big.NewInt(params.Ether)}},
+  }
+  genesis := gspec.MustCommit(db)
+  signer := types.HomesteadSigner{}
+  hashes := []common.Hash{}
+  blocks, _ := core.GenerateChain(gspec.Config, genesis, ethash.NewFaker(), db, 1, func(i int, b *core.BlockGen) {
+    for nonce := uint64(0); nonce < 2; nonce++ {
+      tx, _ := types.SignTx(types.NewTransaction(nonce, common.Address{1}, big.NewInt(1000), params.TxGas, big.NewInt(1), nil), signer, key)
+      b.AddTx(tx)
+      hashes = append(hashes, tx.Hash())
+    }
+  })
+  hc, err := core.NewHeaderChain(db, gspec.Config, ethash.NewFaker(), func() (bool) { return true })
+  if err != nil { t.Fatalf(err.Error()) }
+  bc, err := core.NewBlockChain(db, nil, gspec.Config, ethash.NewFaker(), vm.Config{}, nil, nil)
+  if err != nil { t.Fatalf(err.Error()) }
+  if _, err := bc.InsertChain(blocks); err != nil { t.Fatalf(err.Error()) }
+  backend := NewTestReplicaBackend(db, hc, bc, &MockTransactionProducer{})
+  backend.evmSemaphore = make(chan struct{}, 1)
+  return backend, hashes, key
+}
+
+func TestStateAtTransaction(t *testing.T) {
+  backend, _, _ := testTraceBackend(t)
+  block := backend.bc.GetBlockByNumber(1)
+  msg, _, statedb, release, err := backend.StateAtTransaction(context.Background(), block, 1, 0)
+  if err != nil { t.Fatalf(err.Error()) }
+  if nonce := statedb.GetNonce(msg.From()); nonce != 1 {
+    t.Errorf("Expected the first transaction to have been applied, got nonce %v", nonce)
+  }
+  if len(backend.evmSemaphore) != 1 {
+    t.Errorf("Expected state to hold an EVM slot")
+  }
+  release()
+  if len(backend.evmSemaphore) != 0 {
+    t.Errorf("Expected release to free the EVM slot")
+  }
+  if _, _, _, _, err := backend.StateAtTransaction(context.Background(), block, 2, 0); err == nil {
+    t.Errorf("Expected error for out of range transaction")
+  }
+  if len(backend.evmSemaphore) != 0 {
+    t.Errorf("Expected failed lookup to free the EVM slot")
+  }
+  states, release, err := backend.StatesInRange(context.Background(), backend.bc.Genesis(), block, 0)
+  if err != nil { t.Fatalf(err.Error()) }
+  defer release()
+  if len(states) != 2 || states[1].GetNonce(msg.From()) != 2 {
+    t.Errorf("Unexpected states in range")
+  }
+}
+
+func TestTraceTransactionNative(t *testing.T) {
+  backend, hashes, _ := testTraceBackend(t)
+  api := tracers.NewAPI(backend)
+  tracer := "callTracer"
+  result, err := api.TraceTransaction(context.Background(), hashes[1], &tracers.TraceConfig{Tracer: &tracer})
+  if err != nil { t.Fatalf(err.Error()) }
+  call := struct {
+    Type string `json:"type"`
+    To common.Address `json:"to"`
+    Value string `json:"value"`
+  }{}
+  if err := json.Unmarshal(result.(json.RawMessage), &call); err != nil { t.Fatalf(err.Error()) }
+  if call.Type != "CALL" || call.To != (common.Address{1}) || call.Value != "0x3e8" {
+    t.Errorf("Unexpected call trace %s", result)
+  }
+}
+
+func TestCallBundle(t *testing.T) {
+  backend, _, key := testTraceBackend(t)
+  api := ethapi.NewPublicBlockChainAPI(backend)
+  tx, _ := types.SignTx(types.NewTransaction(2, common.Address{2}, big.NewInt(1000), params.TxGas, big.NewInt(1), nil), types.HomesteadSigner{}, key)
+  raw, _ := tx.MarshalBinary()
+  logCode := hexutil.Bytes(common.FromHex("0x60006000a000")) // LOG0 with no data
+  revertCode := hexutil.Bytes(common.FromHex("0x60006000fd")) // REVERT with no data
+  gas := hexutil.Uint64(100000)
+  input, _ := json.Marshal([]interface{}{hexutil.Bytes(raw), ethapi.CallArgs{Gas: &gas, Data: &logCode}, ethapi.CallArgs{Gas: &gas, Data: &revertCode}})
+  txs := []ethapi.BundleTransaction{}
+  if err := json.Unmarshal(input, &txs); err != nil { t.Fatalf(err.Error()) }
+  coinbase := common.Address{9}
+  gasLimit := hexutil.Uint64(params.TxGas + 200000)
+  overrides := &ethapi.BlockOverrides{Coinbase: &coinbase, GasLimit: &gasLimit}
+  results, err := api.CallBundle(context.Background(), txs, rpc.BlockNumberOrHashWithNumber(rpc.LatestBlockNumber), overrides)
+  if err != nil { t.Fatalf(err.Error()) }
+  if len(results) != 3 {
+    t.Fatalf("Expected 3 results, got %v", len(results))
+  }
+  if res := results[0]; res.TxHash == nil || *res.TxHash != tx.Hash() || res.GasUsed != hexutil.Uint64(params.TxGas) || res.Error != "" {
+    t.Errorf("Unexpected transfer result %+v", res)
+  }
+  if diff := results[0].StateDiff; diff[common.Address{2}] == nil || diff[coinbase] == nil || diff[coinbase].Balance.To.ToInt().Uint64() != params.TxGas {
+    t.Errorf("Unexpected transfer state diff %+v", diff)
+  }
+  if res := results[1]; res.TxHash != nil || res.Error != "" || len(res.Logs) != 1 {
+    t.Errorf("Unexpected logging call result %+v", res)
+  }
+  if res := results[2]; res.Error != vm.ErrExecutionReverted.Error() || len(res.Logs) != 0 {
+    t.Errorf("Unexpected reverting call result %+v", res)
+  }
+  if len(backend.evmSemaphore) != 0 {
+    t.Errorf("Expected the bundle to free the EVM slot")
+  }
+  // The gas limit override caps the whole bundle
+  gasLimit = hexutil.Uint64(params.TxGas)
+  results, err = api.CallBundle(context.Background(), txs, rpc.BlockNumberOrHashWithNumber(rpc.LatestBlockNumber), overrides)
+  if err != nil { t.Fatalf(err.Error()) }
+  if results[0].Error != "" || results[1].Error != core.ErrGasLimitReached.Error() {
+    t.Errorf("Expected calls past the gas limit to fail, got %q", results[1].Error)
+  }
+  // Invalid transactions don't use up the bundle's gas
+  lowGas := hexutil.Uint64(params.TxGas - 1000)
+  input, _ = json.Marshal([]interface{}{ethapi.CallArgs{Gas: &lowGas}, hexutil.Bytes(raw)})
+  txs = nil
+  if err := json.Unmarshal(input, &txs); err != nil { t.Fatalf(err.Error()) }
+  results, err = api.CallBundle(context.Background(), txs, rpc.BlockNumberOrHashWithNumber(rpc.LatestBlockNumber), overrides)
+  if err != nil { t.Fatalf(err.Error()) }
+  if !strings.Contains(results[0].Error, core.ErrIntrinsicGas.Error()) || results[1].Error != "" {
+    t.Errorf("Expected only the call with too little gas to fail, got %q and %q", results[0].Error, results[1].Error)
+  }
+}
+
+func TestStateDiff(t *testing.T) {
+  backend, hashes, key := testTraceBackend(t)
+  sender := crypto.PubkeyToAddress(key.PublicKey)
+  api := tracers.NewAPI(backend)
+  diff, err := api.StateDiff(context.Background(), rpc.BlockNumberOrHashWithHash(hashes[1], false))
+  if err != nil { t.Fatalf(err.Error()) }
+  if d := diff[sender]; d == nil || d.Nonce.From != 1 || d.Nonce.To != 2 {
+    t.Errorf("Unexpected sender diff for transaction %+v", d)
+  }
+  diff, err = api.StateDiff(context.Background(), rpc.BlockNumberOrHashWithNumber(1))
+  if err != nil { t.Fatalf(err.Error()) }
+  if d := diff[common.Address{1}]; d == nil || d.Balance.From.ToInt().Sign() != 0 || d.Balance.To.ToInt().Int64() != 2000 {
+    t.Errorf("Unexpected recipient diff for block %+v", d)
+  }
+  if len(backend.evmSemaphore) != 0 {
+    t.Errorf("Expected state diffs to free the EVM slot")
+  }
+}
@@ -0,0 +1,259 @@
+package replica
+
+import (
+  "sync"
+  "time"
+  "github.com/ethereum/go-ethereum/common"
+  "github.com/ethereum/go-ethereum/core/types"
+  "github.com/ethereum/go-ethereum/log"
+  "github.com/ethereum/go-ethereum/rlp"
+)
+
+const (
+  // Messages on the txpool topic are keyed by type. Unkeyed messages are new
+  // transactions, as sent by masters before pool state was shared.
+  txPoolSnapshotKey = "txpool/snapshot"
+  txPoolRemovedKey = "txpool/removed"
+
+  // txPoolSnapshotInterval is how often the master publishes its pool's
+  // content, so replicas started mid-stream catch up and stray transactions
+  // get pruned.
+  txPoolSnapshotInterval = 60 * time.Second
+
+  // txPoolRemovalInterval is how often the master checks its pool for
+  // transactions that were mined, replaced or evicted.
+  txPoolRemovalInterval = 5 * time.Second
+
+  // txPoolChunkSize caps the transaction bytes in a snapshot message, keeping
+  // messages under Kafka's default size limit.
+  txPoolChunkSize = 512 * 1024
+
+  // txPoolSnapshotGrace protects transactions received just before a
+  // snapshot completes from being pruned. New transactions and snapshots may
+  // be on different partitions, so a transaction the master added after
+  // taking a snapshot can arrive before the snapshot does.
+  txPoolSnapshotGrace = 30 * time.Second
+)
+
+// TxPoolSnapshotChunk is one message of a snapshot of the master's pending
+// and queued transactions. Snapshots are identified by the time they were
+// taken.
+type TxPoolSnapshotChunk struct {
+  ID uint64
+  Index uint64
+  Total uint64
+  Txs []*types.Transaction
+}
+
+// TxPoolUpdate is a change to the master's transaction pool other than a new
+// transaction: either part of a snapshot of its content, or the transactions
+// it has dropped.
+type TxPoolUpdate struct {
+  Snapshot *TxPoolSnapshotChunk
+  Removed []common.Hash
+}
+
+// txPoolContent is the part of core.TxPool the master needs to share its
+// pool state.
+type txPoolContent interface {
+  Content() (map[common.Address]types.Transactions, map[common.Address]types.Transactions)
+}
+
+// poolTransactions flattens a pool's content into a list of transactions and
+// the set of their hashes.
+func poolTransactions(pool txPoolContent) ([]*types.Transaction, map[common.Hash]struct{}) {
+  pending, queued := pool.Content()
+  txs := []*types.Transaction{}
+  hashes := make(map[common.Hash]struct{})
+  for _, content := range []map[common.Address]types.Transactions{pending, queued} {
+    for _, list := range content {
+      for _, tx := range list {
+        txs = append(txs, tx)
+        hashes[tx.Hash()] = struct{}{}
+      }
+    }
+  }
+  return txs, hashes
+}
+
+// encodeTxPoolSnapshot splits a snapshot of txs into RLP encoded chunks of
+// roughly chunkSize transaction bytes.
+func encodeTxPoolSnapshot(id uint64, txs []*types.Transaction, chunkSize int) ([][]byte, error) {
+  chunks := []*TxPoolSnapshotChunk{&TxPoolSnapshotChunk{ID: id, Txs: []*types.Transaction{}}}
+  size := 0
+  for _, tx := range txs {
+    chunk := chunks[len(chunks) - 1]
+    if size > 0 && size + int(tx.Size()) > chunkSize {
+      chunk = &TxPoolSnapshotChunk{ID: id, Index: uint64(len(chunks)), Txs: []*types.Transaction{}}
+      chunks = append(chunks, chunk)
+      size = 0
+    }
+    chunk.Txs = append(chunk.Txs, tx)
+    size += int(tx.Size())
+  }
+  messages := make([][]byte, len(chunks))
+  for i, chunk := range chunks {
+    chunk.Total = uint64(len(chunks))
+    data, err := rlp.EncodeToBytes(chunk)
+    if err != nil { return nil, err }
+    messages[i] = data
+  }
+  return messages, nil
+}
+
+// decodeTxPoolUpdate decodes a txpool topic message other than a new
+// transaction.
+func decodeTxPoolUpdate(key string, value []byte) (*TxPoolUpdate, error) {
+  update := &TxPoolUpdate{}
+  switch key {
+  case txPoolSnapshotKey:
+    update.Snapshot = &TxPoolSnapshotChunk{}
+    return update, rlp.DecodeBytes(value, update.Snapshot)
+  case txPoolRemovedKey:
+    return update, rlp.DecodeBytes(value, &update.Removed)
+  }
+  return nil, nil
+}
+
+// relayPoolState publishes snapshots of the pool's content, and the hashes of
+// transactions that leave the pool between snapshots, until quit is closed.
+func (producer *KafkaTransactionProducer) relayPoolState(pool txPoolContent) {
+  removalTicker := time.NewTicker(txPoolRemovalInterval)
+  defer removalTicker.Stop()
+  snapshotTicker := time.NewTicker(txPoolSnapshotInterval)
+  defer snapshotTicker.Stop()
+
+  txs, known := poolTransactions(pool)
+  producer.emitSnapshot(txs)
+  for {
+    select {
+    case <-removalTicker.C:
+      var current map[common.Hash]struct{}
+      _, current = poolTransactions(pool)
+      removed := []common.Hash{}
+      for hash := range known {
+        if _, ok := current[hash]; !ok {
+          removed = append(removed, hash)
+        }
+      }
+      known = current
+      if len(removed) == 0 { continue }
+      data, err := rlp.EncodeToBytes(removed)
+      if err != nil {
+        log.Warn("Error encoding removed transactions", "err", err)
+        continue
+      }
+      if err := producer.send(txPoolRemovedKey, data); err != nil {
+        log.Warn("Error emitting removed transactions", "count", len(removed), "err", err)
+      }
+    case <-snapshotTicker.C:
+      txs, known = poolTransactions(pool)
+      producer.emitSnapshot(txs)
+    case <-producer.quit:
+      return
+    }
+  }
+}
+
+func (producer *KafkaTransactionProducer) emitSnapshot(txs []*types.Transaction) {
+  messages, err := encodeTxPoolSnapshot(uint64(time.Now().UnixNano()), txs, txPoolChunkSize)
+  if err != nil {
+    log.Warn("Error encoding transaction pool snapshot", "err", err)
+    return
+  }
+  for _, data := range messages {
+    if err := producer.send(txPoolSnapshotKey, data); err != nil {
+      log.Warn("Error emitting transaction pool snapshot", "txs", len(txs), "err", err)
+      return
+    }
+  }
+  log.Debug("Emitted transaction pool snapshot", "txs", len(txs), "messages", len(messages))
+}
+
+// txPoolSyncer is the part of core.TxPool a replica needs to follow its
+// master's pool.
+type txPoolSyncer interface {
+  AddRemotes([]*types.Transaction) []error
+  RemoveTransactions([]common.Hash) int
+  RetainTransactions(func(common.Hash) bool) int
+}
+
+// txPoolSnapshotParts collects the chunks of a snapshot as they arrive.
+type txPoolSnapshotParts struct {
+  hashes map[common.Hash]struct{}
+  chunks map[uint64]struct{}
+  total uint64
+}
+
+// txPoolSync applies the master's pool snapshots and removals to a replica's
+// pool, so the replica converges on the master's pending and queued sets.
+type txPoolSync struct {
+  pool txPoolSyncer
+  lock sync.Mutex
+  received map[common.Hash]time.Time
+  snapshots map[uint64]*txPoolSnapshotParts
+  now func() time.Time
+}
+
+func newTxPoolSync(pool txPoolSyncer) *txPoolSync {
+  return &txPoolSync{
+    pool: pool,
+    received: make(map[common.Hash]time.Time),
+    snapshots: make(map[uint64]*txPoolSnapshotParts),
+    now: time.Now,
+  }
+}
+
+// receivedTx notes the arrival of a new transaction from the master.
+func (s *txPoolSync) receivedTx(tx *types.Transaction) {
+  s.lock.Lock()
+  s.received[tx.Hash()] = s.now()
+  s.lock.Unlock()
+}
+
+func (s *txPoolSync) apply(update *TxPoolUpdate) {
+  if len(update.Removed) > 0 {
+    removed := s.pool.RemoveTransactions(update.Removed)
+    log.Debug("Removed transactions dropped by master", "count", len(update.Removed), "removed", removed)
+  }
+  if update.Snapshot != nil {
+    s.applySnapshot(update.Snapshot)
+  }
+}
+
+func (s *txPoolSync) applySnapshot(chunk *TxPoolSnapshotChunk) {
+  s.pool.AddRemotes(chunk.Txs)
+
+  s.lock.Lock()
+  defer s.lock.Unlock()
+  parts, ok := s.snapshots[chunk.ID]
+  if !ok {
+    parts = &txPoolSnapshotParts{
+      hashes: make(map[common.Hash]struct{}),
+      chunks: make(map[uint64]struct{}),
+      total: chunk.Total,
+    }
+    s.snapshots[chunk.ID] = parts
+  }
+  parts.chunks[chunk.Index] = struct{}{}
+  for _, tx := range chunk.Txs {
+    parts.hashes[tx.Hash()] = struct{}{}
+  }
+  if uint64(len(parts.chunks)) < parts.total {
+    return
+  }
+  // The snapshot is complete. Older, incomplete snapshots are superseded.
+  for id := range s.snapshots {
+    if id <= chunk.ID { delete(s.snapshots, id) }
+  }
+  cutoff := s.now().Add(-txPoolSnapshotGrace)
+  for hash, received := range s.received {
+    if received.Before(cutoff) { delete(s.received, hash) }
+  }
+  pruned := s.pool.RetainTransactions(func(hash common.Hash) bool {
+    if _, ok := parts.hashes[hash]; ok { return true }
+    _, ok := s.received[hash]
+    return ok
+  })
+  log.Debug("Synced transaction pool snapshot", "txs", len(parts.hashes), "pruned", pruned)
+}
@@ -0,0 +1,147 @@
+package replica
+
+import (
+  "math/big"
+  "testing"
+  "time"
+  "github.com/ethereum/go-ethereum/common"
+  "github.com/ethereum/go-ethereum/core/types"
+  "github.com/ethereum/go-ethereum/rlp"
+)
+
+type mockSyncPool struct {
+  txs map[common.Hash]*types.Transaction
+}
+
+func (pool *mockSyncPool) AddRemotes(txs []*types.Transaction) []error {
+  for _, tx := range txs {
+    pool.txs[tx.Hash()] = tx
+  }
+  return make([]error, len(txs))
+}
+
+func (pool *mockSyncPool) RemoveTransactions(hashes []common.Hash) int {
+  removed := 0
+  for _, hash := range hashes {
+    if _, ok := pool.txs[hash]; ok {
+      delete(pool.txs, hash)
+      removed++
+    }
+  }
+  return removed
+}
+
+func (pool *mockSyncPool) RetainTransactions(keep func(common.Hash) bool) int {
+  removed := 0
+  for hash := range pool.txs {
+    if !keep(hash) {
+      delete(pool.txs, hash)
+      removed++
+    }
+  }
+  return removed
+}
+
+func testPoolTxs(count int) []*types.Transaction {
+  txs := make([]*types.Transaction, count)
+  for i := range txs {
+    txs[i] = types.NewTransaction(uint64(i), common.Address{}, big.NewInt(0), 21000, big.NewInt(1), make([]byte, 100))
+  }
+  return txs
+}
+
+func decodeSnapshotChunks(t *testing.T, messages [][]byte) []*TxPoolSnapshotChunk {
+  chunks := make([]*TxPoolSnapshotChunk, len(messages))
+  for i, data := range messages {
+    update, err := decodeTxPoolUpdate(txPoolSnapshotKey, data)
+    if err != nil { t.Fatalf(err.Error()) }
+    chunks[i] = update.Snapshot
+  }
+  return chunks
+}
+
+func TestEncodeTxPoolSnapshot(t *testing.T) {
+  txs := testPoolTxs(10)
+  messages, err := encodeTxPoolSnapshot(7, txs, 4 * int(txs[0].Size()))
+  if err != nil { t.Fatalf(err.Error()) }
+  chunks := decodeSnapshotChunks(t, messages)
+  if len(chunks) != 3 {
+    t.Fatalf("Expected 3 chunks, got %v", len(chunks))
+  }
+  i := 0
+  for index, chunk := range chunks {
+    if chunk.ID != 7 || chunk.Index != uint64(index) || chunk.Total != 3 {
+      t.Errorf("Unexpected chunk header %v/%v/%v", chunk.ID, chunk.Index, chunk.Total)
+    }
+    for _, tx := range chunk.Txs {
+      if tx.Hash() != txs[i].Hash() {
+        t.Errorf("Unexpected tx %v in chunk %v", tx.Hash(), index)
+      }
+      i++
+    }
+  }
+  if i != len(txs) {
+    t.Errorf("Expected %v txs, got %v", len(txs), i)
+  }
+  // An empty pool is still a snapshot, so replicas prune to nothing
+  messages, err = encodeTxPoolSnapshot(8, nil, txPoolChunkSize)
+  if err != nil { t.Fatalf(err.Error()) }
+  if chunks := decodeSnapshotChunks(t, messages); len(chunks) != 1 || chunks[0].Total != 1 || len(chunks[0].Txs) != 0 {
+    t.Errorf("Unexpected empty snapshot %v", chunks)
+  }
+}
+
+func TestDecodeTxPoolRemoved(t *testing.T) {
+  hashes := []common.Hash{common.HexToHash("0x01"), common.HexToHash("0x02")}
+  data, err := rlp.EncodeToBytes(hashes)
+  if err != nil { t.Fatalf(err.Error()) }
+  update, err := decodeTxPoolUpdate(txPoolRemovedKey, data)
+  if err != nil { t.Fatalf(err.Error()) }
+  if len(update.Removed) != 2 || update.Removed[1] != hashes[1] {
+    t.Errorf("Unexpected removals %v", update.Removed)
+  }
+  if update, err := decodeTxPoolUpdate("unknown", data); update != nil || err != nil {
+    t.Errorf("Expected unknown keys to be ignored")
+  }
+}
+
+func TestTxPoolSync(t *testing.T) {
+  txs := testPoolTxs(6)
+  pool := &mockSyncPool{txs: make(map[common.Hash]*types.Transaction)}
+  poolSync := newTxPoolSync(pool)
+  now := time.Now()
+  poolSync.now = func() time.Time { return now }
+
+  // A stale transaction from before the replica caught up, and one that
+  // arrived just ahead of the snapshot
+  pool.AddRemotes(txs[4:5])
+  poolSync.receivedTx(txs[4])
+  now = now.Add(time.Minute)
+  pool.AddRemotes(txs[5:6])
+  poolSync.receivedTx(txs[5])
+
+  messages, err := encodeTxPoolSnapshot(1, txs[:4], 2 * int(txs[0].Size()))
+  if err != nil { t.Fatalf(err.Error()) }
+  chunks := decodeSnapshotChunks(t, messages)
+  poolSync.apply(&TxPoolUpdate{Snapshot: chunks[1]})
+  if len(pool.txs) != 4 {
+    t.Errorf("Expected 4 txs before the snapshot completes, got %v", len(pool.txs))
+  }
+  poolSync.apply(&TxPoolUpdate{Snapshot: chunks[0]})
+  if len(pool.txs) != 5 {
+    t.Errorf("Expected 5 txs after the snapshot, got %v", len(pool.txs))
+  }
+  if _, ok := pool.txs[txs[4].Hash()]; ok {
+    t.Errorf("Expected stale tx to be pruned")
+  }
+  if _, ok := pool.txs[txs[5].Hash()]; !ok {
+    t.Errorf("Expected recently received tx to be kept")
+  }
+  if len(poolSync.snapshots) != 0 {
+    t.Errorf("Expected completed snapshot to be dropped")
+  }
+  poolSync.apply(&TxPoolUpdate{Removed: []common.Hash{txs[0].Hash(), txs[5].Hash()}})
+  if len(pool.txs) != 3 {
+    t.Errorf("Expected 3 txs after removals, got %v", len(pool.txs))
+  }
+}
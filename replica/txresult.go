@@ -0,0 +1,224 @@
+package replica
+
+import (
+  "context"
+  "errors"
+  "sync"
+  "time"
+  "github.com/Shopify/sarama"
+  "github.com/ethereum/go-ethereum/common"
+  "github.com/ethereum/go-ethereum/core/types"
+  "github.com/ethereum/go-ethereum/ethdb/cdc"
+  "github.com/ethereum/go-ethereum/log"
+  "github.com/ethereum/go-ethereum/rlp"
+)
+
+// TransactionResult is the outcome of the transaction relay sending a
+// transaction to the master.
+type TransactionResult struct {
+  Hash common.Hash
+  Accepted bool
+  // Error is the error returned by the master's SendTransaction, if the
+  // transaction was rejected.
+  Error string
+}
+
+// Err returns the master's error if the transaction was rejected.
+func (result *TransactionResult) Err() error {
+  if result.Accepted {
+    return nil
+  }
+  return errors.New(result.Error)
+}
+
+type TransactionResultConsumer interface {
+  // Subscribe returns a channel that receives the result for hash, and a
+  // function to call once it is no longer needed.
+  Subscribe(hash common.Hash) (<-chan *TransactionResult, func())
+  Close()
+}
+
+// TransactionResultWaiter is implemented by TransactionProducers that can wait
+// for the relay to report the result of sending a transaction.
+type TransactionResultWaiter interface {
+  // EmitAndWait emits tx, and returns its result, or nil if none arrived in
+  // time.
+  EmitAndWait(ctx context.Context, tx *types.Transaction) (*TransactionResult, error)
+}
+
+// txResultWaiters dispatches results to the subscribers waiting on them.
+type txResultWaiters struct {
+  lock sync.Mutex
+  waiters map[common.Hash][]chan *TransactionResult
+}
+
+func newTxResultWaiters() *txResultWaiters {
+  return &txResultWaiters{waiters: make(map[common.Hash][]chan *TransactionResult)}
+}
+
+func (w *txResultWaiters) Subscribe(hash common.Hash) (<-chan *TransactionResult, func()) {
+  ch := make(chan *TransactionResult, 1)
+  w.lock.Lock()
+  w.waiters[hash] = append(w.waiters[hash], ch)
+  w.lock.Unlock()
+  return ch, func() {
+    w.lock.Lock()
+    defer w.lock.Unlock()
+    waiters := w.waiters[hash]
+    for i, waiter := range waiters {
+      if waiter == ch {
+        waiters = append(waiters[:i], waiters[i+1:]...)
+        break
+      }
+    }
+    if len(waiters) == 0 {
+      delete(w.waiters, hash)
+    } else {
+      w.waiters[hash] = waiters
+    }
+  }
+}
+
+func (w *txResultWaiters) deliver(result *TransactionResult) {
+  w.lock.Lock()
+  defer w.lock.Unlock()
+  for _, waiter := range w.waiters[result.Hash] {
+    select {
+    case waiter <- result:
+    default:
+    }
+  }
+}
+
+func (w *txResultWaiters) Close() {}
+
+// waitingTransactionProducer emits transactions with producer, and waits up
+// to timeout for their results.
+type waitingTransactionProducer struct {
+  TransactionProducer
+  results TransactionResultConsumer
+  timeout time.Duration
+}
+
+func (producer *waitingTransactionProducer) EmitAndWait(ctx context.Context, tx *types.Transaction) (*TransactionResult, error) {
+  results, unsubscribe := producer.results.Subscribe(tx.Hash())
+  defer unsubscribe()
+  if err := producer.Emit(tx); err != nil {
+    return nil, err
+  }
+  if ctx == nil {
+    ctx = context.Background()
+  }
+  timer := time.NewTimer(producer.timeout)
+  defer timer.Stop()
+  select {
+  case result := <-results:
+    return result, nil
+  case <-timer.C:
+  case <-ctx.Done():
+  }
+  // The transaction has been handed to the relay, so it may yet be sent.
+  log.Debug("No result for transaction", "hash", tx.Hash(), "timeout", producer.timeout)
+  return nil, nil
+}
+
+func (producer *waitingTransactionProducer) Close() {
+  producer.TransactionProducer.Close()
+  producer.results.Close()
+}
+
+// NewWaitingTransactionProducer wraps producer so that SendTx waits up to
+// timeout for the result of each transaction from results.
+func NewWaitingTransactionProducer(producer TransactionProducer, results TransactionResultConsumer, timeout time.Duration) TransactionProducer {
+  return &waitingTransactionProducer{producer, results, timeout}
+}
+
+type KafkaTransactionResultProducer struct {
+  producer sarama.SyncProducer
+  topic string
+}
+
+func (producer *KafkaTransactionResultProducer) Emit(result *TransactionResult) error {
+  data, err := rlp.EncodeToBytes(result)
+  if err != nil {
+    return err
+  }
+  msg := &sarama.ProducerMessage{Topic: producer.topic, Key: sarama.ByteEncoder(result.Hash.Bytes()), Value: sarama.ByteEncoder(data)}
+  _, _, err = producer.producer.SendMessage(msg)
+  return err
+}
+
+func (producer *KafkaTransactionResultProducer) Close() {
+  producer.producer.Close()
+}
+
+func NewKafkaTransactionResultProducerFromURLs(brokerURL, topic string) (*KafkaTransactionResultProducer, error) {
+  configEntries := make(map[string]*string)
+  configEntries["retention.ms"] = strPtr("3600000")
+  brokers, config := cdc.ParseKafkaURL(brokerURL)
+  if err := cdc.CreateTopicIfDoesNotExist(brokerURL, topic, 0, configEntries); err != nil {
+    return nil, err
+  }
+  config.Producer.Return.Successes=true
+  producer, err := sarama.NewSyncProducer(brokers, config)
+  if err != nil {
+    return nil, err
+  }
+  return &KafkaTransactionResultProducer{producer, topic}, nil
+}
+
+// KafkaTransactionResultConsumer delivers results from the relay's result
+// topic to the replica's waiting SendTx calls. Results are only of interest
+// while someone is waiting on them, so it consumes from the newest offset.
+type KafkaTransactionResultConsumer struct {
+  *txResultWaiters
+  consumer sarama.Consumer
+  topic string
+}
+
+func (consumer *KafkaTransactionResultConsumer) start() error {
+  partitions, err := consumer.consumer.Partitions(consumer.topic)
+  if err != nil { return err }
+  for _, partition := range partitions {
+    partitionConsumer, err := consumer.consumer.ConsumePartition(consumer.topic, partition, sarama.OffsetNewest)
+    if err != nil { return err }
+    go func() {
+      for msg := range partitionConsumer.Messages() {
+        result := &TransactionResult{}
+        if err := rlp.DecodeBytes(msg.Value, result); err != nil {
+          log.Warn("Error decoding transaction result", "topic", consumer.topic, "offset", msg.Offset, "err", err)
+          continue
+        }
+        consumer.deliver(result)
+      }
+    }()
+  }
+  return nil
+}
+
+func (consumer *KafkaTransactionResultConsumer) Close() {
+  consumer.consumer.Close()
+}
+
+func NewKafkaTransactionResultConsumerFromURLs(brokerURL, topic string) (TransactionResultConsumer, error) {
+  configEntries := make(map[string]*string)
+  configEntries["retention.ms"] = strPtr("3600000")
+  brokers, config := cdc.ParseKafkaURL(brokerURL)
+  if err := cdc.CreateTopicIfDoesNotExist(brokerURL, topic, 0, configEntries); err != nil {
+    return nil, err
+  }
+  client, err := sarama.NewClient(brokers, config)
+  if err != nil {
+    return nil, err
+  }
+  consumer, err := sarama.NewConsumerFromClient(client)
+  if err != nil {
+    return nil, err
+  }
+  resultConsumer := &KafkaTransactionResultConsumer{newTxResultWaiters(), consumer, topic}
+  if err := resultConsumer.start(); err != nil {
+    consumer.Close()
+    return nil, err
+  }
+  return resultConsumer, nil
+}
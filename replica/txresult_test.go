@@ -0,0 +1,57 @@
+package replica
+
+import (
+  "context"
+  "math/big"
+  "testing"
+  "time"
+  "github.com/ethereum/go-ethereum/common"
+  "github.com/ethereum/go-ethereum/core/types"
+)
+
+// relayingProducer reports a result for each transaction it emits, as the
+// transaction relay would.
+type relayingProducer struct {
+  MockTransactionProducer
+  waiters *txResultWaiters
+  err string
+}
+
+func (producer *relayingProducer) Emit(tx *types.Transaction) error {
+  producer.MockTransactionProducer.Emit(tx)
+  if producer.waiters != nil {
+    go producer.waiters.deliver(&TransactionResult{Hash: tx.Hash(), Accepted: producer.err == "", Error: producer.err})
+  }
+  return nil
+}
+
+func TestEmitAndWait(t *testing.T) {
+  waiters := newTxResultWaiters()
+  tx := types.NewTransaction(0, common.Address{}, big.NewInt(0), 21000, big.NewInt(1), nil)
+  producer := NewWaitingTransactionProducer(&relayingProducer{waiters: waiters, err: "nonce too low"}, waiters, 5 * time.Second).(TransactionResultWaiter)
+  result, err := producer.EmitAndWait(context.Background(), tx)
+  if err != nil { t.Fatalf(err.Error()) }
+  if result == nil || result.Hash != tx.Hash() {
+    t.Fatalf("Unexpected result %+v", result)
+  }
+  if err := result.Err(); err == nil || err.Error() != "nonce too low" {
+    t.Errorf("Expected the relay's error, got %v", err)
+  }
+  if len(waiters.waiters) != 0 {
+    t.Errorf("Expected waiters to be removed")
+  }
+}
+
+func TestEmitAndWaitTimeout(t *testing.T) {
+  waiters := newTxResultWaiters()
+  tx := types.NewTransaction(1, common.Address{}, big.NewInt(0), 21000, big.NewInt(1), nil)
+  mock := &relayingProducer{}
+  producer := NewWaitingTransactionProducer(mock, waiters, 10 * time.Millisecond).(TransactionResultWaiter)
+  result, err := producer.EmitAndWait(context.Background(), tx)
+  if err != nil || result != nil {
+    t.Errorf("Expected no result, got %+v (%v)", result, err)
+  }
+  if len(mock.transactions) != 1 {
+    t.Errorf("Expected the transaction to be emitted")
+  }
+}
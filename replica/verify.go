@@ -0,0 +1,471 @@
+package replica
+
+import (
+  "context"
+  "crypto/rand"
+  "errors"
+  "fmt"
+  "math/big"
+  "time"
+  "github.com/ethereum/go-ethereum/common"
+  "github.com/ethereum/go-ethereum/common/hexutil"
+  "github.com/ethereum/go-ethereum/core/rawdb"
+  "github.com/ethereum/go-ethereum/core/types"
+  "github.com/ethereum/go-ethereum/crypto"
+  "github.com/ethereum/go-ethereum/ethdb"
+  "github.com/ethereum/go-ethereum/log"
+  "github.com/ethereum/go-ethereum/metrics"
+  "github.com/ethereum/go-ethereum/rlp"
+  "github.com/ethereum/go-ethereum/rpc"
+  "github.com/ethereum/go-ethereum/trie"
+)
+
+var (
+  emptyCodeHash = crypto.Keccak256Hash(nil)
+  errCorruptNode = errors.New("Node does not match its hash")
+
+  verifyRunsMeter = metrics.NewRegisteredMeter("replica/verify/runs", nil)
+  verifyFailuresMeter = metrics.NewRegisteredMeter("replica/verify/failures", nil)
+  verifyMismatchGauge = metrics.NewRegisteredGauge("replica/verify/mismatches", nil)
+)
+
+// VerifySource provides the master's view of the chain that a replica is
+// verified against.
+type VerifySource interface {
+  // HeadNumber returns the number of the source's latest block
+  HeadNumber(ctx context.Context) (uint64, error)
+  // CanonicalHash returns the hash of the source's canonical block at number,
+  // or the zero hash if it has none.
+  CanonicalHash(ctx context.Context, number uint64) (common.Hash, error)
+  // TxLookup returns the number of the block the source has indexed a
+  // transaction in, or nil if it is not indexed.
+  TxLookup(ctx context.Context, hash common.Hash) (*uint64, error)
+}
+
+type dbVerifySource struct {
+  db ethdb.Reader
+}
+
+// NewDBVerifySource verifies replicas against a copy of the master's
+// database.
+func NewDBVerifySource(db ethdb.Reader) VerifySource {
+  return &dbVerifySource{db}
+}
+
+func (s *dbVerifySource) HeadNumber(ctx context.Context) (uint64, error) {
+  hash := rawdb.ReadHeadBlockHash(s.db)
+  number := rawdb.ReadHeaderNumber(s.db, hash)
+  if number == nil {
+    return 0, fmt.Errorf("Source has no head block")
+  }
+  return *number, nil
+}
+
+func (s *dbVerifySource) CanonicalHash(ctx context.Context, number uint64) (common.Hash, error) {
+  return rawdb.ReadCanonicalHash(s.db, number), nil
+}
+
+func (s *dbVerifySource) TxLookup(ctx context.Context, hash common.Hash) (*uint64, error) {
+  return rawdb.ReadTxLookupEntry(s.db, hash), nil
+}
+
+type rpcVerifySource struct {
+  client *rpc.Client
+}
+
+// NewRPCVerifySource verifies replicas against the master's RPC endpoint.
+func NewRPCVerifySource(client *rpc.Client) VerifySource {
+  return &rpcVerifySource{client}
+}
+
+func (s *rpcVerifySource) HeadNumber(ctx context.Context) (uint64, error) {
+  var number hexutil.Uint64
+  err := s.client.CallContext(ctx, &number, "eth_blockNumber")
+  return uint64(number), err
+}
+
+func (s *rpcVerifySource) CanonicalHash(ctx context.Context, number uint64) (common.Hash, error) {
+  var header *struct {
+    Hash common.Hash `json:"hash"`
+  }
+  if err := s.client.CallContext(ctx, &header, "eth_getBlockByNumber", hexutil.EncodeUint64(number), false); err != nil {
+    return common.Hash{}, err
+  }
+  if header == nil {
+    return common.Hash{}, nil
+  }
+  return header.Hash, nil
+}
+
+func (s *rpcVerifySource) TxLookup(ctx context.Context, hash common.Hash) (*uint64, error) {
+  var tx *struct {
+    BlockNumber *hexutil.Big `json:"blockNumber"`
+  }
+  if err := s.client.CallContext(ctx, &tx, "eth_getTransactionByHash", hash); err != nil {
+    return nil, err
+  }
+  if tx == nil || tx.BlockNumber == nil {
+    return nil, nil
+  }
+  number := tx.BlockNumber.ToInt().Uint64()
+  return &number, nil
+}
+
+// VerifyMismatch describes a database entry that differs between the replica
+// and the master.
+type VerifyMismatch struct {
+  Kind string
+  Key []byte
+  Detail string
+}
+
+func (m VerifyMismatch) String() string {
+  return fmt.Sprintf("%v %#x: %v", m.Kind, m.Key, m.Detail)
+}
+
+// VerifyResult summarizes a verification of the replica at a single block.
+type VerifyResult struct {
+  Number uint64
+  Hash common.Hash
+  Nodes int
+  Accounts int
+  Slots int
+  Receipts int
+  TxLookups int
+  Mismatches []VerifyMismatch
+  Elapsed time.Duration
+}
+
+// Verifier compares the data a replica has received through the CDC stream
+// against the master.
+//
+// Once the replica's block header matches the master's, the state root,
+// receipt root and transaction root in that header commit to the rest of the
+// block's data, so the verifier checks the replica's trie nodes, contract
+// code, receipts and bodies against those commitments. Transaction lookup
+// entries are not committed to by the header, so those are compared with the
+// source directly.
+type Verifier struct {
+  db ethdb.Database
+  source VerifySource
+  // Full walks every trie node, rather than sampling.
+  Full bool
+  // Samples is the number of random account paths to check when not doing a
+  // full walk. Each sampled account with storage also has one random storage
+  // path checked.
+  Samples int
+  // MaxMismatches stops verification once this many mismatches are found.
+  MaxMismatches int
+}
+
+// NewVerifier creates a verifier for the replica database db.
+func NewVerifier(db ethdb.Database, source VerifySource) *Verifier {
+  return &Verifier{db: db, source: source, Samples: 1000, MaxMismatches: 100}
+}
+
+func (v *Verifier) mismatch(result *VerifyResult, kind string, key []byte, detail string, args ...interface{}) bool {
+  m := VerifyMismatch{Kind: kind, Key: common.CopyBytes(key), Detail: fmt.Sprintf(detail, args...)}
+  log.Warn("Replica mismatch", "block", result.Number, "kind", m.Kind, "key", hexutil.Bytes(m.Key), "detail", m.Detail)
+  result.Mismatches = append(result.Mismatches, m)
+  return v.MaxMismatches > 0 && len(result.Mismatches) >= v.MaxMismatches
+}
+
+// Verify checks the replica's data for the block at number.
+func (v *Verifier) Verify(ctx context.Context, number uint64) (*VerifyResult, error) {
+  start := time.Now()
+  result := &VerifyResult{Number: number, Hash: rawdb.ReadCanonicalHash(v.db, number)}
+  defer func() { result.Elapsed = time.Since(start) }()
+  sourceHash, err := v.source.CanonicalHash(ctx, number)
+  if err != nil { return nil, err }
+  if sourceHash == (common.Hash{}) {
+    return nil, fmt.Errorf("Source has no block %v", number)
+  }
+  if result.Hash != sourceHash {
+    v.mismatch(result, "canonical", new(big.Int).SetUint64(number).Bytes(), "replica %#x, master %#x", result.Hash, sourceHash)
+    // Nothing else can be compared without matching headers
+    return result, nil
+  }
+  header := rawdb.ReadHeader(v.db, result.Hash, number)
+  if header == nil {
+    v.mismatch(result, "header", result.Hash[:], "missing")
+    return result, nil
+  }
+  if done := v.verifyBlock(ctx, result, header); done {
+    return result, nil
+  }
+  if err := ctx.Err(); err != nil { return nil, err }
+  v.verifyState(ctx, result, header.Root)
+  if err := ctx.Err(); err != nil { return nil, err }
+  return result, nil
+}
+
+// verifyBlock checks the block's body, receipts and transaction lookup
+// entries, returning true if the mismatch limit was reached.
+func (v *Verifier) verifyBlock(ctx context.Context, result *VerifyResult, header *types.Header) bool {
+  hash, number := header.Hash(), header.Number.Uint64()
+  body := rawdb.ReadBody(v.db, hash, number)
+  if body == nil {
+    return v.mismatch(result, "body", hash[:], "missing")
+  }
+  if txHash := types.DeriveSha(types.Transactions(body.Transactions), trie.NewStackTrie(nil)); txHash != header.TxHash {
+    return v.mismatch(result, "body", hash[:], "transaction root %#x, header has %#x", txHash, header.TxHash)
+  }
+  receipts := rawdb.ReadRawReceipts(v.db, hash, number)
+  if receipts == nil && len(body.Transactions) > 0 {
+    return v.mismatch(result, "receipts", hash[:], "missing")
+  }
+  if receiptHash := types.DeriveSha(receipts, trie.NewStackTrie(nil)); receiptHash != header.ReceiptHash {
+    return v.mismatch(result, "receipts", hash[:], "receipt root %#x, header has %#x", receiptHash, header.ReceiptHash)
+  }
+  result.Receipts += len(receipts)
+  for _, tx := range body.Transactions {
+    txHash := tx.Hash()
+    sourceLookup, err := v.source.TxLookup(ctx, txHash)
+    if err != nil {
+      log.Warn("Error looking up transaction on source", "hash", txHash, "err", err)
+      continue
+    }
+    lookup := rawdb.ReadTxLookupEntry(v.db, txHash)
+    result.TxLookups++
+    switch {
+    case lookup == nil && sourceLookup == nil:
+    case lookup == nil:
+      if v.mismatch(result, "txlookup", txHash[:], "missing, master has block %v", *sourceLookup) { return true }
+    case sourceLookup == nil:
+      if v.mismatch(result, "txlookup", txHash[:], "block %v, master has none", *lookup) { return true }
+    case *lookup != *sourceLookup:
+      if v.mismatch(result, "txlookup", txHash[:], "block %v, master has block %v", *lookup, *sourceLookup) { return true }
+    }
+  }
+  return false
+}
+
+// hashCheckingStore only returns values that hash to their keys, so that
+// tries opened on it report corrupt nodes as missing, rather than failing to
+// decode them.
+type hashCheckingStore struct {
+  ethdb.KeyValueStore
+}
+
+func (s hashCheckingStore) Get(key []byte) ([]byte, error) {
+  value, err := s.KeyValueStore.Get(key)
+  if err == nil && len(key) == common.HashLength && crypto.Keccak256Hash(value) != common.BytesToHash(key) {
+    return nil, errCorruptNode
+  }
+  return value, err
+}
+
+// checkNode counts the node the iterator is at, if it is stored by hash. Any
+// node the iterator reaches has already been checked by the
+// hashCheckingStore, so it returns true only if the context is cancelled.
+func (v *Verifier) checkNode(ctx context.Context, result *VerifyResult, it trie.NodeIterator) bool {
+  if it.Hash() != (common.Hash{}) {
+    // Nodes small enough to be embedded in their parent aren't stored
+    result.Nodes++
+  }
+  return ctx.Err() != nil
+}
+
+// iteratorError records an error encountered by a trie iterator, returning the
+// path of the missing node if there was one, and true if the mismatch limit
+// was reached.
+func (v *Verifier) iteratorError(result *VerifyResult, kind string, err error) ([]byte, bool) {
+  if missing, ok := err.(*trie.MissingNodeError); ok {
+    problem := "missing"
+    if rawdb.ReadTrieNode(v.db, missing.NodeHash) != nil {
+      problem = "corrupt"
+    }
+    return missing.Path, v.mismatch(result, kind, missing.NodeHash[:], "%v node at path %x", problem, missing.Path)
+  }
+  return nil, v.mismatch(result, kind, nil, "%v", err)
+}
+
+// sample checks the nodes between a random path in the trie and the next leaf,
+// returning that leaf's key and value, and true if the mismatch limit was
+// reached.
+func (v *Verifier) sample(ctx context.Context, result *VerifyResult, kind string, tr *trie.Trie) ([]byte, []byte, bool) {
+  it := tr.NodeIterator(randomKey())
+  for it.Next(true) {
+    if v.checkNode(ctx, result, it) { return nil, nil, true }
+    if it.Leaf() {
+      return it.LeafKey(), it.LeafBlob(), false
+    }
+  }
+  if err := it.Error(); err != nil {
+    _, done := v.iteratorError(result, kind, err)
+    return nil, nil, done
+  }
+  return nil, nil, false
+}
+
+// walk checks every node in the trie, calling onLeaf for each leaf. When a
+// node is missing, the walk resumes after the missing node's subtree. It
+// returns true if the mismatch limit was reached or onLeaf returned true.
+func (v *Verifier) walk(ctx context.Context, result *VerifyResult, kind string, tr *trie.Trie, onLeaf func(key, value []byte) bool) bool {
+  var start []byte
+  for {
+    it := tr.NodeIterator(start)
+    for it.Next(true) {
+      if v.checkNode(ctx, result, it) { return true }
+      if it.Leaf() && onLeaf != nil && onLeaf(it.LeafKey(), it.LeafBlob()) { return true }
+    }
+    err := it.Error()
+    if err == nil {
+      return false
+    }
+    path, done := v.iteratorError(result, kind, err)
+    if done || path == nil {
+      return done
+    }
+    if start = skipSubtree(path); start == nil {
+      return false
+    }
+  }
+}
+
+// skipSubtree returns the first key after every key beginning with the
+// nibbles in path, or nil if there is none.
+func skipSubtree(path []byte) []byte {
+  next := common.CopyBytes(path)
+  i := len(next) - 1
+  for ; i >= 0; i-- {
+    if next[i] < 15 {
+      next[i]++
+      break
+    }
+    next[i] = 0
+  }
+  if i < 0 {
+    return nil
+  }
+  next = next[:i+1]
+  key := make([]byte, (len(next) + 1) / 2)
+  for j, nibble := range next {
+    key[j / 2] |= nibble << (4 * uint(1 - j % 2))
+  }
+  return key
+}
+
+// verifyAccount checks an account's code, and either all of its storage or a
+// random storage path.
+func (v *Verifier) verifyAccount(ctx context.Context, result *VerifyResult, tdb *trie.Database, key, value []byte, seenStorage map[common.Hash]struct{}) bool {
+  var account struct {
+    Nonce    uint64
+    Balance  *big.Int
+    Root     common.Hash
+    CodeHash []byte
+  }
+  if err := rlp.DecodeBytes(value, &account); err != nil {
+    return v.mismatch(result, "account", key, "invalid account: %v", err)
+  }
+  result.Accounts++
+  if codeHash := common.BytesToHash(account.CodeHash); codeHash != emptyCodeHash {
+    if got := crypto.Keccak256Hash(rawdb.ReadCode(v.db, codeHash)); got != codeHash {
+      if v.mismatch(result, "code", codeHash[:], "account %#x code hashes to %#x", key, got) { return true }
+    }
+  }
+  if account.Root == types.EmptyRootHash {
+    return false
+  }
+  if seenStorage != nil {
+    // Identical contracts share storage tries, which only need walking once
+    if _, ok := seenStorage[account.Root]; ok { return false }
+    seenStorage[account.Root] = struct{}{}
+  }
+  storage, err := trie.New(account.Root, tdb)
+  if err != nil {
+    _, done := v.iteratorError(result, "storage", err)
+    return done
+  }
+  if v.Full {
+    return v.walk(ctx, result, "storage", storage, func(key, value []byte) bool {
+      result.Slots++
+      return false
+    })
+  }
+  slot, _, done := v.sample(ctx, result, "storage", storage)
+  if slot != nil {
+    result.Slots++
+  }
+  return done
+}
+
+func (v *Verifier) verifyState(ctx context.Context, result *VerifyResult, root common.Hash) {
+  tdb := trie.NewDatabase(hashCheckingStore{v.db})
+  accounts, err := trie.New(root, tdb)
+  if err != nil {
+    v.iteratorError(result, "state", err)
+    return
+  }
+  if v.Full {
+    seenStorage := make(map[common.Hash]struct{})
+    v.walk(ctx, result, "state", accounts, func(key, value []byte) bool {
+      return v.verifyAccount(ctx, result, tdb, key, value, seenStorage)
+    })
+    return
+  }
+  for i := 0; i < v.Samples; i++ {
+    if ctx.Err() != nil { return }
+    key, value, done := v.sample(ctx, result, "state", accounts)
+    if done { return }
+    if key != nil && v.verifyAccount(ctx, result, tdb, key, value, nil) { return }
+  }
+}
+
+func randomKey() []byte {
+  key := make([]byte, common.HashLength)
+  rand.Read(key)
+  return key
+}
+
+// verifyDepth is how far behind the replica's head periodic checks verify, so
+// that blocks being reorganized are not reported as mismatches.
+const verifyDepth = 6
+
+// VerifyLatest verifies the block verifyDepth blocks behind the older of the
+// replica's and source's heads.
+func (v *Verifier) VerifyLatest(ctx context.Context) (*VerifyResult, error) {
+  head := rawdb.ReadHeaderNumber(v.db, rawdb.ReadHeadBlockHash(v.db))
+  if head == nil {
+    return nil, fmt.Errorf("Replica has no head block")
+  }
+  number := *head
+  sourceHead, err := v.source.HeadNumber(ctx)
+  if err != nil { return nil, err }
+  if sourceHead < number {
+    number = sourceHead
+  }
+  if number > verifyDepth {
+    number -= verifyDepth
+  }
+  return v.Verify(ctx, number)
+}
+
+// Run verifies the replica every interval until ctx is cancelled, logging and
+// recording metrics for each run.
+func (v *Verifier) Run(ctx context.Context, interval time.Duration) {
+  ticker := time.NewTicker(interval)
+  defer ticker.Stop()
+  for {
+    select {
+    case <-ctx.Done():
+      return
+    case <-ticker.C:
+    }
+    verifyRunsMeter.Mark(1)
+    result, err := v.VerifyLatest(ctx)
+    if err != nil {
+      if ctx.Err() == nil {
+        log.Warn("Replica verification failed", "err", err)
+        verifyFailuresMeter.Mark(1)
+      }
+      continue
+    }
+    verifyMismatchGauge.Update(int64(len(result.Mismatches)))
+    if len(result.Mismatches) > 0 {
+      log.Error("Replica differs from master", "block", result.Number, "hash", result.Hash, "mismatches", len(result.Mismatches))
+      continue
+    }
+    log.Info("Replica verified", "block", result.Number, "hash", result.Hash, "nodes", result.Nodes, "accounts", result.Accounts, "receipts", result.Receipts, "elapsed", common.PrettyDuration(result.Elapsed))
+  }
+}
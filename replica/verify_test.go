@@ -0,0 +1,150 @@
+package replica
+
+import (
+  "bytes"
+  "context"
+  "math/big"
+  "github.com/ethereum/go-ethereum/common"
+  "github.com/ethereum/go-ethereum/consensus/ethash"
+  "github.com/ethereum/go-ethereum/core"
+  "github.com/ethereum/go-ethereum/core/rawdb"
+  "github.com/ethereum/go-ethereum/core/types"
+  "github.com/ethereum/go-ethereum/core/vm"
+  "github.com/ethereum/go-ethereum/crypto"
+  "github.com/ethereum/go-ethereum/ethdb"
+  "github.com/ethereum/go-ethereum/params"
+  "testing"
+)
+
+// testVerifyChains builds a short chain including a contract with storage on
+// a master database, and copies it to a replica database.
+func testVerifyChains(t *testing.T) (ethdb.Database, ethdb.Database, []*types.Block) {
+  key, _ := crypto.GenerateKey()
+  address := crypto.PubkeyToAddress(key.PublicKey)
+  master := rawdb.NewMemoryDatabase()
+  gspec := &core.Genesis{
+    Config: params.TestChainConfig,
+    Alloc: core.GenesisAlloc{address: {Balance: big.NewInt(1000000000000000000)}},
+  }
+  genesis := gspec.MustCommit(master)
+  signer := types.LatestSigner(gspec.Config)
+  // Stores 1 in slot 0, and deploys the single byte 0x00 as code
+  initCode := common.FromHex("0x600160005560016000f3")
+  blocks, _ := core.GenerateChain(gspec.Config, genesis, ethash.NewFaker(), master, 3, func(i int, b *core.BlockGen) {
+    var tx *types.Transaction
+    if i == 0 {
+      tx = types.NewContractCreation(b.TxNonce(address), new(big.Int), 100000, big.NewInt(1), initCode)
+    } else {
+      tx = types.NewTransaction(b.TxNonce(address), common.Address{byte(i)}, big.NewInt(1000), params.TxGas, big.NewInt(1), nil)
+    }
+    signed, err := types.SignTx(tx, signer, key)
+    if err != nil { t.Fatalf(err.Error()) }
+    b.AddTx(signed)
+  })
+  bc, err := core.NewBlockChain(master, nil, gspec.Config, ethash.NewFaker(), vm.Config{}, nil, nil)
+  if err != nil { t.Fatalf(err.Error()) }
+  if _, err := bc.InsertChain(blocks); err != nil { t.Fatalf(err.Error()) }
+  bc.Stop()
+  replica := rawdb.NewMemoryDatabase()
+  it := master.NewIterator(nil, nil)
+  for it.Next() {
+    replica.Put(it.Key(), it.Value())
+  }
+  it.Release()
+  return master, replica, blocks
+}
+
+func mismatchKinds(result *VerifyResult) map[string]int {
+  kinds := make(map[string]int)
+  for _, m := range result.Mismatches {
+    kinds[m.Kind]++
+  }
+  return kinds
+}
+
+func TestVerifyConsistent(t *testing.T) {
+  master, replica, blocks := testVerifyChains(t)
+  for _, full := range []bool{true, false} {
+    verifier := NewVerifier(replica, NewDBVerifySource(master))
+    verifier.Full = full
+    verifier.Samples = 16
+    result, err := verifier.Verify(context.Background(), blocks[2].NumberU64())
+    if err != nil { t.Fatalf(err.Error()) }
+    if len(result.Mismatches) > 0 {
+      t.Errorf("Unexpected mismatches (full=%v): %v", full, result.Mismatches)
+    }
+    if result.Hash != blocks[2].Hash() || result.Nodes == 0 || result.Accounts == 0 || result.Receipts != 1 || result.TxLookups != 1 {
+      t.Errorf("Unexpected result (full=%v): %+v", full, result)
+    }
+    if full && (result.Accounts < 3 || result.Slots != 1) {
+      t.Errorf("Full walk missed accounts or storage: %+v", result)
+    }
+  }
+}
+
+func TestVerifyMismatches(t *testing.T) {
+  master, replica, blocks := testVerifyChains(t)
+  ctx := context.Background()
+  contractTx := blocks[0].Transactions()[0]
+  contract := crypto.CreateAddress(mustSender(t, contractTx), contractTx.Nonce())
+
+  // Missing transaction lookup
+  rawdb.DeleteTxLookupEntry(replica, blocks[2].Transactions()[0].Hash())
+  verifier := NewVerifier(replica, NewDBVerifySource(master))
+  verifier.Full = true
+  result, err := verifier.Verify(ctx, blocks[2].NumberU64())
+  if err != nil { t.Fatalf(err.Error()) }
+  if kinds := mismatchKinds(result); kinds["txlookup"] != 1 || len(result.Mismatches) != 1 {
+    t.Errorf("Expected a single txlookup mismatch, got %v", result.Mismatches)
+  }
+
+  // Missing contract code
+  codeHash := crypto.Keccak256Hash([]byte{0})
+  rawdb.DeleteCode(replica, codeHash)
+  replica.Delete(codeHash[:])
+  result, err = verifier.Verify(ctx, blocks[1].NumberU64())
+  if err != nil { t.Fatalf(err.Error()) }
+  if kinds := mismatchKinds(result); kinds["code"] != 1 {
+    t.Errorf("Expected a code mismatch for %#x, got %v", contract, result.Mismatches)
+  }
+
+  // Corrupt trie node
+  root := blocks[1].Root()
+  replica.Put(root[:], []byte{0xc0})
+  result, err = verifier.Verify(ctx, blocks[1].NumberU64())
+  if err != nil { t.Fatalf(err.Error()) }
+  if kinds := mismatchKinds(result); kinds["state"] == 0 {
+    t.Errorf("Expected a state mismatch, got %v", result.Mismatches)
+  }
+
+  // Different canonical block
+  rawdb.WriteCanonicalHash(replica, common.Hash{1}, blocks[0].NumberU64())
+  result, err = verifier.Verify(ctx, blocks[0].NumberU64())
+  if err != nil { t.Fatalf(err.Error()) }
+  if kinds := mismatchKinds(result); kinds["canonical"] != 1 || len(result.Mismatches) != 1 {
+    t.Errorf("Expected a canonical mismatch, got %v", result.Mismatches)
+  }
+}
+
+func mustSender(t *testing.T, tx *types.Transaction) common.Address {
+  sender, err := types.Sender(types.LatestSigner(params.TestChainConfig), tx)
+  if err != nil { t.Fatalf(err.Error()) }
+  return sender
+}
+
+func TestSkipSubtree(t *testing.T) {
+  for _, test := range []struct{
+    path []byte
+    key []byte
+  }{
+    {[]byte{3, 5}, []byte{0x36}},
+    {[]byte{3, 15}, []byte{0x40}},
+    {[]byte{3, 5, 7}, []byte{0x35, 0x80}},
+    {[]byte{15, 15}, nil},
+    {[]byte{}, nil},
+  } {
+    if key := skipSubtree(test.path); !bytes.Equal(key, test.key) {
+      t.Errorf("skipSubtree(%x) = %x, expected %x", test.path, key, test.key)
+    }
+  }
+}
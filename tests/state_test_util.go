@@ -231,8 +231,11 @@ func MakePreState(db ethdb.Database, accounts core.GenesisAlloc, snapshotter boo
 	var snaps *snapshot.Tree
 	if snapshotter {
 		snaps, _ = snapshot.New(db, sdb.TrieDB(), 1, root, false, true, false)
+		statedb, _ = state.New(root, sdb, snaps)
+	} else {
+		// A nil *snapshot.Tree would be a non-nil snapshot.SnapshotTree
+		statedb, _ = state.New(root, sdb, nil)
 	}
-	statedb, _ = state.New(root, sdb, snaps)
 	return snaps, statedb
 }
 